@@ -11,8 +11,10 @@ import (
 
 	"github.com/gestion-ssh/backend/internal/api"
 	"github.com/gestion-ssh/backend/internal/api/handlers"
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/config"
 	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/recording"
 	"github.com/joho/godotenv"
 )
 
@@ -27,6 +29,8 @@ func main() {
 		log.Printf("  port           : %s", cfg.Port)
 		log.Printf("  allowed_origins: %s", cfg.AllowedOrigins)
 		log.Printf("  totp_required  : %v", cfg.TOTPRequired)
+		log.Printf("  recordings_dir : %s", cfg.RecordingsDir)
+		log.Printf("  session_grace  : %s", cfg.SessionGracePeriod)
 		log.Printf("  cors           : toutes les origines acceptées")
 	}
 
@@ -40,7 +44,25 @@ func main() {
 		log.Fatalf("migration failed: %v", err)
 	}
 
-	router := api.NewRouter(cfg, database)
+	sinks, err := audit.SinksFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("cannot configure audit sinks: %v", err)
+	}
+	if len(sinks) > 0 {
+		stream := audit.Start(database, sinks, audit.StreamOptions{
+			QueueSize:   cfg.AuditSinkQueueSize,
+			MaxAttempts: cfg.AuditSinkMaxAttempts,
+			RetryEvery:  cfg.AuditSinkRetryEvery,
+		})
+		defer stream.Close()
+	}
+
+	recordings, err := recording.NewLocalStorage(cfg.RecordingsDir)
+	if err != nil {
+		log.Fatalf("cannot open recordings directory: %v", err)
+	}
+
+	router := api.NewRouter(cfg, database, recordings)
 
 	srv := &http.Server{
 		Addr:              ":" + cfg.Port,
@@ -1,20 +1,40 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/auth"
 	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/gestion-ssh/backend/internal/recording"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type AdminHandler struct {
-	db *pgxpool.Pool
+	db         *pgxpool.Pool
+	recordings recording.Storage
+	sessions   *sshproxy.Manager
 }
 
-func NewAdminHandler(pool *pgxpool.Pool) *AdminHandler {
-	return &AdminHandler{db: pool}
+func NewAdminHandler(pool *pgxpool.Pool, recordings recording.Storage, sessions *sshproxy.Manager) *AdminHandler {
+	return &AdminHandler{db: pool, recordings: recordings, sessions: sessions}
 }
 
 // GET /api/admin/users
@@ -29,7 +49,9 @@ func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 		ID          string `json:"id"`
 		Email       string `json:"email"`
 		IsAdmin     bool   `json:"is_admin"`
+		Role        string `json:"role"`
 		TOTPEnabled bool   `json:"totp_enabled"`
+		Disabled    bool   `json:"disabled"`
 		CreatedAt   string `json:"created_at"`
 	}
 
@@ -39,7 +61,9 @@ func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 			ID:          u.ID,
 			Email:       u.Email,
 			IsAdmin:     u.IsAdmin,
+			Role:        u.Role,
 			TOTPEnabled: u.TOTPEnabled,
+			Disabled:    u.Disabled,
 			CreatedAt:   u.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
 		})
 	}
@@ -57,35 +81,239 @@ func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Vérifier si la cible est admin avant de supprimer
 	target, err := db.GetUserByID(r.Context(), h.db, targetID)
 	if err != nil {
 		jsonError(w, "user not found", http.StatusNotFound)
 		return
 	}
 
-	// Pas de suppression du dernier admin
-	if target.IsAdmin {
-		count, err := db.CountAdmins(r.Context(), h.db)
-		if err != nil {
-			jsonInternalError(w, "count admins", err)
+	// La suppression en cascade révoque aussi ses refresh tokens ; celle du
+	// dernier administrateur actif est refusée.
+	if err := db.DeleteUserByID(r.Context(), h.db, targetID); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			jsonError(w, "user not found", http.StatusNotFound)
+		case errors.Is(err, db.ErrLastAdmin):
+			jsonError(w, "cannot delete the last admin", http.StatusBadRequest)
+		default:
+			jsonInternalError(w, "delete user", err)
+		}
+		return
+	}
+	recordAudit(r, h.db, audit.ActionUserDeleted, targetID, map[string]interface{}{"email": target.Email})
+	h.sessions.TerminateUser(targetID, "account deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /api/admin/users/{id}/disabled — désactive ou réactive un compte. La
+// désactivation ferme aussitôt ses connexions et ses sessions en cours.
+func (h *AdminHandler) SetUserDisabled(w http.ResponseWriter, r *http.Request) {
+	caller := mw.GetUser(r)
+	targetID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(targetID); err != nil {
+		jsonError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Disabled *bool `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Disabled == nil {
+		jsonError(w, "disabled required", http.StatusBadRequest)
+		return
+	}
+	if *req.Disabled && caller.UserID == targetID {
+		jsonError(w, "cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetUserDisabled(r.Context(), h.db, targetID, *req.Disabled); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			jsonError(w, "user not found", http.StatusNotFound)
+		case errors.Is(err, db.ErrLastAdmin):
+			jsonError(w, "cannot disable the last admin", http.StatusBadRequest)
+		default:
+			jsonInternalError(w, "set user disabled", err)
+		}
+		return
+	}
+	if *req.Disabled {
+		recordAudit(r, h.db, audit.ActionUserDisabled, targetID, nil)
+		h.sessions.TerminateUser(targetID, "account disabled")
+	} else {
+		recordAudit(r, h.db, audit.ActionUserEnabled, targetID, nil)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rolePermissions retourne les permissions du rôle name. Celles de RoleAdmin,
+// que PutRole refuse de modifier, sont connues sans lire la base.
+func (h *AdminHandler) rolePermissions(ctx context.Context, name string) ([]string, error) {
+	if name == auth.RoleAdmin {
+		return auth.AllPermissions(), nil
+	}
+	return db.GetRolePermissions(ctx, h.db, name)
+}
+
+// PUT /api/admin/users/{id}/role — l'appelant doit détenir toutes les
+// permissions du rôle attribué et du rôle actuel du compte.
+func (h *AdminHandler) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	caller := mw.GetUser(r)
+	targetID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(targetID); err != nil {
+		jsonError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		jsonError(w, "role required", http.StatusBadRequest)
+		return
+	}
+	perms, err := h.rolePermissions(r.Context(), req.Role)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "unknown role", http.StatusBadRequest)
 			return
 		}
-		if count <= 1 {
-			jsonError(w, "cannot delete the last admin", http.StatusBadRequest)
+		jsonInternalError(w, "get role", err)
+		return
+	}
+	if !caller.HasAllPermissions(perms) {
+		jsonError(w, "cannot grant permissions you do not hold", http.StatusForbidden)
+		return
+	}
+	target, err := db.GetUserByID(r.Context(), h.db, targetID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "user not found", http.StatusNotFound)
 			return
 		}
+		jsonInternalError(w, "get user", err)
+		return
 	}
-
-	if err := db.DeleteUserByID(r.Context(), h.db, targetID); err != nil {
-		if err == db.ErrNotFound {
+	if perms, err = h.rolePermissions(r.Context(), target.Role); err != nil {
+		jsonInternalError(w, "get role", err)
+		return
+	}
+	if !caller.HasAllPermissions(perms) {
+		jsonError(w, "cannot change the role of a user with permissions you do not hold", http.StatusForbidden)
+		return
+	}
+	if err := db.SetUserRole(r.Context(), h.db, targetID, req.Role); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
 			jsonError(w, "user not found", http.StatusNotFound)
+		case errors.Is(err, db.ErrUnknownRole):
+			jsonError(w, "unknown role", http.StatusBadRequest)
+		case errors.Is(err, db.ErrLastAdmin):
+			jsonError(w, "cannot remove the last admin", http.StatusBadRequest)
+		default:
+			jsonInternalError(w, "set user role", err)
+		}
+		return
+	}
+	recordAudit(r, h.db, audit.ActionUserRole, targetID, map[string]interface{}{"role": req.Role})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ─── Rôles ────────────────────────────────────────────────────────────────────
+
+// GET /api/admin/roles
+func (h *AdminHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := db.ListRoles(r.Context(), h.db)
+	if err != nil {
+		jsonInternalError(w, "list roles", err)
+		return
+	}
+	for _, role := range roles {
+		role.Builtin = auth.BuiltinRole(role.Name)
+	}
+	if roles == nil {
+		roles = []*models.Role{}
+	}
+	jsonResponse(w, roles, http.StatusOK)
+}
+
+var roleNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// PUT /api/admin/roles/{name} — crée un rôle ou modifie ses permissions.
+// Le rôle admin conserve toujours toutes les permissions. L'appelant doit
+// détenir toutes les permissions du rôle, avant et après modification.
+func (h *AdminHandler) PutRole(w http.ResponseWriter, r *http.Request) {
+	caller := mw.GetUser(r)
+	name := chi.URLParam(r, "name")
+	if !roleNameRe.MatchString(name) {
+		jsonError(w, "role name must be 2-32 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if name == auth.RoleAdmin {
+		jsonError(w, "the admin role cannot be modified", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	perms := make([]string, 0, len(req.Permissions))
+	for _, p := range req.Permissions {
+		if !auth.ValidPermission(p) {
+			jsonError(w, "unknown permission: "+p, http.StatusBadRequest)
 			return
 		}
-		jsonInternalError(w, "delete user", err)
+		if !seen[p] {
+			seen[p] = true
+			perms = append(perms, p)
+		}
+	}
+	if !caller.HasAllPermissions(perms) {
+		jsonError(w, "cannot grant permissions you do not hold", http.StatusForbidden)
+		return
+	}
+	current, err := db.GetRolePermissions(r.Context(), h.db, name)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		jsonInternalError(w, "get role", err)
+		return
+	}
+	if !caller.HasAllPermissions(current) {
+		jsonError(w, "cannot modify a role with permissions you do not hold", http.StatusForbidden)
+		return
+	}
+	role := &models.Role{Name: name, Description: strings.TrimSpace(req.Description), Permissions: perms}
+	if err := db.UpsertRole(r.Context(), h.db, role); err != nil {
+		jsonInternalError(w, "save role", err)
 		return
 	}
+	role.Builtin = auth.BuiltinRole(name)
+	recordAudit(r, h.db, audit.ActionRoleSaved, name, map[string]interface{}{"permissions": perms})
+	jsonResponse(w, role, http.StatusOK)
+}
 
+// DELETE /api/admin/roles/{name} — rôles personnalisés non attribués uniquement
+func (h *AdminHandler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if auth.BuiltinRole(name) {
+		jsonError(w, "built-in roles cannot be deleted", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteRole(r.Context(), h.db, name); err != nil {
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			jsonError(w, "role not found", http.StatusNotFound)
+		case errors.Is(err, db.ErrRoleInUse):
+			jsonError(w, err.Error(), http.StatusConflict)
+		default:
+			jsonInternalError(w, "delete role", err)
+		}
+		return
+	}
+	recordAudit(r, h.db, audit.ActionRoleDeleted, name, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -102,3 +330,236 @@ func (h *AdminHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
 	}
 	jsonResponse(w, sessions, http.StatusOK)
 }
+
+// DELETE /api/admin/sessions/{id} — ferme une session terminal, SFTP ou un tunnel en cours
+func (h *AdminHandler) TerminateSession(w http.ResponseWriter, r *http.Request) {
+	caller := mw.GetUser(r)
+	sessionID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if !h.sessions.Terminate(sessionID, "terminated by administrator") {
+		jsonError(w, "session not found or already closed", http.StatusNotFound)
+		return
+	}
+	if err := db.SetSessionTerminatedBy(r.Context(), h.db, sessionID, caller.Email); err != nil {
+		log.Printf("[ERROR] set session terminated_by: %v", err)
+	}
+	recordAudit(r, h.db, audit.ActionSessionTerminated, sessionID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/admin/sessions/{id}/recording — enregistrement asciicast v2 de la session
+func (h *AdminHandler) GetSessionRecording(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		jsonError(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	name, err := db.GetSessionRecording(r.Context(), h.db, sessionID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "recording not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "get session recording", err)
+		return
+	}
+	f, err := h.recordings.Open(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			jsonError(w, "recording not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "open recording", err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	io.Copy(w, f)
+}
+
+// GET /api/admin/sessions/{id}/forwards — redirections de ports ouvertes pendant la session
+func (h *AdminHandler) ListSessionForwards(w http.ResponseWriter, r *http.Request) {
+	sessionID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(sessionID); err != nil {
+		jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+	forwards, err := db.ListForwardsBySession(r.Context(), h.db, sessionID)
+	if err != nil {
+		jsonInternalError(w, "list session forwards", err)
+		return
+	}
+	if forwards == nil {
+		jsonResponse(w, []struct{}{}, http.StatusOK)
+		return
+	}
+	jsonResponse(w, forwards, http.StatusOK)
+}
+
+// ─── Journal d'audit ──────────────────────────────────────────────────────────
+
+// GET /api/admin/audit?actor=&action=&since=&until=&cursor=&limit=
+// actor : id ou email ; action : action exacte ou préfixe terminé par "." ;
+// since/until : RFC 3339 ; cursor : next_cursor de la page précédente.
+func (h *AdminHandler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := models.AuditFilter{
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Action: strings.TrimSpace(q.Get("action")),
+		Limit:  100,
+	}
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				jsonError(w, p.name+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*p.dst = &t
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor <= 0 {
+			jsonError(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter.Before = cursor
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 500 {
+			jsonError(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	events, err := db.ListAuditEvents(r.Context(), h.db, filter)
+	if err != nil {
+		jsonInternalError(w, "list audit events", err)
+		return
+	}
+	resp := struct {
+		Events     []*models.AuditEvent `json:"events"`
+		NextCursor *int64               `json:"next_cursor"`
+	}{Events: events}
+	if resp.Events == nil {
+		resp.Events = []*models.AuditEvent{}
+	}
+	// Page pleine : il reste peut-être des événements plus anciens.
+	if len(events) == filter.Limit {
+		next := events[len(events)-1].ID
+		resp.NextCursor = &next
+	}
+	jsonResponse(w, resp, http.StatusOK)
+}
+
+// GET /api/admin/audit/sinks — état de la diffusion vers le SIEM
+func (h *AdminHandler) ListAuditSinks(w http.ResponseWriter, r *http.Request) {
+	sinks, err := audit.Status(r.Context())
+	if err != nil {
+		jsonInternalError(w, "audit sinks status", err)
+		return
+	}
+	jsonResponse(w, sinks, http.StatusOK)
+}
+
+// POST /api/admin/audit/sinks/{name}/replay — redélivre la dead-letter queue sans attendre
+func (h *AdminHandler) ReplayAuditSink(w http.ResponseWriter, r *http.Request) {
+	if !audit.Replay(chi.URLParam(r, "name")) {
+		jsonError(w, "sink not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type recordingPolicyResponse struct {
+	Mode    string           `json:"mode"`
+	HostIDs []string         `json:"host_ids"`
+	Hosts   []recordableHost `json:"hosts"`
+}
+
+type recordableHost struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+}
+
+// GET /api/admin/users/{id}/recording — politique d'enregistrement + hôtes de l'utilisateur
+func (h *AdminHandler) GetRecordingPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(userID); err != nil {
+		jsonError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	policy, err := db.GetRecordingPolicy(r.Context(), h.db, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "get recording policy", err)
+		return
+	}
+	hosts, err := db.ListHostsByUser(r.Context(), h.db, userID)
+	if err != nil {
+		jsonInternalError(w, "list user hosts", err)
+		return
+	}
+	resp := recordingPolicyResponse{Mode: policy.Mode, HostIDs: policy.HostIDs, Hosts: make([]recordableHost, 0, len(hosts))}
+	for _, host := range hosts {
+		resp.Hosts = append(resp.Hosts, recordableHost{ID: host.ID, Name: host.Name, Hostname: host.Hostname})
+	}
+	jsonResponse(w, resp, http.StatusOK)
+}
+
+// PUT /api/admin/users/{id}/recording — impose l'enregistrement des sessions de l'utilisateur
+func (h *AdminHandler) SetRecordingPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(userID); err != nil {
+		jsonError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	var req models.RecordingPolicy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Mode != "off" && req.Mode != "all" && req.Mode != "selected" {
+		jsonError(w, "mode must be 'off', 'all' or 'selected'", http.StatusBadRequest)
+		return
+	}
+	if req.HostIDs == nil {
+		req.HostIDs = []string{}
+	}
+	for _, id := range req.HostIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			jsonError(w, "invalid host id", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.SetRecordingPolicy(r.Context(), h.db, userID, &req); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "set recording policy", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionRecordingPolicy, userID, map[string]interface{}{"mode": req.Mode, "host_ids": req.HostIDs})
+	policy, err := db.GetRecordingPolicy(r.Context(), h.db, userID)
+	if err != nil {
+		jsonInternalError(w, "get recording policy", err)
+		return
+	}
+	jsonResponse(w, policy, http.StatusOK)
+}
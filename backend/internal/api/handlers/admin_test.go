@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+// Un appelant qui n'a que users.manage ne peut pas s'attribuer plus de droits.
+// Les refus précèdent tout accès à la base : le handler n'a pas de pool.
+func TestRoleEscalationForbidden(t *testing.T) {
+	caller := &mw.UserClaims{UserID: "11111111-1111-1111-1111-111111111111", Role: "usermgr", Permissions: []string{auth.PermUsersManage}}
+	h := &AdminHandler{}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		param   string
+		value   string
+		body    string
+	}{
+		{"assign admin to self", h.SetUserRole, "id", caller.UserID, `{"role":"admin"}`},
+		{"add a permission to a role", h.PutRole, "name", "usermgr", `{"permissions":["users.manage","settings.manage"]}`},
+		{"create a broader role", h.PutRole, "name", "ops", `{"permissions":["hosts.connect"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add(tt.param, tt.value)
+			ctx := context.WithValue(context.Background(), chi.RouteCtxKey, rctx)
+			ctx = context.WithValue(ctx, mw.UserContextKey, caller)
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body)).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			tt.handler(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status %d (%s), want 403", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Jetons d'accès personnels : gérés depuis une connexion interactive uniquement
+// (un jeton ne peut pas en créer d'autres).
+
+const maxAPITokenLifetimeDays = 366
+
+type APITokenHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewAPITokenHandler(pool *pgxpool.Pool) *APITokenHandler {
+	return &APITokenHandler{db: pool}
+}
+
+// GET /api/auth/tokens
+func (h *APITokenHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	tokens, err := db.ListAPITokens(r.Context(), h.db, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "list api tokens", err)
+		return
+	}
+	if tokens == nil {
+		jsonResponse(w, []struct{}{}, http.StatusOK)
+		return
+	}
+	jsonResponse(w, tokens, http.StatusOK)
+}
+
+type createAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 : sans expiration
+}
+
+// POST /api/auth/tokens — le secret n'est retourné qu'ici
+func (h *APITokenHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+
+	var req createAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		jsonError(w, "name required (max 100 characters)", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		jsonError(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, s := range req.Scopes {
+		if !auth.ValidScope(s) {
+			jsonError(w, "unknown scope: "+s, http.StatusBadRequest)
+			return
+		}
+		if s == auth.ScopeAdmin && !user.HasPermission(auth.PermUsersManage) && !user.HasPermission(auth.PermSettingsManage) {
+			jsonError(w, "admin scope requires an administrative role", http.StatusForbidden)
+			return
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxAPITokenLifetimeDays {
+		jsonError(w, "expires_in_days must be between 0 and 366", http.StatusBadRequest)
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	secret, prefix, hash, err := auth.GenerateAPIToken()
+	if err != nil {
+		jsonInternalError(w, "generate api token", err)
+		return
+	}
+	token, err := db.CreateAPIToken(r.Context(), h.db, user.UserID, req.Name, prefix, hash, scopes, expiresAt)
+	if err != nil {
+		jsonInternalError(w, "create api token", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionAPITokenCreated, token.ID, map[string]interface{}{"name": token.Name, "scopes": scopes})
+	jsonResponse(w, map[string]interface{}{
+		"token":     secret,
+		"api_token": token,
+	}, http.StatusCreated)
+}
+
+// DELETE /api/auth/tokens/{id} — révocation immédiate
+func (h *APITokenHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		jsonError(w, "token not found", http.StatusNotFound)
+		return
+	}
+	if err := db.DeleteAPIToken(r.Context(), h.db, id, user.UserID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "token not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "delete api token", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionAPITokenRevoked, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -3,24 +3,30 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/auth"
 	"github.com/gestion-ssh/backend/internal/config"
 	"github.com/gestion-ssh/backend/internal/db"
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
-	"github.com/jackc/pgx/v5"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type AuthHandler struct {
-	db  *pgxpool.Pool
-	cfg *config.Config
+	db             *pgxpool.Pool
+	cfg            *config.Config
+	authenticators []Authenticator
+	sessions       *sshproxy.Manager // fermeture des sessions au changement de mot de passe
 }
 
-func NewAuthHandler(pool *pgxpool.Pool, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{db: pool, cfg: cfg}
+func NewAuthHandler(pool *pgxpool.Pool, cfg *config.Config, sessions *sshproxy.Manager) *AuthHandler {
+	return &AuthHandler{db: pool, cfg: cfg, authenticators: newAuthenticators(pool, cfg), sessions: sessions}
 }
 
 // ─── Register ─────────────────────────────────────────────────────────────────
@@ -89,35 +95,52 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := db.GetUserByEmail(r.Context(), h.db, req.Email)
+	// req.Email est l'identifiant saisi : email, ou nom d'utilisateur de l'annuaire
+	user, err := h.authenticate(r.Context(), req.Email, req.Password)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			recordLoginFailure(r, h.db, "", req.Email, "password")
 			jsonError(w, "invalid credentials", http.StatusUnauthorized)
 			return
 		}
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		jsonInternalError(w, "authenticate", err)
+		return
+	}
+	if user.Disabled {
+		recordLoginFailure(r, h.db, user.ID, user.Email, "disabled")
+		jsonError(w, "account disabled", http.StatusForbidden)
 		return
 	}
 
-	match, err := auth.VerifyPassword(req.Password, user.PasswordHash)
-	if err != nil || !match {
-		jsonError(w, "invalid credentials", http.StatusUnauthorized)
+	passkeys, err := db.CountWebAuthnCredentials(r.Context(), h.db, user.ID)
+	if err != nil {
+		jsonInternalError(w, "count webauthn credentials", err)
 		return
 	}
 
-	// Si la 2FA est activée, on retourne un token temporaire au lieu des vrais tokens
-	if user.TOTPEnabled {
+	// Si un second facteur est configuré (TOTP et/ou clé de sécurité), on retourne
+	// un token temporaire au lieu des vrais tokens
+	if user.TOTPEnabled || passkeys > 0 {
 		totpToken, err := auth.GenerateTOTPPendingToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin)
 		if err != nil {
 			jsonError(w, "internal error", http.StatusInternalServerError)
 			return
 		}
+		methods := []string{}
+		if user.TOTPEnabled {
+			methods = append(methods, "totp")
+		}
+		if passkeys > 0 {
+			methods = append(methods, "webauthn")
+		}
 		jsonResponse(w, map[string]interface{}{
 			"two_factor_required": true,
+			"two_factor_methods":  methods,
 			"totp_token":          totpToken,
 			"user": map[string]interface{}{
-				"kdf_salt":   user.KDFSalt,
-				"kdf_params": json.RawMessage(user.KDFParams),
+				"kdf_salt":    user.KDFSalt,
+				"kdf_params":  json.RawMessage(user.KDFParams),
+				"auth_source": user.AuthSource,
 			},
 		}, http.StatusOK)
 		return
@@ -135,23 +158,24 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			"totp_setup_required": true,
 			"totp_token":          totpToken,
 			"user": map[string]interface{}{
-				"kdf_salt":   user.KDFSalt,
-				"kdf_params": json.RawMessage(user.KDFParams),
+				"kdf_salt":    user.KDFSalt,
+				"kdf_params":  json.RawMessage(user.KDFParams),
+				"auth_source": user.AuthSource,
 			},
 		}, http.StatusOK)
 		return
 	}
 
-	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin)
-	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+	sessionID, refreshToken, refreshExpiresAt, err := openLoginSession(r, h.db, h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, req.RememberMe)
+	if errors.Is(err, db.ErrAccountDisabled) {
+		jsonError(w, "account disabled", http.StatusForbidden)
 		return
 	}
-	refreshDuration := auth.RefreshTokenDuration
-	if req.RememberMe {
-		refreshDuration = auth.LongRefreshTokenDuration
+	if err != nil {
+		jsonInternalError(w, "open login session", err)
+		return
 	}
-	refreshToken, err := auth.GenerateRefreshToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, refreshDuration)
+	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, sessionID)
 	if err != nil {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
@@ -160,24 +184,8 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	// Secure=true uniquement sur HTTPS (TLS direct ou derrière un reverse-proxy HTTPS)
 	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    accessToken,
-		HttpOnly: true,
-		Secure:   isSecure,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		MaxAge:   int(auth.AccessTokenDuration.Seconds()),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		HttpOnly: true,
-		Secure:   isSecure,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/api/auth/refresh",
-		MaxAge:   int(refreshDuration.Seconds()),
-	})
+	setAccessCookie(w, isSecure, accessToken)
+	setRefreshCookie(w, isSecure, refreshToken, refreshExpiresAt)
 
 	jsonResponse(w, map[string]interface{}{
 		"user": map[string]interface{}{
@@ -187,6 +195,7 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 			"kdf_params":   json.RawMessage(user.KDFParams),
 			"is_admin":     user.IsAdmin,
 			"totp_enabled": user.TOTPEnabled,
+			"auth_source":  user.AuthSource,
 		},
 		"access_token": accessToken,
 	}, http.StatusOK)
@@ -194,55 +203,154 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 // ─── Refresh ──────────────────────────────────────────────────────────────────
 
-func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("refresh_token")
-	if err != nil {
-		jsonError(w, "refresh token missing", http.StatusUnauthorized)
-		return
+// refreshCookiePath couvre /api/auth/refresh et /api/auth/logout (révocation).
+const refreshCookiePath = "/api/auth"
+
+// openLoginSession enregistre une nouvelle connexion (appareil) et émet son
+// premier refresh token.
+func openLoginSession(r *http.Request, pool *pgxpool.Pool, secret, userID, email string, isAdmin, rememberMe bool) (sessionID, refreshToken string, expiresAt time.Time, err error) {
+	duration := auth.RefreshTokenDuration
+	if rememberMe {
+		duration = auth.LongRefreshTokenDuration
 	}
+	expiresAt = time.Now().Add(duration)
 
-	claims, err := auth.ValidateToken(h.cfg.JWTSecret, cookie.Value)
+	sessionID, err = db.CreateLoginSession(r.Context(), pool, userID, clientIP(r), r.UserAgent(), rememberMe, expiresAt)
 	if err != nil {
-		jsonError(w, "invalid refresh token", http.StatusUnauthorized)
-		return
+		return "", "", time.Time{}, err
 	}
-
-	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin)
+	jti := uuid.NewString()
+	refreshToken, err = auth.GenerateRefreshToken(secret, userID, email, isAdmin, sessionID, jti, expiresAt)
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
-		return
+		return "", "", time.Time{}, err
+	}
+	if err = db.CreateRefreshToken(r.Context(), pool, userID, sessionID, auth.HashTokenID(jti), expiresAt); err != nil {
+		return "", "", time.Time{}, err
 	}
+	audit.Record(r.Context(), pool, audit.Event{
+		ActorID:    userID,
+		ActorEmail: email,
+		Action:     audit.ActionLogin,
+		Target:     sessionID,
+		IP:         clientIP(r),
+		Details:    map[string]interface{}{"user_agent": r.UserAgent(), "remember_me": rememberMe},
+	})
+	return sessionID, refreshToken, expiresAt, nil
+}
 
-	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+func setAccessCookie(w http.ResponseWriter, isSecure bool, token string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "access_token",
-		Value:    accessToken,
+		Value:    token,
 		HttpOnly: true,
 		Secure:   isSecure,
 		SameSite: http.SameSiteStrictMode,
 		Path:     "/",
 		MaxAge:   int(auth.AccessTokenDuration.Seconds()),
 	})
-
-	jsonResponse(w, map[string]string{"access_token": accessToken}, http.StatusOK)
 }
 
-// ─── Logout ───────────────────────────────────────────────────────────────────
+func setRefreshCookie(w http.ResponseWriter, isSecure bool, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    token,
+		HttpOnly: true,
+		Secure:   isSecure,
+		SameSite: http.SameSiteStrictMode,
+		Path:     refreshCookiePath,
+		MaxAge:   int(time.Until(expiresAt).Seconds()),
+	})
+}
 
-func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
-	for _, name := range []string{"access_token", "refresh_token"} {
+// clearAuthCookies supprime les cookies d'authentification, y compris le
+// refresh token posé sur l'ancien chemin /api/auth/refresh.
+func clearAuthCookies(w http.ResponseWriter, isSecure bool) {
+	for _, c := range []struct{ name, path string }{
+		{"access_token", "/"},
+		{"refresh_token", refreshCookiePath},
+		{"refresh_token", "/api/auth/refresh"},
+	} {
 		http.SetCookie(w, &http.Cookie{
-			Name:     name,
+			Name:     c.name,
 			Value:    "",
 			HttpOnly: true,
 			Secure:   isSecure,
 			SameSite: http.SameSiteStrictMode,
-			Path:     "/",
+			Path:     c.path,
 			Expires:  time.Unix(0, 0),
 			MaxAge:   -1,
 		})
 	}
+}
+
+// Refresh échange le refresh token contre un nouveau (rotation) et un access token.
+// Présenter un token déjà échangé révoque tous les tokens issus du même login.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+
+	cookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		jsonError(w, "refresh token missing", http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := auth.ValidateToken(h.cfg.JWTSecret, cookie.Value)
+	if err != nil || claims.TokenType != "refresh" || claims.ID == "" || claims.SessionID == "" || claims.ExpiresAt == nil {
+		jsonError(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	expiresAt := claims.ExpiresAt.Time
+	jti := uuid.NewString()
+	refreshToken, err := auth.GenerateRefreshToken(h.cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin, claims.SessionID, jti, expiresAt)
+	if err != nil {
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.RotateRefreshToken(r.Context(), h.db, claims.UserID, claims.SessionID, auth.HashTokenID(claims.ID), auth.HashTokenID(jti)); err != nil {
+		switch {
+		case errors.Is(err, db.ErrRefreshTokenReused):
+			log.Printf("refresh token reuse detected for user %s, login session %s revoked", claims.UserID, claims.SessionID)
+			clearAuthCookies(w, isSecure)
+			jsonError(w, "invalid refresh token", http.StatusUnauthorized)
+		case errors.Is(err, db.ErrNotFound):
+			clearAuthCookies(w, isSecure)
+			jsonError(w, "invalid refresh token", http.StatusUnauthorized)
+		default:
+			jsonInternalError(w, "rotate refresh token", err)
+		}
+		return
+	}
+
+	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin, claims.SessionID)
+	if err != nil {
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	setAccessCookie(w, isSecure, accessToken)
+	setRefreshCookie(w, isSecure, refreshToken, expiresAt)
+
+	jsonResponse(w, map[string]string{"access_token": accessToken}, http.StatusOK)
+}
+
+// ─── Logout ───────────────────────────────────────────────────────────────────
+
+// Logout révoque la connexion courante et efface les cookies.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		// Signature vérifiée : seul un token émis par ce serveur peut révoquer une connexion.
+		claims, err := auth.ValidateToken(h.cfg.JWTSecret, cookie.Value)
+		if err == nil && claims.TokenType == "refresh" && claims.SessionID != "" {
+			err := db.RevokeLoginSession(r.Context(), h.db, claims.UserID, claims.SessionID)
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				jsonInternalError(w, "revoke login session", err)
+				return
+			}
+		}
+	}
+	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	clearAuthCookies(w, isSecure)
 	jsonResponse(w, map[string]string{"message": "logged out"}, http.StatusOK)
 }
 
@@ -293,6 +401,7 @@ func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, map[string]string{"message": "email updated", "new_email": req.NewEmail}, http.StatusOK)
 
 	case "password":
+		// Vide le coffre (nouvelle clé maître) ; POST /api/auth/rekey permet de le conserver.
 		if len(req.NewPassword) < 8 {
 			jsonError(w, "new password must be at least 8 characters", http.StatusBadRequest)
 			return
@@ -311,6 +420,8 @@ func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 			jsonError(w, "internal error", http.StatusInternalServerError)
 			return
 		}
+		recordAudit(r, h.db, audit.ActionPasswordChanged, userClaims.UserID, map[string]interface{}{"vault_kept": false})
+		h.sessions.TerminateUser(userClaims.UserID, "password changed")
 		jsonResponse(w, map[string]string{"message": "password updated"}, http.StatusOK)
 
 	default:
@@ -318,6 +429,55 @@ func (h *AuthHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ─── Login sessions ───────────────────────────────────────────────────────────
+
+// GET /api/auth/sessions — connexions actives de l'utilisateur
+func (h *AuthHandler) ListLoginSessions(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	sessions, err := db.ListLoginSessions(r.Context(), h.db, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "list login sessions", err)
+		return
+	}
+	if sessions == nil {
+		jsonResponse(w, []struct{}{}, http.StatusOK)
+		return
+	}
+	for _, s := range sessions {
+		s.Current = s.ID == user.SessionID
+	}
+	jsonResponse(w, sessions, http.StatusOK)
+}
+
+// DELETE /api/auth/sessions/{id} — déconnecte un appareil
+func (h *AuthHandler) RevokeLoginSession(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		jsonError(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err := db.RevokeLoginSession(r.Context(), h.db, user.UserID, id); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "revoke login session", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/auth/sessions — déconnecte tous les appareils sauf celui-ci
+func (h *AuthHandler) RevokeOtherLoginSessions(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	if err := db.RevokeOtherLoginSessions(r.Context(), h.db, user.UserID, user.SessionID); err != nil {
+		jsonInternalError(w, "revoke other login sessions", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // ─── Me ───────────────────────────────────────────────────────────────────────
 
 func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
@@ -327,12 +487,23 @@ func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "user not found", http.StatusNotFound)
 		return
 	}
+	recoveryCodes, err := db.CountRecoveryCodes(r.Context(), h.db, u.ID)
+	if err != nil {
+		jsonInternalError(w, "count recovery codes", err)
+		return
+	}
 	jsonResponse(w, map[string]interface{}{
-		"id":           u.ID,
-		"email":        u.Email,
-		"kdf_salt":     u.KDFSalt,
-		"kdf_params":   json.RawMessage(u.KDFParams),
-		"is_admin":     u.IsAdmin,
-		"totp_enabled": u.TOTPEnabled,
+		"id":                       u.ID,
+		"email":                    u.Email,
+		"kdf_salt":                 u.KDFSalt,
+		"kdf_params":               json.RawMessage(u.KDFParams),
+		"is_admin":                 u.IsAdmin,
+		"role":                     u.Role,
+		"permissions":              user.Permissions,
+		"totp_enabled":             u.TOTPEnabled,
+		"recovery_codes_remaining": recoveryCodes,
+		"auth_source":              u.AuthSource,
+		// Compte SSO ou annuaire : le client doit faire définir une passphrase de coffre
+		"vault_passphrase_set": u.PasswordHash != "",
 	}, http.StatusOK)
 }
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ─── Authentificateurs ────────────────────────────────────────────────────────
+//
+// Login essaie successivement les authentificateurs configurés : le premier
+// qui reconnaît l'identifiant et le mot de passe l'emporte. Chacun retourne
+// auth.ErrInvalidCredentials quand il ne reconnaît pas le couple.
+
+// Valeurs de users.auth_source
+const (
+	authSourceLocal = "local"
+	authSourceOIDC  = "oidc"
+	authSourceLDAP  = "ldap"
+)
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, login, password string) (*models.User, error)
+}
+
+func newAuthenticators(pool *pgxpool.Pool, cfg *config.Config) []Authenticator {
+	authenticators := []Authenticator{NewPasswordAuthenticator(pool)}
+	if cfg.LDAPURL == "" {
+		return authenticators
+	}
+	dir, err := auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:          cfg.LDAPURL,
+		StartTLS:     cfg.LDAPStartTLS,
+		SkipVerify:   cfg.LDAPSkipVerify,
+		BindDN:       cfg.LDAPBindDN,
+		BindPassword: cfg.LDAPBindPassword,
+		BaseDN:       cfg.LDAPBaseDN,
+		UserFilter:   cfg.LDAPUserFilter,
+		EmailAttr:    cfg.LDAPEmailAttr,
+		GroupAttr:    cfg.LDAPGroupAttr,
+		PoolSize:     cfg.LDAPPoolSize,
+	})
+	if err != nil {
+		log.Printf("ldap authentication disabled: %v", err)
+		return authenticators
+	}
+	return append(authenticators, NewLDAPAuthenticator(pool, dir, cfg.LDAPAdminGroup))
+}
+
+// authenticate retourne l'utilisateur reconnu par le premier authentificateur.
+func (h *AuthHandler) authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	for _, a := range h.authenticators {
+		user, err := a.Authenticate(ctx, login, password)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			continue
+		}
+		return user, err
+	}
+	return nil, auth.ErrInvalidCredentials
+}
+
+// PasswordAuthenticator vérifie le mot de passe local (hash Argon2id).
+type PasswordAuthenticator struct {
+	db *pgxpool.Pool
+}
+
+func NewPasswordAuthenticator(pool *pgxpool.Pool) *PasswordAuthenticator {
+	return &PasswordAuthenticator{db: pool}
+}
+
+func (a *PasswordAuthenticator) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	user, err := db.GetUserByEmail(ctx, a.db, login)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, auth.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	// Seuls les comptes locaux ont un mot de passe : pour les comptes SSO ou
+	// annuaire, password_hash protège la passphrase du coffre.
+	if user.AuthSource != authSourceLocal {
+		return nil, auth.ErrInvalidCredentials
+	}
+	match, err := auth.VerifyPassword(password, user.PasswordHash)
+	if err != nil || !match {
+		return nil, auth.ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// LDAPAuthenticator authentifie auprès d'un annuaire LDAP / Active Directory.
+// Le compte est provisionné à la première connexion ; le mot de passe de
+// l'annuaire pouvant changer hors de l'application, la clé du coffre est
+// dérivée d'une passphrase distincte, comme pour les comptes SSO.
+type LDAPAuthenticator struct {
+	db         *pgxpool.Pool
+	dir        auth.Directory
+	adminGroup string // DN du groupe donnant le rôle admin ("" : rôle géré localement)
+}
+
+func NewLDAPAuthenticator(pool *pgxpool.Pool, dir auth.Directory, adminGroup string) *LDAPAuthenticator {
+	return &LDAPAuthenticator{db: pool, dir: dir, adminGroup: adminGroup}
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	entry, err := a.dir.Authenticate(ctx, login, password)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Email == "" {
+		log.Printf("ldap: %s has no email attribute, login refused", entry.DN)
+		return nil, auth.ErrInvalidCredentials
+	}
+	isAdmin := a.isAdmin(entry)
+
+	user, err := db.GetUserByEmail(ctx, a.db, entry.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		kdfSalt, err := auth.GenerateKDFSalt()
+		if err != nil {
+			return nil, err
+		}
+		user, err = db.CreateLDAPUser(ctx, a.db, entry.Email, kdfSalt, isAdmin)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("ldap: provisioned user %s (%s)", user.ID, entry.DN)
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Un compte local ou SSO de même email n'est pas repris par l'annuaire
+	if user.AuthSource != authSourceLDAP {
+		log.Printf("ldap: %s matches non-directory user %s, login refused", entry.DN, user.ID)
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	if a.adminGroup != "" && user.IsAdmin != isAdmin {
+		applied, err := db.SetUserAdmin(ctx, a.db, user.ID, isAdmin)
+		if err != nil {
+			return nil, err
+		}
+		if applied {
+			user.IsAdmin = isAdmin
+		} else {
+			log.Printf("ldap: keeping admin role of %s (last administrator)", user.ID)
+		}
+	}
+	return user, nil
+}
+
+func (a *LDAPAuthenticator) isAdmin(entry *auth.DirectoryEntry) bool {
+	if a.adminGroup == "" {
+		return false
+	}
+	for _, g := range entry.Groups {
+		if strings.EqualFold(g, a.adminGroup) {
+			return true
+		}
+	}
+	return false
+}
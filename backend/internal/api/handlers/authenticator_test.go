@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/models"
+)
+
+// stubAuthenticator reconnaît un seul couple identifiant / mot de passe.
+type stubAuthenticator struct {
+	login, password string
+	err             error // retourné pour tout autre couple
+	calls           int
+}
+
+func (s *stubAuthenticator) Authenticate(ctx context.Context, login, password string) (*models.User, error) {
+	s.calls++
+	if login == s.login && password == s.password {
+		return &models.User{ID: s.login + "-" + s.password, Email: login}, nil
+	}
+	return nil, s.err
+}
+
+func TestAuthenticateFallsBack(t *testing.T) {
+	unreachable := errors.New("ldap dial: connection refused")
+	tests := []struct {
+		name      string
+		ldapErr   error
+		password  string
+		wantUser  string
+		wantErr   error
+		ldapCalls int
+	}{
+		{"local password", unreachable, "local-pw", "alice@example.com-local-pw", nil, 0},
+		{"directory password", auth.ErrInvalidCredentials, "ldap-pw", "alice@example.com-ldap-pw", nil, 1},
+		{"both rejected", auth.ErrInvalidCredentials, "wrong", "", auth.ErrInvalidCredentials, 1},
+		{"directory down", unreachable, "wrong", "", unreachable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := &stubAuthenticator{login: "alice@example.com", password: "local-pw", err: auth.ErrInvalidCredentials}
+			dir := &stubAuthenticator{login: "alice@example.com", password: "ldap-pw", err: tt.ldapErr}
+			h := &AuthHandler{authenticators: []Authenticator{local, dir}}
+
+			user, err := h.authenticate(context.Background(), "alice@example.com", tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantUser != "" && (user == nil || user.ID != tt.wantUser) {
+				t.Fatalf("user = %+v, want %s", user, tt.wantUser)
+			}
+			if dir.calls != tt.ldapCalls {
+				t.Fatalf("directory called %d times, want %d", dir.calls, tt.ldapCalls)
+			}
+		})
+	}
+}
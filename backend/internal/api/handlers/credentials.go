@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/db"
 	"github.com/gestion-ssh/backend/internal/models"
 	"github.com/go-chi/chi/v5"
@@ -105,6 +106,7 @@ func (h *CredentialHandler) Create(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.ActionCredentialCreated, cred.ID, map[string]interface{}{"name": cred.Name, "type": cred.Type})
 	jsonResponse(w, toCredentialResponse(cred), http.StatusCreated)
 }
 
@@ -119,5 +121,6 @@ func (h *CredentialHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.ActionCredentialDeleted, id, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // DebugMode est activé via DEBUG=true dans le .env.
@@ -31,3 +35,33 @@ func jsonInternalError(w http.ResponseWriter, context string, err error) {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 	}
 }
+
+// clientIP retourne l'IP du client : X-Real-IP (positionné par nginx) plutôt
+// que X-Forwarded-For (falsifiable), sinon l'adresse de la connexion.
+func clientIP(r *http.Request) string {
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	return r.RemoteAddr
+}
+
+// recordAudit enregistre une action de l'utilisateur courant dans le journal d'audit.
+func recordAudit(r *http.Request, pool *pgxpool.Pool, action, target string, details map[string]interface{}) {
+	e := audit.Event{Action: action, Target: target, IP: clientIP(r), Details: details}
+	if user := mw.GetUser(r); user != nil {
+		e.ActorID, e.ActorEmail = user.UserID, user.Email
+	}
+	audit.Record(r.Context(), pool, e)
+}
+
+// recordLoginFailure enregistre un échec de connexion ; identifier est
+// l'identifiant saisi ou l'email du compte visé.
+func recordLoginFailure(r *http.Request, pool *pgxpool.Pool, userID, identifier, method string) {
+	audit.Record(r.Context(), pool, audit.Event{
+		ActorID:    userID,
+		ActorEmail: identifier,
+		Action:     audit.ActionLoginFailed,
+		IP:         clientIP(r),
+		Details:    map[string]interface{}{"method": method},
+	})
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ─── Clés d'hôte épinglées (TOFU) ─────────────────────────────────────────────
+
+type hostKeyEntry struct {
+	KeyType     string `json:"key_type"`
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"public_key"` // format authorized_keys
+	SeenAt      string `json:"seen_at"`
+}
+
+type hostKeysResponse struct {
+	HostID  string        `json:"host_id"`
+	Pinned  *hostKeyEntry `json:"pinned"`
+	Pending *hostKeyEntry `json:"pending"`
+}
+
+func authorizedKey(raw []byte) string {
+	key, err := gossh.ParsePublicKey(raw)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+}
+
+func toHostKeysResponse(hostID string, k *models.HostKey) hostKeysResponse {
+	resp := hostKeysResponse{HostID: hostID}
+	if k == nil {
+		return resp
+	}
+	resp.Pinned = &hostKeyEntry{
+		KeyType:     k.KeyType,
+		Fingerprint: k.Fingerprint,
+		PublicKey:   authorizedKey(k.PublicKey),
+		SeenAt:      k.UpdatedAt.String(),
+	}
+	if k.PendingFingerprint != nil && k.PendingKeyType != nil && k.PendingSeenAt != nil {
+		resp.Pending = &hostKeyEntry{
+			KeyType:     *k.PendingKeyType,
+			Fingerprint: *k.PendingFingerprint,
+			PublicKey:   authorizedKey(k.PendingPublicKey),
+			SeenAt:      k.PendingSeenAt.String(),
+		}
+	}
+	return resp
+}
+
+// ownedHostID vérifie que l'hôte {id} est accessible à l'utilisateur courant.
+func (h *HostHandler) ownedHostID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	if _, err := db.GetHostByID(r.Context(), h.db, id, user.UserID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "host not found", http.StatusNotFound)
+			return "", false
+		}
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return "", false
+	}
+	return id, true
+}
+
+// GET /api/hosts/{id}/host-keys — clé épinglée et éventuelle clé refusée en attente
+func (h *HostHandler) GetHostKeys(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.ownedHostID(w, r)
+	if !ok {
+		return
+	}
+	k, err := db.GetHostKey(r.Context(), h.db, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonResponse(w, toHostKeysResponse(id, nil), http.StatusOK)
+			return
+		}
+		jsonInternalError(w, "get host key", err)
+		return
+	}
+	jsonResponse(w, toHostKeysResponse(id, k), http.StatusOK)
+}
+
+// POST /api/hosts/{id}/host-keys/accept — remplace la clé épinglée par la clé en attente.
+// L'empreinte confirmée par l'utilisateur doit correspondre à la clé en attente.
+// Pour un hôte d'équipe, seuls les owners et admins peuvent changer la clé épinglée.
+func (h *HostHandler) AcceptHostKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := h.writableHost(w, r, id); !ok {
+		return
+	}
+	var req struct {
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Fingerprint == "" {
+		jsonError(w, "fingerprint required", http.StatusBadRequest)
+		return
+	}
+	if err := db.AcceptPendingHostKey(r.Context(), h.db, id, req.Fingerprint); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "no pending host key with this fingerprint", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "accept host key", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionHostKeyAccepted, id, map[string]interface{}{"fingerprint": req.Fingerprint})
+	k, err := db.GetHostKey(r.Context(), h.db, id)
+	if err != nil {
+		jsonInternalError(w, "get host key", err)
+		return
+	}
+	jsonResponse(w, toHostKeysResponse(id, k), http.StatusOK)
+}
+
+// DELETE /api/hosts/{id}/host-keys — oublie la clé épinglée (nouveau TOFU à la prochaine connexion)
+func (h *HostHandler) ResetHostKeys(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, ok := h.writableHost(w, r, id); !ok {
+		return
+	}
+	if err := db.DeleteHostKey(r.Context(), h.db, id); err != nil {
+		jsonInternalError(w, "reset host key", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionHostKeyReset, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
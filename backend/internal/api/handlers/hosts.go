@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/db"
 	"github.com/gestion-ssh/backend/internal/models"
 	"github.com/go-chi/chi/v5"
@@ -35,6 +36,8 @@ type hostRequest struct {
 	IV            string   `json:"iv"`             // base64
 	Tags          []string `json:"tags"`
 	Icon          string   `json:"icon"`
+	JumpHostID    string   `json:"jump_host_id"` // optionnel : bastion par lequel passer
+	TeamID        string   `json:"team_id"`      // optionnel, création uniquement : équipe propriétaire
 }
 
 func (h *hostRequest) toModel() (*models.CreateHostInput, error) {
@@ -57,6 +60,13 @@ func (h *hostRequest) toModel() (*models.CreateHostInput, error) {
 	if tags == nil {
 		tags = []string{}
 	}
+	var jumpHostID, teamID *string
+	if h.JumpHostID != "" {
+		jumpHostID = &h.JumpHostID
+	}
+	if h.TeamID != "" {
+		teamID = &h.TeamID
+	}
 	return &models.CreateHostInput{
 		Name:          h.Name,
 		Hostname:      h.Hostname,
@@ -67,6 +77,8 @@ func (h *hostRequest) toModel() (*models.CreateHostInput, error) {
 		IV:            iv,
 		Tags:          tags,
 		Icon:          h.Icon,
+		JumpHostID:    jumpHostID,
+		TeamID:        teamID,
 	}, nil
 }
 
@@ -92,11 +104,47 @@ func validateHostRequest(h *hostRequest) string {
 	return ""
 }
 
+// validateJumpHost vérifie que le bastion est accessible à l'utilisateur et que
+// la chaîne ainsi formée ne repasse pas par l'hôte lui-même (hostID vide à la création).
+// Pour un hôte d'équipe (teamID non nil), toute la chaîne doit appartenir à
+// l'équipe afin que chaque membre puisse l'emprunter. Retourne le motif du
+// refus, ou une erreur si la vérification n'a pu être faite.
+func (h *HostHandler) validateJumpHost(r *http.Request, userID, hostID string, teamID, jumpHostID *string) (string, error) {
+	if jumpHostID == nil {
+		return "", nil
+	}
+	if *jumpHostID == hostID {
+		return "a host cannot be its own jump host", nil
+	}
+	chain, err := db.GetHostChain(r.Context(), h.db, *jumpHostID, userID)
+	switch {
+	case errors.Is(err, db.ErrInvalidJumpChain):
+		return "invalid jump host chain", nil
+	case errors.Is(err, db.ErrNotFound):
+		return "jump host not found", nil
+	case err != nil:
+		return "", err
+	}
+	if len(chain) > db.MaxJumpHops {
+		return "too many jump hosts", nil
+	}
+	for _, hop := range chain {
+		if hop.ID == hostID {
+			return "jump host chain would create a loop", nil
+		}
+		if teamID != nil && (hop.TeamID == nil || *hop.TeamID != *teamID) {
+			return "jump hosts of a team host must belong to the same team", nil
+		}
+	}
+	return "", nil
+}
+
 // ─── Réponse JSON ─────────────────────────────────────────────────────────────
 
 type hostResponse struct {
 	ID            string   `json:"id"`
-	UserID        string   `json:"user_id"`
+	UserID        *string  `json:"user_id"`
+	TeamID        *string  `json:"team_id"`
 	Name          string   `json:"name"`
 	Hostname      string   `json:"hostname"`
 	Port          int      `json:"port"`
@@ -106,8 +154,12 @@ type hostResponse struct {
 	IV            string   `json:"iv"`             // base64
 	Tags          []string `json:"tags"`
 	Icon          string   `json:"icon"`
+	JumpHostID    *string  `json:"jump_host_id"`
 	CreatedAt     string   `json:"created_at"`
 	UpdatedAt     string   `json:"updated_at"`
+	// Hôte d'équipe : copie du credential chiffrée avec la clé maître du membre
+	MemberEncryptedCred string `json:"member_encrypted_cred,omitempty"` // base64
+	MemberIV            string `json:"member_iv,omitempty"`             // base64
 }
 
 func toHostResponse(h *models.Host) hostResponse {
@@ -115,9 +167,10 @@ func toHostResponse(h *models.Host) hostResponse {
 	if tags == nil {
 		tags = []string{}
 	}
-	return hostResponse{
+	resp := hostResponse{
 		ID:            h.ID,
 		UserID:        h.UserID,
+		TeamID:        h.TeamID,
 		Name:          h.Name,
 		Hostname:      h.Hostname,
 		Port:          h.Port,
@@ -127,9 +180,40 @@ func toHostResponse(h *models.Host) hostResponse {
 		IV:            base64.StdEncoding.EncodeToString(h.IV),
 		Tags:          tags,
 		Icon:          h.Icon,
+		JumpHostID:    h.JumpHostID,
 		CreatedAt:     h.CreatedAt.String(),
 		UpdatedAt:     h.UpdatedAt.String(),
 	}
+	if h.MemberEncryptedCred != nil {
+		resp.MemberEncryptedCred = base64.StdEncoding.EncodeToString(h.MemberEncryptedCred)
+		resp.MemberIV = base64.StdEncoding.EncodeToString(h.MemberIV)
+	}
+	return resp
+}
+
+// writableHost charge l'hôte id et vérifie que l'utilisateur courant peut le
+// modifier (propriétaire, ou owner/admin de l'équipe propriétaire).
+func (h *HostHandler) writableHost(w http.ResponseWriter, r *http.Request, id string) (*models.Host, bool) {
+	user := mw.GetUser(r)
+	host, err := db.GetHostByID(r.Context(), h.db, id, user.UserID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "host not found", http.StatusNotFound)
+			return nil, false
+		}
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	writable, err := db.CanWriteHost(r.Context(), h.db, id, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "check host permission", err)
+		return nil, false
+	}
+	if !writable {
+		jsonError(w, "only team owners and admins can modify team hosts", http.StatusForbidden)
+		return nil, false
+	}
+	return host, true
 }
 
 // ─── Handlers ─────────────────────────────────────────────────────────────────
@@ -164,14 +248,51 @@ func (h *HostHandler) Create(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if input.TeamID != nil {
+		role, err := db.GetTeamRole(r.Context(), h.db, *input.TeamID, user.UserID)
+		if err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				jsonError(w, "team not found", http.StatusNotFound)
+				return
+			}
+			jsonInternalError(w, "get team role", err)
+			return
+		}
+		if role == db.TeamRoleMember {
+			jsonError(w, "only team owners and admins can add hosts", http.StatusForbidden)
+			return
+		}
+	}
+	if msg, err := h.validateJumpHost(r, user.UserID, "", input.TeamID, input.JumpHostID); err != nil {
+		jsonInternalError(w, "validate jump host", err)
+		return
+	} else if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
 	host, err := db.CreateHost(r.Context(), h.db, input, user.UserID)
 	if err != nil {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.ActionHostCreated, host.ID, hostAuditDetails(host))
 	jsonResponse(w, toHostResponse(host), http.StatusCreated)
 }
 
+// hostAuditDetails résume l'hôte pour le journal d'audit (jamais le credential).
+func hostAuditDetails(host *models.Host) map[string]interface{} {
+	details := map[string]interface{}{
+		"name":     host.Name,
+		"hostname": host.Hostname,
+		"port":     host.Port,
+		"username": host.Username,
+	}
+	if host.TeamID != nil {
+		details["team_id"] = *host.TeamID
+	}
+	return details
+}
+
 func (h *HostHandler) Get(w http.ResponseWriter, r *http.Request) {
 	user := mw.GetUser(r)
 	id := chi.URLParam(r, "id")
@@ -204,6 +325,17 @@ func (h *HostHandler) Update(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	current, ok := h.writableHost(w, r, id)
+	if !ok {
+		return
+	}
+	if msg, err := h.validateJumpHost(r, user.UserID, id, current.TeamID, input.JumpHostID); err != nil {
+		jsonInternalError(w, "validate jump host", err)
+		return
+	} else if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
 	host, err := db.UpdateHost(r.Context(), h.db, id, user.UserID, input)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -213,14 +345,71 @@ func (h *HostHandler) Update(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.ActionHostUpdated, host.ID, hostAuditDetails(host))
 	jsonResponse(w, toHostResponse(host), http.StatusOK)
 }
 
 func (h *HostHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	user := mw.GetUser(r)
 	id := chi.URLParam(r, "id")
+	host, ok := h.writableHost(w, r, id)
+	if !ok {
+		return
+	}
 	if err := db.DeleteHost(r.Context(), h.db, id, user.UserID); err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		if errors.Is(err, db.ErrJumpHostInUse) {
+			jsonError(w, "host is used as a jump host by another host: change that host's jump host first", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "delete host", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionHostDeleted, id, hostAuditDetails(host))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ─── Copie personnelle du credential (hôtes d'équipe) ─────────────────────────
+//
+// Le credential d'un hôte d'équipe est chiffré avec la clé d'équipe. Chaque
+// membre peut en conserver une copie chiffrée avec sa propre clé maître, pour
+// se connecter sans déchiffrer la clé d'équipe à chaque fois.
+
+// PUT /api/hosts/{id}/member-credential
+func (h *HostHandler) SetMemberCredential(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	var req vaultBlob
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.ID = id
+	entries, err := decodeVaultBlobs("host", []vaultBlob{req})
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := db.SetHostMemberCredential(r.Context(), h.db, id, user.UserID, entries[0].EncryptedCred, entries[0].IV); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "team host not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "set member credential", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/hosts/{id}/member-credential
+func (h *HostHandler) DeleteMemberCredential(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	if err := db.DeleteHostMemberCredential(r.Context(), h.db, id, user.UserID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "member credential not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "delete member credential", err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/gestion-ssh/backend/internal/oidc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Single sign-on OpenID Connect (authorization code + PKCE). Le fournisseur
+// d'identité authentifie l'utilisateur mais ne connaît pas la clé du coffre :
+// les comptes SSO définissent une passphrase de coffre distincte, dérivée côté
+// client avec kdf_salt comme le mot de passe d'un compte local.
+//
+// Le callback est une navigation du navigateur : le résultat est transmis au
+// frontend par redirection, dans le fragment d'URL (jamais envoyé au serveur).
+
+const (
+	oidcLoginTTL    = 10 * time.Minute
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/api/auth/oidc"
+)
+
+type OIDCHandler struct {
+	store    oidcStore
+	cfg      *config.Config
+	provider *oidc.Provider
+}
+
+func NewOIDCHandler(pool *pgxpool.Pool, cfg *config.Config) *OIDCHandler {
+	scopes := strings.Fields(cfg.OIDCScopes)
+	provider := oidc.NewProvider(cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL, scopes)
+	return &OIDCHandler{store: pgOIDCStore{pool}, cfg: cfg, provider: provider}
+}
+
+// oidcStore regroupe les accès à la base du flux SSO ; les tests le
+// remplacent par un stockage en mémoire.
+type oidcStore interface {
+	CreateOIDCLogin(ctx context.Context, stateHash, nonce, codeVerifier string, rememberMe bool, expiresAt time.Time) error
+	TakeOIDCLogin(ctx context.Context, stateHash string) (nonce, codeVerifier string, rememberMe bool, err error)
+	GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*models.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*models.User, error)
+	LinkUserOIDC(ctx context.Context, userID, issuer, subject string) error
+	CreateOIDCUser(ctx context.Context, email, issuer, subject string, kdfSalt []byte, isAdmin bool) (*models.User, error)
+	SetUserAdmin(ctx context.Context, userID string, isAdmin bool) (bool, error)
+	CountWebAuthnCredentials(ctx context.Context, userID string) (int, error)
+	OpenLoginSession(r *http.Request, secret, userID, email string, isAdmin, rememberMe bool) (sessionID, refreshToken string, expiresAt time.Time, err error)
+}
+
+type pgOIDCStore struct {
+	pool *pgxpool.Pool
+}
+
+func (s pgOIDCStore) CreateOIDCLogin(ctx context.Context, stateHash, nonce, codeVerifier string, rememberMe bool, expiresAt time.Time) error {
+	return db.CreateOIDCLogin(ctx, s.pool, stateHash, nonce, codeVerifier, rememberMe, expiresAt)
+}
+
+func (s pgOIDCStore) TakeOIDCLogin(ctx context.Context, stateHash string) (string, string, bool, error) {
+	return db.TakeOIDCLogin(ctx, s.pool, stateHash)
+}
+
+func (s pgOIDCStore) GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	return db.GetUserByOIDCIdentity(ctx, s.pool, issuer, subject)
+}
+
+func (s pgOIDCStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	return db.GetUserByEmail(ctx, s.pool, email)
+}
+
+func (s pgOIDCStore) LinkUserOIDC(ctx context.Context, userID, issuer, subject string) error {
+	return db.LinkUserOIDC(ctx, s.pool, userID, issuer, subject)
+}
+
+func (s pgOIDCStore) CreateOIDCUser(ctx context.Context, email, issuer, subject string, kdfSalt []byte, isAdmin bool) (*models.User, error) {
+	return db.CreateOIDCUser(ctx, s.pool, email, issuer, subject, kdfSalt, isAdmin)
+}
+
+func (s pgOIDCStore) SetUserAdmin(ctx context.Context, userID string, isAdmin bool) (bool, error) {
+	return db.SetUserAdmin(ctx, s.pool, userID, isAdmin)
+}
+
+func (s pgOIDCStore) CountWebAuthnCredentials(ctx context.Context, userID string) (int, error) {
+	return db.CountWebAuthnCredentials(ctx, s.pool, userID)
+}
+
+func (s pgOIDCStore) OpenLoginSession(r *http.Request, secret, userID, email string, isAdmin, rememberMe bool) (string, string, time.Time, error) {
+	return openLoginSession(r, s.pool, secret, userID, email, isAdmin, rememberMe)
+}
+
+func hashOIDCState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// GET /api/auth/oidc/login?remember_me=true — redirige vers le fournisseur
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := oidc.RandomString()
+	if err != nil {
+		jsonInternalError(w, "oidc state", err)
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		jsonInternalError(w, "oidc nonce", err)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		jsonInternalError(w, "oidc verifier", err)
+		return
+	}
+
+	authURL, err := h.provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("[ERROR] oidc discovery: %v", err)
+		jsonError(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	rememberMe := r.URL.Query().Get("remember_me") == "true"
+	if err := h.store.CreateOIDCLogin(r.Context(), hashOIDCState(state), nonce, verifier, rememberMe, time.Now().Add(oidcLoginTTL)); err != nil {
+		jsonInternalError(w, "create oidc login", err)
+		return
+	}
+
+	// Le state est aussi lié au navigateur : un callback reçu sans ce cookie
+	// (login CSRF) est rejeté. SameSite=Lax car le retour vient du fournisseur.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+		Path:     oidcCookiePath,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// GET /api/auth/oidc/callback?code=...&state=... — retour du fournisseur
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    "",
+		HttpOnly: true,
+		Secure:   isSecure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     oidcCookiePath,
+		MaxAge:   -1,
+	})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("oidc callback: provider error %q: %s", e, q.Get("error_description"))
+		h.redirect(w, r, url.Values{"sso_error": {"provider_error"}})
+		return
+	}
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		h.redirect(w, r, url.Values{"sso_error": {"invalid_state"}})
+		return
+	}
+	nonce, verifier, rememberMe, err := h.store.TakeOIDCLogin(r.Context(), hashOIDCState(state))
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("[ERROR] take oidc login: %v", err)
+		}
+		h.redirect(w, r, url.Values{"sso_error": {"invalid_state"}})
+		return
+	}
+
+	rawIDToken, err := h.provider.Exchange(r.Context(), q.Get("code"), verifier)
+	if err != nil {
+		log.Printf("oidc callback: code exchange: %v", err)
+		h.redirect(w, r, url.Values{"sso_error": {"exchange_failed"}})
+		return
+	}
+	claims, err := h.provider.VerifyIDToken(r.Context(), rawIDToken, nonce)
+	if err != nil {
+		log.Printf("oidc callback: %v", err)
+		h.redirect(w, r, url.Values{"sso_error": {"invalid_token"}})
+		return
+	}
+
+	user, code := h.resolveUser(r, claims)
+	if user == nil {
+		h.redirect(w, r, url.Values{"sso_error": {code}})
+		return
+	}
+	if user.Disabled {
+		h.redirect(w, r, url.Values{"sso_error": {"account_disabled"}})
+		return
+	}
+	h.syncAdmin(r, user, claims)
+
+	// Le second facteur local reste exigé s'il est configuré : le frontend
+	// termine le login par /api/auth/2fa/verify avec le token temporaire.
+	passkeys, err := h.store.CountWebAuthnCredentials(r.Context(), user.ID)
+	if err != nil {
+		log.Printf("[ERROR] count webauthn credentials: %v", err)
+		h.redirect(w, r, url.Values{"sso_error": {"internal"}})
+		return
+	}
+	if user.TOTPEnabled || passkeys > 0 || h.cfg.TOTPRequired {
+		totpToken, err := auth.GenerateTOTPPendingToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin)
+		if err != nil {
+			log.Printf("[ERROR] totp pending token: %v", err)
+			h.redirect(w, r, url.Values{"sso_error": {"internal"}})
+			return
+		}
+		frag := url.Values{"totp_token": {totpToken}}
+		if !user.TOTPEnabled && passkeys == 0 {
+			frag.Set("totp_setup_required", "true")
+		} else {
+			var methods []string
+			if user.TOTPEnabled {
+				methods = append(methods, "totp")
+			}
+			if passkeys > 0 {
+				methods = append(methods, "webauthn")
+			}
+			frag.Set("two_factor_methods", strings.Join(methods, ","))
+		}
+		h.redirect(w, r, frag)
+		return
+	}
+
+	sessionID, refreshToken, refreshExpiresAt, err := h.store.OpenLoginSession(r, h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, rememberMe)
+	if errors.Is(err, db.ErrAccountDisabled) {
+		h.redirect(w, r, url.Values{"sso_error": {"account_disabled"}})
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] open login session: %v", err)
+		h.redirect(w, r, url.Values{"sso_error": {"internal"}})
+		return
+	}
+	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, sessionID)
+	if err != nil {
+		log.Printf("[ERROR] access token: %v", err)
+		h.redirect(w, r, url.Values{"sso_error": {"internal"}})
+		return
+	}
+	setAccessCookie(w, isSecure, accessToken)
+	setRefreshCookie(w, isSecure, refreshToken, refreshExpiresAt)
+	h.redirect(w, r, url.Values{"sso": {"ok"}})
+}
+
+// resolveUser retrouve le compte lié à l'identité OIDC, lie un compte local de
+// même email (si le fournisseur l'a vérifié) ou en provisionne un nouveau.
+// En cas d'échec, retourne le code d'erreur transmis au frontend.
+func (h *OIDCHandler) resolveUser(r *http.Request, claims *oidc.Claims) (*models.User, string) {
+	ctx := r.Context()
+	issuer := h.provider.Issuer
+
+	user, err := h.store.GetUserByOIDCIdentity(ctx, issuer, claims.Subject)
+	if err == nil {
+		return user, ""
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("[ERROR] get user by oidc identity: %v", err)
+		return nil, "internal"
+	}
+
+	if claims.Email != "" && claims.EmailVerified {
+		user, err := h.store.GetUserByEmail(ctx, claims.Email)
+		if err == nil {
+			if err := h.store.LinkUserOIDC(ctx, user.ID, issuer, claims.Subject); err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					// Compte déjà lié à une autre identité
+					return nil, "account_conflict"
+				}
+				log.Printf("[ERROR] link oidc identity: %v", err)
+				return nil, "internal"
+			}
+			log.Printf("oidc: linked %s to user %s", claims.Subject, user.ID)
+			return user, ""
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			log.Printf("[ERROR] get user by email: %v", err)
+			return nil, "internal"
+		}
+	}
+
+	if !h.cfg.OIDCAutoProvision {
+		return nil, "account_not_found"
+	}
+	if claims.Email == "" {
+		return nil, "email_required"
+	}
+	kdfSalt, err := auth.GenerateKDFSalt()
+	if err != nil {
+		log.Printf("[ERROR] kdf salt: %v", err)
+		return nil, "internal"
+	}
+	user, err = h.store.CreateOIDCUser(ctx, claims.Email, issuer, claims.Subject, kdfSalt, h.inAdminGroup(claims))
+	if err != nil {
+		// Email déjà utilisé par un compte local non vérifiable côté fournisseur
+		log.Printf("oidc: provisioning %s failed: %v", claims.Email, err)
+		return nil, "account_conflict"
+	}
+	log.Printf("oidc: provisioned user %s (%s)", user.ID, user.Email)
+	return user, ""
+}
+
+func (h *OIDCHandler) inAdminGroup(claims *oidc.Claims) bool {
+	if h.cfg.OIDCAdminGroup == "" {
+		return false
+	}
+	for _, g := range claims.StringList(h.cfg.OIDCGroupsClaim) {
+		if g == h.cfg.OIDCAdminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// syncAdmin aligne is_admin sur l'appartenance au groupe OIDC_ADMIN_GROUP,
+// sans jamais retirer le rôle au dernier administrateur.
+func (h *OIDCHandler) syncAdmin(r *http.Request, user *models.User, claims *oidc.Claims) {
+	if h.cfg.OIDCAdminGroup == "" {
+		return
+	}
+	isAdmin := h.inAdminGroup(claims)
+	if isAdmin == user.IsAdmin {
+		return
+	}
+	applied, err := h.store.SetUserAdmin(r.Context(), user.ID, isAdmin)
+	if err != nil {
+		log.Printf("[ERROR] set user admin: %v", err)
+		return
+	}
+	if !applied {
+		log.Printf("oidc: keeping admin role of %s (last administrator)", user.ID)
+		return
+	}
+	user.IsAdmin = isAdmin
+}
+
+// redirect renvoie le navigateur vers le frontend avec le résultat dans le fragment.
+func (h *OIDCHandler) redirect(w http.ResponseWriter, r *http.Request, frag url.Values) {
+	http.Redirect(w, r, h.cfg.OIDCPostLoginURL+"#"+frag.Encode(), http.StatusFound)
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/gestion-ssh/backend/internal/oidc"
+	"github.com/gestion-ssh/backend/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const testJWTSecret = "test-secret"
+
+// fakeOIDCStore reproduit en mémoire la sémantique des requêtes SQL du flux SSO.
+type fakeOIDCStore struct {
+	mu         sync.Mutex
+	logins     map[string]fakeOIDCLogin
+	users      []*models.User
+	identities map[string]string // issuer|subject → user ID
+}
+
+type fakeOIDCLogin struct {
+	nonce, verifier string
+	rememberMe      bool
+	expiresAt       time.Time
+}
+
+func newFakeOIDCStore() *fakeOIDCStore {
+	return &fakeOIDCStore{logins: make(map[string]fakeOIDCLogin), identities: make(map[string]string)}
+}
+
+func (f *fakeOIDCStore) addUser(email string, isAdmin bool) *models.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := &models.User{ID: fmt.Sprintf("user-%d", len(f.users)+1), Email: email, IsAdmin: isAdmin, AuthSource: "local"}
+	f.users = append(f.users, u)
+	return u
+}
+
+func (f *fakeOIDCStore) user(id string) *models.User {
+	for _, u := range f.users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (f *fakeOIDCStore) CreateOIDCLogin(ctx context.Context, stateHash, nonce, codeVerifier string, rememberMe bool, expiresAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logins[stateHash] = fakeOIDCLogin{nonce, codeVerifier, rememberMe, expiresAt}
+	return nil
+}
+
+func (f *fakeOIDCStore) TakeOIDCLogin(ctx context.Context, stateHash string) (string, string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.logins[stateHash]
+	delete(f.logins, stateHash)
+	if !ok || time.Now().After(l.expiresAt) {
+		return "", "", false, db.ErrNotFound
+	}
+	return l.nonce, l.verifier, l.rememberMe, nil
+}
+
+func (f *fakeOIDCStore) GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u := f.user(f.identities[issuer+"|"+subject]); u != nil {
+		c := *u
+		return &c, nil
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (f *fakeOIDCStore) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.users {
+		if u.Email == email {
+			c := *u
+			return &c, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (f *fakeOIDCStore) LinkUserOIDC(ctx context.Context, userID, issuer, subject string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range f.identities {
+		if id == userID {
+			return db.ErrNotFound
+		}
+	}
+	f.identities[issuer+"|"+subject] = userID
+	return nil
+}
+
+func (f *fakeOIDCStore) CreateOIDCUser(ctx context.Context, email, issuer, subject string, kdfSalt []byte, isAdmin bool) (*models.User, error) {
+	if _, err := f.GetUserByEmail(ctx, email); err == nil {
+		return nil, fmt.Errorf("duplicate email %s", email)
+	}
+	u := f.addUser(email, isAdmin)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u.AuthSource = "oidc"
+	f.identities[issuer+"|"+subject] = u.ID
+	c := *u
+	return &c, nil
+}
+
+func (f *fakeOIDCStore) SetUserAdmin(ctx context.Context, userID string, isAdmin bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := f.user(userID)
+	if u == nil {
+		return false, nil
+	}
+	if !isAdmin && u.IsAdmin && !u.Disabled {
+		others := 0
+		for _, o := range f.users {
+			if o.IsAdmin && !o.Disabled && o.ID != userID {
+				others++
+			}
+		}
+		if others == 0 {
+			return false, nil
+		}
+	}
+	u.IsAdmin = isAdmin
+	return true, nil
+}
+
+func (f *fakeOIDCStore) CountWebAuthnCredentials(ctx context.Context, userID string) (int, error) {
+	return 0, nil
+}
+
+func (f *fakeOIDCStore) OpenLoginSession(r *http.Request, secret, userID, email string, isAdmin, rememberMe bool) (string, string, time.Time, error) {
+	return "session-" + userID, "refresh-" + userID, time.Now().Add(auth.RefreshTokenDuration), nil
+}
+
+type oidcFixture struct {
+	idp   *oidctest.Server
+	store *fakeOIDCStore
+	cfg   *config.Config
+	h     *OIDCHandler
+}
+
+func newOIDCFixture(t *testing.T) *oidcFixture {
+	idp := oidctest.NewServer(t, "nexterm")
+	cfg := &config.Config{
+		JWTSecret:        testJWTSecret,
+		OIDCIssuer:       idp.Issuer(),
+		OIDCClientID:     "nexterm",
+		OIDCRedirectURL:  "https://app.example/api/auth/oidc/callback",
+		OIDCGroupsClaim:  "groups",
+		OIDCPostLoginURL: "/",
+	}
+	store := newFakeOIDCStore()
+	provider := oidc.NewProvider(cfg.OIDCIssuer, cfg.OIDCClientID, "", cfg.OIDCRedirectURL, []string{"openid", "email"})
+	return &oidcFixture{idp: idp, store: store, cfg: cfg, h: &OIDCHandler{store: store, cfg: cfg, provider: provider}}
+}
+
+// start appelle Login et retourne l'URL d'autorisation et le cookie de state.
+func (f *oidcFixture) start(t *testing.T) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	f.h.Login(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			return rec.Header().Get("Location"), c
+		}
+	}
+	t.Fatal("login did not set the state cookie")
+	return "", nil
+}
+
+// callback appelle Callback et retourne le fragment de redirection et la réponse.
+func (f *oidcFixture) callback(t *testing.T, code, state string, cookie *http.Cookie) (url.Values, *http.Response) {
+	t.Helper()
+	q := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?"+q.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	f.h.Callback(rec, req)
+	loc := rec.Header().Get("Location")
+	i := strings.Index(loc, "#")
+	if rec.Code != http.StatusFound || i < 0 {
+		t.Fatalf("callback: status %d, location %q", rec.Code, loc)
+	}
+	frag, err := url.ParseQuery(loc[i+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frag, rec.Result()
+}
+
+// login déroule le flux complet avec les claims modifiés par edit.
+func (f *oidcFixture) login(t *testing.T, edit func(jwt.MapClaims)) (url.Values, *http.Response) {
+	t.Helper()
+	authURL, cookie := f.start(t)
+	u, _ := url.Parse(authURL)
+	code := f.idp.Authorize(t, authURL, edit)
+	return f.callback(t, code, u.Query().Get("state"), cookie)
+}
+
+func accessClaims(t *testing.T, resp *http.Response) *auth.Claims {
+	t.Helper()
+	for _, c := range resp.Cookies() {
+		if c.Name == "access_token" {
+			claims, err := auth.ValidateToken(testJWTSecret, c.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return claims
+		}
+	}
+	t.Fatal("no access_token cookie")
+	return nil
+}
+
+func withEmail(email string, verified bool, groups ...string) func(jwt.MapClaims) {
+	return func(c jwt.MapClaims) {
+		c["email"] = email
+		c["email_verified"] = verified
+		if groups != nil {
+			c["groups"] = groups
+		}
+	}
+}
+
+func TestOIDCCallbackLogsInLinkedUser(t *testing.T) {
+	f := newOIDCFixture(t)
+	u := f.store.addUser("alice@example.com", false)
+	f.store.identities[f.idp.Issuer()+"|subject-1"] = u.ID
+
+	frag, resp := f.login(t, nil)
+	if frag.Get("sso") != "ok" {
+		t.Fatalf("fragment %v", frag)
+	}
+	if c := accessClaims(t, resp); c.UserID != u.ID || c.SessionID != "session-"+u.ID {
+		t.Fatalf("access claims %+v", c)
+	}
+}
+
+func TestOIDCCallbackRejectsState(t *testing.T) {
+	f := newOIDCFixture(t)
+	f.store.addUser("alice@example.com", false)
+
+	authURL, cookie := f.start(t)
+	u, _ := url.Parse(authURL)
+	state := u.Query().Get("state")
+	code := f.idp.Authorize(t, authURL, nil)
+
+	if frag, _ := f.callback(t, code, state, nil); frag.Get("sso_error") != "invalid_state" {
+		t.Fatalf("missing cookie: %v", frag)
+	}
+	other := &http.Cookie{Name: oidcStateCookie, Value: "other-state"}
+	if frag, _ := f.callback(t, code, state, other); frag.Get("sso_error") != "invalid_state" {
+		t.Fatalf("mismatched cookie: %v", frag)
+	}
+	if frag, _ := f.callback(t, code, "other-state", other); frag.Get("sso_error") != "invalid_state" {
+		t.Fatalf("unknown state: %v", frag)
+	}
+
+	// Le premier callback consomme le state ; le rejouer est refusé.
+	f.store.identities[f.idp.Issuer()+"|subject-1"] = "user-1"
+	if frag, _ := f.callback(t, code, state, cookie); frag.Get("sso") != "ok" {
+		t.Fatalf("first callback: %v", frag)
+	}
+	code = f.idp.Authorize(t, authURL, nil)
+	if frag, _ := f.callback(t, code, state, cookie); frag.Get("sso_error") != "invalid_state" {
+		t.Fatalf("replayed state: %v", frag)
+	}
+}
+
+func TestOIDCCallbackRejectsTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(jwt.MapClaims)
+	}{
+		{"nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }},
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newOIDCFixture(t)
+			u := f.store.addUser("alice@example.com", false)
+			f.store.identities[f.idp.Issuer()+"|subject-1"] = u.ID
+			if frag, _ := f.login(t, tt.edit); frag.Get("sso_error") != "invalid_token" {
+				t.Fatalf("fragment %v", frag)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsPKCEMismatch(t *testing.T) {
+	f := newOIDCFixture(t)
+	authURL, cookie := f.start(t)
+	u, _ := url.Parse(authURL)
+	state := u.Query().Get("state")
+	code := f.idp.Authorize(t, authURL, nil)
+
+	// Verifier stocké altéré : le fournisseur refuse l'échange du code.
+	for h, l := range f.store.logins {
+		l.verifier = "tampered"
+		f.store.logins[h] = l
+	}
+	if frag, _ := f.callback(t, code, state, cookie); frag.Get("sso_error") != "exchange_failed" {
+		t.Fatalf("fragment %v", frag)
+	}
+}
+
+func TestOIDCCallbackLinksVerifiedEmail(t *testing.T) {
+	f := newOIDCFixture(t)
+	u := f.store.addUser("alice@example.com", false)
+
+	frag, resp := f.login(t, withEmail("alice@example.com", true))
+	if frag.Get("sso") != "ok" {
+		t.Fatalf("fragment %v", frag)
+	}
+	if c := accessClaims(t, resp); c.UserID != u.ID {
+		t.Fatalf("logged in as %s, want %s", c.UserID, u.ID)
+	}
+	if f.store.identities[f.idp.Issuer()+"|subject-1"] != u.ID {
+		t.Fatal("identity not linked")
+	}
+
+	// Une autre identité avec le même email ne peut pas reprendre le compte lié.
+	frag, _ = f.login(t, func(c jwt.MapClaims) {
+		withEmail("alice@example.com", true)(c)
+		c["sub"] = "subject-2"
+	})
+	if frag.Get("sso_error") != "account_conflict" {
+		t.Fatalf("second identity: %v", frag)
+	}
+}
+
+func TestOIDCCallbackIgnoresUnverifiedEmail(t *testing.T) {
+	f := newOIDCFixture(t)
+	f.store.addUser("alice@example.com", false)
+
+	if frag, _ := f.login(t, withEmail("alice@example.com", false)); frag.Get("sso_error") != "account_not_found" {
+		t.Fatalf("fragment %v", frag)
+	}
+	if len(f.store.identities) != 0 {
+		t.Fatal("unverified email linked an account")
+	}
+}
+
+func TestOIDCCallbackProvisions(t *testing.T) {
+	f := newOIDCFixture(t)
+	f.cfg.OIDCAutoProvision = true
+	f.cfg.OIDCAdminGroup = "admins"
+
+	frag, resp := f.login(t, withEmail("bob@example.com", false, "admins"))
+	if frag.Get("sso") != "ok" {
+		t.Fatalf("fragment %v", frag)
+	}
+	if c := accessClaims(t, resp); c.Email != "bob@example.com" || !c.IsAdmin {
+		t.Fatalf("access claims %+v", c)
+	}
+}
+
+func TestOIDCAdminGroupSync(t *testing.T) {
+	f := newOIDCFixture(t)
+	f.cfg.OIDCAdminGroup = "admins"
+	admin := f.store.addUser("admin@example.com", true)
+	f.store.identities[f.idp.Issuer()+"|subject-1"] = admin.ID
+	member := f.store.addUser("member@example.com", false)
+	f.store.identities[f.idp.Issuer()+"|subject-2"] = member.ID
+	asMember := func(groups ...string) func(jwt.MapClaims) {
+		return func(c jwt.MapClaims) {
+			c["sub"] = "subject-2"
+			c["groups"] = groups
+		}
+	}
+
+	// Le dernier administrateur hors du groupe garde son rôle.
+	_, resp := f.login(t, func(c jwt.MapClaims) { c["groups"] = []string{"ops"} })
+	if !accessClaims(t, resp).IsAdmin || !f.store.user(admin.ID).IsAdmin {
+		t.Fatal("last administrator demoted")
+	}
+
+	// Un membre du groupe est promu.
+	_, resp = f.login(t, asMember("admins"))
+	if !accessClaims(t, resp).IsAdmin || !f.store.user(member.ID).IsAdmin {
+		t.Fatal("group member not promoted")
+	}
+
+	// Avec un autre administrateur, la sortie du groupe retire le rôle.
+	_, resp = f.login(t, asMember("ops"))
+	if accessClaims(t, resp).IsAdmin || f.store.user(member.ID).IsAdmin {
+		t.Fatal("member kept admin role after leaving the group")
+	}
+}
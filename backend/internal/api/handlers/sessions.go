@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
+	"github.com/go-chi/chi/v5"
+)
+
+// SessionHandler expose les opérations sur les sessions terminal actives de l'utilisateur.
+type SessionHandler struct {
+	sessions *sshproxy.Manager
+}
+
+func NewSessionHandler(sessions *sshproxy.Manager) *SessionHandler {
+	return &SessionHandler{sessions: sessions}
+}
+
+// POST /api/sessions/{id}/invites — crée un jeton pour inviter un collègue dans la session
+func (h *SessionHandler) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	sessionID := chi.URLParam(r, "id")
+
+	var req struct {
+		Permission string `json:"permission"` // "read" | "write"
+		ExpiresIn  int    `json:"expires_in"` // secondes
+		Email      string `json:"email"`      // optionnel : restreint l'invitation à cet utilisateur
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = "read"
+	}
+	if req.Permission != "read" && req.Permission != "write" {
+		jsonError(w, "permission must be 'read' or 'write'", http.StatusBadRequest)
+		return
+	}
+	ttl := sshproxy.DefaultInviteTTL
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > sshproxy.MaxInviteTTL {
+		jsonError(w, "expires_in is too long", http.StatusBadRequest)
+		return
+	}
+
+	token, expiresAt, err := h.sessions.Invite(sessionID, user.UserID, req.Permission == "write", req.Email, ttl)
+	if err != nil {
+		if errors.Is(err, sshproxy.ErrSessionNotFound) {
+			jsonError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "create session invite", err)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"token":      token,
+		"permission": req.Permission,
+		"email":      req.Email,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	}, http.StatusCreated)
+}
+
+// DELETE /api/sessions/{id}/invites — révoque les invitations et déconnecte les invités
+func (h *SessionHandler) RevokeInvites(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	sessionID := chi.URLParam(r, "id")
+	if err := h.sessions.RevokeInvites(sessionID, user.UserID); err != nil {
+		if errors.Is(err, sshproxy.ErrSessionNotFound) {
+			jsonError(w, "session not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "revoke session invites", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/config"
 	"github.com/gestion-ssh/backend/internal/db"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -23,6 +24,11 @@ func (h *SettingsHandler) GetTOTPRequired(w http.ResponseWriter, r *http.Request
 	jsonResponse(w, map[string]bool{"totp_required": h.cfg.TOTPRequired}, http.StatusOK)
 }
 
+// GET /api/settings/sso — public
+func (h *SettingsHandler) GetSSO(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, map[string]bool{"sso_enabled": h.cfg.OIDCIssuer != ""}, http.StatusOK)
+}
+
 // GET /api/settings/registration — public
 func (h *SettingsHandler) GetRegistration(w http.ResponseWriter, r *http.Request) {
 	val, err := db.GetSetting(r.Context(), h.db, "allow_registration")
@@ -52,5 +58,6 @@ func (h *SettingsHandler) SetRegistration(w http.ResponseWriter, r *http.Request
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.ActionRegistration, "allow_registration", map[string]interface{}{"allow": req.Allow})
 	jsonResponse(w, map[string]bool{"allow_registration": req.Allow}, http.StatusOK)
 }
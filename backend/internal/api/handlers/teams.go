@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ─── Équipes ──────────────────────────────────────────────────────────────────
+//
+// Les hôtes d'une équipe sont chiffrés avec une clé d'équipe symétrique générée
+// par le client. Chaque membre la reçoit chiffrée avec sa clé publique de
+// partage ; le serveur ne voit jamais la clé d'équipe en clair. Les clés
+// binaires sont transportées en base64 dans le JSON.
+
+type TeamHandler struct {
+	db *pgxpool.Pool
+}
+
+func NewTeamHandler(pool *pgxpool.Pool) *TeamHandler {
+	return &TeamHandler{db: pool}
+}
+
+func validTeamRole(role string) bool {
+	return role == db.TeamRoleOwner || role == db.TeamRoleAdmin || role == db.TeamRoleMember
+}
+
+// requireTeamRole retourne le rôle de l'utilisateur courant dans l'équipe {id}
+// et vérifie qu'il fait partie de roles (tous les membres si roles est vide).
+func (h *TeamHandler) requireTeamRole(w http.ResponseWriter, r *http.Request, roles ...string) (string, bool) {
+	user := mw.GetUser(r)
+	role, err := db.GetTeamRole(r.Context(), h.db, chi.URLParam(r, "id"), user.UserID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "team not found", http.StatusNotFound)
+			return "", false
+		}
+		jsonInternalError(w, "get team role", err)
+		return "", false
+	}
+	if len(roles) == 0 {
+		return role, true
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return role, true
+		}
+	}
+	jsonError(w, "insufficient team role", http.StatusForbidden)
+	return "", false
+}
+
+// GET /api/teams
+func (h *TeamHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	teams, err := db.ListTeamsByUser(r.Context(), h.db, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "list teams", err)
+		return
+	}
+	if teams == nil {
+		teams = []*models.Team{}
+	}
+	jsonResponse(w, teams, http.StatusOK)
+}
+
+// POST /api/teams — encrypted_team_key est la clé d'équipe chiffrée avec la
+// clé publique du créateur, qui en devient owner.
+func (h *TeamHandler) Create(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	var req struct {
+		Name             string `json:"name"`
+		EncryptedTeamKey []byte `json:"encrypted_team_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		jsonError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.EncryptedTeamKey) == 0 {
+		jsonError(w, "encrypted_team_key is required", http.StatusBadRequest)
+		return
+	}
+	keys, err := db.GetUserKeyPair(r.Context(), h.db, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "get key pair", err)
+		return
+	}
+	if keys.PublicKey == nil {
+		jsonError(w, "generate a sharing key pair first", http.StatusConflict)
+		return
+	}
+	team, err := db.CreateTeam(r.Context(), h.db, req.Name, user.UserID, req.EncryptedTeamKey)
+	if err != nil {
+		jsonInternalError(w, "create team", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionTeamCreated, team.ID, map[string]interface{}{"name": team.Name})
+	jsonResponse(w, team, http.StatusCreated)
+}
+
+// GET /api/teams/{id}
+func (h *TeamHandler) Get(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	team, err := db.GetTeam(r.Context(), h.db, chi.URLParam(r, "id"), user.UserID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "team not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "get team", err)
+		return
+	}
+	jsonResponse(w, team, http.StatusOK)
+}
+
+// PUT /api/teams/{id} — renomme l'équipe (owner ou admin)
+func (h *TeamHandler) Rename(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin); !ok {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		jsonError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if err := db.RenameTeam(r.Context(), h.db, chi.URLParam(r, "id"), req.Name); err != nil {
+		jsonInternalError(w, "rename team", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/teams/{id} — supprime l'équipe et ses hôtes (owner uniquement)
+func (h *TeamHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireTeamRole(w, r, db.TeamRoleOwner); !ok {
+		return
+	}
+	if err := db.DeleteTeam(r.Context(), h.db, chi.URLParam(r, "id")); err != nil {
+		if errors.Is(err, db.ErrJumpHostInUse) {
+			jsonError(w, "a team host is used as a jump host by a member's personal host", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "delete team", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionTeamDeleted, chi.URLParam(r, "id"), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ─── Membres ──────────────────────────────────────────────────────────────────
+
+// GET /api/teams/{id}/members
+func (h *TeamHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireTeamRole(w, r); !ok {
+		return
+	}
+	members, err := db.ListTeamMembers(r.Context(), h.db, chi.URLParam(r, "id"))
+	if err != nil {
+		jsonInternalError(w, "list team members", err)
+		return
+	}
+	if members == nil {
+		members = []*models.TeamMember{}
+	}
+	jsonResponse(w, members, http.StatusOK)
+}
+
+// GET /api/teams/{id}/public-key?email= — clé publique d'un futur membre, pour
+// lui chiffrer la clé d'équipe avant de l'ajouter (owner ou admin).
+func (h *TeamHandler) LookupPublicKey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin); !ok {
+		return
+	}
+	userID, publicKey, err := db.GetUserPublicKeyByEmail(r.Context(), h.db, strings.TrimSpace(r.URL.Query().Get("email")))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "lookup public key", err)
+		return
+	}
+	if publicKey == nil {
+		jsonError(w, "user has no sharing key pair yet", http.StatusConflict)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"user_id":    userID,
+		"public_key": publicKey,
+	}, http.StatusOK)
+}
+
+// POST /api/teams/{id}/members — seul un owner peut ajouter un owner
+func (h *TeamHandler) AddMember(w http.ResponseWriter, r *http.Request) {
+	role, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+	var req struct {
+		Email            string `json:"email"`
+		Role             string `json:"role"`
+		EncryptedTeamKey []byte `json:"encrypted_team_key"` // chiffrée avec la clé publique du membre
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = db.TeamRoleMember
+	}
+	if !validTeamRole(req.Role) {
+		jsonError(w, "role must be 'owner', 'admin' or 'member'", http.StatusBadRequest)
+		return
+	}
+	if req.Role == db.TeamRoleOwner && role != db.TeamRoleOwner {
+		jsonError(w, "only owners can add owners", http.StatusForbidden)
+		return
+	}
+	if len(req.EncryptedTeamKey) == 0 {
+		jsonError(w, "encrypted_team_key is required", http.StatusBadRequest)
+		return
+	}
+	userID, publicKey, err := db.GetUserPublicKeyByEmail(r.Context(), h.db, strings.TrimSpace(req.Email))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			jsonError(w, "user not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "lookup user", err)
+		return
+	}
+	if publicKey == nil {
+		jsonError(w, "user has no sharing key pair yet", http.StatusConflict)
+		return
+	}
+	if err := db.AddTeamMember(r.Context(), h.db, chi.URLParam(r, "id"), userID, req.Role, req.EncryptedTeamKey); err != nil {
+		if errors.Is(err, db.ErrAlreadyTeamMember) {
+			jsonError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "add team member", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionTeamMemberAdded, chi.URLParam(r, "id"), map[string]interface{}{"user_id": userID, "role": req.Role})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// targetMemberRole retourne le rôle du membre {userID} et vérifie que l'appelant
+// (de rôle callerRole) peut le gérer : un admin ne gère pas les owners.
+func (h *TeamHandler) targetMemberRole(w http.ResponseWriter, r *http.Request, callerRole string) (string, bool) {
+	role, err := db.GetTeamRole(r.Context(), h.db, chi.URLParam(r, "id"), chi.URLParam(r, "userID"))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "member not found", http.StatusNotFound)
+			return "", false
+		}
+		jsonInternalError(w, "get team role", err)
+		return "", false
+	}
+	if role == db.TeamRoleOwner && callerRole != db.TeamRoleOwner {
+		jsonError(w, "only owners can manage owners", http.StatusForbidden)
+		return "", false
+	}
+	return role, true
+}
+
+// PUT /api/teams/{id}/members/{userID} — change le rôle d'un membre
+func (h *TeamHandler) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	callerRole, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !validTeamRole(req.Role) {
+		jsonError(w, "role must be 'owner', 'admin' or 'member'", http.StatusBadRequest)
+		return
+	}
+	if req.Role == db.TeamRoleOwner && callerRole != db.TeamRoleOwner {
+		jsonError(w, "only owners can grant the owner role", http.StatusForbidden)
+		return
+	}
+	if _, ok := h.targetMemberRole(w, r, callerRole); !ok {
+		return
+	}
+	err := db.UpdateTeamMemberRole(r.Context(), h.db, chi.URLParam(r, "id"), chi.URLParam(r, "userID"), req.Role)
+	if err != nil {
+		if errors.Is(err, db.ErrLastTeamOwner) {
+			jsonError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "member not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "update team member", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionTeamMemberRole, chi.URLParam(r, "id"), map[string]interface{}{"user_id": chi.URLParam(r, "userID"), "role": req.Role})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /api/teams/{id}/members/{userID}/key — repartage la clé d'équipe avec un
+// membre qui l'a perdue (ex. changement de mot de passe sans rechiffrement)
+func (h *TeamHandler) ShareKey(w http.ResponseWriter, r *http.Request) {
+	callerRole, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin)
+	if !ok {
+		return
+	}
+	if _, ok := h.targetMemberRole(w, r, callerRole); !ok {
+		return
+	}
+	var req struct {
+		EncryptedTeamKey []byte `json:"encrypted_team_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.EncryptedTeamKey) == 0 {
+		jsonError(w, "encrypted_team_key is required", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetTeamMemberKey(r.Context(), h.db, chi.URLParam(r, "id"), chi.URLParam(r, "userID"), req.EncryptedTeamKey); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "member not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "share team key", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/teams/{id}/members/{userID} — retire un membre (owner ou admin),
+// ou quitte l'équipe (userID = soi-même). Le client doit ensuite renouveler la
+// clé d'équipe via rotate-key.
+func (h *TeamHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	callerRole, ok := h.requireTeamRole(w, r)
+	if !ok {
+		return
+	}
+	if chi.URLParam(r, "userID") != user.UserID {
+		if callerRole == db.TeamRoleMember {
+			jsonError(w, "insufficient team role", http.StatusForbidden)
+			return
+		}
+		if _, ok := h.targetMemberRole(w, r, callerRole); !ok {
+			return
+		}
+	}
+	if err := db.RemoveTeamMember(r.Context(), h.db, chi.URLParam(r, "id"), chi.URLParam(r, "userID")); err != nil {
+		if errors.Is(err, db.ErrLastTeamOwner) {
+			jsonError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "member not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "remove team member", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionTeamMemberRemoved, chi.URLParam(r, "id"), map[string]interface{}{"user_id": chi.URLParam(r, "userID")})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /api/teams/{id}/rotate-key — remplace la clé d'équipe : credentials de
+// tous les hôtes de l'équipe rechiffrés et nouvelle clé chiffrée pour chaque
+// membre (member_keys : user_id → clé). Tout est appliqué ou rien.
+func (h *TeamHandler) RotateKey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireTeamRole(w, r, db.TeamRoleOwner, db.TeamRoleAdmin); !ok {
+		return
+	}
+	var req struct {
+		Hosts      []vaultBlob       `json:"hosts"`
+		MemberKeys map[string][]byte `json:"member_keys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	hosts, err := decodeVaultBlobs("host", req.Hosts)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for userID, key := range req.MemberKeys {
+		if len(key) == 0 {
+			jsonError(w, "member "+userID+": encrypted team key is required", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := db.RotateTeamKey(r.Context(), h.db, chi.URLParam(r, "id"), hosts, req.MemberKeys); err != nil {
+		if errors.Is(err, db.ErrVaultMismatch) {
+			jsonError(w, "re-encrypted entries must cover every team host and member exactly once", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "rotate team key", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ─── Paire de clés de partage ─────────────────────────────────────────────────
+//
+// Générée par le client : la clé publique sert aux autres membres pour lui
+// chiffrer les clés d'équipe, la clé privée est chiffrée avec sa clé maître.
+
+// GET /api/auth/keypair
+func (h *TeamHandler) GetKeyPair(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	keys, err := db.GetUserKeyPair(r.Context(), h.db, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "get key pair", err)
+		return
+	}
+	jsonResponse(w, keys, http.StatusOK)
+}
+
+// PUT /api/auth/keypair — enregistre la paire de clés ; elle n'est ensuite
+// remplacée que par le rechiffrement du coffre (ou perdue au changement de mot de passe).
+func (h *TeamHandler) SetKeyPair(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	var req models.UserKeyPair
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.PublicKey) == 0 || len(req.EncryptedPrivateKey) == 0 {
+		jsonError(w, "public_key and encrypted_private_key are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.PrivateKeyIV) != 12 {
+		jsonError(w, "private_key_iv must be 12 bytes (96 bits)", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetUserKeyPair(r.Context(), h.db, user.UserID, &req); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "key pair already set", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "set key pair", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/auth"
 	"github.com/gestion-ssh/backend/internal/config"
 	"github.com/gestion-ssh/backend/internal/db"
@@ -89,7 +91,90 @@ func (h *TOTPHandler) Enable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonResponse(w, map[string]string{"message": "2FA enabled"}, http.StatusOK)
+	codes, err := h.newRecoveryCodes(r, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "generate recovery codes", err)
+		return
+	}
+	recordAudit(r, h.db, audit.Action2FAEnabled, user.UserID, nil)
+
+	jsonResponse(w, map[string]interface{}{
+		"message":        "2FA enabled",
+		"recovery_codes": codes,
+	}, http.StatusOK)
+}
+
+// POST /api/auth/2fa/recovery-codes — régénère les codes de récupération (invalide les anciens)
+func (h *TOTPHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		jsonError(w, "code required", http.StatusBadRequest)
+		return
+	}
+
+	secret, enabled, err := db.GetTOTPSecret(r.Context(), h.db, user.UserID)
+	if err != nil || !enabled || secret == "" {
+		jsonError(w, "2FA is not enabled", http.StatusBadRequest)
+		return
+	}
+	if !auth.ValidateTOTP(req.Code, secret) {
+		jsonError(w, "invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := h.newRecoveryCodes(r, user.UserID)
+	if err != nil {
+		jsonInternalError(w, "generate recovery codes", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionRecoveryCodes, user.UserID, nil)
+	jsonResponse(w, map[string]interface{}{"recovery_codes": codes}, http.StatusOK)
+}
+
+// newRecoveryCodes génère et enregistre (hachés) de nouveaux codes de récupération.
+func (h *TOTPHandler) newRecoveryCodes(r *http.Request, userID string) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		if hashes[i], err = auth.HashPassword(auth.NormalizeRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.ReplaceRecoveryCodes(r.Context(), h.db, userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// useRecoveryCode consomme le code de récupération s'il correspond à un code
+// non utilisé de l'utilisateur.
+func (h *TOTPHandler) useRecoveryCode(r *http.Request, userID, code string) (bool, error) {
+	stored, err := db.ListUnusedRecoveryCodes(r.Context(), h.db, userID)
+	if err != nil {
+		return false, err
+	}
+	code = auth.NormalizeRecoveryCode(code)
+	for id, hash := range stored {
+		match, err := auth.VerifyPassword(code, hash)
+		if err != nil || !match {
+			continue
+		}
+		if err := db.ConsumeRecoveryCode(r.Context(), h.db, id); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
 }
 
 // POST /api/auth/2fa/disable — vérifie le code et désactive la 2FA
@@ -119,6 +204,7 @@ func (h *TOTPHandler) Disable(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
+	recordAudit(r, h.db, audit.Action2FADisabled, user.UserID, nil)
 
 	jsonResponse(w, map[string]string{"message": "2FA disabled"}, http.StatusOK)
 }
@@ -126,15 +212,16 @@ func (h *TOTPHandler) Disable(w http.ResponseWriter, r *http.Request) {
 // POST /api/auth/2fa/verify — étape 2 du login : vérifie le code TOTP et émet les vrais tokens
 func (h *TOTPHandler) Verify(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		TOTPToken string `json:"totp_token"`
-		Code      string `json:"code"`
+		TOTPToken    string `json:"totp_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"` // alternative au code TOTP (téléphone perdu)
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	if req.TOTPToken == "" || req.Code == "" {
-		jsonError(w, "totp_token and code are required", http.StatusBadRequest)
+	if req.TOTPToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		jsonError(w, "totp_token and code (or recovery_code) are required", http.StatusBadRequest)
 		return
 	}
 
@@ -150,47 +237,55 @@ func (h *TOTPHandler) Verify(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !auth.ValidateTOTP(req.Code, secret) {
-		jsonError(w, "invalid code", http.StatusUnauthorized)
-		return
+	if req.Code != "" {
+		if !auth.ValidateTOTP(req.Code, secret) {
+			recordLoginFailure(r, h.db, claims.UserID, claims.Email, "totp")
+			jsonError(w, "invalid code", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		ok, err := h.useRecoveryCode(r, claims.UserID, req.RecoveryCode)
+		if err != nil {
+			jsonInternalError(w, "check recovery code", err)
+			return
+		}
+		if !ok {
+			recordLoginFailure(r, h.db, claims.UserID, claims.Email, "recovery_code")
+			jsonError(w, "invalid recovery code", http.StatusUnauthorized)
+			return
+		}
 	}
 
-	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin)
+	completeLogin(w, r, h.db, h.cfg, claims)
+}
+
+// completeLogin termine un login en deux étapes (second facteur validé) :
+// ouvre la connexion et émet les vrais tokens.
+func completeLogin(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg *config.Config, claims *auth.Claims) {
+	sessionID, refreshToken, refreshExpiresAt, err := openLoginSession(r, pool, cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin, false)
+	if errors.Is(err, db.ErrAccountDisabled) {
+		jsonError(w, "account disabled", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		jsonError(w, "internal error", http.StatusInternalServerError)
+		jsonInternalError(w, "open login session", err)
 		return
 	}
-	refreshToken, err := auth.GenerateRefreshToken(h.cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin, auth.RefreshTokenDuration)
+	accessToken, err := auth.GenerateAccessToken(cfg.JWTSecret, claims.UserID, claims.Email, claims.IsAdmin, sessionID)
 	if err != nil {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	u, err := db.GetUserByID(r.Context(), h.db, claims.UserID)
+	u, err := db.GetUserByID(r.Context(), pool, claims.UserID)
 	if err != nil {
 		jsonError(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
 	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
-	http.SetCookie(w, &http.Cookie{
-		Name:     "access_token",
-		Value:    accessToken,
-		HttpOnly: true,
-		Secure:   isSecure,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		MaxAge:   int(auth.AccessTokenDuration.Seconds()),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:     "refresh_token",
-		Value:    refreshToken,
-		HttpOnly: true,
-		Secure:   isSecure,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/api/auth/refresh",
-		MaxAge:   int(auth.RefreshTokenDuration.Seconds()),
-	})
+	setAccessCookie(w, isSecure, accessToken)
+	setRefreshCookie(w, isSecure, refreshToken, refreshExpiresAt)
 
 	jsonResponse(w, map[string]interface{}{
 		"user": map[string]interface{}{
@@ -200,6 +295,7 @@ func (h *TOTPHandler) Verify(w http.ResponseWriter, r *http.Request) {
 			"kdf_params":   json.RawMessage(u.KDFParams),
 			"is_admin":     u.IsAdmin,
 			"totp_enabled": u.TOTPEnabled,
+			"auth_source":  u.AuthSource,
 		},
 		"access_token": accessToken,
 	}, http.StatusOK)
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+)
+
+// ─── Rechiffrement du coffre ──────────────────────────────────────────────────
+//
+// La clé maître est dérivée côté client du mot de passe et du sel KDF. Pour
+// changer de mot de passe sans perdre le coffre, le client génère un nouveau
+// sel, déchiffre chaque secret avec l'ancienne clé et le rechiffre avec la
+// nouvelle, puis envoie l'ensemble ici. Tout est appliqué ou rien.
+
+type vaultBlob struct {
+	ID            string `json:"id"`
+	EncryptedCred string `json:"encrypted_cred"` // base64
+	IV            string `json:"iv"`             // base64
+}
+
+type rekeyRequest struct {
+	CurrentPassword string      `json:"current_password"`
+	NewPassword     string      `json:"new_password"`
+	KDFSalt         string      `json:"kdf_salt"` // base64, 32 octets, généré par le client
+	Hosts           []vaultBlob `json:"hosts"`
+	Credentials     []vaultBlob `json:"credentials"`
+	// Copies personnelles des credentials d'hôtes d'équipe (id = host_id)
+	MemberCredentials []vaultBlob `json:"member_credentials"`
+	// Clé privée de partage rechiffrée, requise si l'utilisateur en possède une (id ignoré)
+	PrivateKey *vaultBlob `json:"private_key"`
+}
+
+func decodeVaultBlobs(kind string, blobs []vaultBlob) ([]models.VaultEntry, error) {
+	entries := make([]models.VaultEntry, 0, len(blobs))
+	for _, b := range blobs {
+		encCred, err := base64.StdEncoding.DecodeString(b.EncryptedCred)
+		if err != nil || len(encCred) == 0 {
+			return nil, fmt.Errorf("%s %s: invalid encrypted_cred encoding", kind, b.ID)
+		}
+		iv, err := base64.StdEncoding.DecodeString(b.IV)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: invalid iv encoding", kind, b.ID)
+		}
+		if len(iv) != 12 {
+			return nil, fmt.Errorf("%s %s: iv must be 12 bytes (96 bits)", kind, b.ID)
+		}
+		entries = append(entries, models.VaultEntry{ID: b.ID, EncryptedCred: encCred, IV: iv})
+	}
+	return entries, nil
+}
+
+// POST /api/auth/rekey — change le mot de passe et rechiffre tout le coffre
+func (h *AuthHandler) Rekey(w http.ResponseWriter, r *http.Request) {
+	userClaims := mw.GetUser(r)
+
+	var req rekeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.CurrentPassword == "" {
+		jsonError(w, "current_password required", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < 8 {
+		jsonError(w, "new password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	kdfSalt, err := base64.StdEncoding.DecodeString(req.KDFSalt)
+	if err != nil || len(kdfSalt) != 32 {
+		jsonError(w, "kdf_salt must be 32 bytes (base64)", http.StatusBadRequest)
+		return
+	}
+	hosts, err := decodeVaultBlobs("host", req.Hosts)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	creds, err := decodeVaultBlobs("credential", req.Credentials)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	memberCreds, err := decodeVaultBlobs("member credential", req.MemberCredentials)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var privateKey *models.VaultEntry
+	if req.PrivateKey != nil {
+		entries, err := decodeVaultBlobs("private key", []vaultBlob{*req.PrivateKey})
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		privateKey = &entries[0]
+	}
+
+	user, err := db.GetUserByID(r.Context(), h.db, userClaims.UserID)
+	if err != nil {
+		jsonError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	match, err := auth.VerifyPassword(req.CurrentPassword, user.PasswordHash)
+	if err != nil || !match {
+		jsonError(w, "invalid current password", http.StatusUnauthorized)
+		return
+	}
+
+	hash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := db.RekeyVault(r.Context(), h.db, user.ID, userClaims.SessionID, hash, kdfSalt, hosts, creds, memberCreds, privateKey); err != nil {
+		if errors.Is(err, db.ErrVaultMismatch) {
+			jsonError(w, "re-encrypted entries must cover every host, credential, member credential and private key exactly once", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "rekey vault", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionPasswordChanged, user.ID, map[string]interface{}{"vault_kept": true})
+	h.sessions.TerminateUser(user.ID, "password changed")
+
+	// Les tokens d'accès émis avant le changement sont révoqués : la connexion
+	// courante, conservée, reçoit un nouveau token.
+	accessToken, err := auth.GenerateAccessToken(h.cfg.JWTSecret, user.ID, user.Email, user.IsAdmin, userClaims.SessionID)
+	if err != nil {
+		jsonError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	isSecure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	setAccessCookie(w, isSecure, accessToken)
+
+	jsonResponse(w, map[string]interface{}{
+		"message":      "password updated",
+		"kdf_salt":     kdfSalt,
+		"kdf_params":   json.RawMessage(user.KDFParams),
+		"access_token": accessToken,
+	}, http.StatusOK)
+}
+
+// ─── Passphrase du coffre (comptes SSO / annuaire) ────────────────────────────
+//
+// Un compte provisionné par OIDC ou LDAP n'a pas de mot de passe local : sa clé maître
+// est dérivée d'une passphrase choisie à la première connexion, avec kdf_salt.
+// Son hash est conservé dans password_hash pour que Rekey puisse la vérifier.
+
+// POST /api/auth/vault-passphrase — définit la passphrase initiale
+func (h *AuthHandler) SetVaultPassphrase(w http.ResponseWriter, r *http.Request) {
+	userClaims := mw.GetUser(r)
+
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Passphrase) < 8 {
+		jsonError(w, "passphrase must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+	hash, err := auth.HashPassword(req.Passphrase)
+	if err != nil {
+		jsonInternalError(w, "hash passphrase", err)
+		return
+	}
+	if err := db.SetVaultPassphrase(r.Context(), h.db, userClaims.UserID, hash); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "vault passphrase already set, use /api/auth/rekey to change it", http.StatusConflict)
+			return
+		}
+		jsonInternalError(w, "set vault passphrase", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Clés de sécurité / passkeys WebAuthn, alternative au TOTP pour l'étape
+// "totp_pending" du login. Elles restent un second facteur : la clé maître du
+// coffre est dérivée du mot de passe, qui reste donc indispensable.
+
+const webauthnChallengeTTL = 5 * time.Minute
+
+type WebAuthnHandler struct {
+	db  *pgxpool.Pool
+	cfg *config.Config
+	wa  *webauthn.WebAuthn // nil si la configuration WebAuthn est invalide
+}
+
+func NewWebAuthnHandler(pool *pgxpool.Pool, cfg *config.Config) *WebAuthnHandler {
+	origins := splitNonEmpty(cfg.WebAuthnOrigins)
+	if len(origins) == 0 {
+		origins = splitNonEmpty(cfg.AllowedOrigins)
+	}
+	rpID := cfg.WebAuthnRPID
+	if rpID == "" && len(origins) > 0 {
+		if u, err := url.Parse(origins[0]); err == nil {
+			rpID = u.Hostname()
+		}
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "SSH Manager",
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		log.Printf("webauthn disabled: %v", err)
+	}
+	return &WebAuthnHandler{db: pool, cfg: cfg, wa: wa}
+}
+
+func splitNonEmpty(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// webauthnUser adapte un utilisateur et ses credentials à l'interface webauthn.User.
+type webauthnUser struct {
+	id    string
+	email string
+	creds []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return []byte(u.id) }
+func (u *webauthnUser) WebAuthnName() string                       { return u.email }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.email }
+func (u *webauthnUser) WebAuthnIcon() string                       { return "" }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.creds }
+
+func (h *WebAuthnHandler) loadUser(r *http.Request, userID, email string) (*webauthnUser, error) {
+	stored, err := db.ListWebAuthnCredentials(r.Context(), h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	u := &webauthnUser{id: userID, email: email}
+	for _, c := range stored {
+		var cred webauthn.Credential
+		if err := json.Unmarshal(c.Data, &cred); err != nil {
+			return nil, err
+		}
+		u.creds = append(u.creds, cred)
+	}
+	return u, nil
+}
+
+func (h *WebAuthnHandler) available(w http.ResponseWriter) bool {
+	if h.wa == nil {
+		jsonError(w, "webauthn is not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// saveChallenge conserve les données de session de la cérémonie et retourne son identifiant.
+func (h *WebAuthnHandler) saveChallenge(r *http.Request, userID, kind, name string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	return db.CreateWebAuthnChallenge(r.Context(), h.db, userID, kind, name, data, time.Now().Add(webauthnChallengeTTL))
+}
+
+// takeChallenge consomme le challenge passé en paramètre ?challenge_id=.
+func (h *WebAuthnHandler) takeChallenge(r *http.Request, kind string) (userID, name string, session *webauthn.SessionData, err error) {
+	id := r.URL.Query().Get("challenge_id")
+	if _, err := uuid.Parse(id); err != nil {
+		return "", "", nil, db.ErrNotFound
+	}
+	userID, name, data, err := db.TakeWebAuthnChallenge(r.Context(), h.db, id, kind)
+	if err != nil {
+		return "", "", nil, err
+	}
+	session = &webauthn.SessionData{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return "", "", nil, err
+	}
+	return userID, name, session, nil
+}
+
+// ─── Enregistrement (utilisateur connecté) ────────────────────────────────────
+
+// POST /api/auth/webauthn/register/begin — options de création pour navigator.credentials.create
+func (h *WebAuthnHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	claims := mw.GetUser(r)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		jsonError(w, "name required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.loadUser(r, claims.UserID, claims.Email)
+	if err != nil {
+		jsonInternalError(w, "load webauthn credentials", err)
+		return
+	}
+	// Exclure les authentificateurs déjà enregistrés
+	exclude := make([]protocol.CredentialDescriptor, 0, len(user.creds))
+	for _, c := range user.creds {
+		exclude = append(exclude, c.Descriptor())
+	}
+	options, session, err := h.wa.BeginRegistration(user, webauthn.WithExclusions(exclude))
+	if err != nil {
+		jsonInternalError(w, "begin webauthn registration", err)
+		return
+	}
+	challengeID, err := h.saveChallenge(r, claims.UserID, "register", strings.TrimSpace(req.Name), session)
+	if err != nil {
+		jsonInternalError(w, "save webauthn challenge", err)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"challenge_id": challengeID,
+		"options":      options,
+	}, http.StatusOK)
+}
+
+// POST /api/auth/webauthn/register/finish?challenge_id= — corps : réponse d'attestation du navigateur
+func (h *WebAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	claims := mw.GetUser(r)
+
+	userID, name, session, err := h.takeChallenge(r, "register")
+	if err != nil || userID != claims.UserID {
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			jsonInternalError(w, "load webauthn challenge", err)
+			return
+		}
+		jsonError(w, "invalid or expired challenge", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.loadUser(r, claims.UserID, claims.Email)
+	if err != nil {
+		jsonInternalError(w, "load webauthn credentials", err)
+		return
+	}
+	cred, err := h.wa.FinishRegistration(user, *session, r)
+	if err != nil {
+		jsonError(w, "webauthn registration failed", http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		jsonInternalError(w, "encode webauthn credential", err)
+		return
+	}
+	stored, err := db.CreateWebAuthnCredential(r.Context(), h.db, claims.UserID, name, cred.ID, data)
+	if err != nil {
+		jsonError(w, "authenticator already registered", http.StatusConflict)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionWebAuthnAdded, stored.ID, map[string]interface{}{"name": stored.Name})
+	jsonResponse(w, stored, http.StatusCreated)
+}
+
+// ─── Gestion des authentificateurs ────────────────────────────────────────────
+
+// GET /api/auth/webauthn/credentials
+func (h *WebAuthnHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims := mw.GetUser(r)
+	creds, err := db.ListWebAuthnCredentials(r.Context(), h.db, claims.UserID)
+	if err != nil {
+		jsonInternalError(w, "list webauthn credentials", err)
+		return
+	}
+	if creds == nil {
+		jsonResponse(w, []struct{}{}, http.StatusOK)
+		return
+	}
+	jsonResponse(w, creds, http.StatusOK)
+}
+
+// PUT /api/auth/webauthn/credentials/{id} — renommer
+func (h *WebAuthnHandler) Rename(w http.ResponseWriter, r *http.Request) {
+	claims := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		jsonError(w, "name required", http.StatusBadRequest)
+		return
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		jsonError(w, "authenticator not found", http.StatusNotFound)
+		return
+	}
+	if err := db.RenameWebAuthnCredential(r.Context(), h.db, id, claims.UserID, strings.TrimSpace(req.Name)); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "authenticator not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "rename webauthn credential", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /api/auth/webauthn/credentials/{id}
+func (h *WebAuthnHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	claims := mw.GetUser(r)
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		jsonError(w, "authenticator not found", http.StatusNotFound)
+		return
+	}
+	if err := db.DeleteWebAuthnCredential(r.Context(), h.db, id, claims.UserID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			jsonError(w, "authenticator not found", http.StatusNotFound)
+			return
+		}
+		jsonInternalError(w, "delete webauthn credential", err)
+		return
+	}
+	recordAudit(r, h.db, audit.ActionWebAuthnRemoved, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ─── Second facteur au login (token totp_pending) ─────────────────────────────
+
+// POST /api/auth/2fa/webauthn/begin — options d'assertion pour navigator.credentials.get
+func (h *WebAuthnHandler) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	var req struct {
+		TOTPToken string `json:"totp_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TOTPToken == "" {
+		jsonError(w, "totp_token is required", http.StatusBadRequest)
+		return
+	}
+	claims, err := auth.ValidateToken(h.cfg.JWTSecret, req.TOTPToken)
+	if err != nil || claims.TokenType != "totp_pending" {
+		jsonError(w, "invalid or expired TOTP token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.loadUser(r, claims.UserID, claims.Email)
+	if err != nil {
+		jsonInternalError(w, "load webauthn credentials", err)
+		return
+	}
+	if len(user.creds) == 0 {
+		jsonError(w, "no security key registered", http.StatusBadRequest)
+		return
+	}
+	options, session, err := h.wa.BeginLogin(user)
+	if err != nil {
+		jsonInternalError(w, "begin webauthn login", err)
+		return
+	}
+	challengeID, err := h.saveChallenge(r, claims.UserID, "login", "", session)
+	if err != nil {
+		jsonInternalError(w, "save webauthn challenge", err)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"challenge_id": challengeID,
+		"options":      options,
+	}, http.StatusOK)
+}
+
+// POST /api/auth/2fa/webauthn/finish?challenge_id= — corps : réponse d'assertion du navigateur.
+// Le challenge, à usage unique, n'a pu être créé qu'avec un token totp_pending valide.
+func (h *WebAuthnHandler) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	userID, _, session, err := h.takeChallenge(r, "login")
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			jsonInternalError(w, "load webauthn challenge", err)
+			return
+		}
+		jsonError(w, "invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := db.GetUserByID(r.Context(), h.db, userID)
+	if err != nil {
+		jsonError(w, "invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.loadUser(r, u.ID, u.Email)
+	if err != nil {
+		jsonInternalError(w, "load webauthn credentials", err)
+		return
+	}
+	cred, err := h.wa.FinishLogin(user, *session, r)
+	if err != nil {
+		recordLoginFailure(r, h.db, u.ID, u.Email, "webauthn")
+		jsonError(w, "invalid security key response", http.StatusUnauthorized)
+		return
+	}
+	// Compteur de signatures non croissant : authentificateur probablement cloné.
+	if cred.Authenticator.CloneWarning {
+		log.Printf("webauthn: sign count regression for user %s, possible cloned authenticator", u.ID)
+		recordLoginFailure(r, h.db, u.ID, u.Email, "webauthn_cloned")
+		jsonError(w, "security key rejected", http.StatusUnauthorized)
+		return
+	}
+	data, err := json.Marshal(cred)
+	if err != nil {
+		jsonInternalError(w, "encode webauthn credential", err)
+		return
+	}
+	if err := db.UpdateWebAuthnCredentialUse(r.Context(), h.db, u.ID, cred.ID, data); err != nil {
+		jsonInternalError(w, "update webauthn credential", err)
+		return
+	}
+
+	completeLogin(w, r, h.db, h.cfg, &auth.Claims{UserID: u.ID, Email: u.Email, IsAdmin: u.IsAdmin})
+}
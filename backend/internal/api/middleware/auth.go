@@ -2,10 +2,15 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gestion-ssh/backend/internal/auth"
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type contextKey string
@@ -13,12 +18,84 @@ type contextKey string
 const UserContextKey contextKey = "user"
 
 type UserClaims struct {
-	UserID  string
-	Email   string
-	IsAdmin bool
+	UserID    string
+	Email     string
+	IsAdmin   bool
+	SessionID string // connexion (login_sessions) du token d'accès
+	// Rôle et permissions, relus en base à chaque requête : un changement de
+	// rôle s'applique sans attendre l'expiration du token.
+	Role        string
+	Permissions []string
+	// Requête authentifiée par un jeton d'accès personnel : identifiant et scopes
+	APITokenID string
+	Scopes     []string
 }
 
-func Authenticate(jwtSecret string) func(http.Handler) http.Handler {
+// HasScope indique si la requête peut accéder à une ressource du scope donné.
+// Une connexion interactive (navigateur) n'est pas limitée par les scopes.
+func (u *UserClaims) HasScope(scope string) bool {
+	if u.APITokenID == "" {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission indique si le rôle de l'utilisateur accorde la permission.
+func (u *UserClaims) HasPermission(perm string) bool {
+	for _, p := range u.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAllPermissions indique si le rôle de l'utilisateur accorde toutes les
+// permissions perms.
+func (u *UserClaims) HasAllPermissions(perms []string) bool {
+	for _, p := range perms {
+		if !u.HasPermission(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionActive vérifie que la connexion portée par un token d'accès n'a pas été
+// révoquée (déconnexion depuis un autre appareil, changement de mot de passe...).
+func sessionActive(ctx context.Context, pool *pgxpool.Pool, claims *auth.Claims) bool {
+	if claims.SessionID == "" {
+		return false
+	}
+	if err := db.TouchLoginSession(ctx, pool, claims.SessionID, claims.UserID); err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			log.Printf("[ERROR] check login session: %v", err)
+		}
+		return false
+	}
+	return true
+}
+
+// issuedBefore indique si le token a été émis avant revokedAt (révocation des
+// tokens de l'utilisateur). iat étant à la seconde, un token émis dans la seconde
+// de la révocation reste accepté : c'est le cas du token réémis à l'appareil
+// qui vient de changer le mot de passe.
+func issuedBefore(claims *auth.Claims, revokedAt *time.Time) bool {
+	if revokedAt == nil {
+		return false
+	}
+	if claims.IssuedAt == nil {
+		return true
+	}
+	return claims.IssuedAt.Time.Before(revokedAt.Truncate(time.Second))
+}
+
+func Authenticate(jwtSecret string, pool *pgxpool.Pool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var tokenStr string
@@ -40,15 +117,64 @@ func Authenticate(jwtSecret string) func(http.Handler) http.Handler {
 			}
 
 			claims, err := auth.ValidateToken(jwtSecret, tokenStr)
-			if err != nil || (claims.TokenType != "access" && claims.TokenType != "") {
+			if err != nil || claims.TokenType != "access" || !sessionActive(r.Context(), pool, claims) {
+				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+			// Compte supprimé ou désactivé, ou token émis avant une révocation
+			role, permissions, revokedAt, err := db.GetUserPermissions(r.Context(), pool, claims.UserID)
+			if err != nil || issuedBefore(claims, revokedAt) {
+				if err != nil && !errors.Is(err, db.ErrNotFound) {
+					log.Printf("[ERROR] load permissions: %v", err)
+				}
+				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserContextKey, &UserClaims{
+				UserID:      claims.UserID,
+				Email:       claims.Email,
+				IsAdmin:     role == auth.RoleAdmin,
+				SessionID:   claims.SessionID,
+				Role:        role,
+				Permissions: permissions,
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AuthenticateOrAPIToken accepte, en plus d'un token d'accès, un jeton d'accès
+// personnel dans le header Authorization. Les routes ainsi protégées doivent
+// préciser le scope requis avec RequireScope.
+func AuthenticateOrAPIToken(jwtSecret string, pool *pgxpool.Pool) func(http.Handler) http.Handler {
+	session := Authenticate(jwtSecret, pool)
+	return func(next http.Handler) http.Handler {
+		sessionNext := session(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !auth.IsAPIToken(tokenStr) {
+				sessionNext.ServeHTTP(w, r)
+				return
+			}
+
+			token, owner, permissions, err := db.AuthenticateAPIToken(r.Context(), pool, auth.HashTokenID(tokenStr))
+			if err != nil {
+				if !errors.Is(err, db.ErrNotFound) {
+					log.Printf("[ERROR] check api token: %v", err)
+				}
 				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
 				return
 			}
 
 			ctx := context.WithValue(r.Context(), UserContextKey, &UserClaims{
-				UserID:  claims.UserID,
-				Email:   claims.Email,
-				IsAdmin: claims.IsAdmin,
+				UserID:      token.UserID,
+				Email:       owner.Email,
+				IsAdmin:     owner.IsAdmin,
+				Role:        owner.Role,
+				Permissions: permissions,
+				APITokenID:  token.ID,
+				Scopes:      token.Scopes,
 			})
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
@@ -62,7 +188,7 @@ func GetUser(r *http.Request) *UserClaims {
 
 // AuthenticateOrTOTPPending accepte les tokens "access" ET "totp_pending".
 // Utilisé pour les endpoints de configuration 2FA accessibles pendant le setup obligatoire.
-func AuthenticateOrTOTPPending(jwtSecret string) func(http.Handler) http.Handler {
+func AuthenticateOrTOTPPending(jwtSecret string, pool *pgxpool.Pool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var tokenStr string
@@ -87,29 +213,71 @@ func AuthenticateOrTOTPPending(jwtSecret string) func(http.Handler) http.Handler
 				return
 			}
 
-			// Accepte "access", "totp_pending" ou "" (compat)
-			if claims.TokenType != "access" && claims.TokenType != "totp_pending" && claims.TokenType != "" {
+			// Accepte "access" (connexion active) ou "totp_pending"
+			switch claims.TokenType {
+			case "totp_pending":
+			case "access":
+				if !sessionActive(r.Context(), pool, claims) {
+					http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+					return
+				}
+			default:
+				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+			_, _, revokedAt, err := db.GetUserPermissions(r.Context(), pool, claims.UserID)
+			if err != nil || issuedBefore(claims, revokedAt) {
+				if err != nil && !errors.Is(err, db.ErrNotFound) {
+					log.Printf("[ERROR] load permissions: %v", err)
+				}
 				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
 				return
 			}
 
 			ctx := context.WithValue(r.Context(), UserContextKey, &UserClaims{
-				UserID:  claims.UserID,
-				Email:   claims.Email,
-				IsAdmin: claims.IsAdmin,
+				UserID:    claims.UserID,
+				Email:     claims.Email,
+				IsAdmin:   claims.IsAdmin,
+				SessionID: claims.SessionID,
 			})
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func RequireAdmin(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user := GetUser(r)
-		if user == nil || !user.IsAdmin {
+// RequirePermission exige que le rôle de l'utilisateur accorde l'une des
+// permissions données.
+func RequirePermission(perms ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r)
+			if user != nil {
+				for _, perm := range perms {
+					if user.HasPermission(perm) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
 			http.Error(w, `{"error":"forbidden"}`, http.StatusForbidden)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+		})
+	}
+}
+
+// RequireScope exige qu'un jeton d'accès personnel porte l'un des scopes donnés.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r)
+			if user != nil {
+				for _, scope := range scopes {
+					if user.HasScope(scope) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			http.Error(w, `{"error":"insufficient scope"}`, http.StatusForbidden)
+		})
+	}
 }
@@ -7,8 +7,12 @@ import (
 
 	"github.com/gestion-ssh/backend/internal/api/handlers"
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/auth"
 	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/forward"
+	"github.com/gestion-ssh/backend/internal/recording"
 	sftpws "github.com/gestion-ssh/backend/internal/sftp"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
 	"github.com/gestion-ssh/backend/internal/ws"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -16,7 +20,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func NewRouter(cfg *config.Config, pool *pgxpool.Pool) http.Handler {
+func NewRouter(cfg *config.Config, pool *pgxpool.Pool, recordings recording.Storage) http.Handler {
 	r := chi.NewRouter()
 
 	// ─── Middlewares globaux ───────────────────────────────────────────────────
@@ -48,14 +52,25 @@ func NewRouter(cfg *config.Config, pool *pgxpool.Pool) http.Handler {
 	r.Use(cors.Handler(corsOptions))
 
 	// ─── Handlers ─────────────────────────────────────────────────────────────
-	authHandler := handlers.NewAuthHandler(pool, cfg)
+	sessionManager := sshproxy.NewManager(pool, recordings, cfg.SessionGracePeriod)
+	authHandler := handlers.NewAuthHandler(pool, cfg, sessionManager)
 	hostHandler := handlers.NewHostHandler(pool)
 	credentialHandler := handlers.NewCredentialHandler(pool)
 	settingsHandler := handlers.NewSettingsHandler(pool, cfg)
 	initHandler := handlers.NewInitHandler(pool)
 	totpHandler := handlers.NewTOTPHandler(pool, cfg)
-	wsHandler := ws.NewHandler(pool, origins)
-	sftpHandler := sftpws.NewHandler(pool, origins)
+	webauthnHandler := handlers.NewWebAuthnHandler(pool, cfg)
+	apiTokenHandler := handlers.NewAPITokenHandler(pool)
+	teamHandler := handlers.NewTeamHandler(pool)
+	wsHandler := ws.NewHandler(pool, origins, sessionManager)
+	sessionHandler := handlers.NewSessionHandler(sessionManager)
+	sftpHandler := sftpws.NewHandler(pool, origins, sessionManager, sftpws.TransferOptions{
+		ChunkSize: cfg.SFTPChunkSize,
+		Window:    cfg.SFTPWindow,
+
+		ArchiveMaxSize: cfg.SFTPArchiveMaxSize,
+	})
+	forwardHandler := forward.NewHandler(pool, origins, sessionManager)
 
 	// ─── Routes init (first-launch) ───────────────────────────────────────────
 	r.Get("/api/init/status", initHandler.Status)
@@ -70,26 +85,60 @@ func NewRouter(cfg *config.Config, pool *pgxpool.Pool) http.Handler {
 		r.Post("/logout", authHandler.Logout)
 		// Étape 2 login 2FA (utilise le totp_pending token dans le body)
 		r.Post("/2fa/verify", totpHandler.Verify)
+		r.Post("/2fa/webauthn/begin", webauthnHandler.BeginLogin)
+		r.Post("/2fa/webauthn/finish", webauthnHandler.FinishLogin)
+		// Single sign-on OpenID Connect (si OIDC_ISSUER est configuré)
+		if cfg.OIDCIssuer != "" {
+			oidcHandler := handlers.NewOIDCHandler(pool, cfg)
+			r.Get("/oidc/login", oidcHandler.Login)
+			r.Get("/oidc/callback", oidcHandler.Callback)
+		}
 	})
 
 	// ─── Paramètres publics (lecture seule) ───────────────────────────────────
 	r.Get("/api/settings/registration", settingsHandler.GetRegistration)
 	r.Get("/api/settings/totp-required", settingsHandler.GetTOTPRequired)
+	r.Get("/api/settings/sso", settingsHandler.GetSSO)
 
 	// ─── Routes authentifiées (access token) ──────────────────────────────────
 	r.Group(func(r chi.Router) {
-		r.Use(mw.Authenticate(cfg.JWTSecret))
+		r.Use(mw.Authenticate(cfg.JWTSecret, pool))
 
 		r.Get("/api/auth/me", authHandler.Me)
 		r.Put("/api/auth/profile", authHandler.UpdateProfile)
-
-		// Hosts CRUD
-		r.Route("/api/hosts", func(r chi.Router) {
-			r.Get("/", hostHandler.List)
-			r.Post("/", hostHandler.Create)
-			r.Get("/{id}", hostHandler.Get)
-			r.Put("/{id}", hostHandler.Update)
-			r.Delete("/{id}", hostHandler.Delete)
+		r.Post("/api/auth/rekey", authHandler.Rekey)
+		r.Post("/api/auth/vault-passphrase", authHandler.SetVaultPassphrase)
+
+		// Connexions actives (appareils) de l'utilisateur
+		r.Get("/api/auth/sessions", authHandler.ListLoginSessions)
+		r.Delete("/api/auth/sessions", authHandler.RevokeOtherLoginSessions)
+		r.Delete("/api/auth/sessions/{id}", authHandler.RevokeLoginSession)
+
+		// Jetons d'accès personnels
+		r.Get("/api/auth/tokens", apiTokenHandler.List)
+		r.Post("/api/auth/tokens", apiTokenHandler.Create)
+		r.Delete("/api/auth/tokens/{id}", apiTokenHandler.Delete)
+
+		// Paire de clés de partage (clés d'équipe)
+		r.Get("/api/auth/keypair", teamHandler.GetKeyPair)
+		r.Put("/api/auth/keypair", teamHandler.SetKeyPair)
+
+		// Équipes et membres
+		// (consulter ses équipes et les quitter reste possible sans hosts.share)
+		r.Route("/api/teams", func(r chi.Router) {
+			share := r.With(mw.RequirePermission(auth.PermHostsShare))
+			r.Get("/", teamHandler.List)
+			share.Post("/", teamHandler.Create)
+			r.Get("/{id}", teamHandler.Get)
+			share.Put("/{id}", teamHandler.Rename)
+			share.Delete("/{id}", teamHandler.Delete)
+			share.Get("/{id}/public-key", teamHandler.LookupPublicKey)
+			share.Post("/{id}/rotate-key", teamHandler.RotateKey)
+			r.Get("/{id}/members", teamHandler.ListMembers)
+			share.Post("/{id}/members", teamHandler.AddMember)
+			share.Put("/{id}/members/{userID}", teamHandler.UpdateMemberRole)
+			share.Put("/{id}/members/{userID}/key", teamHandler.ShareKey)
+			r.Delete("/{id}/members/{userID}", teamHandler.RemoveMember)
 		})
 
 		// Credentials vault CRUD
@@ -99,33 +148,98 @@ func NewRouter(cfg *config.Config, pool *pgxpool.Pool) http.Handler {
 			r.Delete("/{id}", credentialHandler.Delete)
 		})
 
+		// Partage des sessions terminal actives
+		r.Post("/api/sessions/{id}/invites", sessionHandler.CreateInvite)
+		r.Delete("/api/sessions/{id}/invites", sessionHandler.RevokeInvites)
+
 		// 2FA — désactivation (requiert d'être connecté)
 		r.Post("/api/auth/2fa/disable", totpHandler.Disable)
+		r.Post("/api/auth/2fa/recovery-codes", totpHandler.RegenerateRecoveryCodes)
+
+		// Clés de sécurité WebAuthn (second facteur)
+		r.Post("/api/auth/webauthn/register/begin", webauthnHandler.BeginRegistration)
+		r.Post("/api/auth/webauthn/register/finish", webauthnHandler.FinishRegistration)
+		r.Get("/api/auth/webauthn/credentials", webauthnHandler.List)
+		r.Put("/api/auth/webauthn/credentials/{id}", webauthnHandler.Rename)
+		r.Delete("/api/auth/webauthn/credentials/{id}", webauthnHandler.Delete)
 
-		// WebSocket SSH terminal
+		// WebSocket SSH terminal (rejoindre une session partagée ne demande pas
+		// hosts.connect : le handler le vérifie pour les autres messages)
 		r.Get("/ws/ssh", wsHandler.ServeHTTP)
+		connect := r.With(mw.RequirePermission(auth.PermHostsConnect))
 		// WebSocket SFTP
-		r.Get("/ws/sftp", sftpHandler.ServeHTTP)
+		connect.Get("/ws/sftp", sftpHandler.ServeHTTP)
+		// Archive d'un répertoire, via la connexion d'un WebSocket SFTP ouvert
+		connect.Get("/api/sftp/archive", sftpHandler.Archive)
+		// WebSocket redirection de ports (locale, distante, SOCKS5)
+		connect.Get("/ws/forward", forwardHandler.ServeHTTP)
+	})
+
+	// ─── Routes accessibles aussi par jeton d'accès personnel ─────────────────
+	r.Group(func(r chi.Router) {
+		r.Use(mw.AuthenticateOrAPIToken(cfg.JWTSecret, pool))
+
+		// Hosts CRUD
+		r.Route("/api/hosts", func(r chi.Router) {
+			read := r.With(mw.RequireScope(auth.ScopeHostsRead))
+			write := r.With(mw.RequirePermission(auth.PermHostsManage), mw.RequireScope(auth.ScopeHostsWrite))
+			read.Get("/", hostHandler.List)
+			write.Post("/", hostHandler.Create)
+			read.Get("/{id}", hostHandler.Get)
+			write.Put("/{id}", hostHandler.Update)
+			write.Delete("/{id}", hostHandler.Delete)
+			// Copie personnelle du credential d'un hôte d'équipe
+			write.Put("/{id}/member-credential", hostHandler.SetMemberCredential)
+			write.Delete("/{id}/member-credential", hostHandler.DeleteMemberCredential)
+			// Clés d'hôte épinglées (TOFU)
+			read.Get("/{id}/host-keys", hostHandler.GetHostKeys)
+			write.Post("/{id}/host-keys/accept", hostHandler.AcceptHostKey)
+			write.Delete("/{id}/host-keys", hostHandler.ResetHostKeys)
+		})
 	})
 
 	// ─── Routes 2FA setup (access OU totp_pending) ────────────────────────────
 	// Accessibles avec un token "access" (depuis le dashboard) OU
 	// avec un "totp_pending" (setup obligatoire juste après le login)
 	r.Group(func(r chi.Router) {
-		r.Use(mw.AuthenticateOrTOTPPending(cfg.JWTSecret))
+		r.Use(mw.AuthenticateOrTOTPPending(cfg.JWTSecret, pool))
 		r.Get("/api/auth/2fa/setup", totpHandler.Setup)
 		r.Post("/api/auth/2fa/enable", totpHandler.Enable)
 	})
 
-	// ─── Routes admin ─────────────────────────────────────────────────────────
-	adminHandler := handlers.NewAdminHandler(pool)
+	// ─── Routes d'administration ──────────────────────────────────────────────
+	adminHandler := handlers.NewAdminHandler(pool, recordings, sessionManager)
+	// Chaque groupe exige une permission du rôle de l'utilisateur. Un jeton d'accès
+	// personnel y accède en plus avec le scope "admin" ; l'audit des sessions est
+	// aussi ouvert au scope "sessions:read".
 	r.Group(func(r chi.Router) {
-		r.Use(mw.Authenticate(cfg.JWTSecret))
-		r.Use(mw.RequireAdmin)
-		r.Put("/api/settings/registration", settingsHandler.SetRegistration)
-		r.Get("/api/admin/users", adminHandler.ListUsers)
-		r.Delete("/api/admin/users/{id}", adminHandler.DeleteUser)
-		r.Get("/api/admin/sessions", adminHandler.ListSessions)
+		r.Use(mw.AuthenticateOrAPIToken(cfg.JWTSecret, pool))
+
+		audit := r.With(
+			mw.RequirePermission(auth.PermSessionsViewAll),
+			mw.RequireScope(auth.ScopeSessionsRead, auth.ScopeAdmin),
+		)
+		audit.Get("/api/admin/sessions", adminHandler.ListSessions)
+		audit.Get("/api/admin/sessions/{id}/recording", adminHandler.GetSessionRecording)
+		audit.Get("/api/admin/sessions/{id}/forwards", adminHandler.ListSessionForwards)
+		audit.Get("/api/admin/audit", adminHandler.ListAudit)
+
+		settings := r.With(mw.RequirePermission(auth.PermSettingsManage), mw.RequireScope(auth.ScopeAdmin))
+		settings.Put("/api/settings/registration", settingsHandler.SetRegistration)
+		settings.Get("/api/admin/audit/sinks", adminHandler.ListAuditSinks)
+		settings.Post("/api/admin/audit/sinks/{name}/replay", adminHandler.ReplayAuditSink)
+
+		users := r.With(mw.RequirePermission(auth.PermUsersManage), mw.RequireScope(auth.ScopeAdmin))
+		users.Get("/api/admin/users", adminHandler.ListUsers)
+		users.Delete("/api/admin/users/{id}", adminHandler.DeleteUser)
+		users.Delete("/api/admin/sessions/{id}", adminHandler.TerminateSession)
+		users.Put("/api/admin/users/{id}/role", adminHandler.SetUserRole)
+		users.Put("/api/admin/users/{id}/disabled", adminHandler.SetUserDisabled)
+		users.Get("/api/admin/users/{id}/recording", adminHandler.GetRecordingPolicy)
+		users.Put("/api/admin/users/{id}/recording", adminHandler.SetRecordingPolicy)
+		users.Get("/api/admin/roles", adminHandler.ListRoles)
+		users.Put("/api/admin/roles/{name}", adminHandler.PutRole)
+		users.Delete("/api/admin/roles/{name}", adminHandler.DeleteRole)
 	})
 
 	// ─── Health check ─────────────────────────────────────────────────────────
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Actions enregistrées dans le journal d'audit (audit_events.action). Le
+// préfixe avant le point regroupe les actions d'un même domaine.
+const (
+	ActionLogin           = "auth.login"
+	ActionLoginFailed     = "auth.login_failed"
+	ActionPasswordChanged = "auth.password_changed"
+	Action2FAEnabled      = "auth.2fa_enabled"
+	Action2FADisabled     = "auth.2fa_disabled"
+	ActionRecoveryCodes   = "auth.recovery_codes_regenerated"
+	ActionWebAuthnAdded   = "auth.webauthn_added"
+	ActionWebAuthnRemoved = "auth.webauthn_removed"
+	ActionAPITokenCreated = "auth.api_token_created"
+	ActionAPITokenRevoked = "auth.api_token_revoked"
+
+	ActionHostCreated     = "host.created"
+	ActionHostUpdated     = "host.updated"
+	ActionHostDeleted     = "host.deleted"
+	ActionHostKeyAccepted = "host.key_accepted"
+	ActionHostKeyReset    = "host.key_reset"
+
+	ActionCredentialCreated = "credential.created"
+	ActionCredentialDeleted = "credential.deleted"
+
+	ActionTeamCreated       = "team.created"
+	ActionTeamDeleted       = "team.deleted"
+	ActionTeamMemberAdded   = "team.member_added"
+	ActionTeamMemberRemoved = "team.member_removed"
+	ActionTeamMemberRole    = "team.member_role_changed"
+
+	ActionUserDeleted       = "admin.user_deleted"
+	ActionUserDisabled      = "admin.user_disabled"
+	ActionUserEnabled       = "admin.user_enabled"
+	ActionUserRole          = "admin.user_role_changed"
+	ActionRecordingPolicy   = "admin.recording_policy_changed"
+	ActionRoleSaved         = "admin.role_saved"
+	ActionRoleDeleted       = "admin.role_deleted"
+	ActionSessionTerminated = "admin.session_terminated"
+	ActionRegistration      = "settings.registration_changed"
+
+	ActionSSHSession  = "ssh.session_started"
+	ActionForward     = "ssh.forward_started"
+	ActionSFTPPut     = "sftp.put"
+	ActionSFTPRemove  = "sftp.rm"
+	ActionSFTPRename  = "sftp.rename"
+	ActionSFTPMkdir   = "sftp.mkdir"
+	ActionSFTPCopy    = "sftp.copy"
+	ActionSFTPArchive = "sftp.archive"
+	ActionSFTPExtract = "sftp.extract"
+)
+
+// Event décrit une action à enregistrer. ActorID est vide pour une action
+// anonyme (échec de connexion : ActorEmail porte alors l'identifiant saisi).
+type Event struct {
+	ActorID    string
+	ActorEmail string
+	Action     string
+	Target     string
+	IP         string
+	Details    map[string]interface{}
+}
+
+// Record ajoute l'événement au journal. Une erreur est seulement loguée :
+// l'échec de l'audit ne doit pas faire échouer l'action elle-même.
+func Record(ctx context.Context, pool *pgxpool.Pool, e Event) {
+	stored := &models.AuditEvent{
+		ActorEmail: e.ActorEmail,
+		Action:     e.Action,
+		Target:     e.Target,
+		IP:         e.IP,
+	}
+	if e.ActorID != "" {
+		stored.ActorID = &e.ActorID
+	}
+	if len(e.Details) > 0 {
+		details, err := json.Marshal(e.Details)
+		if err != nil {
+			log.Printf("[ERROR] audit %s: marshal details: %v", e.Action, err)
+		} else {
+			stored.Details = details
+		}
+	}
+	// context.WithoutCancel : l'événement est enregistré même si le client a
+	// déjà fermé la connexion.
+	if err := db.InsertAuditEvent(context.WithoutCancel(ctx), pool, stored); err != nil {
+		log.Printf("[ERROR] audit %s: %v", e.Action, err)
+		return
+	}
+	publish(stored)
+}
@@ -0,0 +1,321 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/config"
+	"github.com/gestion-ssh/backend/internal/models"
+)
+
+// SinksFromConfig construit les sinks activés par la configuration
+// (AUDIT_SYSLOG_URL, AUDIT_FILE, AUDIT_WEBHOOK_URL).
+func SinksFromConfig(cfg *config.Config) ([]Sink, error) {
+	var sinks []Sink
+	if cfg.AuditSyslogURL != "" {
+		var tlsConfig *tls.Config
+		if strings.HasPrefix(cfg.AuditSyslogURL, "tls://") {
+			tlsConfig = &tls.Config{InsecureSkipVerify: cfg.AuditSyslogSkipVerify}
+			if cfg.AuditSyslogCAFile != "" {
+				pem, err := os.ReadFile(cfg.AuditSyslogCAFile)
+				if err != nil {
+					return nil, fmt.Errorf("syslog CA: %w", err)
+				}
+				roots := x509.NewCertPool()
+				if !roots.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("syslog CA: no certificate in %s", cfg.AuditSyslogCAFile)
+				}
+				tlsConfig.RootCAs = roots
+			}
+		}
+		s, err := NewSyslogSink(cfg.AuditSyslogURL, cfg.AuditSyslogAppName, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.AuditFile != "" {
+		s, err := NewFileSink(cfg.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.AuditWebhookURL != "" {
+		s, err := NewWebhookSink(cfg.AuditWebhookURL, cfg.AuditWebhookSecret)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// ─── Syslog (RFC 5424) ────────────────────────────────────────────────────────
+
+// SyslogSink envoie chaque événement en message RFC 5424 : en datagramme sur
+// UDP, avec le cadrage par longueur (octet counting, RFC 6587 / RFC 5425) sur
+// TCP et TLS. La connexion est rétablie au premier envoi après une erreur.
+type SyslogSink struct {
+	network   string // "udp", "tcp" ou "tls"
+	addr      string
+	tlsConfig *tls.Config
+	hostname  string
+	appName   string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// syslogFacility : authpriv (10), réservée aux messages de sécurité.
+const syslogFacility = 10
+
+// SD-ID des données structurées. 32473 est le numéro d'entreprise IANA
+// réservé à la documentation (RFC 5612).
+const syslogSDID = "audit@32473"
+
+// NewSyslogSink accepte une URL udp://, tcp:// ou tls:// avec hôte et port.
+func NewSyslogSink(rawURL, appName string, tlsConfig *tls.Config) (*SyslogSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("syslog url: %w", err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("syslog url: scheme must be udp, tcp or tls")
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("syslog url: port required")
+	}
+	if u.Scheme == "tls" && tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if appName == "" {
+		appName = "ssh-manager"
+	}
+	return &SyslogSink{
+		network:   u.Scheme,
+		addr:      u.Host,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+		appName:   appName,
+	}, nil
+}
+
+func (s *SyslogSink) Name() string { return "syslog" }
+
+func (s *SyslogSink) Send(ctx context.Context, e *models.AuditEvent) error {
+	msg, err := s.format(e)
+	if err != nil {
+		return Permanent(err)
+	}
+	if s.network != "udp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *SyslogSink) dial(ctx context.Context) error {
+	if s.network == "tls" {
+		d := &tls.Dialer{Config: s.tlsConfig}
+		conn, err := d.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		return nil
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// format produit : <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] BOM JSON
+func (s *SyslogSink) format(e *models.AuditEvent) ([]byte, error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	severity := 5 // notice
+	if e.Action == ActionLoginFailed {
+		severity = 4 // warning
+	}
+	actorID := ""
+	if e.ActorID != nil {
+		actorID = *e.ActorID
+	}
+	msgID := e.Action
+	if len(msgID) > 32 {
+		msgID = msgID[:32]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s id=\"%d\" actor_id=\"%s\" actor=\"%s\" target=\"%s\" ip=\"%s\"] \xEF\xBB\xBF",
+		syslogFacility*8+severity,
+		e.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, s.appName, os.Getpid(), msgID, syslogSDID,
+		e.ID, sdEscape(actorID), sdEscape(e.ActorEmail), sdEscape(e.Target), sdEscape(e.IP))
+	b.Write(body)
+	return b.Bytes(), nil
+}
+
+// sdEscaper échappe une valeur de paramètre de données structurées (RFC 5424 §6.3.3).
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sdEscape(v string) string {
+	return sdEscaper.Replace(v)
+}
+
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// ─── Fichier NDJSON ───────────────────────────────────────────────────────────
+
+// FileSink ajoute chaque événement en une ligne JSON à la fin du fichier.
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("audit file: %w", err)
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Name() string { return "file" }
+
+func (s *FileSink) Send(_ context.Context, e *models.AuditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return Permanent(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// ─── Webhook HTTP ─────────────────────────────────────────────────────────────
+
+// WebhookSink POSTe chaque événement en JSON. Le destinataire vérifie
+// l'en-tête X-Audit-Signature : "sha256=" + HMAC-SHA256 hexadécimal, avec le
+// secret partagé, de "<X-Audit-Timestamp>.<corps>". Le timestamp signé permet
+// de rejeter les requêtes rejouées.
+type WebhookSink struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewWebhookSink(rawURL, secret string) (*WebhookSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("audit webhook: invalid url %q", rawURL)
+	}
+	if secret == "" {
+		return nil, fmt.Errorf("audit webhook: AUDIT_WEBHOOK_SECRET is required")
+	}
+	return &WebhookSink{
+		url:    rawURL,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: sendTimeout},
+	}, nil
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Send(ctx context.Context, e *models.AuditEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return Permanent(err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Audit-Event", e.Action)
+	req.Header.Set("X-Audit-Timestamp", ts)
+	req.Header.Set("X-Audit-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		// Les autres 4xx ne changeront pas en réessayant.
+		return Permanent(fmt.Errorf("webhook returned %s", resp.Status))
+	}
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,354 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Diffusion des événements d'audit vers des systèmes externes (SIEM).
+//
+// Chaque sink a sa propre file et son goroutine : un sink lent ou indisponible
+// ne bloque ni les autres sinks ni la requête qui a produit l'événement. Un
+// événement refusé MaxAttempts fois, ou qui ne trouve pas de place dans la
+// file, part dans la dead-letter queue (table audit_dead_letters) d'où il est
+// redélivré périodiquement. L'écriture en base d'un événement refusé faute de
+// place est confiée à un goroutine dédié ; si sa propre file est pleine,
+// l'événement est perdu pour ce sink et compté dans Dropped.
+
+// Sink reçoit les événements d'audit. Send est appelé depuis un seul goroutine.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e *models.AuditEvent) error
+	Close() error
+}
+
+// permanentError signale un refus qu'un nouvel essai ne corrigera pas.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marque l'erreur d'un sink comme définitive : l'événement part
+// directement en dead-letter sans nouvel essai.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type StreamOptions struct {
+	QueueSize   int           // événements en attente par sink
+	MaxAttempts int           // essais avant la dead-letter queue
+	RetryEvery  time.Duration // période de redélivraison de la dead-letter queue
+}
+
+const (
+	sendTimeout    = 10 * time.Second
+	maxBackoff     = 30 * time.Second
+	deadLetterPage = 100
+)
+
+// Stream distribue les événements enregistrés par Record aux sinks configurés.
+type Stream struct {
+	pool    *pgxpool.Pool
+	opts    StreamOptions
+	workers []*sinkWorker
+	letters chan pendingLetter // files pleines : dead-letters à écrire
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+type sinkWorker struct {
+	sink   Sink
+	queue  chan *models.AuditEvent
+	replay chan struct{}
+
+	delivered atomic.Int64
+	failed    atomic.Int64
+	dropped   atomic.Int64 // perdus : file et dead-letters à écrire pleines
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt *time.Time
+}
+
+type pendingLetter struct {
+	w     *sinkWorker
+	e     *models.AuditEvent
+	cause error
+}
+
+// SinkStatus est l'état d'un sink exposé aux administrateurs.
+type SinkStatus struct {
+	Name        string     `json:"name"`
+	Queued      int        `json:"queued"`
+	Delivered   int64      `json:"delivered"`
+	Failed      int64      `json:"failed"`
+	Dropped     int64      `json:"dropped"`
+	DeadLetters int        `json:"dead_letters"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+var current atomic.Pointer[Stream]
+
+// Start démarre la diffusion vers les sinks ; Record y publie désormais chaque
+// événement enregistré. Close arrête la diffusion.
+func Start(pool *pgxpool.Pool, sinks []Sink, opts StreamOptions) *Stream {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.RetryEvery <= 0 {
+		opts.RetryEvery = 5 * time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{pool: pool, opts: opts, ctx: ctx, cancel: cancel,
+		letters: make(chan pendingLetter, opts.QueueSize)}
+	s.wg.Add(1)
+	go s.writeDeadLetters()
+	for _, sink := range sinks {
+		w := &sinkWorker{
+			sink:   sink,
+			queue:  make(chan *models.AuditEvent, opts.QueueSize),
+			replay: make(chan struct{}, 1),
+		}
+		s.workers = append(s.workers, w)
+		s.wg.Add(1)
+		go s.run(w)
+		log.Printf("audit sink enabled: %s", sink.Name())
+	}
+	current.Store(s)
+	return s
+}
+
+// Close arrête la diffusion. Les événements encore en file passent dans la
+// dead-letter queue et seront délivrés au prochain démarrage.
+func (s *Stream) Close() {
+	current.CompareAndSwap(s, nil)
+	s.cancel()
+	s.wg.Wait()
+	for _, w := range s.workers {
+		if err := w.sink.Close(); err != nil {
+			log.Printf("audit sink %s: close: %v", w.sink.Name(), err)
+		}
+	}
+}
+
+// publish transmet l'événement à chaque sink sans jamais bloquer l'appelant,
+// ni attendre la base quand la file d'un sink est pleine.
+func publish(e *models.AuditEvent) {
+	s := current.Load()
+	if s == nil {
+		return
+	}
+	for _, w := range s.workers {
+		select {
+		case w.queue <- e:
+		default:
+			s.overflow(w, e)
+		}
+	}
+}
+
+// overflow confie l'événement refusé par une file pleine à writeDeadLetters.
+func (s *Stream) overflow(w *sinkWorker, e *models.AuditEvent) {
+	select {
+	case s.letters <- pendingLetter{w: w, e: e, cause: errors.New("queue full")}:
+	default:
+		w.dropped.Add(1)
+		log.Printf("[ERROR] audit sink %s: event %d lost: queue full", w.sink.Name(), e.ID)
+	}
+}
+
+// writeDeadLetters écrit en base les événements refusés par publish. À l'arrêt,
+// ceux encore en attente sont écrits avant de rendre la main.
+func (s *Stream) writeDeadLetters() {
+	defer s.wg.Done()
+	for {
+		select {
+		case l := <-s.letters:
+			s.deadLetter(l.w, l.e, 0, l.cause)
+		case <-s.ctx.Done():
+			for {
+				select {
+				case l := <-s.letters:
+					s.deadLetter(l.w, l.e, 0, l.cause)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Stream) run(w *sinkWorker) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.RetryEvery)
+	defer ticker.Stop()
+
+	// Événements laissés en dead-letter par une exécution précédente
+	s.redeliver(w)
+	for {
+		select {
+		case e := <-w.queue:
+			s.deliver(w, e)
+		case <-w.replay:
+			s.redeliver(w)
+		case <-ticker.C:
+			s.redeliver(w)
+		case <-s.ctx.Done():
+			for {
+				select {
+				case e := <-w.queue:
+					s.deadLetter(w, e, 0, errors.New("server shutting down"))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver envoie l'événement avec backoff exponentiel (1s, 2s, 4s… plafonné à
+// maxBackoff) puis le place en dead-letter après MaxAttempts échecs.
+func (s *Stream) deliver(w *sinkWorker, e *models.AuditEvent) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := w.send(s.ctx, e)
+		if err == nil {
+			return
+		}
+		if isPermanent(err) || attempt >= s.opts.MaxAttempts {
+			s.deadLetter(w, e, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+			s.deadLetter(w, e, attempt, err)
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// redeliver vide la dead-letter queue du sink, du plus ancien événement au plus
+// récent. Elle s'interrompt au premier échec temporaire : le sink est encore
+// indisponible, inutile d'insister avant la prochaine période.
+func (s *Stream) redeliver(w *sinkWorker) {
+	for s.ctx.Err() == nil {
+		letters, err := db.ListAuditDeadLetters(s.ctx, s.pool, w.sink.Name(), deadLetterPage)
+		if err != nil {
+			log.Printf("[ERROR] audit sink %s: list dead letters: %v", w.sink.Name(), err)
+			return
+		}
+		progressed := false
+		for _, l := range letters {
+			if err := w.send(s.ctx, l.Event); err != nil {
+				if err := db.FailAuditDeadLetter(s.ctx, s.pool, l.ID, err.Error()); err != nil {
+					log.Printf("[ERROR] audit sink %s: update dead letter: %v", w.sink.Name(), err)
+				}
+				if !isPermanent(err) {
+					return
+				}
+				continue
+			}
+			progressed = true
+			if err := db.DeleteAuditDeadLetter(s.ctx, s.pool, l.ID); err != nil {
+				log.Printf("[ERROR] audit sink %s: delete dead letter: %v", w.sink.Name(), err)
+				return
+			}
+		}
+		if len(letters) < deadLetterPage || !progressed {
+			return
+		}
+	}
+}
+
+func (s *Stream) deadLetter(w *sinkWorker, e *models.AuditEvent, attempts int, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if err := db.InsertAuditDeadLetter(ctx, s.pool, w.sink.Name(), e.ID, attempts, cause.Error()); err != nil {
+		log.Printf("[ERROR] audit sink %s: event %d lost: %v (dead letter: %v)", w.sink.Name(), e.ID, cause, err)
+	}
+}
+
+func (w *sinkWorker) send(ctx context.Context, e *models.AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	err := w.sink.Send(ctx, e)
+	if err == nil {
+		w.delivered.Add(1)
+		return nil
+	}
+	w.failed.Add(1)
+	now := time.Now()
+	w.mu.Lock()
+	w.lastError, w.lastErrorAt = err.Error(), &now
+	w.mu.Unlock()
+	log.Printf("audit sink %s: event %d: %v", w.sink.Name(), e.ID, err)
+	return err
+}
+
+// Status retourne l'état des sinks actifs (aucun si la diffusion est désactivée).
+func Status(ctx context.Context) ([]SinkStatus, error) {
+	s := current.Load()
+	if s == nil {
+		return []SinkStatus{}, nil
+	}
+	statuses := make([]SinkStatus, 0, len(s.workers))
+	for _, w := range s.workers {
+		n, err := db.CountAuditDeadLetters(ctx, s.pool, w.sink.Name())
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		st := SinkStatus{
+			Name:        w.sink.Name(),
+			Queued:      len(w.queue),
+			Delivered:   w.delivered.Load(),
+			Failed:      w.failed.Load(),
+			Dropped:     w.dropped.Load(),
+			DeadLetters: n,
+			LastError:   w.lastError,
+			LastErrorAt: w.lastErrorAt,
+		}
+		w.mu.Unlock()
+		statuses = append(statuses, st)
+	}
+	return statuses, nil
+}
+
+// Replay déclenche immédiatement la redélivraison de la dead-letter queue du
+// sink. Retourne false si aucun sink actif ne porte ce nom.
+func Replay(name string) bool {
+	s := current.Load()
+	if s == nil {
+		return false
+	}
+	for _, w := range s.workers {
+		if w.sink.Name() == name {
+			select {
+			case w.replay <- struct{}{}:
+			default: // redélivraison déjà demandée
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package audit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gestion-ssh/backend/internal/models"
+)
+
+type nopSink struct{}
+
+func (nopSink) Name() string                                   { return "nop" }
+func (nopSink) Send(context.Context, *models.AuditEvent) error { return nil }
+func (nopSink) Close() error                                   { return nil }
+
+// Une file pleine ne doit jamais faire attendre la base à l'appelant : sans
+// pool ni goroutines, publish paniquerait s'il écrivait la dead-letter.
+func TestPublishQueueFullDoesNotBlock(t *testing.T) {
+	w := &sinkWorker{sink: nopSink{}, queue: make(chan *models.AuditEvent, 1)}
+	s := &Stream{workers: []*sinkWorker{w}, letters: make(chan pendingLetter, 2)}
+	current.Store(s)
+	t.Cleanup(func() { current.CompareAndSwap(s, nil) })
+
+	for id := int64(1); id <= 5; id++ {
+		publish(&models.AuditEvent{ID: id})
+	}
+	if len(w.queue) != 1 || len(s.letters) != 2 || w.dropped.Load() != 2 {
+		t.Fatalf("queued %d, dead letters pending %d, dropped %d", len(w.queue), len(s.letters), w.dropped.Load())
+	}
+	if l := <-s.letters; l.w != w || l.e.ID != 2 || l.cause.Error() != "queue full" {
+		t.Fatalf("pending letter %+v", l)
+	}
+}
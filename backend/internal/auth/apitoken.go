@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+// Jetons d'accès personnels (automatisation, CLI). Le préfixe permet de les
+// reconnaître (scanners de secrets, header Authorization) ; seul leur hash
+// SHA-256 est conservé, le secret n'est affiché qu'à la création.
+
+const APITokenPrefix = "sshm_"
+
+// apiTokenDisplayLen est la longueur du début de jeton conservé en clair pour
+// que l'utilisateur reconnaisse ses jetons dans la liste.
+const apiTokenDisplayLen = len(APITokenPrefix) + 6
+
+// Scopes d'un jeton d'accès personnel.
+const (
+	ScopeHostsRead    = "hosts:read"
+	ScopeHostsWrite   = "hosts:write"
+	ScopeSessionsRead = "sessions:read"
+	ScopeAdmin        = "admin"
+)
+
+var validScopes = map[string]bool{
+	ScopeHostsRead:    true,
+	ScopeHostsWrite:   true,
+	ScopeSessionsRead: true,
+	ScopeAdmin:        true,
+}
+
+func ValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// GenerateAPIToken retourne un nouveau jeton, son début affichable et son hash.
+func GenerateAPIToken() (token, displayPrefix, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	token = APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, token[:apiTokenDisplayLen], HashTokenID(token), nil
+}
+
+// IsAPIToken indique si une valeur de header Bearer est un jeton personnel
+// plutôt qu'un JWT.
+func IsAPIToken(s string) bool {
+	return strings.HasPrefix(s, APITokenPrefix)
+}
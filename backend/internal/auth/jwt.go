@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -12,6 +14,7 @@ type Claims struct {
 	Email     string `json:"email"`
 	IsAdmin   bool   `json:"is_admin"`
 	TokenType string `json:"token_type"` // "access" | "refresh" | "totp_pending"
+	SessionID string `json:"sid,omitempty"` // login_sessions.id (access et refresh)
 	jwt.RegisteredClaims
 }
 
@@ -27,12 +30,13 @@ const (
 	TOTPPendingTokenDuration     = 5 * time.Minute
 )
 
-func GenerateAccessToken(secret, userID, email string, isAdmin bool) (string, error) {
+func GenerateAccessToken(secret, userID, email string, isAdmin bool, sessionID string) (string, error) {
 	claims := Claims{
 		UserID:    userID,
 		Email:     email,
 		IsAdmin:   isAdmin,
 		TokenType: "access",
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenDuration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -43,14 +47,18 @@ func GenerateAccessToken(secret, userID, email string, isAdmin bool) (string, er
 	return token.SignedString([]byte(secret))
 }
 
-func GenerateRefreshToken(secret, userID, email string, isAdmin bool, duration time.Duration) (string, error) {
+// GenerateRefreshToken signe un refresh token identifié par jti. Le serveur ne
+// conserve que le hash du jti (voir HashTokenID) pour la rotation et la révocation.
+func GenerateRefreshToken(secret, userID, email string, isAdmin bool, sessionID, jti string, expiresAt time.Time) (string, error) {
 	claims := Claims{
 		UserID:    userID,
 		Email:     email,
 		IsAdmin:   isAdmin,
 		TokenType: "refresh",
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+			ID:        jti,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   userID,
 		},
@@ -94,3 +102,9 @@ func ValidateToken(secret, tokenStr string) (*Claims, error) {
 	}
 	return claims, nil
 }
+
+// HashTokenID retourne le hash SHA-256 (hex) d'un identifiant de token, tel que stocké en base.
+func HashTokenID(jti string) string {
+	sum := sha256.Sum256([]byte(jti))
+	return hex.EncodeToString(sum[:])
+}
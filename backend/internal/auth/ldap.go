@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials est retourné par un annuaire quand l'identifiant ou le
+// mot de passe est incorrect.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// DirectoryEntry décrit un utilisateur authentifié par un annuaire externe.
+type DirectoryEntry struct {
+	DN     string
+	Email  string
+	Groups []string // DN des groupes (attribut memberOf)
+}
+
+// Directory authentifie un identifiant auprès d'un annuaire externe ; l'annulation
+// de ctx interrompt la requête en cours.
+type Directory interface {
+	Authenticate(ctx context.Context, login, password string) (*DirectoryEntry, error)
+}
+
+// ─── LDAP / Active Directory ──────────────────────────────────────────────────
+
+type LDAPConfig struct {
+	URL            string // ldap://host:389 ou ldaps://host:636
+	StartTLS       bool
+	SkipVerify     bool
+	BindDN         string // compte de service utilisé pour la recherche
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string // {login} est remplacé par l'identifiant échappé
+	EmailAttr      string
+	GroupAttr      string
+	PoolSize       int
+	DialTimeout    time.Duration
+	RequestTimeout time.Duration
+}
+
+// LDAPDirectory recherche l'utilisateur avec le compte de service puis vérifie
+// son mot de passe par un bind sous son DN. Les connexions, liées au compte de
+// service, sont réutilisées via un pool borné.
+type LDAPDirectory struct {
+	cfg  LDAPConfig
+	pool chan ldap.Client
+	dial func() (ldap.Client, error)
+}
+
+func NewLDAPDirectory(cfg LDAPConfig) (*LDAPDirectory, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return nil, fmt.Errorf("invalid LDAP URL %q", cfg.URL)
+	}
+	if cfg.StartTLS && u.Scheme == "ldaps" {
+		return nil, errors.New("StartTLS cannot be combined with ldaps://")
+	}
+	if cfg.BaseDN == "" {
+		return nil, errors.New("LDAP base DN is required")
+	}
+	if !strings.Contains(cfg.UserFilter, "{login}") {
+		return nil, errors.New("LDAP user filter must contain {login}")
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 4
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 10 * time.Second
+	}
+	d := &LDAPDirectory{cfg: cfg, pool: make(chan ldap.Client, cfg.PoolSize)}
+	d.dial = d.dialLDAP
+	return d, nil
+}
+
+func (d *LDAPDirectory) Authenticate(ctx context.Context, login, password string) (*DirectoryEntry, error) {
+	// Un bind avec mot de passe vide est un bind anonyme qui "réussit" (RFC 4513).
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.get()
+	if err != nil {
+		return nil, err
+	}
+	// Fermer la connexion est le seul moyen d'interrompre une opération en cours.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	entry, err := d.authenticate(conn, login, password)
+	// Le bind utilisateur a changé l'identité de la connexion : on rétablit le
+	// compte de service avant de la remettre dans le pool.
+	rebindErr := d.bindService(conn)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if rebindErr != nil {
+		conn.Close()
+	} else {
+		d.put(conn)
+	}
+	return entry, err
+}
+
+func (d *LDAPDirectory) authenticate(conn ldap.Client, login, password string) (*DirectoryEntry, error) {
+	filter := strings.ReplaceAll(d.cfg.UserFilter, "{login}", ldap.EscapeFilter(login))
+	res, err := conn.Search(ldap.NewSearchRequest(
+		d.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(d.cfg.RequestTimeout.Seconds()), false,
+		filter, []string{d.cfg.EmailAttr, d.cfg.GroupAttr}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		// Inconnu ou ambigu : on ne devine pas quel compte est visé
+		return nil, ErrInvalidCredentials
+	}
+	e := res.Entries[0]
+
+	if err := conn.Bind(e.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind: %w", err)
+	}
+	return &DirectoryEntry{
+		DN:     e.DN,
+		Email:  e.GetAttributeValue(d.cfg.EmailAttr),
+		Groups: e.GetAttributeValues(d.cfg.GroupAttr),
+	}, nil
+}
+
+func (d *LDAPDirectory) get() (ldap.Client, error) {
+	for {
+		select {
+		case conn := <-d.pool:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return d.dial()
+		}
+	}
+}
+
+func (d *LDAPDirectory) put(conn ldap.Client) {
+	select {
+	case d.pool <- conn:
+	default:
+		conn.Close() // pool plein
+	}
+}
+
+func (d *LDAPDirectory) dialLDAP() (ldap.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: d.cfg.SkipVerify}
+	if u, err := url.Parse(d.cfg.URL); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(d.cfg.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: d.cfg.DialTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	conn.SetTimeout(d.cfg.RequestTimeout)
+	if d.cfg.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls: %w", err)
+		}
+	}
+	if err := d.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *LDAPDirectory) bindService(conn ldap.Client) error {
+	if d.cfg.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	if err := conn.Bind(d.cfg.BindDN, d.cfg.BindPassword); err != nil {
+		return fmt.Errorf("ldap service bind: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN = "cn=svc,dc=example,dc=org"
+	testUserDN    = "uid=alice,ou=people,dc=example,dc=org"
+)
+
+// fakeLDAP est un annuaire en mémoire : un compte de service et des entrées
+// recherchées par le filtre exact (uid=<login échappé>).
+type fakeLDAP struct {
+	mu        sync.Mutex
+	passwords map[string]string
+	entries   map[string][]*ldap.Entry // filtre → résultats
+	filters   []string
+	dials     int
+	conns     []*fakeLDAPConn
+	block     chan struct{} // non nil : Search attend sa fermeture
+	failBind  bool          // le rebind du compte de service échoue
+}
+
+func newFakeLDAP() *fakeLDAP {
+	return &fakeLDAP{
+		passwords: map[string]string{testServiceDN: "svc-secret", testUserDN: "alice-secret"},
+		entries: map[string][]*ldap.Entry{
+			"(uid=alice)": {ldap.NewEntry(testUserDN, map[string][]string{
+				"mail":     {"alice@example.org"},
+				"memberOf": {"cn=admins,dc=example,dc=org", "cn=ops,dc=example,dc=org"},
+			})},
+		},
+	}
+}
+
+func (f *fakeLDAP) dial() (ldap.Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dials++
+	c := &fakeLDAPConn{dir: f, closed: make(chan struct{})}
+	f.conns = append(f.conns, c)
+	return c, nil
+}
+
+func (f *fakeLDAP) dialCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+// fakeLDAPConn implémente les méthodes de ldap.Client utilisées par LDAPDirectory ;
+// les autres paniquent via l'interface embarquée nil.
+type fakeLDAPConn struct {
+	ldap.Client
+	dir       *fakeLDAP
+	boundDN   string
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *fakeLDAPConn) Bind(dn, password string) error {
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+	if dn == testServiceDN && c.dir.failBind {
+		return ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable"))
+	}
+	if pw, ok := c.dir.passwords[dn]; !ok || pw != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.boundDN = dn
+	return nil
+}
+
+func (c *fakeLDAPConn) UnauthenticatedBind(string) error {
+	c.boundDN = ""
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.dir.mu.Lock()
+	c.dir.filters = append(c.dir.filters, req.Filter)
+	block := c.dir.block
+	entries := c.dir.entries[req.Filter]
+	c.dir.mu.Unlock()
+	if block != nil {
+		select {
+		case <-block:
+		case <-c.closed:
+			return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection closed"))
+		}
+	}
+	return &ldap.SearchResult{Entries: entries}, nil
+}
+
+func (c *fakeLDAPConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeLDAPConn) IsClosing() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func newTestDirectory(t *testing.T, f *fakeLDAP, poolSize int) *LDAPDirectory {
+	t.Helper()
+	d, err := NewLDAPDirectory(LDAPConfig{
+		URL:          "ldap://ldap.example.org",
+		BindDN:       testServiceDN,
+		BindPassword: "svc-secret",
+		BaseDN:       "dc=example,dc=org",
+		UserFilter:   "(uid={login})",
+		EmailAttr:    "mail",
+		GroupAttr:    "memberOf",
+		PoolSize:     poolSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.dial = func() (ldap.Client, error) {
+		conn, err := f.dial()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.bindService(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return d
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	f := newFakeLDAP()
+	d := newTestDirectory(t, f, 2)
+
+	entry, err := d.Authenticate(context.Background(), "alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.DN != testUserDN || entry.Email != "alice@example.org" || len(entry.Groups) != 2 {
+		t.Fatalf("entry %+v", entry)
+	}
+	// La connexion remise dans le pool est de nouveau liée au compte de service.
+	if c := f.conns[0]; c.boundDN != testServiceDN || c.IsClosing() || len(d.pool) != 1 {
+		t.Fatalf("conn bound to %q, closing %v, pool %d", c.boundDN, c.IsClosing(), len(d.pool))
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	tests := []struct {
+		name, login, password string
+	}{
+		{"bad password", "alice", "wrong"},
+		{"unknown user", "bob", "alice-secret"},
+		{"empty password", "alice", ""},
+		{"empty login", "", "alice-secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeLDAP()
+			d := newTestDirectory(t, f, 2)
+			if _, err := d.Authenticate(context.Background(), tt.login, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+			}
+		})
+	}
+}
+
+func TestLDAPEmptyPasswordNeverBinds(t *testing.T) {
+	f := newFakeLDAP()
+	// Un annuaire qui accepterait le bind anonyme sous le DN de l'utilisateur
+	f.passwords[testUserDN] = ""
+	d := newTestDirectory(t, f, 2)
+	if _, err := d.Authenticate(context.Background(), "alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+	if n := f.dialCount(); n != 0 {
+		t.Fatalf("empty password reached the directory (%d dials)", n)
+	}
+}
+
+func TestLDAPAmbiguousLogin(t *testing.T) {
+	f := newFakeLDAP()
+	f.entries["(uid=alice)"] = append(f.entries["(uid=alice)"], ldap.NewEntry("uid=alice,ou=other,dc=example,dc=org", nil))
+	d := newTestDirectory(t, f, 2)
+	if _, err := d.Authenticate(context.Background(), "alice", "alice-secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	f := newFakeLDAP()
+	d := newTestDirectory(t, f, 2)
+	for _, login := range []string{"*", "alice)(uid=*", `a\b`, "x*()\\"} {
+		if _, err := d.Authenticate(context.Background(), login, "alice-secret"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Fatalf("login %q: err = %v", login, err)
+		}
+	}
+	want := []string{`(uid=\2a)`, `(uid=alice\29\28uid=\2a)`, `(uid=a\5cb)`, `(uid=x\2a\28\29\5c)`}
+	if strings.Join(f.filters, " ") != strings.Join(want, " ") {
+		t.Fatalf("filters = %q, want %q", f.filters, want)
+	}
+}
+
+func TestLDAPPoolReuse(t *testing.T) {
+	f := newFakeLDAP()
+	d := newTestDirectory(t, f, 2)
+	for _, pw := range []string{"alice-secret", "wrong", "alice-secret"} {
+		d.Authenticate(context.Background(), "alice", pw)
+	}
+	if n := f.dialCount(); n != 1 {
+		t.Fatalf("%d dials for sequential logins, want 1", n)
+	}
+
+	// Une connexion fermée par le serveur n'est pas réutilisée.
+	f.conns[0].Close()
+	if _, err := d.Authenticate(context.Background(), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.dialCount(); n != 2 {
+		t.Fatalf("%d dials after a closed connection, want 2", n)
+	}
+}
+
+func TestLDAPPoolExhaustion(t *testing.T) {
+	f := newFakeLDAP()
+	d := newTestDirectory(t, f, 2)
+
+	// Pool vide : chaque demande ouvre une connexion, sans attendre.
+	var conns []ldap.Client
+	for i := 0; i < 3; i++ {
+		c, err := d.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	if n := f.dialCount(); n != 3 {
+		t.Fatalf("%d dials, want 3", n)
+	}
+	// Pool plein : la connexion en trop est fermée.
+	for _, c := range conns {
+		d.put(c)
+	}
+	if len(d.pool) != 2 || !f.conns[2].IsClosing() {
+		t.Fatalf("pool %d, third conn closing %v", len(d.pool), f.conns[2].IsClosing())
+	}
+}
+
+func TestLDAPRebindFailureDropsConn(t *testing.T) {
+	f := newFakeLDAP()
+	d := newTestDirectory(t, f, 2)
+	if _, err := d.get(); err != nil { // connexion ouverte, liée au compte de service
+		t.Fatal(err)
+	}
+	d.put(f.conns[0])
+	f.failBind = true
+	if _, err := d.Authenticate(context.Background(), "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !f.conns[0].IsClosing() || len(d.pool) != 0 {
+		t.Fatal("connection left in the pool without the service identity")
+	}
+}
+
+func TestLDAPContextCancel(t *testing.T) {
+	f := newFakeLDAP()
+	f.block = make(chan struct{})
+	d := newTestDirectory(t, f, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Authenticate(ctx, "alice", "alice-secret")
+		done <- err
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		searching := len(f.filters) > 0
+		f.mu.Unlock()
+		if searching {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("search never started")
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Authenticate ignored the cancelled context")
+	}
+	if !f.conns[0].IsClosing() || len(d.pool) != 0 {
+		t.Fatal("interrupted connection returned to the pool")
+	}
+
+	if _, err := d.Authenticate(ctx, "alice", "alice-secret"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled context: err = %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+// Contrôle d'accès par rôle. Chaque utilisateur a un rôle (table roles) qui
+// porte une liste de permissions ; les routes exigent une permission avec
+// middleware.RequirePermission.
+//
+// PermUsersManage permet d'attribuer des rôles et de modifier leurs
+// permissions, mais seulement dans la limite des permissions que l'appelant
+// détient lui-même : les handlers refusent toute élévation de privilèges.
+
+const (
+	PermHostsManage     = "hosts.manage"      // créer, modifier, supprimer des hôtes
+	PermHostsConnect    = "hosts.connect"     // ouvrir des sessions SSH, SFTP et redirections
+	PermHostsShare      = "hosts.share"       // créer des équipes et y gérer les membres
+	PermSessionsViewAll = "sessions.view_all" // audit des sessions de tous les utilisateurs
+	PermUsersManage     = "users.manage"      // comptes, rôles, politiques d'enregistrement
+	PermSettingsManage  = "settings.manage"   // paramètres globaux du panel
+)
+
+// Rôles prédéfinis, créés par la migration. Leurs permissions se modifient comme
+// celles des rôles personnalisés, sauf pour RoleAdmin, créé avec toutes les
+// permissions : le handler PutRole refuse de le modifier (la base ne le
+// protège pas).
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAuditor  = "auditor"
+	RoleAdmin    = "admin"
+)
+
+var validPermissions = map[string]bool{
+	PermHostsManage:     true,
+	PermHostsConnect:    true,
+	PermHostsShare:      true,
+	PermSessionsViewAll: true,
+	PermUsersManage:     true,
+	PermSettingsManage:  true,
+}
+
+func ValidPermission(perm string) bool {
+	return validPermissions[perm]
+}
+
+// AllPermissions retourne toutes les permissions, c'est-à-dire celles de
+// RoleAdmin.
+func AllPermissions() []string {
+	perms := make([]string, 0, len(validPermissions))
+	for p := range validPermissions {
+		perms = append(perms, p)
+	}
+	return perms
+}
+
+// BuiltinRole indique si le rôle est prédéfini. Les handlers refusent de
+// supprimer un rôle prédéfini ; ses permissions restent modifiables, sauf
+// celles de RoleAdmin.
+func BuiltinRole(name string) bool {
+	return name == RoleViewer || name == RoleOperator || name == RoleAuditor || name == RoleAdmin
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+)
+
+// RecoveryCodeCount est le nombre de codes de récupération générés à l'activation de la 2FA.
+const RecoveryCodeCount = 10
+
+// recoveryEncoding utilise l'alphabet de Crockford (sans i, l, o, u) pour éviter
+// les confusions à la saisie.
+var recoveryEncoding = base32.NewEncoding("0123456789abcdefghjkmnpqrstvwxyz").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes génère n codes de récupération à usage unique au format
+// "xxxxx-xxxxx" (50 bits d'entropie chacun). Ils ne sont affichés qu'une fois ;
+// seul leur hash Argon2id (HashPassword) est conservé.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	raw := make([]byte, 7)
+	for i := range codes {
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		c := recoveryEncoding.EncodeToString(raw)[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode met un code saisi sous la forme hachée à la génération
+// (minuscules, sans espaces ni tirets).
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -22,6 +22,138 @@ ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FAL
 ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
 ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
 
+-- Contrôle d'accès par rôle. users.role remplace is_admin, qui reste tenu à
+-- jour (is_admin = rôle 'admin') pour les requêtes existantes. Les rôles
+-- prédéfinis ne sont insérés qu'une fois : leurs permissions restent modifiables.
+CREATE TABLE IF NOT EXISTS roles (
+    name        TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    permissions TEXT[] NOT NULL DEFAULT '{}'
+);
+INSERT INTO roles (name, description, permissions) VALUES
+    ('viewer', 'Consulte ses hôtes et rejoint les sessions partagées', '{}'),
+    ('operator', 'Gère ses hôtes et s''y connecte', '{hosts.manage,hosts.connect,hosts.share}'),
+    ('auditor', 'Consulte l''audit des sessions', '{sessions.view_all}'),
+    ('admin', 'Accès complet', '{hosts.manage,hosts.connect,hosts.share,sessions.view_all,users.manage,settings.manage}')
+ON CONFLICT (name) DO NOTHING;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT REFERENCES roles(name);
+UPDATE users SET role = CASE WHEN is_admin THEN 'admin' ELSE 'operator' END WHERE role IS NULL;
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'operator';
+ALTER TABLE users ALTER COLUMN role SET NOT NULL;
+
+-- Compte désactivé par un administrateur ; tokens_revoked_at : les tokens
+-- d'accès émis avant cette date sont refusés (désactivation, changement de mot de passe).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_revoked_at TIMESTAMPTZ;
+
+-- Single sign-on OpenID Connect : identité (iss, sub) liée au compte.
+-- auth_source = 'oidc' (SSO) ou 'ldap' (annuaire) pour les comptes provisionnés :
+-- password_hash contient alors le hash de la passphrase du coffre ('' tant
+-- qu'elle n'est pas définie).
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_source TEXT NOT NULL DEFAULT 'local';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users(oidc_issuer, oidc_subject);
+
+-- Flux d'autorisation OIDC en cours (state à usage unique, nonce, verifier PKCE).
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash    TEXT PRIMARY KEY,
+    nonce         TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    remember_me   BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at    TIMESTAMPTZ NOT NULL
+);
+
+-- Connexions (login) actives d'un utilisateur, une par navigateur / appareil.
+CREATE TABLE IF NOT EXISTS login_sessions (
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id      UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    ip           TEXT NOT NULL DEFAULT '',
+    user_agent   TEXT NOT NULL DEFAULT '',
+    remember_me  BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    revoked_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS login_sessions_user_idx ON login_sessions(user_id);
+
+-- Refresh tokens émis (hash du jti). Une famille regroupe les tokens successifs
+-- d'un même login : la réutilisation d'un token déjà échangé révoque la famille.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id  UUID NOT NULL,
+    jti_hash   TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    used_at    TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_idx ON refresh_tokens(user_id);
+
+-- La famille d'un refresh token est la connexion (login_sessions) qui l'a émis.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'refresh_tokens_family_fkey'
+    ) THEN
+        DELETE FROM refresh_tokens WHERE family_id NOT IN (SELECT id FROM login_sessions);
+        ALTER TABLE refresh_tokens ADD CONSTRAINT refresh_tokens_family_fkey
+            FOREIGN KEY (family_id) REFERENCES login_sessions(id) ON DELETE CASCADE;
+    END IF;
+END;
+$$;
+
+-- Codes de récupération 2FA à usage unique (hash Argon2id)
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash  TEXT NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS totp_recovery_codes_user_idx ON totp_recovery_codes(user_id);
+
+-- Clés de sécurité / passkeys WebAuthn utilisées comme second facteur.
+-- data contient le credential sérialisé (clé publique, compteur de signatures...).
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id            UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id       UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name          TEXT NOT NULL,
+    credential_id BYTEA UNIQUE NOT NULL,
+    data          JSONB NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_idx ON webauthn_credentials(user_id);
+
+-- Challenges WebAuthn en cours (enregistrement ou login), à usage unique
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id    UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind       TEXT NOT NULL CHECK (kind IN ('register','login')),
+    name       TEXT NOT NULL DEFAULT '',
+    session    JSONB NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Jetons d'accès personnels (API, scripts). Seul le hash SHA-256 est conservé ;
+-- prefix est le début du jeton, affiché pour le reconnaître.
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id      UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name         TEXT NOT NULL,
+    prefix       TEXT NOT NULL,
+    token_hash   TEXT UNIQUE NOT NULL,
+    scopes       TEXT[] NOT NULL,
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens(user_id);
+
 CREATE TABLE IF NOT EXISTS app_settings (
     key   TEXT PRIMARY KEY,
     value TEXT NOT NULL
@@ -49,6 +181,135 @@ CREATE TABLE IF NOT EXISTS hosts (
 -- Migrations idempotentes pour les hôtes
 ALTER TABLE hosts ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
 ALTER TABLE hosts ADD COLUMN IF NOT EXISTS icon TEXT NOT NULL DEFAULT '';
+-- Rebond via bastion : chaque hôte peut passer par un autre hôte (chaîne ordonnée).
+-- Un bastion encore utilisé ne peut pas être supprimé : SET NULL changeait
+-- silencieusement le chemin réseau des hôtes qui passaient par lui. NO ACTION
+-- plutôt que RESTRICT : vérifiée en fin d'instruction, la contrainte laisse
+-- passer la suppression en cascade d'une chaîne entière (compte ou équipe).
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS jump_host_id UUID REFERENCES hosts(id);
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'hosts_jump_host_id_fkey' AND confdeltype <> 'a'
+    ) THEN
+        ALTER TABLE hosts DROP CONSTRAINT hosts_jump_host_id_fkey;
+        ALTER TABLE hosts ADD CONSTRAINT hosts_jump_host_id_fkey
+            FOREIGN KEY (jump_host_id) REFERENCES hosts(id);
+    END IF;
+END;
+$$;
+
+-- Équipes : un hôte appartient soit à un utilisateur, soit à une équipe.
+-- La clé d'équipe (symétrique, générée par le client) chiffre le credential des
+-- hôtes de l'équipe ; chaque membre la reçoit chiffrée avec sa clé publique
+-- (encrypted_team_key NULL : à repartager, ex. après perte de sa clé privée).
+CREATE TABLE IF NOT EXISTS teams (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS team_members (
+    team_id            UUID NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    user_id            UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role               TEXT NOT NULL CHECK (role IN ('owner','admin','member')),
+    encrypted_team_key BYTEA,
+    created_at         TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (team_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS team_members_user_idx ON team_members(user_id);
+
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS team_id UUID REFERENCES teams(id) ON DELETE CASCADE;
+ALTER TABLE hosts ALTER COLUMN user_id DROP NOT NULL;
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'hosts_owner_check'
+    ) THEN
+        ALTER TABLE hosts ADD CONSTRAINT hosts_owner_check
+            CHECK ((user_id IS NULL) <> (team_id IS NULL));
+    END IF;
+END;
+$$;
+
+-- Paire de clés de l'utilisateur pour le partage : la clé privée est chiffrée
+-- avec sa clé maître, comme les autres secrets du coffre.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS public_key BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS encrypted_private_key BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS private_key_iv BYTEA;
+
+-- Copie personnelle du credential d'un hôte d'équipe, chiffrée avec la clé
+-- maître du membre.
+CREATE TABLE IF NOT EXISTS host_member_credentials (
+    host_id        UUID NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+    user_id        UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    encrypted_cred BYTEA NOT NULL,
+    iv             BYTEA NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (host_id, user_id)
+);
+
+-- Journal d'audit append-only : actor_id sans clé étrangère pour conserver
+-- l'historique des comptes supprimés ; UPDATE et DELETE sont refusés.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id          BIGSERIAL PRIMARY KEY,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    actor_id    UUID,
+    actor_email TEXT NOT NULL DEFAULT '',
+    action      TEXT NOT NULL,
+    target      TEXT NOT NULL DEFAULT '',
+    ip          TEXT NOT NULL DEFAULT '',
+    details     JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events(actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_events_action_idx ON audit_events(action, id);
+CREATE INDEX IF NOT EXISTS audit_events_created_idx ON audit_events(created_at);
+
+CREATE OR REPLACE FUNCTION audit_events_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_trigger WHERE tgname = 'audit_events_append_only'
+    ) THEN
+        CREATE TRIGGER audit_events_append_only
+        BEFORE UPDATE OR DELETE ON audit_events
+        FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+    END IF;
+END;
+$$;
+
+-- Événements d'audit qu'un sink (syslog, fichier, webhook) n'a pas pu recevoir.
+-- Ils sont redélivrés périodiquement puis supprimés une fois acceptés.
+CREATE TABLE IF NOT EXISTS audit_dead_letters (
+    id           BIGSERIAL PRIMARY KEY,
+    sink         TEXT NOT NULL,
+    event_id     BIGINT NOT NULL REFERENCES audit_events(id),
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    last_error   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_attempt TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (sink, event_id)
+);
+
+-- Clés d'hôte SSH épinglées (trust-on-first-use). La clé "pending" est la
+-- dernière clé refusée pour non-correspondance, en attente d'acceptation.
+CREATE TABLE IF NOT EXISTS host_keys (
+    host_id             UUID PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+    key_type            TEXT NOT NULL,
+    public_key          BYTEA NOT NULL,
+    fingerprint         TEXT NOT NULL,
+    pending_key_type    TEXT,
+    pending_public_key  BYTEA,
+    pending_fingerprint TEXT,
+    pending_seen_at     TIMESTAMPTZ,
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
 
 CREATE TABLE IF NOT EXISTS credentials (
     id             UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -69,6 +330,38 @@ CREATE TABLE IF NOT EXISTS sessions (
     client_ip  TEXT
 );
 
+-- Enregistrement asciicast des sessions : nom du fichier dans le stockage
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS recording TEXT;
+
+-- Enregistrement imposé par un admin, par utilisateur : aucun, tous les hôtes
+-- ou seulement les hôtes listés dans recorded_hosts
+ALTER TABLE users ADD COLUMN IF NOT EXISTS recording_mode TEXT NOT NULL DEFAULT 'off'
+    CHECK (recording_mode IN ('off','all','selected'));
+
+-- Type de session : terminal interactif ou tunnel de redirection de ports
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'terminal';
+
+-- Session fermée par un administrateur : email de l'administrateur
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS terminated_by TEXT;
+
+-- Redirections de ports ouvertes pendant une session (audit)
+CREATE TABLE IF NOT EXISTS session_forwards (
+    id         UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    kind       TEXT NOT NULL CHECK (kind IN ('local','remote','dynamic')),
+    address    TEXT NOT NULL,
+    opened_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    closed_at  TIMESTAMPTZ,
+    bytes_in   BIGINT NOT NULL DEFAULT 0,
+    bytes_out  BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recorded_hosts (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    host_id UUID NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, host_id)
+);
+
 CREATE OR REPLACE FUNCTION update_updated_at()
 RETURNS TRIGGER AS $$
 BEGIN
@@ -2,16 +2,53 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // ErrNotFound est retourné quand une opération ne trouve pas la ressource ciblée.
 var ErrNotFound = errors.New("not found")
 
+// ErrInvalidJumpChain est retourné quand la chaîne de bastions boucle ou est trop longue.
+var ErrInvalidJumpChain = errors.New("invalid jump host chain")
+
+// ErrJumpHostInUse est retourné à la suppression d'un hôte qui sert encore de
+// bastion à un autre hôte.
+var ErrJumpHostInUse = errors.New("host is used as a jump host")
+
+// ErrRefreshTokenReused est retourné quand un refresh token déjà échangé est présenté
+// à nouveau : la famille entière a été révoquée.
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// ErrAccountDisabled est retourné quand une connexion est ouverte pour un compte désactivé.
+var ErrAccountDisabled = errors.New("account disabled")
+
+// ErrVaultMismatch est retourné quand un rechiffrement du coffre ne couvre pas
+// exactement les hôtes et credentials de l'utilisateur.
+var ErrVaultMismatch = errors.New("re-encrypted entries do not match the vault")
+
+// ErrLastTeamOwner est retourné quand une opération retirerait le dernier owner d'une équipe.
+var ErrLastTeamOwner = errors.New("team must keep at least one owner")
+
+// ErrAlreadyTeamMember est retourné à l'ajout d'un utilisateur déjà membre de l'équipe.
+var ErrAlreadyTeamMember = errors.New("user is already a team member")
+
+// RefreshReuseGrace tolère la double présentation d'un même refresh token dans
+// ce délai (requêtes concurrentes d'un même navigateur) sans la traiter comme un vol.
+const RefreshReuseGrace = 10 * time.Second
+
+// MaxJumpHops borne le nombre de bastions traversés pour joindre un hôte.
+const MaxJumpHops = 8
+
 // ─── Users ────────────────────────────────────────────────────────────────────
 
 func CreateUser(ctx context.Context, pool *pgxpool.Pool, email, passwordHash string, kdfSalt []byte) (*models.User, error) {
@@ -19,10 +56,10 @@ func CreateUser(ctx context.Context, pool *pgxpool.Pool, email, passwordHash str
 	err := pool.QueryRow(ctx, `
 		INSERT INTO users (email, password_hash, kdf_salt)
 		VALUES ($1, $2, $3)
-		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, totp_enabled, created_at
+		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
 	`, email, passwordHash, kdfSalt).Scan(
 		&user.ID, &user.Email, &user.PasswordHash,
-		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.TOTPEnabled, &user.CreatedAt,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
 	)
 	return user, err
 }
@@ -30,12 +67,12 @@ func CreateUser(ctx context.Context, pool *pgxpool.Pool, email, passwordHash str
 func CreateAdminUser(ctx context.Context, pool *pgxpool.Pool, email, passwordHash string, kdfSalt []byte) (*models.User, error) {
 	user := &models.User{}
 	err := pool.QueryRow(ctx, `
-		INSERT INTO users (email, password_hash, kdf_salt, is_admin)
-		VALUES ($1, $2, $3, TRUE)
-		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, totp_enabled, created_at
+		INSERT INTO users (email, password_hash, kdf_salt, is_admin, role)
+		VALUES ($1, $2, $3, TRUE, 'admin')
+		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
 	`, email, passwordHash, kdfSalt).Scan(
 		&user.ID, &user.Email, &user.PasswordHash,
-		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.TOTPEnabled, &user.CreatedAt,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
 	)
 	return user, err
 }
@@ -49,11 +86,11 @@ func CountUsers(ctx context.Context, pool *pgxpool.Pool) (int, error) {
 func GetUserByEmail(ctx context.Context, pool *pgxpool.Pool, email string) (*models.User, error) {
 	user := &models.User{}
 	err := pool.QueryRow(ctx, `
-		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, totp_enabled, created_at
+		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
 		FROM users WHERE email = $1
 	`, email).Scan(
 		&user.ID, &user.Email, &user.PasswordHash,
-		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.TOTPEnabled, &user.CreatedAt,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
 	)
 	return user, err
 }
@@ -61,11 +98,11 @@ func GetUserByEmail(ctx context.Context, pool *pgxpool.Pool, email string) (*mod
 func GetUserByID(ctx context.Context, pool *pgxpool.Pool, id string) (*models.User, error) {
 	user := &models.User{}
 	err := pool.QueryRow(ctx, `
-		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, totp_enabled, created_at
+		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
 		FROM users WHERE id = $1
 	`, id).Scan(
 		&user.ID, &user.Email, &user.PasswordHash,
-		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.TOTPEnabled, &user.CreatedAt,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
 	)
 	return user, err
 }
@@ -77,6 +114,7 @@ func UpdateUserEmail(ctx context.Context, pool *pgxpool.Pool, userID, newEmail s
 
 // UpdateUserPassword met à jour le hash et le sel KDF, et supprime tous les hôtes
 // (les credentials chiffrés avec l'ancienne clé maître deviennent inutilisables).
+// Les connexions, tokens d'accès et jetons d'API de l'utilisateur sont révoqués.
 func UpdateUserPassword(ctx context.Context, pool *pgxpool.Pool, userID, newPasswordHash string, newKDFSalt []byte) error {
 	tx, err := pool.Begin(ctx)
 	if err != nil {
@@ -96,12 +134,150 @@ func UpdateUserPassword(ctx context.Context, pool *pgxpool.Pool, userID, newPass
 	if _, err = tx.Exec(ctx, `DELETE FROM credentials WHERE user_id = $1`, userID); err != nil {
 		return err
 	}
+	// La clé privée de partage est perdue avec l'ancienne clé maître : les clés
+	// d'équipe devront lui être repartagées.
+	if _, err = tx.Exec(ctx, `DELETE FROM host_member_credentials WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `
+		UPDATE users SET public_key = NULL, encrypted_private_key = NULL, private_key_iv = NULL
+		WHERE id = $1
+	`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `UPDATE team_members SET encrypted_team_key = NULL WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	// Nouveau mot de passe : toutes les connexions existantes doivent se réauthentifier.
+	if err = revokeLoginSessions(ctx, tx, userID, ""); err != nil {
+		return err
+	}
+	if err = revokeAccessTokens(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err = deleteAPITokens(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RekeyVault remplace le mot de passe et le sel KDF de l'utilisateur et, dans la
+// même transaction, tous ses secrets chiffrés par leur version rechiffrée avec la
+// nouvelle clé maître. hosts, creds, memberCreds (identifiées par host_id) et
+// privateKey (clé privée de partage, nil si l'utilisateur n'en a pas) doivent couvrir exactement le coffre
+// (ErrVaultMismatch sinon). Les autres connexions que keepSessionID sont révoquées,
+// ainsi que les tokens d'accès et jetons d'API.
+func RekeyVault(ctx context.Context, pool *pgxpool.Pool, userID, keepSessionID, newPasswordHash string, newKDFSalt []byte, hosts, creds, memberCreds []models.VaultEntry, privateKey *models.VaultEntry) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Verrou sur l'utilisateur : sérialise les rechiffrements concurrents.
+	if _, err = tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+	if err = rekeyTable(ctx, tx, "hosts", "id", "user_id", userID, hosts); err != nil {
+		return err
+	}
+	if err = rekeyTable(ctx, tx, "credentials", "id", "user_id", userID, creds); err != nil {
+		return err
+	}
+	if err = rekeyTable(ctx, tx, "host_member_credentials", "host_id", "user_id", userID, memberCreds); err != nil {
+		return err
+	}
+	if err = rekeyPrivateKey(ctx, tx, userID, privateKey); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx,
+		`UPDATE users SET password_hash = $1, kdf_salt = $2 WHERE id = $3`,
+		newPasswordHash, newKDFSalt, userID,
+	); err != nil {
+		return err
+	}
+	if err = revokeLoginSessions(ctx, tx, userID, keepSessionID); err != nil {
+		return err
+	}
+	if err = revokeAccessTokens(ctx, tx, userID); err != nil {
+		return err
+	}
+	if err = deleteAPITokens(ctx, tx, userID); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
+// rekeyPrivateKey remplace la clé privée de partage chiffrée ; elle doit être
+// fournie si et seulement si l'utilisateur en possède une.
+func rekeyPrivateKey(ctx context.Context, tx pgx.Tx, userID string, privateKey *models.VaultEntry) error {
+	var hasKey bool
+	if err := tx.QueryRow(ctx,
+		`SELECT encrypted_private_key IS NOT NULL FROM users WHERE id = $1`, userID,
+	).Scan(&hasKey); err != nil {
+		return err
+	}
+	if hasKey != (privateKey != nil) {
+		return ErrVaultMismatch
+	}
+	if privateKey == nil {
+		return nil
+	}
+	_, err := tx.Exec(ctx,
+		`UPDATE users SET encrypted_private_key = $1, private_key_iv = $2 WHERE id = $3`,
+		privateKey.EncryptedCred, privateKey.IV, userID,
+	)
+	return err
+}
+
+// rekeyTable vérifie que entries couvre exactement les lignes de table (hosts,
+// credentials...) dont la colonne owner (user_id ou team_id) vaut ownerID, puis
+// met à jour leurs secrets chiffrés. Les entrées sont identifiées par la colonne
+// key (id, ou host_id pour host_member_credentials).
+func rekeyTable(ctx context.Context, tx pgx.Tx, table, key, owner, ownerID string, entries []models.VaultEntry) error {
+	rows, err := tx.Query(ctx, `SELECT `+key+` FROM `+table+` WHERE `+owner+` = $1 FOR UPDATE`, ownerID)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = false
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(entries) != len(existing) {
+		return ErrVaultMismatch
+	}
+	for _, e := range entries {
+		covered, ok := existing[e.ID]
+		if !ok || covered {
+			return ErrVaultMismatch
+		}
+		existing[e.ID] = true
+	}
+
+	for _, e := range entries {
+		if _, err := tx.Exec(ctx,
+			`UPDATE `+table+` SET encrypted_cred = $1, iv = $2 WHERE `+key+` = $3 AND `+owner+` = $4`,
+			e.EncryptedCred, e.IV, e.ID, ownerID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ListUsers(ctx context.Context, pool *pgxpool.Pool) ([]*models.User, error) {
 	rows, err := pool.Query(ctx, `
-		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, totp_enabled, created_at
+		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
 		FROM users ORDER BY created_at ASC
 	`)
 	if err != nil {
@@ -114,7 +290,7 @@ func ListUsers(ctx context.Context, pool *pgxpool.Pool) ([]*models.User, error)
 		u := &models.User{}
 		if err := rows.Scan(
 			&u.ID, &u.Email, &u.PasswordHash,
-			&u.KDFSalt, &u.KDFParams, &u.IsAdmin, &u.TOTPEnabled, &u.CreatedAt,
+			&u.KDFSalt, &u.KDFParams, &u.IsAdmin, &u.Role, &u.TOTPEnabled, &u.AuthSource, &u.Disabled, &u.CreatedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -123,21 +299,301 @@ func ListUsers(ctx context.Context, pool *pgxpool.Pool) ([]*models.User, error)
 	return users, rows.Err()
 }
 
-func CountAdmins(ctx context.Context, pool *pgxpool.Pool) (int, error) {
-	var count int
-	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE is_admin = TRUE`).Scan(&count)
-	return count, err
+// otherActiveAdmins compte les administrateurs actifs autres que userID. Elle
+// les verrouille pour sérialiser les opérations concurrentes qui retireraient
+// chacune un administrateur.
+func otherActiveAdmins(ctx context.Context, tx pgx.Tx, userID string) (int, error) {
+	var others int
+	err := tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM (
+			SELECT 1 FROM users WHERE role = 'admin' AND disabled_at IS NULL AND id <> $1 FOR UPDATE
+		) a
+	`, userID).Scan(&others)
+	return others, err
+}
+
+// SetUserDisabled désactive ou réactive un compte. La désactivation révoque ses
+// connexions et ses tokens d'accès ; le dernier administrateur actif ne peut
+// pas être désactivé.
+func SetUserDisabled(ctx context.Context, pool *pgxpool.Pool, userID string, disabled bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var role string
+	if err = tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&role); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if !disabled {
+		if _, err = tx.Exec(ctx, `UPDATE users SET disabled_at = NULL WHERE id = $1`, userID); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+	if role == "admin" {
+		others, err := otherActiveAdmins(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastAdmin
+		}
+	}
+	if _, err = tx.Exec(ctx,
+		`UPDATE users SET disabled_at = COALESCE(disabled_at, NOW()) WHERE id = $1`, userID,
+	); err != nil {
+		return err
+	}
+	if err = revokeLoginSessions(ctx, tx, userID, ""); err != nil {
+		return err
+	}
+	if err = revokeAccessTokens(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
+// DeleteUserByID supprime un compte ; le dernier administrateur actif ne peut
+// pas être supprimé (ErrLastAdmin).
 func DeleteUserByID(ctx context.Context, pool *pgxpool.Pool, id string) error {
-	tag, err := pool.Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var activeAdmin bool
+	if err = tx.QueryRow(ctx,
+		`SELECT role = 'admin' AND disabled_at IS NULL FROM users WHERE id = $1 FOR UPDATE`, id,
+	).Scan(&activeAdmin); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if activeAdmin {
+		others, err := otherActiveAdmins(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastAdmin
+		}
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ─── Login sessions ───────────────────────────────────────────────────────────
+
+// CreateLoginSession ouvre une connexion pour userID et retourne son identifiant.
+// Les connexions expirées de l'utilisateur sont purgées au passage.
+func CreateLoginSession(ctx context.Context, pool *pgxpool.Pool, userID, ip, userAgent string, rememberMe bool, expiresAt time.Time) (string, error) {
+	if _, err := pool.Exec(ctx,
+		`DELETE FROM login_sessions WHERE user_id = $1 AND expires_at < NOW()`, userID,
+	); err != nil {
+		return "", err
+	}
+	// Le contrôle du compte dans l'INSERT écarte une désactivation concurrente.
+	var id string
+	err := pool.QueryRow(ctx, `
+		INSERT INTO login_sessions (user_id, ip, user_agent, remember_me, expires_at)
+		SELECT id, $2, $3, $4, $5 FROM users WHERE id = $1 AND disabled_at IS NULL
+		RETURNING id
+	`, userID, ip, userAgent, rememberMe, expiresAt).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrAccountDisabled
+	}
+	return id, err
+}
+
+// TouchLoginSession vérifie que la connexion est active (ErrNotFound sinon) et
+// rafraîchit last_used_at au plus une fois par minute.
+func TouchLoginSession(ctx context.Context, pool *pgxpool.Pool, id, userID string) error {
+	var lastUsed time.Time
+	err := pool.QueryRow(ctx, `
+		SELECT last_used_at FROM login_sessions
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`, id, userID).Scan(&lastUsed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if time.Since(lastUsed) < time.Minute {
+		return nil
+	}
+	_, err = pool.Exec(ctx, `UPDATE login_sessions SET last_used_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// ListLoginSessions retourne les connexions actives de l'utilisateur, la plus récente d'abord.
+func ListLoginSessions(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.LoginSession, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, ip, user_agent, remember_me, created_at, last_used_at, expires_at
+		FROM login_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*models.LoginSession
+	for rows.Next() {
+		ls := &models.LoginSession{}
+		if err := rows.Scan(&ls.ID, &ls.IP, &ls.UserAgent, &ls.RememberMe, &ls.CreatedAt, &ls.LastUsedAt, &ls.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, ls)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeLoginSession déconnecte la connexion id de userID et révoque ses refresh tokens.
+func RevokeLoginSession(ctx context.Context, pool *pgxpool.Pool, userID, id string) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE login_sessions SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
 	if err != nil {
 		return err
 	}
 	if tag.RowsAffected() == 0 {
 		return ErrNotFound
 	}
-	return nil
+	_, err = pool.Exec(ctx,
+		`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, id,
+	)
+	return err
+}
+
+// RevokeOtherLoginSessions déconnecte toutes les connexions de userID sauf keepID.
+// keepID vide révoque tout.
+func RevokeOtherLoginSessions(ctx context.Context, pool *pgxpool.Pool, userID, keepID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := revokeLoginSessions(ctx, tx, userID, keepID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// revokeAccessTokens invalide les tokens d'accès déjà émis pour l'utilisateur
+// (voir middleware.Authenticate), y compris celui de la connexion conservée.
+func revokeAccessTokens(ctx context.Context, tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(ctx, `UPDATE users SET tokens_revoked_at = NOW() WHERE id = $1`, userID)
+	return err
+}
+
+// deleteAPITokens révoque les jetons d'API personnels de l'utilisateur ; ils
+// sont vérifiés en base à chaque requête, la révocation est immédiate.
+func deleteAPITokens(ctx context.Context, tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM api_tokens WHERE user_id = $1`, userID)
+	return err
+}
+
+func revokeLoginSessions(ctx context.Context, tx pgx.Tx, userID, keepID string) error {
+	if _, err := tx.Exec(ctx, `
+		UPDATE login_sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL AND ($2 = '' OR id::text <> $2)
+	`, userID, keepID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL AND ($2 = '' OR family_id::text <> $2)
+	`, userID, keepID)
+	return err
+}
+
+// ─── Refresh tokens ───────────────────────────────────────────────────────────
+
+// CreateRefreshToken enregistre le refresh token jtiHash de la connexion sessionID.
+func CreateRefreshToken(ctx context.Context, pool *pgxpool.Pool, userID, sessionID, jtiHash string, expiresAt time.Time) error {
+	_, err := pool.Exec(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, jti_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, sessionID, jtiHash, expiresAt)
+	return err
+}
+
+// RotateRefreshToken échange le token oldHash contre newHash dans la même
+// connexion. Un token inconnu, révoqué ou expiré donne ErrNotFound ; un token
+// déjà échangé révoque la connexion et donne ErrRefreshTokenReused.
+func RotateRefreshToken(ctx context.Context, pool *pgxpool.Pool, userID, sessionID, oldHash, newHash string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		expiresAt time.Time
+		usedAt    *time.Time
+		revokedAt *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		SELECT rt.expires_at, rt.used_at, COALESCE(rt.revoked_at, ls.revoked_at)
+		FROM refresh_tokens rt
+		JOIN login_sessions ls ON ls.id = rt.family_id
+		WHERE rt.jti_hash = $1 AND rt.user_id = $2 AND rt.family_id = $3
+		FOR UPDATE OF rt
+	`, oldHash, userID, sessionID).Scan(&expiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if revokedAt != nil || time.Now().After(expiresAt) {
+		return ErrNotFound
+	}
+	if usedAt != nil && time.Since(*usedAt) > RefreshReuseGrace {
+		if _, err := tx.Exec(ctx,
+			`UPDATE login_sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, sessionID,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx,
+			`UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`, sessionID,
+		); err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+
+	if usedAt == nil {
+		if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE jti_hash = $1`, oldHash); err != nil {
+			return err
+		}
+	}
+	// Le nouveau token hérite de l'expiration de la connexion (fixée au login).
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, jti_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, sessionID, newHash, expiresAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE login_sessions SET last_used_at = NOW() WHERE id = $1`, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
 func ListSessionsAll(ctx context.Context, pool *pgxpool.Pool) ([]*models.SessionWithDetails, error) {
@@ -146,7 +602,8 @@ func ListSessionsAll(ctx context.Context, pool *pgxpool.Pool) ([]*models.Session
 		       COALESCE(u.email, '(supprimé)'),
 		       COALESCE(h.name, '(supprimé)'),
 		       COALESCE(h.hostname, ''),
-		       s.started_at, s.ended_at, s.client_ip
+		       s.started_at, s.ended_at, s.client_ip, s.kind, s.recording IS NOT NULL,
+		       s.terminated_by
 		FROM sessions s
 		LEFT JOIN users u ON s.user_id = u.id
 		LEFT JOIN hosts h ON s.host_id = h.id
@@ -163,7 +620,8 @@ func ListSessionsAll(ctx context.Context, pool *pgxpool.Pool) ([]*models.Session
 		s := &models.SessionWithDetails{}
 		if err := rows.Scan(
 			&s.ID, &s.UserEmail, &s.HostName, &s.HostHostname,
-			&s.StartedAt, &s.EndedAt, &s.ClientIP,
+			&s.StartedAt, &s.EndedAt, &s.ClientIP, &s.Kind, &s.HasRecording,
+			&s.TerminatedBy,
 		); err != nil {
 			return nil, err
 		}
@@ -196,122 +654,1151 @@ func EnableTOTP(ctx context.Context, pool *pgxpool.Pool, userID string) error {
 	return err
 }
 
+// DisableTOTP désactive la 2FA et supprime les codes de récupération.
 func DisableTOTP(ctx context.Context, pool *pgxpool.Pool, userID string) error {
-	_, err := pool.Exec(ctx, `UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1`, userID)
-	return err
-}
-
-// ─── Settings ─────────────────────────────────────────────────────────────────
-
-func GetSetting(ctx context.Context, pool *pgxpool.Pool, key string) (string, error) {
-	var value string
-	err := pool.QueryRow(ctx, `SELECT value FROM app_settings WHERE key = $1`, key).Scan(&value)
-	return value, err
-}
-
-func SetSetting(ctx context.Context, pool *pgxpool.Pool, key, value string) error {
-	_, err := pool.Exec(ctx, `
-		INSERT INTO app_settings (key, value) VALUES ($1, $2)
-		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
-	`, key, value)
-	return err
-}
-
-// ─── Hosts ────────────────────────────────────────────────────────────────────
-
-func CreateHost(ctx context.Context, pool *pgxpool.Pool, h *models.CreateHostInput, userID string) (*models.Host, error) {
-	if h.Tags == nil {
-		h.Tags = []string{}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
 	}
-	host := &models.Host{}
-	err := pool.QueryRow(ctx, `
-		INSERT INTO hosts (user_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id, user_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon, created_at, updated_at
-	`, userID, h.Name, h.Hostname, h.Port, h.Username,
-		h.AuthType, h.EncryptedCred, h.IV, h.Tags, h.Icon).Scan(
-		&host.ID, &host.UserID, &host.Name, &host.Hostname,
-		&host.Port, &host.Username, &host.AuthType,
-		&host.EncryptedCred, &host.IV, &host.Tags, &host.Icon,
-		&host.CreatedAt, &host.UpdatedAt,
-	)
-	if host.Tags == nil {
-		host.Tags = []string{}
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, `UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
 	}
-	return host, err
+	return tx.Commit(ctx)
 }
 
-func ListHostsByUser(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.Host, error) {
-	rows, err := pool.Query(ctx, `
-		SELECT id, user_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon, created_at, updated_at
-		FROM hosts WHERE user_id = $1 ORDER BY created_at DESC
-	`, userID)
+// ReplaceRecoveryCodes remplace tous les codes de récupération de l'utilisateur.
+func ReplaceRecoveryCodes(ctx context.Context, pool *pgxpool.Pool, userID string, hashes []string) error {
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-
-	var hosts []*models.Host
-	for rows.Next() {
-		h := &models.Host{}
-		if err := rows.Scan(
-			&h.ID, &h.UserID, &h.Name, &h.Hostname,
-			&h.Port, &h.Username, &h.AuthType,
-			&h.EncryptedCred, &h.IV, &h.Tags, &h.Icon,
-			&h.CreatedAt, &h.UpdatedAt,
+	defer tx.Rollback(ctx)
+	if _, err = tx.Exec(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err = tx.Exec(ctx,
+			`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash,
 		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ListUnusedRecoveryCodes retourne les hash des codes non consommés, indexés par id.
+func ListUnusedRecoveryCodes(ctx context.Context, pool *pgxpool.Pool, userID string) (map[string]string, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, code_hash FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := make(map[string]string)
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		codes[id] = hash
+	}
+	return codes, rows.Err()
+}
+
+// ConsumeRecoveryCode marque un code comme utilisé. Retourne ErrNotFound s'il
+// l'a déjà été (requête concurrente).
+func ConsumeRecoveryCode(ctx context.Context, pool *pgxpool.Pool, id string) error {
+	tag, err := pool.Exec(ctx,
+		`UPDATE totp_recovery_codes SET used_at = NOW() WHERE id = $1 AND used_at IS NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func CountRecoveryCodes(ctx context.Context, pool *pgxpool.Pool, userID string) (int, error) {
+	var count int
+	err := pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID,
+	).Scan(&count)
+	return count, err
+}
+
+// ─── WebAuthn ─────────────────────────────────────────────────────────────────
+
+func CreateWebAuthnCredential(ctx context.Context, pool *pgxpool.Pool, userID, name string, credentialID, data []byte) (*models.WebAuthnCredential, error) {
+	c := &models.WebAuthnCredential{}
+	err := pool.QueryRow(ctx, `
+		INSERT INTO webauthn_credentials (user_id, name, credential_id, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, name, credential_id, data, created_at, last_used_at
+	`, userID, name, credentialID, data).Scan(&c.ID, &c.Name, &c.CredentialID, &c.Data, &c.CreatedAt, &c.LastUsedAt)
+	return c, err
+}
+
+func ListWebAuthnCredentials(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.WebAuthnCredential, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, name, credential_id, data, created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*models.WebAuthnCredential
+	for rows.Next() {
+		c := &models.WebAuthnCredential{}
+		if err := rows.Scan(&c.ID, &c.Name, &c.CredentialID, &c.Data, &c.CreatedAt, &c.LastUsedAt); err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+func CountWebAuthnCredentials(ctx context.Context, pool *pgxpool.Pool, userID string) (int, error) {
+	var count int
+	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1`, userID).Scan(&count)
+	return count, err
+}
+
+// UpdateWebAuthnCredentialUse enregistre le credential mis à jour (compteur de
+// signatures, flags) après une authentification réussie.
+func UpdateWebAuthnCredentialUse(ctx context.Context, pool *pgxpool.Pool, userID string, credentialID, data []byte) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE webauthn_credentials SET data = $1, last_used_at = NOW()
+		WHERE user_id = $2 AND credential_id = $3
+	`, data, userID, credentialID)
+	return err
+}
+
+func RenameWebAuthnCredential(ctx context.Context, pool *pgxpool.Pool, id, userID, name string) error {
+	tag, err := pool.Exec(ctx, `UPDATE webauthn_credentials SET name = $1 WHERE id = $2 AND user_id = $3`, name, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func DeleteWebAuthnCredential(ctx context.Context, pool *pgxpool.Pool, id, userID string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateWebAuthnChallenge conserve les données de session d'une cérémonie
+// WebAuthn et retourne son identifiant. Les challenges expirés sont purgés.
+func CreateWebAuthnChallenge(ctx context.Context, pool *pgxpool.Pool, userID, kind, name string, session []byte, expiresAt time.Time) (string, error) {
+	if _, err := pool.Exec(ctx, `DELETE FROM webauthn_challenges WHERE expires_at < NOW()`); err != nil {
+		return "", err
+	}
+	var id string
+	err := pool.QueryRow(ctx, `
+		INSERT INTO webauthn_challenges (user_id, kind, name, session, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, userID, kind, name, session, expiresAt).Scan(&id)
+	return id, err
+}
+
+// TakeWebAuthnChallenge consomme un challenge non expiré (usage unique).
+func TakeWebAuthnChallenge(ctx context.Context, pool *pgxpool.Pool, id, kind string) (userID, name string, session []byte, err error) {
+	err = pool.QueryRow(ctx, `
+		DELETE FROM webauthn_challenges
+		WHERE id = $1 AND kind = $2 AND expires_at > NOW()
+		RETURNING user_id, name, session
+	`, id, kind).Scan(&userID, &name, &session)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", nil, ErrNotFound
+	}
+	return userID, name, session, err
+}
+
+// ─── API tokens ───────────────────────────────────────────────────────────────
+
+func CreateAPIToken(ctx context.Context, pool *pgxpool.Pool, userID, name, prefix, tokenHash string, scopes []string, expiresAt *time.Time) (*models.APIToken, error) {
+	t := &models.APIToken{UserID: userID, Name: name, Prefix: prefix, Scopes: scopes, ExpiresAt: expiresAt}
+	err := pool.QueryRow(ctx, `
+		INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, userID, name, prefix, tokenHash, scopes, expiresAt).Scan(&t.ID, &t.CreatedAt)
+	return t, err
+}
+
+// ListAPITokens retourne les jetons de l'utilisateur (expirés compris), le plus récent d'abord.
+func ListAPITokens(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.APIToken, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+		FROM api_tokens WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*models.APIToken
+	for rows.Next() {
+		t := &models.APIToken{}
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken révoque un jeton : il est vérifié en base à chaque requête,
+// la révocation est donc immédiate.
+func DeleteAPIToken(ctx context.Context, pool *pgxpool.Pool, id, userID string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AuthenticateAPIToken retrouve un jeton non expiré par son hash, avec le compte
+// de son propriétaire (email, is_admin, role) et les permissions de son rôle.
+// last_used_at est mis à jour au plus une fois par minute.
+func AuthenticateAPIToken(ctx context.Context, pool *pgxpool.Pool, tokenHash string) (t *models.APIToken, owner *models.User, permissions []string, err error) {
+	t = &models.APIToken{}
+	owner = &models.User{}
+	err = pool.QueryRow(ctx, `
+		SELECT t.id, t.user_id, t.name, t.prefix, t.scopes, t.expires_at, t.last_used_at, t.created_at,
+		       u.email, u.is_admin, u.role, r.permissions
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		JOIN roles r ON r.name = u.role
+		WHERE t.token_hash = $1 AND (t.expires_at IS NULL OR t.expires_at > NOW())
+		  AND u.disabled_at IS NULL
+	`, tokenHash).Scan(
+		&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt,
+		&owner.Email, &owner.IsAdmin, &owner.Role, &permissions,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil, nil, ErrNotFound
+		}
+		return nil, nil, nil, err
+	}
+	owner.ID = t.UserID
+	if t.LastUsedAt == nil || time.Since(*t.LastUsedAt) >= time.Minute {
+		if _, err := pool.Exec(ctx, `UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1`, t.ID); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return t, owner, permissions, nil
+}
+
+// ─── OIDC ─────────────────────────────────────────────────────────────────────
+
+// CreateOIDCLogin enregistre un flux d'autorisation en cours. Les flux expirés
+// sont purgés.
+func CreateOIDCLogin(ctx context.Context, pool *pgxpool.Pool, stateHash, nonce, codeVerifier string, rememberMe bool, expiresAt time.Time) error {
+	if _, err := pool.Exec(ctx, `DELETE FROM oidc_logins WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	_, err := pool.Exec(ctx, `
+		INSERT INTO oidc_logins (state_hash, nonce, code_verifier, remember_me, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, stateHash, nonce, codeVerifier, rememberMe, expiresAt)
+	return err
+}
+
+// TakeOIDCLogin consomme un flux non expiré (state à usage unique).
+func TakeOIDCLogin(ctx context.Context, pool *pgxpool.Pool, stateHash string) (nonce, codeVerifier string, rememberMe bool, err error) {
+	err = pool.QueryRow(ctx, `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING nonce, code_verifier, remember_me
+	`, stateHash).Scan(&nonce, &codeVerifier, &rememberMe)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", false, ErrNotFound
+	}
+	return nonce, codeVerifier, rememberMe, err
+}
+
+func GetUserByOIDCIdentity(ctx context.Context, pool *pgxpool.Pool, issuer, subject string) (*models.User, error) {
+	user := &models.User{}
+	err := pool.QueryRow(ctx, `
+		SELECT id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
+		FROM users WHERE oidc_issuer = $1 AND oidc_subject = $2
+	`, issuer, subject).Scan(
+		&user.ID, &user.Email, &user.PasswordHash,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
+	)
+	return user, err
+}
+
+// LinkUserOIDC associe une identité OIDC à un compte existant qui n'en a pas encore.
+func LinkUserOIDC(ctx context.Context, pool *pgxpool.Pool, userID, issuer, subject string) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE users SET oidc_issuer = $2, oidc_subject = $3
+		WHERE id = $1 AND oidc_subject IS NULL
+	`, userID, issuer, subject)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateOIDCUser provisionne un compte SSO. Sans mot de passe local, il ne peut
+// pas se connecter par /api/auth/login ; sa passphrase de coffre reste à définir.
+func CreateOIDCUser(ctx context.Context, pool *pgxpool.Pool, email, issuer, subject string, kdfSalt []byte, isAdmin bool) (*models.User, error) {
+	user := &models.User{}
+	err := pool.QueryRow(ctx, `
+		INSERT INTO users (email, password_hash, kdf_salt, is_admin, role, auth_source, oidc_issuer, oidc_subject)
+		VALUES ($1, '', $2, $3, CASE WHEN $3 THEN 'admin' ELSE 'operator' END, 'oidc', $4, $5)
+		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
+	`, email, kdfSalt, isAdmin, issuer, subject).Scan(
+		&user.ID, &user.Email, &user.PasswordHash,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
+	)
+	return user, err
+}
+
+// CreateLDAPUser provisionne un compte authentifié par l'annuaire LDAP.
+func CreateLDAPUser(ctx context.Context, pool *pgxpool.Pool, email string, kdfSalt []byte, isAdmin bool) (*models.User, error) {
+	user := &models.User{}
+	err := pool.QueryRow(ctx, `
+		INSERT INTO users (email, password_hash, kdf_salt, is_admin, role, auth_source)
+		VALUES ($1, '', $2, $3, CASE WHEN $3 THEN 'admin' ELSE 'operator' END, 'ldap')
+		RETURNING id, email, password_hash, kdf_salt, kdf_params, is_admin, role, totp_enabled, auth_source, disabled_at IS NOT NULL, created_at
+	`, email, kdfSalt, isAdmin).Scan(
+		&user.ID, &user.Email, &user.PasswordHash,
+		&user.KDFSalt, &user.KDFParams, &user.IsAdmin, &user.Role, &user.TOTPEnabled, &user.AuthSource, &user.Disabled, &user.CreatedAt,
+	)
+	return user, err
+}
+
+// SetUserAdmin modifie le rôle administrateur (un administrateur rétrogradé
+// devient operator). Retirer le rôle au dernier administrateur actif est
+// ignoré : la fonction retourne alors false.
+func SetUserAdmin(ctx context.Context, pool *pgxpool.Pool, userID string, isAdmin bool) (bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var activeAdmin bool
+	if err = tx.QueryRow(ctx,
+		`SELECT role = 'admin' AND disabled_at IS NULL FROM users WHERE id = $1 FOR UPDATE`, userID,
+	).Scan(&activeAdmin); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !isAdmin && activeAdmin {
+		others, err := otherActiveAdmins(ctx, tx, userID)
+		if err != nil {
+			return false, err
+		}
+		if others == 0 {
+			return false, nil
+		}
+	}
+	if _, err = tx.Exec(ctx, `
+		UPDATE users SET is_admin = $2,
+			role = CASE WHEN $2 THEN 'admin' WHEN role = 'admin' THEN 'operator' ELSE role END
+		WHERE id = $1
+	`, userID, isAdmin); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// SetVaultPassphrase définit la passphrase de coffre d'un compte SSO ou annuaire
+// qui n'en a pas encore. Les changements ultérieurs passent par RekeyVault.
+func SetVaultPassphrase(ctx context.Context, pool *pgxpool.Pool, userID, passphraseHash string) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE users SET password_hash = $2
+		WHERE id = $1 AND auth_source <> 'local' AND password_hash = ''
+	`, userID, passphraseHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ─── Settings ─────────────────────────────────────────────────────────────────
+
+func GetSetting(ctx context.Context, pool *pgxpool.Pool, key string) (string, error) {
+	var value string
+	err := pool.QueryRow(ctx, `SELECT value FROM app_settings WHERE key = $1`, key).Scan(&value)
+	return value, err
+}
+
+func SetSetting(ctx context.Context, pool *pgxpool.Pool, key, value string) error {
+	_, err := pool.Exec(ctx, `
+		INSERT INTO app_settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value
+	`, key, value)
+	return err
+}
+
+// ─── Roles ────────────────────────────────────────────────────────────────────
+
+// ErrLastAdmin est retourné quand une opération retirerait le rôle admin au
+// dernier administrateur.
+var ErrLastAdmin = errors.New("at least one admin is required")
+
+// ErrRoleInUse est retourné à la suppression d'un rôle encore attribué.
+var ErrRoleInUse = errors.New("role is assigned to users")
+
+// ErrUnknownRole est retourné à l'attribution d'un rôle inexistant.
+var ErrUnknownRole = errors.New("unknown role")
+
+// GetUserPermissions retourne le rôle de l'utilisateur, ses permissions et la
+// date avant laquelle ses tokens d'accès sont révoqués (nil si aucune).
+// Un compte désactivé est traité comme inexistant (ErrNotFound).
+func GetUserPermissions(ctx context.Context, pool *pgxpool.Pool, userID string) (role string, permissions []string, tokensRevokedAt *time.Time, err error) {
+	err = pool.QueryRow(ctx, `
+		SELECT u.role, r.permissions, u.tokens_revoked_at FROM users u JOIN roles r ON r.name = u.role
+		WHERE u.id = $1 AND u.disabled_at IS NULL
+	`, userID).Scan(&role, &permissions, &tokensRevokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, nil, ErrNotFound
+	}
+	return role, permissions, tokensRevokedAt, err
+}
+
+// GetRolePermissions retourne les permissions du rôle name (ErrNotFound s'il
+// n'existe pas).
+func GetRolePermissions(ctx context.Context, pool *pgxpool.Pool, name string) ([]string, error) {
+	var permissions []string
+	err := pool.QueryRow(ctx, `SELECT permissions FROM roles WHERE name = $1`, name).Scan(&permissions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return permissions, err
+}
+
+func ListRoles(ctx context.Context, pool *pgxpool.Pool) ([]*models.Role, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT r.name, r.description, r.permissions,
+		       (SELECT COUNT(*) FROM users u WHERE u.role = r.name)
+		FROM roles r ORDER BY r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*models.Role
+	for rows.Next() {
+		role := &models.Role{}
+		if err := rows.Scan(&role.Name, &role.Description, &role.Permissions, &role.UserCount); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// UpsertRole crée un rôle ou remplace sa description et ses permissions.
+func UpsertRole(ctx context.Context, pool *pgxpool.Pool, role *models.Role) error {
+	_, err := pool.Exec(ctx, `
+		INSERT INTO roles (name, description, permissions) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE
+		SET description = EXCLUDED.description, permissions = EXCLUDED.permissions
+	`, role.Name, role.Description, role.Permissions)
+	return err
+}
+
+// DeleteRole supprime un rôle qui n'est plus attribué (ErrRoleInUse sinon).
+func DeleteRole(ctx context.Context, pool *pgxpool.Pool, name string) error {
+	tag, err := pool.Exec(ctx, `
+		DELETE FROM roles r WHERE r.name = $1
+		AND NOT EXISTS (SELECT 1 FROM users u WHERE u.role = r.name)
+	`, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+	var exists bool
+	if err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrRoleInUse
+	}
+	return ErrNotFound
+}
+
+// SetUserRole attribue un rôle (is_admin suit le rôle 'admin'). Retirer le rôle
+// admin au dernier administrateur actif retourne ErrLastAdmin.
+func SetUserRole(ctx context.Context, pool *pgxpool.Pool, userID, role string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var known bool
+	if err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`, role).Scan(&known); err != nil {
+		return err
+	}
+	if !known {
+		return ErrUnknownRole
+	}
+	var current string
+	if err = tx.QueryRow(ctx, `SELECT role FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if current == "admin" && role != "admin" {
+		others, err := otherActiveAdmins(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if others == 0 {
+			return ErrLastAdmin
+		}
+	}
+	if _, err = tx.Exec(ctx,
+		`UPDATE users SET role = $2, is_admin = ($2 = 'admin') WHERE id = $1`, userID, role,
+	); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ─── Hosts ────────────────────────────────────────────────────────────────────
+
+// Un hôte est accessible à son propriétaire ou aux membres de son équipe ; seuls
+// les owners et admins de l'équipe peuvent modifier un hôte d'équipe.
+// Les fragments supposent l'alias h pour hosts et $2 pour l'utilisateur.
+const (
+	hostReadable = `(h.user_id = $2 OR h.team_id IN (
+		SELECT team_id FROM team_members WHERE user_id = $2))`
+	hostWritable = `(h.user_id = $2 OR h.team_id IN (
+		SELECT team_id FROM team_members WHERE user_id = $2 AND role IN ('owner','admin')))`
+)
+
+// hostColumns est lu par scanHost ; mc est la copie personnelle du credential
+// (LEFT JOIN host_member_credentials pour l'utilisateur courant).
+const hostColumns = `h.id, h.user_id, h.team_id, h.name, h.hostname, h.port, h.username, h.auth_type,
+	h.encrypted_cred, h.iv, h.tags, h.icon, h.jump_host_id, h.created_at, h.updated_at,
+	mc.encrypted_cred, mc.iv`
+
+const hostFrom = `FROM hosts h
+	LEFT JOIN host_member_credentials mc ON mc.host_id = h.id AND mc.user_id = $2`
+
+func scanHost(row pgx.Row) (*models.Host, error) {
+	h := &models.Host{}
+	err := row.Scan(
+		&h.ID, &h.UserID, &h.TeamID, &h.Name, &h.Hostname,
+		&h.Port, &h.Username, &h.AuthType,
+		&h.EncryptedCred, &h.IV, &h.Tags, &h.Icon, &h.JumpHostID,
+		&h.CreatedAt, &h.UpdatedAt,
+		&h.MemberEncryptedCred, &h.MemberIV,
+	)
+	if h.Tags == nil {
+		h.Tags = []string{}
+	}
+	return h, err
+}
+
+// CreateHost crée un hôte personnel, ou un hôte de l'équipe h.TeamID (le rôle
+// de l'utilisateur dans l'équipe est vérifié par l'appelant).
+func CreateHost(ctx context.Context, pool *pgxpool.Pool, h *models.CreateHostInput, userID string) (*models.Host, error) {
+	if h.Tags == nil {
+		h.Tags = []string{}
+	}
+	owner := &userID
+	if h.TeamID != nil {
+		owner = nil
+	}
+	var id string
+	err := pool.QueryRow(ctx, `
+		INSERT INTO hosts (user_id, team_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon, jump_host_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`, owner, h.TeamID, h.Name, h.Hostname, h.Port, h.Username,
+		h.AuthType, h.EncryptedCred, h.IV, h.Tags, h.Icon, h.JumpHostID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return GetHostByID(ctx, pool, id, userID)
+}
+
+// ListHostsByUser retourne les hôtes personnels de l'utilisateur et ceux de ses équipes.
+func ListHostsByUser(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.Host, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT `+hostColumns+` FROM hosts h
+		LEFT JOIN host_member_credentials mc ON mc.host_id = h.id AND mc.user_id = $1
+		WHERE h.user_id = $1 OR h.team_id IN (SELECT team_id FROM team_members WHERE user_id = $1)
+		ORDER BY h.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hosts []*models.Host
+	for rows.Next() {
+		h, err := scanHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, rows.Err()
+}
+
+func GetHostByID(ctx context.Context, pool *pgxpool.Pool, id, userID string) (*models.Host, error) {
+	return scanHost(pool.QueryRow(ctx, `
+		SELECT `+hostColumns+` `+hostFrom+`
+		WHERE h.id = $1 AND `+hostReadable,
+		id, userID))
+}
+
+// CanWriteHost indique si l'utilisateur peut modifier l'hôte (pgx.ErrNoRows si
+// l'hôte ne lui est pas accessible).
+func CanWriteHost(ctx context.Context, pool *pgxpool.Pool, id, userID string) (bool, error) {
+	var writable bool
+	err := pool.QueryRow(ctx, `
+		SELECT `+hostWritable+` FROM hosts h
+		WHERE h.id = $1 AND `+hostReadable,
+		id, userID).Scan(&writable)
+	return writable, err
+}
+
+// GetHostChain retourne la chaîne de connexion d'un hôte, du premier bastion
+// jusqu'à l'hôte lui-même. Tous les maillons doivent être accessibles à
+// l'utilisateur (ErrNotFound sinon).
+func GetHostChain(ctx context.Context, pool *pgxpool.Pool, hostID, userID string) ([]*models.Host, error) {
+	var chain []*models.Host
+	seen := make(map[string]bool)
+	id := hostID
+	for {
+		if seen[id] || len(chain) > MaxJumpHops {
+			return nil, ErrInvalidJumpChain
+		}
+		seen[id] = true
+		h, err := GetHostByID(ctx, pool, id, userID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*models.Host{h}, chain...)
+		if h.JumpHostID == nil {
+			return chain, nil
+		}
+		id = *h.JumpHostID
+	}
+}
+
+// UpdateHost modifie un hôte que l'utilisateur peut gérer. L'équipe propriétaire
+// ne change pas (h.TeamID est ignoré).
+func UpdateHost(ctx context.Context, pool *pgxpool.Pool, id, userID string, h *models.CreateHostInput) (*models.Host, error) {
+	if h.Tags == nil {
+		h.Tags = []string{}
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Un changement d'adresse invalide la clé d'hôte épinglée.
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM host_keys k USING hosts h
+		WHERE k.host_id = h.id AND h.id = $1 AND `+hostWritable+`
+		  AND (h.hostname <> $3 OR h.port <> $4)
+	`, id, userID, h.Hostname, h.Port); err != nil {
+		return nil, err
+	}
+
+	// Un nouveau credential rend caduques les copies personnelles des membres :
+	// elles sont supprimées et chaque membre repart du credential d'équipe.
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM host_member_credentials mc USING hosts h
+		WHERE mc.host_id = h.id AND h.id = $1 AND `+hostWritable+`
+		  AND (h.encrypted_cred <> $3 OR h.iv <> $4)
+	`, id, userID, h.EncryptedCred, h.IV); err != nil {
+		return nil, err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE hosts h SET name=$3, hostname=$4, port=$5, username=$6,
+		auth_type=$7, encrypted_cred=$8, iv=$9, tags=$10, icon=$11, jump_host_id=$12
+		WHERE h.id = $1 AND `+hostWritable,
+		id, userID, h.Name, h.Hostname, h.Port, h.Username,
+		h.AuthType, h.EncryptedCred, h.IV, h.Tags, h.Icon, h.JumpHostID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return GetHostByID(ctx, pool, id, userID)
+}
+
+// DeleteHost supprime l'hôte ; ErrJumpHostInUse s'il sert de bastion à un autre hôte.
+func DeleteHost(ctx context.Context, pool *pgxpool.Pool, id, userID string) error {
+	_, err := pool.Exec(ctx, `DELETE FROM hosts h WHERE h.id = $1 AND `+hostWritable, id, userID)
+	if isJumpHostReference(err) {
+		return ErrJumpHostInUse
+	}
+	return err
+}
+
+// isJumpHostReference signale une suppression refusée parce qu'un hôte
+// restant passe encore par l'hôte supprimé.
+func isJumpHostReference(err error) bool {
+	var pgErr *pgconn.PgError
+	// 23503 : foreign_key_violation
+	return errors.As(err, &pgErr) && pgErr.Code == "23503" && pgErr.ConstraintName == "hosts_jump_host_id_fkey"
+}
+
+// SetHostMemberCredential enregistre la copie personnelle du credential d'un
+// hôte d'équipe accessible à l'utilisateur.
+func SetHostMemberCredential(ctx context.Context, pool *pgxpool.Pool, hostID, userID string, encryptedCred, iv []byte) error {
+	tag, err := pool.Exec(ctx, `
+		INSERT INTO host_member_credentials (host_id, user_id, encrypted_cred, iv)
+		SELECT h.id, $2, $3, $4 FROM hosts h
+		WHERE h.id = $1 AND h.team_id IS NOT NULL AND `+hostReadable+`
+		ON CONFLICT (host_id, user_id) DO UPDATE
+		SET encrypted_cred = EXCLUDED.encrypted_cred, iv = EXCLUDED.iv
+	`, hostID, userID, encryptedCred, iv)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func DeleteHostMemberCredential(ctx context.Context, pool *pgxpool.Pool, hostID, userID string) error {
+	tag, err := pool.Exec(ctx, `DELETE FROM host_member_credentials WHERE host_id = $1 AND user_id = $2`, hostID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ─── Teams ────────────────────────────────────────────────────────────────────
+
+// Rôles dans une équipe : owner et admin gèrent les membres et les hôtes,
+// member peut utiliser les hôtes de l'équipe.
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleAdmin  = "admin"
+	TeamRoleMember = "member"
+)
+
+// CreateTeam crée une équipe dont ownerID est le premier owner.
+func CreateTeam(ctx context.Context, pool *pgxpool.Pool, name, ownerID string, encryptedTeamKey []byte) (*models.Team, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	t := &models.Team{Name: name, Role: TeamRoleOwner, EncryptedTeamKey: encryptedTeamKey, MemberCount: 1}
+	if err = tx.QueryRow(ctx,
+		`INSERT INTO teams (name) VALUES ($1) RETURNING id, created_at`, name,
+	).Scan(&t.ID, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO team_members (team_id, user_id, role, encrypted_team_key)
+		VALUES ($1, $2, $3, $4)
+	`, t.ID, ownerID, TeamRoleOwner, encryptedTeamKey); err != nil {
+		return nil, err
+	}
+	return t, tx.Commit(ctx)
+}
+
+const teamColumns = `t.id, t.name, m.role, m.encrypted_team_key,
+	(SELECT COUNT(*) FROM team_members c WHERE c.team_id = t.id), t.created_at`
+
+func scanTeam(row pgx.Row) (*models.Team, error) {
+	t := &models.Team{}
+	err := row.Scan(&t.ID, &t.Name, &t.Role, &t.EncryptedTeamKey, &t.MemberCount, &t.CreatedAt)
+	return t, err
+}
+
+// ListTeamsByUser retourne les équipes de l'utilisateur, avec son rôle et sa clé d'équipe.
+func ListTeamsByUser(ctx context.Context, pool *pgxpool.Pool, userID string) ([]*models.Team, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT `+teamColumns+`
+		FROM teams t JOIN team_members m ON m.team_id = t.id
+		WHERE m.user_id = $1
+		ORDER BY t.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []*models.Team
+	for rows.Next() {
+		t, err := scanTeam(rows)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// GetTeam retourne une équipe vue par l'un de ses membres (ErrNotFound sinon).
+func GetTeam(ctx context.Context, pool *pgxpool.Pool, teamID, userID string) (*models.Team, error) {
+	t, err := scanTeam(pool.QueryRow(ctx, `
+		SELECT `+teamColumns+`
+		FROM teams t JOIN team_members m ON m.team_id = t.id
+		WHERE t.id = $1 AND m.user_id = $2
+	`, teamID, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func RenameTeam(ctx context.Context, pool *pgxpool.Pool, teamID, name string) error {
+	_, err := pool.Exec(ctx, `UPDATE teams SET name = $1 WHERE id = $2`, name, teamID)
+	return err
+}
+
+// DeleteTeam supprime l'équipe et ses hôtes ; ErrJumpHostInUse si l'un d'eux
+// sert de bastion à un hôte personnel d'un membre.
+func DeleteTeam(ctx context.Context, pool *pgxpool.Pool, teamID string) error {
+	_, err := pool.Exec(ctx, `DELETE FROM teams WHERE id = $1`, teamID)
+	if isJumpHostReference(err) {
+		return ErrJumpHostInUse
+	}
+	return err
+}
+
+func ListTeamMembers(ctx context.Context, pool *pgxpool.Pool, teamID string) ([]*models.TeamMember, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT m.user_id, u.email, m.role, m.encrypted_team_key IS NOT NULL, u.public_key, m.created_at
+		FROM team_members m JOIN users u ON u.id = m.user_id
+		WHERE m.team_id = $1
+		ORDER BY m.created_at
+	`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*models.TeamMember
+	for rows.Next() {
+		m := &models.TeamMember{}
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.HasKey, &m.PublicKey, &m.CreatedAt); err != nil {
 			return nil, err
 		}
-		if h.Tags == nil {
-			h.Tags = []string{}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// GetTeamRole retourne le rôle de l'utilisateur dans l'équipe (ErrNotFound s'il n'en est pas membre).
+func GetTeamRole(ctx context.Context, pool *pgxpool.Pool, teamID, userID string) (string, error) {
+	var role string
+	err := pool.QueryRow(ctx,
+		`SELECT role FROM team_members WHERE team_id = $1 AND user_id = $2`, teamID, userID,
+	).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return role, err
+}
+
+func AddTeamMember(ctx context.Context, pool *pgxpool.Pool, teamID, userID, role string, encryptedTeamKey []byte) error {
+	tag, err := pool.Exec(ctx, `
+		INSERT INTO team_members (team_id, user_id, role, encrypted_team_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (team_id, user_id) DO NOTHING
+	`, teamID, userID, role, encryptedTeamKey)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyTeamMember
+	}
+	return nil
+}
+
+// lockTeamOwners verrouille les membres de l'équipe et vérifie que retirer le
+// rôle owner à userID en laisse au moins un.
+func lockTeamOwners(ctx context.Context, tx pgx.Tx, teamID, userID string) error {
+	rows, err := tx.Query(ctx, `SELECT user_id, role FROM team_members WHERE team_id = $1 FOR UPDATE`, teamID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	owners, isOwner := 0, false
+	for rows.Next() {
+		var id, role string
+		if err := rows.Scan(&id, &role); err != nil {
+			return err
+		}
+		if role == TeamRoleOwner {
+			owners++
+			isOwner = isOwner || id == userID
 		}
-		hosts = append(hosts, h)
 	}
-	return hosts, rows.Err()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if isOwner && owners == 1 {
+		return ErrLastTeamOwner
+	}
+	return nil
 }
 
-func GetHostByID(ctx context.Context, pool *pgxpool.Pool, id, userID string) (*models.Host, error) {
-	h := &models.Host{}
-	err := pool.QueryRow(ctx, `
-		SELECT id, user_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon, created_at, updated_at
-		FROM hosts WHERE id = $1 AND user_id = $2
-	`, id, userID).Scan(
-		&h.ID, &h.UserID, &h.Name, &h.Hostname,
-		&h.Port, &h.Username, &h.AuthType,
-		&h.EncryptedCred, &h.IV, &h.Tags, &h.Icon,
-		&h.CreatedAt, &h.UpdatedAt,
+func UpdateTeamMemberRole(ctx context.Context, pool *pgxpool.Pool, teamID, userID, role string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if role != TeamRoleOwner {
+		if err = lockTeamOwners(ctx, tx, teamID, userID); err != nil {
+			return err
+		}
+	}
+	tag, err := tx.Exec(ctx,
+		`UPDATE team_members SET role = $1 WHERE team_id = $2 AND user_id = $3`, role, teamID, userID,
 	)
-	if h.Tags == nil {
-		h.Tags = []string{}
+	if err != nil {
+		return err
 	}
-	return h, err
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit(ctx)
 }
 
-func UpdateHost(ctx context.Context, pool *pgxpool.Pool, id, userID string, h *models.CreateHostInput) (*models.Host, error) {
-	if h.Tags == nil {
-		h.Tags = []string{}
+// SetTeamMemberKey (re)partage la clé d'équipe avec un membre.
+func SetTeamMemberKey(ctx context.Context, pool *pgxpool.Pool, teamID, userID string, encryptedTeamKey []byte) error {
+	tag, err := pool.Exec(ctx,
+		`UPDATE team_members SET encrypted_team_key = $1 WHERE team_id = $2 AND user_id = $3`,
+		encryptedTeamKey, teamID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RemoveTeamMember retire un membre et supprime ses copies des credentials de
+// l'équipe. Le membre ayant connu la clé d'équipe, le client doit ensuite la
+// renouveler (RotateTeamKey).
+func RemoveTeamMember(ctx context.Context, pool *pgxpool.Pool, teamID, userID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err = lockTeamOwners(ctx, tx, teamID, userID); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `DELETE FROM team_members WHERE team_id = $1 AND user_id = $2`, teamID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if _, err = tx.Exec(ctx, `
+		DELETE FROM host_member_credentials mc USING hosts h
+		WHERE mc.host_id = h.id AND h.team_id = $1 AND mc.user_id = $2
+	`, teamID, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RotateTeamKey remplace la clé d'équipe : hosts contient les credentials de
+// tous les hôtes de l'équipe rechiffrés avec la nouvelle clé et memberKeys la
+// nouvelle clé chiffrée pour chaque membre. Tout est appliqué ou rien
+// (ErrVaultMismatch si hôtes ou membres ne sont pas exactement couverts).
+func RotateTeamKey(ctx context.Context, pool *pgxpool.Pool, teamID string, hosts []models.VaultEntry, memberKeys map[string][]byte) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, `SELECT 1 FROM teams WHERE id = $1 FOR UPDATE`, teamID); err != nil {
+		return err
+	}
+	if err = rekeyTable(ctx, tx, "hosts", "id", "team_id", teamID, hosts); err != nil {
+		return err
+	}
+
+	var members int
+	if err = tx.QueryRow(ctx, `SELECT COUNT(*) FROM team_members WHERE team_id = $1`, teamID).Scan(&members); err != nil {
+		return err
+	}
+	if members != len(memberKeys) {
+		return ErrVaultMismatch
 	}
-	host := &models.Host{}
+	for userID, key := range memberKeys {
+		tag, err := tx.Exec(ctx,
+			`UPDATE team_members SET encrypted_team_key = $1 WHERE team_id = $2 AND user_id = $3`,
+			key, teamID, userID,
+		)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrVaultMismatch
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// ─── Clés de partage ──────────────────────────────────────────────────────────
+
+func GetUserKeyPair(ctx context.Context, pool *pgxpool.Pool, userID string) (*models.UserKeyPair, error) {
+	k := &models.UserKeyPair{}
+	err := pool.QueryRow(ctx,
+		`SELECT public_key, encrypted_private_key, private_key_iv FROM users WHERE id = $1`, userID,
+	).Scan(&k.PublicKey, &k.EncryptedPrivateKey, &k.PrivateKeyIV)
+	return k, err
+}
+
+// SetUserKeyPair enregistre la paire de clés de partage si l'utilisateur n'en a
+// pas encore (ErrNotFound sinon).
+func SetUserKeyPair(ctx context.Context, pool *pgxpool.Pool, userID string, k *models.UserKeyPair) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE users SET public_key = $2, encrypted_private_key = $3, private_key_iv = $4
+		WHERE id = $1 AND public_key IS NULL
+	`, userID, k.PublicKey, k.EncryptedPrivateKey, k.PrivateKeyIV)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetUserPublicKeyByEmail retourne l'identifiant et la clé publique de partage
+// (nil si non générée) d'un utilisateur.
+func GetUserPublicKeyByEmail(ctx context.Context, pool *pgxpool.Pool, email string) (id string, publicKey []byte, err error) {
+	err = pool.QueryRow(ctx, `SELECT id, public_key FROM users WHERE email = $1`, email).Scan(&id, &publicKey)
+	return id, publicKey, err
+}
+
+// ─── Host keys ────────────────────────────────────────────────────────────────
+
+func GetHostKey(ctx context.Context, pool *pgxpool.Pool, hostID string) (*models.HostKey, error) {
+	k := &models.HostKey{}
 	err := pool.QueryRow(ctx, `
-		UPDATE hosts SET name=$1, hostname=$2, port=$3, username=$4,
-		auth_type=$5, encrypted_cred=$6, iv=$7, tags=$8, icon=$9
-		WHERE id=$10 AND user_id=$11
-		RETURNING id, user_id, name, hostname, port, username, auth_type, encrypted_cred, iv, tags, icon, created_at, updated_at
-	`, h.Name, h.Hostname, h.Port, h.Username,
-		h.AuthType, h.EncryptedCred, h.IV, h.Tags, h.Icon, id, userID).Scan(
-		&host.ID, &host.UserID, &host.Name, &host.Hostname,
-		&host.Port, &host.Username, &host.AuthType,
-		&host.EncryptedCred, &host.IV, &host.Tags, &host.Icon,
-		&host.CreatedAt, &host.UpdatedAt,
+		SELECT host_id, key_type, public_key, fingerprint,
+		       pending_key_type, pending_public_key, pending_fingerprint, pending_seen_at,
+		       created_at, updated_at
+		FROM host_keys WHERE host_id = $1
+	`, hostID).Scan(
+		&k.HostID, &k.KeyType, &k.PublicKey, &k.Fingerprint,
+		&k.PendingKeyType, &k.PendingPublicKey, &k.PendingFingerprint, &k.PendingSeenAt,
+		&k.CreatedAt, &k.UpdatedAt,
 	)
-	if host.Tags == nil {
-		host.Tags = []string{}
+	return k, err
+}
+
+// PinHostKey enregistre la clé vue lors de la première connexion.
+// Retourne false si une clé était déjà épinglée (connexion concurrente).
+func PinHostKey(ctx context.Context, pool *pgxpool.Pool, hostID, keyType string, publicKey []byte, fingerprint string) (bool, error) {
+	tag, err := pool.Exec(ctx, `
+		INSERT INTO host_keys (host_id, key_type, public_key, fingerprint)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (host_id) DO NOTHING
+	`, hostID, keyType, publicKey, fingerprint)
+	if err != nil {
+		return false, err
 	}
-	return host, err
+	return tag.RowsAffected() == 1, nil
 }
 
-func DeleteHost(ctx context.Context, pool *pgxpool.Pool, id, userID string) error {
-	_, err := pool.Exec(ctx, `DELETE FROM hosts WHERE id = $1 AND user_id = $2`, id, userID)
+// SetPendingHostKey mémorise une clé refusée pour que l'utilisateur puisse l'accepter.
+func SetPendingHostKey(ctx context.Context, pool *pgxpool.Pool, hostID, keyType string, publicKey []byte, fingerprint string) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE host_keys
+		SET pending_key_type = $1, pending_public_key = $2, pending_fingerprint = $3, pending_seen_at = NOW()
+		WHERE host_id = $4
+	`, keyType, publicKey, fingerprint, hostID)
+	return err
+}
+
+// AcceptPendingHostKey remplace la clé épinglée par la clé en attente,
+// à condition que son empreinte corresponde à celle confirmée par l'utilisateur.
+func AcceptPendingHostKey(ctx context.Context, pool *pgxpool.Pool, hostID, fingerprint string) error {
+	tag, err := pool.Exec(ctx, `
+		UPDATE host_keys
+		SET key_type = pending_key_type, public_key = pending_public_key, fingerprint = pending_fingerprint,
+		    pending_key_type = NULL, pending_public_key = NULL, pending_fingerprint = NULL, pending_seen_at = NULL,
+		    updated_at = NOW()
+		WHERE host_id = $1 AND pending_fingerprint = $2
+	`, hostID, fingerprint)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteHostKey oublie la clé épinglée : la prochaine connexion refera un TOFU.
+func DeleteHostKey(ctx context.Context, pool *pgxpool.Pool, hostID string) error {
+	_, err := pool.Exec(ctx, `DELETE FROM host_keys WHERE host_id = $1`, hostID)
 	return err
 }
 
@@ -366,13 +1853,13 @@ func DeleteCredential(ctx context.Context, pool *pgxpool.Pool, id, userID string
 
 // ─── Sessions ─────────────────────────────────────────────────────────────────
 
-func CreateSession(ctx context.Context, pool *pgxpool.Pool, userID, hostID, clientIP string) (string, error) {
+func CreateSession(ctx context.Context, pool *pgxpool.Pool, userID, hostID, clientIP, kind string) (string, error) {
 	var sessionID string
 	err := pool.QueryRow(ctx, `
-		INSERT INTO sessions (user_id, host_id, client_ip)
-		VALUES ($1, $2, $3)
+		INSERT INTO sessions (user_id, host_id, client_ip, kind)
+		VALUES ($1, $2, $3, $4)
 		RETURNING id
-	`, userID, hostID, clientIP).Scan(&sessionID)
+	`, userID, hostID, clientIP, kind).Scan(&sessionID)
 	return sessionID, err
 }
 
@@ -382,3 +1869,272 @@ func CloseSession(ctx context.Context, pool *pgxpool.Pool, sessionID string) err
 	`, time.Now(), sessionID)
 	return err
 }
+
+// SetSessionTerminatedBy note l'administrateur qui a fermé la session.
+func SetSessionTerminatedBy(ctx context.Context, pool *pgxpool.Pool, sessionID, email string) error {
+	_, err := pool.Exec(ctx, `UPDATE sessions SET terminated_by = $1 WHERE id = $2`, email, sessionID)
+	return err
+}
+
+// ─── Port forwards ────────────────────────────────────────────────────────────
+
+func CreateForward(ctx context.Context, pool *pgxpool.Pool, sessionID, kind, address string) (string, error) {
+	var id string
+	err := pool.QueryRow(ctx, `
+		INSERT INTO session_forwards (session_id, kind, address)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, sessionID, kind, address).Scan(&id)
+	return id, err
+}
+
+// AddForwardBytes cumule le trafic d'un flux ; closed marque la redirection comme terminée.
+func AddForwardBytes(ctx context.Context, pool *pgxpool.Pool, id string, bytesIn, bytesOut int64, closed bool) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE session_forwards
+		SET bytes_in = bytes_in + $1, bytes_out = bytes_out + $2,
+		    closed_at = CASE WHEN $3 THEN NOW() ELSE closed_at END
+		WHERE id = $4
+	`, bytesIn, bytesOut, closed, id)
+	return err
+}
+
+func ListForwardsBySession(ctx context.Context, pool *pgxpool.Pool, sessionID string) ([]*models.SessionForward, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT id, session_id, kind, address, opened_at, closed_at, bytes_in, bytes_out
+		FROM session_forwards WHERE session_id = $1 ORDER BY opened_at ASC
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var forwards []*models.SessionForward
+	for rows.Next() {
+		f := &models.SessionForward{}
+		if err := rows.Scan(
+			&f.ID, &f.SessionID, &f.Kind, &f.Address,
+			&f.OpenedAt, &f.ClosedAt, &f.BytesIn, &f.BytesOut,
+		); err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards, rows.Err()
+}
+
+// ─── Audit ────────────────────────────────────────────────────────────────────
+
+func InsertAuditEvent(ctx context.Context, pool *pgxpool.Pool, e *models.AuditEvent) error {
+	details := e.Details
+	if len(details) == 0 {
+		details = json.RawMessage(`{}`)
+	}
+	return pool.QueryRow(ctx, `
+		INSERT INTO audit_events (actor_id, actor_email, action, target, ip, details)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, e.ActorID, e.ActorEmail, e.Action, e.Target, e.IP, details).Scan(&e.ID, &e.CreatedAt)
+}
+
+// ListAuditEvents retourne les événements correspondant au filtre, du plus
+// récent au plus ancien.
+func ListAuditEvents(ctx context.Context, pool *pgxpool.Pool, f models.AuditFilter) ([]*models.AuditEvent, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.Actor != "" {
+		if _, err := uuid.Parse(f.Actor); err == nil {
+			conds = append(conds, "actor_id = "+arg(f.Actor))
+		} else {
+			conds = append(conds, "actor_email = "+arg(f.Actor))
+		}
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		conds = append(conds, "starts_with(action, "+arg(f.Action)+")")
+	} else if f.Action != "" {
+		conds = append(conds, "action = "+arg(f.Action))
+	}
+	if f.Since != nil {
+		conds = append(conds, "created_at >= "+arg(*f.Since))
+	}
+	if f.Until != nil {
+		conds = append(conds, "created_at < "+arg(*f.Until))
+	}
+	if f.Before > 0 {
+		conds = append(conds, "id < "+arg(f.Before))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	rows, err := pool.Query(ctx, `
+		SELECT id, created_at, actor_id, actor_email, action, target, ip, details
+		FROM audit_events `+where+`
+		ORDER BY id DESC
+		LIMIT `+arg(f.Limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.AuditEvent
+	for rows.Next() {
+		e := &models.AuditEvent{}
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorEmail, &e.Action, &e.Target, &e.IP, &e.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// InsertAuditDeadLetter met l'événement en attente pour le sink. Un événement
+// déjà en attente pour ce sink n'est pas dupliqué.
+func InsertAuditDeadLetter(ctx context.Context, pool *pgxpool.Pool, sink string, eventID int64, attempts int, lastErr string) error {
+	_, err := pool.Exec(ctx, `
+		INSERT INTO audit_dead_letters (sink, event_id, attempts, last_error)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (sink, event_id) DO UPDATE
+		SET attempts = audit_dead_letters.attempts + EXCLUDED.attempts,
+		    last_error = EXCLUDED.last_error, last_attempt = NOW()
+	`, sink, eventID, attempts, lastErr)
+	return err
+}
+
+// ListAuditDeadLetters retourne les plus anciens événements en attente pour le sink.
+func ListAuditDeadLetters(ctx context.Context, pool *pgxpool.Pool, sink string, limit int) ([]*models.AuditDeadLetter, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT d.id, d.attempts,
+		       e.id, e.created_at, e.actor_id, e.actor_email, e.action, e.target, e.ip, e.details
+		FROM audit_dead_letters d
+		JOIN audit_events e ON e.id = d.event_id
+		WHERE d.sink = $1
+		ORDER BY d.event_id
+		LIMIT $2
+	`, sink, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []*models.AuditDeadLetter
+	for rows.Next() {
+		e := &models.AuditEvent{}
+		l := &models.AuditDeadLetter{Event: e}
+		if err := rows.Scan(&l.ID, &l.Attempts, &e.ID, &e.CreatedAt, &e.ActorID, &e.ActorEmail, &e.Action, &e.Target, &e.IP, &e.Details); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
+
+func DeleteAuditDeadLetter(ctx context.Context, pool *pgxpool.Pool, id int64) error {
+	_, err := pool.Exec(ctx, `DELETE FROM audit_dead_letters WHERE id = $1`, id)
+	return err
+}
+
+func FailAuditDeadLetter(ctx context.Context, pool *pgxpool.Pool, id int64, lastErr string) error {
+	_, err := pool.Exec(ctx, `
+		UPDATE audit_dead_letters
+		SET attempts = attempts + 1, last_error = $2, last_attempt = NOW()
+		WHERE id = $1
+	`, id, lastErr)
+	return err
+}
+
+func CountAuditDeadLetters(ctx context.Context, pool *pgxpool.Pool, sink string) (int, error) {
+	var n int
+	err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM audit_dead_letters WHERE sink = $1`, sink).Scan(&n)
+	return n, err
+}
+
+// ─── Recordings ───────────────────────────────────────────────────────────────
+
+// ShouldRecordSession indique si la politique de l'utilisateur impose
+// l'enregistrement des sessions vers cet hôte.
+func ShouldRecordSession(ctx context.Context, pool *pgxpool.Pool, userID, hostID string) (bool, error) {
+	var record bool
+	err := pool.QueryRow(ctx, `
+		SELECT u.recording_mode = 'all'
+		    OR (u.recording_mode = 'selected' AND EXISTS (
+		        SELECT 1 FROM recorded_hosts rh WHERE rh.user_id = u.id AND rh.host_id = $2))
+		FROM users u WHERE u.id = $1
+	`, userID, hostID).Scan(&record)
+	return record, err
+}
+
+func SetSessionRecording(ctx context.Context, pool *pgxpool.Pool, sessionID, name string) error {
+	_, err := pool.Exec(ctx, `UPDATE sessions SET recording = $1 WHERE id = $2`, name, sessionID)
+	return err
+}
+
+// GetSessionRecording retourne le nom de l'enregistrement d'une session, ou ErrNotFound.
+func GetSessionRecording(ctx context.Context, pool *pgxpool.Pool, sessionID string) (string, error) {
+	var name *string
+	err := pool.QueryRow(ctx, `SELECT recording FROM sessions WHERE id = $1`, sessionID).Scan(&name)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && name == nil) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return *name, nil
+}
+
+func GetRecordingPolicy(ctx context.Context, pool *pgxpool.Pool, userID string) (*models.RecordingPolicy, error) {
+	policy := &models.RecordingPolicy{HostIDs: []string{}}
+	if err := pool.QueryRow(ctx, `SELECT recording_mode FROM users WHERE id = $1`, userID).Scan(&policy.Mode); err != nil {
+		return nil, err
+	}
+	rows, err := pool.Query(ctx, `SELECT host_id FROM recorded_hosts WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		policy.HostIDs = append(policy.HostIDs, id)
+	}
+	return policy, rows.Err()
+}
+
+// SetRecordingPolicy remplace la politique d'enregistrement d'un utilisateur.
+// Les hôtes qui ne lui sont pas accessibles sont ignorés.
+func SetRecordingPolicy(ctx context.Context, pool *pgxpool.Pool, userID string, policy *models.RecordingPolicy) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE users SET recording_mode = $1 WHERE id = $2`, policy.Mode, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if _, err = tx.Exec(ctx, `DELETE FROM recorded_hosts WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `
+		INSERT INTO recorded_hosts (user_id, host_id)
+		SELECT $1, h.id FROM hosts h
+		WHERE h.id = ANY($2::uuid[]) AND (h.user_id = $1 OR h.team_id IN (
+			SELECT team_id FROM team_members WHERE user_id = $1))
+	`, userID, policy.HostIDs); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,695 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+	"github.com/gestion-ssh/backend/internal/db"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5/pgxpool"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Redirection de ports multiplexée sur un WebSocket.
+//
+// Les messages de contrôle sont en JSON (frames texte). Les données d'un flux
+// circulent en frames binaires : 4 octets big-endian d'identifiant de flux
+// suivis des données. Les flux ouverts par le client ("open") utilisent des
+// identifiants < 0x80000000 ; ceux créés par le serveur pour les connexions
+// acceptées sur une redirection distante ont le bit de poids fort positionné.
+//
+// Contrôle de flux : "opened" et "accepted" annoncent la fenêtre du flux
+// (window, en octets). Le client n'a jamais plus de window octets envoyés et
+// non acquittés ; le serveur acquitte avec ack {stream_id, offset}, offset
+// étant le total des octets écrits vers la destination. Un client qui dépasse
+// la fenêtre voit son flux fermé.
+
+const (
+	// Client → Serveur
+	msgConnect  = "connect"
+	msgOpen     = "open"     // redirection locale (host/port) ou dynamique (socks5)
+	msgClose    = "close"    // ferme un flux
+	msgListen   = "listen"   // redirection distante (tcpip-forward)
+	msgUnlisten = "unlisten" // arrête une redirection distante
+
+	// Serveur → Client
+	msgConnected      = "connected"
+	msgOpened         = "opened"
+	msgAccepted       = "accepted" // nouvelle connexion sur une redirection distante
+	msgListening      = "listening"
+	msgClosed         = "closed"
+	msgAck            = "ack" // octets du client écrits vers la destination
+	msgError          = "error"
+	msgHostKeyChanged = "host_key_changed"
+)
+
+const (
+	maxStreams       = 256
+	maxListeners     = 16
+	serverStreamBit  = 0x80000000
+	streamBufferSize = 32 * 1024
+	streamWindow     = 256 * 1024 // octets du client non acquittés, par flux
+)
+
+type clientMsg struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type connectPayload struct {
+	HostID          string                   `json:"host_id"`
+	Credential      string                   `json:"credential"`
+	JumpCredentials []sshproxy.HopCredential `json:"jump_credentials"`
+}
+
+type openPayload struct {
+	StreamID uint32 `json:"stream_id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	SOCKS5   bool   `json:"socks5"` // le flux commence par une négociation SOCKS5
+}
+
+type ackPayload struct {
+	StreamID uint32 `json:"stream_id"`
+	Offset   int64  `json:"offset"`
+}
+
+type closePayload struct {
+	StreamID uint32 `json:"stream_id"`
+}
+
+type listenPayload struct {
+	BindHost string `json:"bind_host"`
+	BindPort int    `json:"bind_port"`
+}
+
+type unlistenPayload struct {
+	ListenerID string `json:"listener_id"`
+}
+
+// ── Handler WebSocket ────────────────────────────────────────────────────────
+
+type Handler struct {
+	pool     *pgxpool.Pool
+	sessions *sshproxy.Manager // registre des sessions actives (fermeture par un admin)
+	upgrader websocket.Upgrader
+}
+
+func NewHandler(pool *pgxpool.Pool, allowedOrigins []string, sessions *sshproxy.Manager) *Handler {
+	h := &Handler{pool: pool, sessions: sessions}
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  streamBufferSize,
+		WriteBufferSize: streamBufferSize,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range allowedOrigins {
+				if origin == strings.TrimSpace(allowed) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return h
+}
+
+// writeWait borne chaque écriture sur le WebSocket : un client qui ne lit plus
+// ne doit pas bloquer indéfiniment les flux ni la fermeture par un admin.
+const writeWait = 10 * time.Second
+
+// conn encapsule le WebSocket avec un mutex d'écriture.
+type conn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// write envoie un message sous le mutex ; en cas d'échec (deadline dépassée
+// comprise) le WebSocket est fermé, ce qui termine la boucle de lecture et
+// ferme les flux du tunnel.
+func (c *conn) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		c.ws.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *conn) send(msgType string, payload any) {
+	type outMsg struct {
+		Type    string `json:"type"`
+		Payload any    `json:"payload"`
+	}
+	data, _ := json.Marshal(outMsg{Type: msgType, Payload: payload})
+	c.write(websocket.TextMessage, data)
+}
+
+func (c *conn) sendError(msg string) {
+	c.send(msgError, map[string]string{"message": msg})
+}
+
+func (c *conn) sendData(streamID uint32, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, streamID)
+	copy(frame[4:], data)
+	return c.write(websocket.BinaryMessage, frame)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	wsConn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("forward ws upgrade: %v", err)
+		return
+	}
+	defer wsConn.Close()
+
+	c := &conn{ws: wsConn}
+
+	// Premier message : connect
+	_, raw, err := wsConn.ReadMessage()
+	if err != nil {
+		return
+	}
+	var first clientMsg
+	if err := json.Unmarshal(raw, &first); err != nil || first.Type != msgConnect {
+		c.sendError("expected connect message")
+		return
+	}
+
+	var cp connectPayload
+	if err := json.Unmarshal(first.Payload, &cp); err != nil || cp.HostID == "" || cp.Credential == "" {
+		c.sendError("invalid connect payload")
+		return
+	}
+
+	hosts, err := db.GetHostChain(r.Context(), h.pool, cp.HostID, user.UserID)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidJumpChain) {
+			c.sendError("invalid jump host chain")
+			return
+		}
+		c.sendError("host not found")
+		return
+	}
+	host := hosts[len(hosts)-1]
+
+	chain, err := sshproxy.DialChain(r.Context(), h.pool, hosts, sshproxy.ChainCredentials(host.ID, cp.Credential, cp.JumpCredentials))
+	if err != nil {
+		if hkErr, ok := sshproxy.AsHostKeyChanged(err); ok {
+			c.send(msgHostKeyChanged, hkErr.Payload())
+			return
+		}
+		if errors.Is(err, sshproxy.ErrInvalidPrivateKey) || errors.Is(err, sshproxy.ErrMissingCredential) {
+			c.sendError(err.Error())
+			return
+		}
+		c.sendError(fmt.Sprintf("connection failed: %v", err))
+		return
+	}
+	defer chain.Close()
+
+	// Utiliser X-Real-IP (positionné par nginx) plutôt que X-Forwarded-For (falsifiable)
+	clientIP := r.RemoteAddr
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		clientIP = realIP
+	}
+	sessionID, err := db.CreateSession(context.Background(), h.pool, user.UserID, host.ID, clientIP, "forward")
+	if err != nil {
+		// Sans ligne de session, les redirections ne pourraient pas être auditées.
+		log.Printf("forward: failed to create session record: %v", err)
+		c.sendError("failed to create session")
+		return
+	}
+	defer db.CloseSession(context.Background(), h.pool, sessionID)
+	untrack := h.sessions.Track(sessionID, user.UserID, func(reason string) {
+		c.send(msgClosed, map[string]string{"reason": reason})
+		wsConn.Close()
+	})
+	defer untrack()
+
+	t := &tunnel{
+		c:         c,
+		pool:      h.pool,
+		client:    chain.Target,
+		sessionID: sessionID,
+		tag:       fmt.Sprintf("[forward=%s host=%s]", sessionID[:8], host.Name),
+		streams:   make(map[uint32]*stream),
+		listeners: make(map[string]*listener),
+	}
+	defer t.closeAll()
+
+	log.Printf("%s tunnel started (user=%s ip=%s)", t.tag, user.UserID, clientIP)
+	audit.Record(r.Context(), h.pool, audit.Event{
+		ActorID:    user.UserID,
+		ActorEmail: user.Email,
+		Action:     audit.ActionForward,
+		Target:     host.ID,
+		IP:         clientIP,
+		Details:    map[string]interface{}{"session_id": sessionID, "host": host.Name, "hostname": host.Hostname},
+	})
+	c.send(msgConnected, map[string]string{"session_id": sessionID, "host_name": host.Name})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go t.keepalive(ctx)
+
+	for {
+		msgType, raw, err := wsConn.ReadMessage()
+		if err != nil {
+			log.Printf("%s ws closed: %v", t.tag, err)
+			return
+		}
+
+		if msgType == websocket.BinaryMessage {
+			t.write(raw)
+			continue
+		}
+
+		var msg clientMsg
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			continue
+		}
+
+		switch msg.Type {
+		case msgOpen:
+			var p openPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid open payload")
+				continue
+			}
+			t.open(p)
+
+		case msgClose:
+			var p closePayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid close payload")
+				continue
+			}
+			t.closeStream(p.StreamID)
+
+		case msgListen:
+			var p listenPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid listen payload")
+				continue
+			}
+			t.listen(p)
+
+		case msgUnlisten:
+			var p unlistenPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid unlisten payload")
+				continue
+			}
+			t.unlisten(p.ListenerID)
+		}
+	}
+}
+
+// ── Tunnel ───────────────────────────────────────────────────────────────────
+
+// tunnel regroupe les flux et redirections distantes d'une connexion WebSocket.
+type tunnel struct {
+	c         *conn
+	pool      *pgxpool.Pool
+	client    *gossh.Client
+	sessionID string
+	tag       string
+
+	mu           sync.Mutex
+	streams      map[uint32]*stream
+	listeners    map[string]*listener
+	nextServerID uint32
+	nextListener int
+}
+
+// stream est un flux TCP relayé. conn est, selon le cas, le canal SSH vers la
+// destination, l'extrémité locale d'un pipe SOCKS5 ou une connexion acceptée.
+// Les données du client s'accumulent dans pending, vidé par une goroutine
+// propre au flux : une destination lente ne bloque pas la lecture du
+// WebSocket. La fenêtre annoncée au client borne pending à streamWindow octets.
+type stream struct {
+	id    uint32
+	conn  net.Conn
+	ready chan struct{} // signale des données dans pending
+	done  chan struct{} // fermé avec le flux
+
+	pendingMu sync.Mutex
+	pending   []byte
+
+	// Protégés par tunnel.mu une fois le flux enregistré
+	forwardID string // ligne session_forwards à laquelle imputer le trafic
+	closeRow  bool   // le flux porte sa propre ligne (local/dynamique)
+
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	closeOnce sync.Once
+}
+
+func newStream(id uint32, c net.Conn) *stream {
+	return &stream{id: id, conn: c, ready: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+type listener struct {
+	id        string
+	ln        net.Listener
+	forwardID string
+}
+
+func (t *tunnel) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.c.write(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			if _, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				log.Printf("%s ssh-keepalive failed: %v", t.tag, err)
+				t.c.ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// register ajoute un flux et démarre l'écriture vers sa destination ; retourne
+// false si l'identifiant est pris ou la limite atteinte.
+func (t *tunnel) register(s *stream) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.streams[s.id]; exists || len(t.streams) >= maxStreams {
+		return false
+	}
+	t.streams[s.id] = s
+	go t.drain(s)
+	return true
+}
+
+// attach impute le trafic du flux à la ligne forwardID, fermée avec lui. Si
+// le flux a déjà été fermé, la ligne est fermée aussitôt.
+func (t *tunnel) attach(s *stream, forwardID string) {
+	t.mu.Lock()
+	open := t.streams[s.id] == s
+	if open {
+		s.forwardID, s.closeRow = forwardID, true
+	}
+	t.mu.Unlock()
+	if !open {
+		t.finish(forwardID, 0, 0, true)
+	}
+}
+
+func (t *tunnel) open(p openPayload) {
+	if p.StreamID == 0 || p.StreamID&serverStreamBit != 0 {
+		t.c.sendError("invalid stream_id")
+		return
+	}
+	if !p.SOCKS5 && (p.Host == "" || p.Port <= 0 || p.Port > 65535) {
+		t.c.send(msgClosed, map[string]any{"stream_id": p.StreamID, "error": "host and port are required"})
+		return
+	}
+
+	if p.SOCKS5 {
+		// Le client parle SOCKS5 sur le flux ; la négociation est faite côté serveur.
+		local, remote := net.Pipe()
+		s := newStream(p.StreamID, local)
+		if !t.register(s) {
+			local.Close()
+			remote.Close()
+			t.c.send(msgClosed, map[string]any{"stream_id": p.StreamID, "error": "stream unavailable"})
+			return
+		}
+		t.c.send(msgOpened, map[string]any{"stream_id": p.StreamID, "window": streamWindow})
+		go t.pump(s)
+		go t.serveSOCKS5(s, remote)
+		return
+	}
+
+	// Dial en arrière-plan pour ne pas bloquer la boucle de lecture du WebSocket.
+	go func() {
+		addr := net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+		target, err := t.client.Dial("tcp", addr)
+		if err != nil {
+			t.c.send(msgClosed, map[string]any{"stream_id": p.StreamID, "error": err.Error()})
+			return
+		}
+		s := newStream(p.StreamID, target)
+		if !t.register(s) {
+			target.Close()
+			t.c.send(msgClosed, map[string]any{"stream_id": p.StreamID, "error": "stream unavailable"})
+			return
+		}
+		t.attach(s, t.record("local", addr))
+		log.Printf("%s local forward opened: stream=%d → %s", t.tag, p.StreamID, addr)
+		t.c.send(msgOpened, map[string]any{"stream_id": p.StreamID, "window": streamWindow})
+		t.pump(s)
+	}()
+}
+
+func (t *tunnel) listen(p listenPayload) {
+	if p.BindPort < 0 || p.BindPort > 65535 {
+		t.c.sendError("invalid bind_port")
+		return
+	}
+	bindHost := p.BindHost
+	if bindHost == "" {
+		bindHost = "localhost"
+	}
+	addr := net.JoinHostPort(bindHost, strconv.Itoa(p.BindPort))
+
+	t.mu.Lock()
+	if len(t.listeners) >= maxListeners {
+		t.mu.Unlock()
+		t.c.sendError("too many remote forwards")
+		return
+	}
+	t.nextListener++
+	id := strconv.Itoa(t.nextListener)
+	t.mu.Unlock()
+
+	ln, err := t.client.Listen("tcp", addr)
+	if err != nil {
+		t.c.sendError(fmt.Sprintf("listen %s: %v", addr, err))
+		return
+	}
+	l := &listener{id: id, ln: ln, forwardID: t.record("remote", ln.Addr().String())}
+	t.mu.Lock()
+	t.listeners[id] = l
+	t.mu.Unlock()
+
+	log.Printf("%s remote forward listening on %s", t.tag, ln.Addr())
+	t.c.send(msgListening, map[string]string{"listener_id": id, "address": ln.Addr().String()})
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.mu.Lock()
+			t.nextServerID++
+			sid := serverStreamBit | t.nextServerID
+			t.mu.Unlock()
+
+			s := newStream(sid, nc)
+			s.forwardID = l.forwardID
+			if !t.register(s) {
+				nc.Close()
+				continue
+			}
+			t.c.send(msgAccepted, map[string]any{
+				"listener_id": id,
+				"stream_id":   sid,
+				"origin":      nc.RemoteAddr().String(),
+				"window":      streamWindow,
+			})
+			go t.pump(s)
+		}
+	}()
+}
+
+func (t *tunnel) unlisten(id string) {
+	t.mu.Lock()
+	l, ok := t.listeners[id]
+	delete(t.listeners, id)
+	t.mu.Unlock()
+	if !ok {
+		t.c.sendError("unknown listener_id")
+		return
+	}
+	l.ln.Close()
+	t.finish(l.forwardID, 0, 0, true)
+	t.c.send(msgClosed, map[string]string{"listener_id": id})
+}
+
+// pump relaie les données du flux vers le WebSocket jusqu'à sa fermeture.
+func (t *tunnel) pump(s *stream) {
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			s.bytesIn.Add(int64(n))
+			if werr := t.c.sendData(s.id, buf[:n]); werr != nil {
+				t.closeStream(s.id)
+				return
+			}
+		}
+		if err != nil {
+			t.closeStream(s.id)
+			return
+		}
+	}
+}
+
+// write met en attente une frame binaire du client pour le flux
+// correspondant. Un client qui dépasse la fenêtre du flux enfreint le
+// contrôle de flux : le flux est fermé.
+func (t *tunnel) write(frame []byte) {
+	if len(frame) < 4 {
+		return
+	}
+	id := binary.BigEndian.Uint32(frame)
+	t.mu.Lock()
+	s := t.streams[id]
+	t.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.pendingMu.Lock()
+	overflow := len(s.pending)+len(frame)-4 > streamWindow
+	if !overflow {
+		s.pending = append(s.pending, frame[4:]...)
+	}
+	s.pendingMu.Unlock()
+	if overflow {
+		log.Printf("%s stream=%d: flow control window exceeded, closing", t.tag, id)
+		t.closeStreamError(id, "flow control window exceeded")
+		return
+	}
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drain écrit vers la destination les données du client en attente, puis les
+// acquitte pour rouvrir la fenêtre.
+func (t *tunnel) drain(s *stream) {
+	for {
+		select {
+		case <-s.ready:
+			s.pendingMu.Lock()
+			data := s.pending
+			s.pending = nil
+			s.pendingMu.Unlock()
+			if len(data) == 0 {
+				continue
+			}
+			if _, err := s.conn.Write(data); err != nil {
+				t.closeStream(s.id)
+				return
+			}
+			t.c.send(msgAck, ackPayload{StreamID: s.id, Offset: s.bytesOut.Add(int64(len(data)))})
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (t *tunnel) closeStream(id uint32) {
+	t.closeStreamError(id, "")
+}
+
+// closeStreamError ferme le flux ; errMsg, si non vide, accompagne le message
+// closed envoyé au client.
+func (t *tunnel) closeStreamError(id uint32, errMsg string) {
+	t.mu.Lock()
+	s := t.streams[id]
+	delete(t.streams, id)
+	var forwardID string
+	var closeRow bool
+	if s != nil {
+		forwardID, closeRow = s.forwardID, s.closeRow
+	}
+	t.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+		t.finish(forwardID, s.bytesIn.Load(), s.bytesOut.Load(), closeRow)
+		closed := map[string]any{"stream_id": id}
+		if errMsg != "" {
+			closed["error"] = errMsg
+		}
+		t.c.send(msgClosed, closed)
+	})
+}
+
+func (t *tunnel) closeAll() {
+	t.mu.Lock()
+	ids := make([]uint32, 0, len(t.streams))
+	for id := range t.streams {
+		ids = append(ids, id)
+	}
+	listeners := t.listeners
+	t.listeners = make(map[string]*listener)
+	t.mu.Unlock()
+
+	for _, id := range ids {
+		t.closeStream(id)
+	}
+	for _, l := range listeners {
+		l.ln.Close()
+		t.finish(l.forwardID, 0, 0, true)
+	}
+	log.Printf("%s tunnel closed", t.tag)
+}
+
+// record enregistre une redirection pour l'audit et retourne son identifiant.
+func (t *tunnel) record(kind, address string) string {
+	id, err := db.CreateForward(context.Background(), t.pool, t.sessionID, kind, address)
+	if err != nil {
+		log.Printf("%s failed to record %s forward to %s: %v", t.tag, kind, address, err)
+	}
+	return id
+}
+
+func (t *tunnel) finish(forwardID string, bytesIn, bytesOut int64, closed bool) {
+	if forwardID == "" {
+		return
+	}
+	if err := db.AddForwardBytes(context.Background(), t.pool, forwardID, bytesIn, bytesOut, closed); err != nil {
+		log.Printf("%s failed to update forward %s: %v", t.tag, forwardID, err)
+	}
+}
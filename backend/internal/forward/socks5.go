@@ -0,0 +1,149 @@
+package forward
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Négociation SOCKS5 (RFC 1928) côté serveur pour la redirection dynamique :
+// seule la méthode sans authentification et la commande CONNECT sont acceptées,
+// l'utilisateur étant déjà authentifié sur le WebSocket.
+
+const (
+	socksVersion     = 0x05
+	socksNoAuth      = 0x00
+	socksNoMethod    = 0xFF
+	socksCmdConnect  = 0x01
+	socksAtypIPv4    = 0x01
+	socksAtypDomain  = 0x03
+	socksAtypIPv6    = 0x04
+	socksReplyOK     = 0x00
+	socksReplyFail   = 0x01
+	socksReplyNoCmd  = 0x07
+	socksReplyNoAtyp = 0x08
+)
+
+var errSOCKS = errors.New("invalid socks5 request")
+
+// serveSOCKS5 négocie sur pipe (l'autre extrémité du flux s), ouvre la
+// connexion demandée via SSH puis relaie les données dans les deux sens.
+func (t *tunnel) serveSOCKS5(s *stream, pipe net.Conn) {
+	defer pipe.Close()
+
+	addr, err := socksHandshake(pipe)
+	if err != nil {
+		log.Printf("%s socks5 stream=%d: %v", t.tag, s.id, err)
+		t.closeStream(s.id)
+		return
+	}
+
+	target, err := t.client.Dial("tcp", addr)
+	if err != nil {
+		socksReply(pipe, socksReplyFail)
+		t.closeStream(s.id)
+		return
+	}
+	defer target.Close()
+	if err := socksReply(pipe, socksReplyOK); err != nil {
+		t.closeStream(s.id)
+		return
+	}
+
+	t.attach(s, t.record("dynamic", addr))
+	log.Printf("%s dynamic forward opened: stream=%d → %s", t.tag, s.id, addr)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, pipe)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(pipe, target)
+		done <- struct{}{}
+	}()
+	<-done
+	t.closeStream(s.id)
+}
+
+// socksHandshake lit le greeting et la requête CONNECT et retourne l'adresse cible.
+func socksHandshake(rw io.ReadWriter) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSOCKS
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socksNoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		rw.Write([]byte{socksVersion, socksNoMethod})
+		return "", errors.New("socks5: no acceptable auth method")
+	}
+	if _, err := rw.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(rw, req); err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", errSOCKS
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(rw, socksReplyNoCmd)
+		return "", errors.New("socks5: only CONNECT is supported")
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if req[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(rw, l); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(rw, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		socksReply(rw, socksReplyNoAtyp)
+		return "", errSOCKS
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rw, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply répond avec une adresse liée nulle (0.0.0.0:0) : le client n'en a pas l'usage.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	ID           string    `json:"id"`
@@ -8,14 +11,18 @@ type User struct {
 	PasswordHash string    `json:"-"`
 	KDFSalt      []byte    `json:"kdf_salt"`
 	KDFParams    []byte    `json:"kdf_params"`
-	IsAdmin      bool      `json:"is_admin"`
+	IsAdmin      bool      `json:"is_admin"` // role = 'admin', conservé pour compatibilité
+	Role         string    `json:"role"`
 	TOTPEnabled  bool      `json:"totp_enabled"`
+	AuthSource   string    `json:"auth_source"` // "local" ou "oidc"
+	Disabled     bool      `json:"disabled"`    // compte désactivé par un administrateur
 	CreatedAt    time.Time `json:"created_at"`
 }
 
 type Host struct {
 	ID            string    `json:"id"`
-	UserID        string    `json:"user_id"`
+	UserID        *string   `json:"user_id"` // nil pour un hôte d'équipe
+	TeamID        *string   `json:"team_id"`
 	Name          string    `json:"name"`
 	Hostname      string    `json:"hostname"`
 	Port          int       `json:"port"`
@@ -25,8 +32,12 @@ type Host struct {
 	IV            []byte    `json:"iv"`
 	Tags          []string  `json:"tags"`
 	Icon          string    `json:"icon"`
+	JumpHostID    *string   `json:"jump_host_id"`
 	CreatedAt     time.Time `json:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	// Hôte d'équipe : copie du credential propre au membre qui consulte
+	MemberEncryptedCred []byte `json:"member_encrypted_cred,omitempty"`
+	MemberIV            []byte `json:"member_iv,omitempty"`
 }
 
 type CreateHostInput struct {
@@ -39,6 +50,22 @@ type CreateHostInput struct {
 	IV            []byte   `json:"iv"`
 	Tags          []string `json:"tags"`
 	Icon          string   `json:"icon"`
+	JumpHostID    *string  `json:"jump_host_id"`
+	TeamID        *string  `json:"team_id"` // création uniquement
+}
+
+// HostKey est la clé d'hôte SSH épinglée pour un hôte (trust-on-first-use).
+type HostKey struct {
+	HostID             string     `json:"host_id"`
+	KeyType            string     `json:"key_type"`
+	PublicKey          []byte     `json:"public_key"`
+	Fingerprint        string     `json:"fingerprint"`
+	PendingKeyType     *string    `json:"pending_key_type,omitempty"`
+	PendingPublicKey   []byte     `json:"pending_public_key,omitempty"`
+	PendingFingerprint *string    `json:"pending_fingerprint,omitempty"`
+	PendingSeenAt      *time.Time `json:"pending_seen_at,omitempty"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
 }
 
 type Credential struct {
@@ -51,6 +78,13 @@ type Credential struct {
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// VaultEntry est un secret rechiffré par le client lors d'un changement de clé maître.
+type VaultEntry struct {
+	ID            string
+	EncryptedCred []byte
+	IV            []byte
+}
+
 type CreateCredentialInput struct {
 	Name          string `json:"name"`
 	Type          string `json:"type"`
@@ -67,6 +101,75 @@ type Session struct {
 	ClientIP  string     `json:"client_ip"`
 }
 
+// WebAuthnCredential est une clé de sécurité (passkey) enregistrée comme second facteur.
+type WebAuthnCredential struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"-"`
+	Data         []byte     `json:"-"` // webauthn.Credential sérialisé
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+// LoginSession est une connexion d'un utilisateur (un navigateur / appareil).
+type LoginSession struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	RememberMe bool      `json:"remember_me"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// APIToken est un jeton d'accès personnel ; le secret n'est jamais conservé.
+type APIToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Role est un rôle et les permissions qu'il accorde (voir auth.Perm*).
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	Builtin     bool     `json:"builtin"`
+	UserCount   int      `json:"user_count"`
+}
+
+// Team est une équipe vue par l'un de ses membres (rôle et clé d'équipe de ce membre).
+type Team struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	Role             string    `json:"role"`
+	EncryptedTeamKey []byte    `json:"encrypted_team_key"`
+	MemberCount      int       `json:"member_count"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type TeamMember struct {
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	HasKey    bool      `json:"has_key"`    // clé d'équipe partagée avec ce membre
+	PublicKey []byte    `json:"public_key"` // pour lui (re)partager la clé d'équipe
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserKeyPair est la paire de clés de partage d'un utilisateur.
+type UserKeyPair struct {
+	PublicKey           []byte `json:"public_key"`
+	EncryptedPrivateKey []byte `json:"encrypted_private_key"`
+	PrivateKeyIV        []byte `json:"private_key_iv"`
+}
+
 type SessionWithDetails struct {
 	ID           string     `json:"id"`
 	UserEmail    string     `json:"user_email"`
@@ -75,4 +178,57 @@ type SessionWithDetails struct {
 	StartedAt    time.Time  `json:"started_at"`
 	EndedAt      *time.Time `json:"ended_at"`
 	ClientIP     string     `json:"client_ip"`
+	Kind         string     `json:"kind"` // "terminal" | "sftp" | "forward"
+	HasRecording bool       `json:"has_recording"`
+	TerminatedBy *string    `json:"terminated_by"` // administrateur ayant fermé la session
+}
+
+// AuditEvent est une action de sécurité enregistrée dans le journal d'audit.
+// ActorID est nil pour une action anonyme (ex. échec de connexion) ; l'email est
+// conservé même après suppression du compte.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *string         `json:"actor_id"`
+	ActorEmail string          `json:"actor_email"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target"`
+	IP         string          `json:"ip"`
+	Details    json.RawMessage `json:"details"`
+}
+
+// AuditDeadLetter est un événement en attente de redélivraison vers un sink.
+type AuditDeadLetter struct {
+	ID       int64
+	Attempts int
+	Event    *AuditEvent
+}
+
+// AuditFilter restreint la lecture du journal d'audit. Les champs vides ne
+// filtrent pas ; Before est le curseur (id du dernier événement déjà lu).
+type AuditFilter struct {
+	Actor  string // id ou email
+	Action string // action exacte, ou préfixe terminé par "." (ex. "auth.")
+	Since  *time.Time
+	Until  *time.Time
+	Before int64
+	Limit  int
+}
+
+// SessionForward est une redirection de ports ouverte pendant une session.
+type SessionForward struct {
+	ID        string     `json:"id"`
+	SessionID string     `json:"session_id"`
+	Kind      string     `json:"kind"` // "local" | "remote" | "dynamic"
+	Address   string     `json:"address"`
+	OpenedAt  time.Time  `json:"opened_at"`
+	ClosedAt  *time.Time `json:"closed_at"`
+	BytesIn   int64      `json:"bytes_in"`
+	BytesOut  int64      `json:"bytes_out"`
+}
+
+// RecordingPolicy définit quelles sessions d'un utilisateur sont enregistrées.
+type RecordingPolicy struct {
+	Mode    string   `json:"mode"` // "off" | "all" | "selected"
+	HostIDs []string `json:"host_ids"`
 }
@@ -0,0 +1,202 @@
+// Package oidctest fournit un fournisseur OpenID Connect local (découverte,
+// JWKS, endpoint token avec PKCE) pour les tests du client et du callback SSO.
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type Server struct {
+	*httptest.Server
+	ClientID string
+
+	// AnnouncedIssuer, s'il est défini, remplace l'issuer du document de découverte.
+	AnnouncedIssuer string
+
+	mu          sync.Mutex
+	keys        []signingKey // la première signe les nouveaux tokens
+	codes       map[string]authCode
+	jwksFetches int
+}
+
+type signingKey struct {
+	kid  string
+	priv *ecdsa.PrivateKey
+}
+
+type authCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+// NewServer démarre le fournisseur ; il est arrêté à la fin du test.
+func NewServer(t testing.TB, clientID string) *Server {
+	t.Helper()
+	s := &Server{ClientID: clientID, codes: make(map[string]authCode)}
+	s.RotateKey()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", s.jwks)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// Kid retourne l'identifiant de la clé de signature courante.
+func (s *Server) Kid() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[0].kid
+}
+
+// RotateKey publie une nouvelle clé de signature ; les précédentes restent dans
+// le JWKS, comme pendant une rotation réelle.
+func (s *Server) RotateKey() {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kid := fmt.Sprintf("key-%d", len(s.keys)+1)
+	s.keys = append([]signingKey{{kid: kid, priv: priv}}, s.keys...)
+}
+
+// JWKSFetches retourne le nombre de téléchargements du JWKS.
+func (s *Server) JWKSFetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jwksFetches
+}
+
+// Claims retourne des claims valides pour le client, avec le nonce donné.
+func (s *Server) Claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   s.Issuer(),
+		"aud":   s.ClientID,
+		"sub":   "subject-1",
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+}
+
+// Sign signe les claims avec la clé courante (ES256).
+func (s *Server) Sign(claims jwt.MapClaims) string {
+	s.mu.Lock()
+	k := s.keys[0]
+	s.mu.Unlock()
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	tok.Header["kid"] = k.kid
+	raw, err := tok.SignedString(k.priv)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// Authorize simule l'étape navigateur : elle lit le challenge PKCE et le nonce
+// de l'URL d'autorisation et retourne un code à usage unique. edit, s'il est
+// non nil, modifie les claims de l'ID token qui sera émis pour ce code.
+func (s *Server) Authorize(t testing.TB, authURL string, edit func(jwt.MapClaims)) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse auth url: %v", err)
+	}
+	q := u.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+	claims := s.Claims(q.Get("nonce"))
+	if edit != nil {
+		edit(claims)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	s.mu.Lock()
+	s.codes[code] = authCode{challenge: q.Get("code_challenge"), claims: claims}
+	s.mu.Unlock()
+	return code
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := s.Issuer()
+	if s.AnnouncedIssuer != "" {
+		issuer = s.AnnouncedIssuer
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.jwksFetches++
+	keys := make([]map[string]string, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, map[string]string{
+			"kid": k.kid,
+			"kty": "EC",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(k.priv.PublicKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(k.priv.PublicKey.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	s.mu.Lock()
+	c, ok := s.codes[r.PostForm.Get("code")]
+	delete(s.codes, r.PostForm.Get("code"))
+	s.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("client_id") != s.ClientID ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "opaque",
+		"token_type":   "Bearer",
+		"id_token":     s.Sign(c.claims),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
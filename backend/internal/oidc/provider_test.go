@@ -0,0 +1,201 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/oidc"
+	"github.com/gestion-ssh/backend/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const clientID = "nexterm"
+
+func newProvider(idp *oidctest.Server) *oidc.Provider {
+	return oidc.NewProvider(idp.Issuer(), clientID, "", "https://app.example/api/auth/oidc/callback", []string{"openid", "email"})
+}
+
+// login déroule AuthCodeURL → Authorize → Exchange et retourne l'ID token brut.
+func login(t *testing.T, idp *oidctest.Server, p *oidc.Provider, nonce, verifier string, edit func(jwt.MapClaims)) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code := idp.Authorize(t, authURL, edit)
+	return p.Exchange(ctx, code, verifier)
+}
+
+func TestLoginFlow(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	p := newProvider(idp)
+
+	raw, err := login(t, idp, p, "nonce-1", "verifier-1", func(c jwt.MapClaims) {
+		c["email"] = "alice@example.com"
+		c["email_verified"] = "true"
+		c["groups"] = []string{"ops", "admins"}
+	})
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := p.VerifyIDToken(context.Background(), raw, "nonce-1")
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if g := claims.StringList("groups"); len(g) != 2 || g[1] != "admins" {
+		t.Fatalf("groups = %v", g)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	authURL, err := newProvider(idp).AuthCodeURL(context.Background(), "st", "nn", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if q.Get("state") != "st" || q.Get("nonce") != "nn" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected query %v", q)
+	}
+	if q.Get("code_challenge") == "verifier" {
+		t.Fatal("verifier sent in clear")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	p := newProvider(idp)
+	authURL, err := p.AuthCodeURL(context.Background(), "state", "nonce", "good-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.Authorize(t, authURL, nil)
+	if _, err := p.Exchange(context.Background(), code, "other-verifier"); err == nil {
+		t.Fatal("exchange accepted a mismatched PKCE verifier")
+	}
+	// Le code est à usage unique, même après un échec.
+	if _, err := p.Exchange(context.Background(), code, "good-verifier"); err == nil {
+		t.Fatal("exchange accepted a replayed code")
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	p := newProvider(idp)
+	ctx := context.Background()
+
+	forged, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name  string
+		token func() string
+		nonce string
+	}{
+		{"wrong issuer", func() string {
+			c := idp.Claims("n")
+			c["iss"] = "https://evil.example"
+			return idp.Sign(c)
+		}, "n"},
+		{"wrong audience", func() string {
+			c := idp.Claims("n")
+			c["aud"] = "other-client"
+			return idp.Sign(c)
+		}, "n"},
+		{"expired", func() string {
+			c := idp.Claims("n")
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+			return idp.Sign(c)
+		}, "n"},
+		{"missing exp", func() string {
+			c := idp.Claims("n")
+			delete(c, "exp")
+			return idp.Sign(c)
+		}, "n"},
+		{"nonce mismatch", func() string { return idp.Sign(idp.Claims("n")) }, "other"},
+		{"missing nonce", func() string { return idp.Sign(idp.Claims("")) }, ""},
+		{"missing sub", func() string {
+			c := idp.Claims("n")
+			delete(c, "sub")
+			return idp.Sign(c)
+		}, "n"},
+		{"HS256", func() string {
+			tok := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.Claims("n"))
+			tok.Header["kid"] = idp.Kid()
+			raw, _ := tok.SignedString([]byte(clientID))
+			return raw
+		}, "n"},
+		{"alg none", func() string {
+			raw, _ := jwt.NewWithClaims(jwt.SigningMethodNone, idp.Claims("n")).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return raw
+		}, "n"},
+		{"forged key with known kid", func() string {
+			tok := jwt.NewWithClaims(jwt.SigningMethodES256, idp.Claims("n"))
+			tok.Header["kid"] = idp.Kid()
+			raw, _ := tok.SignedString(forged)
+			return raw
+		}, "n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.VerifyIDToken(ctx, tt.token(), tt.nonce)
+			if !errors.Is(err, oidc.ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestKeyRotationRefetchesJWKS(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	p := newProvider(idp)
+	ctx := context.Background()
+
+	if _, err := p.VerifyIDToken(ctx, idp.Sign(idp.Claims("n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if n := idp.JWKSFetches(); n != 1 {
+		t.Fatalf("jwks fetched %d times, want 1", n)
+	}
+	if _, err := p.VerifyIDToken(ctx, idp.Sign(idp.Claims("n")), "n"); err != nil {
+		t.Fatal(err)
+	}
+	if n := idp.JWKSFetches(); n != 1 {
+		t.Fatalf("known kid refetched the jwks (%d fetches)", n)
+	}
+
+	idp.RotateKey()
+	if _, err := p.VerifyIDToken(ctx, idp.Sign(idp.Claims("n")), "n"); err != nil {
+		t.Fatalf("token signed with rotated key: %v", err)
+	}
+	if n := idp.JWKSFetches(); n != 2 {
+		t.Fatalf("jwks fetched %d times after rotation, want 2", n)
+	}
+
+	// Un kid absent du JWKS rechargé reste refusé.
+	forged, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, idp.Claims("n"))
+	tok.Header["kid"] = "unknown"
+	raw, _ := tok.SignedString(forged)
+	if _, err := p.VerifyIDToken(ctx, raw, "n"); !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Fatalf("unknown kid: err = %v", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := oidctest.NewServer(t, clientID)
+	idp.AnnouncedIssuer = "https://evil.example"
+	if _, err := newProvider(idp).AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+		t.Fatal("discovery accepted a foreign issuer")
+	}
+}
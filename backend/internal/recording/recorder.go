@@ -0,0 +1,89 @@
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Recorder enregistre un flux de terminal au format asciicast v2 :
+// une ligne d'en-tête JSON puis un événement [temps, type, données] par ligne.
+// Seule la sortie ("o") et les redimensionnements ("r") sont enregistrés ;
+// la saisie n'est jamais écrite (elle peut contenir des mots de passe).
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.WriteCloser
+	start  time.Time
+	closed bool
+}
+
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Start crée l'enregistrement name dans store et écrit l'en-tête asciicast.
+func Start(store Storage, name string, cols, rows int, title string) (*Recorder, error) {
+	w, err := store.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	data, err := json.Marshal(header{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: now.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &Recorder{w: w, start: now}, nil
+}
+
+// Output enregistre un bloc de sortie du terminal (stdout ou stderr).
+func (r *Recorder) Output(data []byte) {
+	r.event("o", string(data))
+}
+
+// Resize enregistre un changement de taille du terminal.
+func (r *Recorder) Resize(cols, rows int) {
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *Recorder) event(kind, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]any{elapsed, kind, data})
+	if err != nil {
+		return
+	}
+	r.w.Write(append(line, '\n'))
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.w.Close()
+}
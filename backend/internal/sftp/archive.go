@@ -0,0 +1,361 @@
+package sftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
+)
+
+// Téléchargement d'un répertoire en archive tar.gz ou zip.
+//
+// GET /api/sftp/archive?session=…&id=…&path=…&format=tar.gz|zip
+//
+//	&include=…&exclude=… (répétables) &max_size=…
+//
+// L'archive est produite à la volée à partir de la connexion SFTP d'un
+// WebSocket ouvert (session = session_id du message connected) : rien n'est
+// mis en mémoire ni sur disque. L'opération porte l'identifiant id côté
+// WebSocket, y émet des op_progress et s'annule avec cancel.
+//
+// Un motif sans "/" s'applique au nom de l'entrée, sinon à son chemin relatif
+// au répertoire archivé (syntaxe de path.Match). Un répertoire exclu n'est pas
+// parcouru. include ne filtre que les fichiers.
+
+// liveSFTP est une connexion SFTP ouverte, utilisable par l'endpoint archive.
+type liveSFTP struct {
+	userID string
+	xfers  *transfers
+}
+
+func (h *Handler) register(sessionID, userID string, xfers *transfers) (unregister func()) {
+	h.mu.Lock()
+	h.live[sessionID] = &liveSFTP{userID: userID, xfers: xfers}
+	h.mu.Unlock()
+	return func() {
+		h.mu.Lock()
+		delete(h.live, sessionID)
+		h.mu.Unlock()
+	}
+}
+
+type archiveFilter struct {
+	include, exclude []string
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f archiveFilter) excluded(rel string) bool {
+	return matchAny(f.exclude, rel)
+}
+
+func (f archiveFilter) included(rel string) bool {
+	return len(f.include) == 0 || matchAny(f.include, rel)
+}
+
+// Archive sert GET /api/sftp/archive.
+func (h *Handler) Archive(w http.ResponseWriter, r *http.Request) {
+	user := mw.GetUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+
+	h.mu.Lock()
+	live := h.live[q.Get("session")]
+	h.mu.Unlock()
+	if live == nil || live.userID != user.UserID {
+		http.Error(w, "sftp session not found", http.StatusNotFound)
+		return
+	}
+	ts := live.xfers
+
+	n, err := strconv.ParseUint(q.Get("id"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	id := uint32(n)
+	// Le client suit l'opération sur le WebSocket : les refus y sont aussi
+	// signalés.
+	fail := func(msg string, code int) {
+		ts.c.sendTransferError(id, msg)
+		http.Error(w, msg, code)
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	if format != "tar.gz" && format != "zip" {
+		fail("format must be tar.gz or zip", http.StatusBadRequest)
+		return
+	}
+	filter := archiveFilter{include: q["include"], exclude: q["exclude"]}
+	for _, p := range append(append([]string{}, filter.include...), filter.exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			fail(fmt.Sprintf("invalid pattern %q", p), http.StatusBadRequest)
+			return
+		}
+	}
+	maxSize := ts.opts.ArchiveMaxSize
+	if v := q.Get("max_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			fail("invalid max_size", http.StatusBadRequest)
+			return
+		}
+		maxSize = min(n, maxSize)
+	}
+
+	root := path.Clean(q.Get("path"))
+	fi, err := ts.client.Stat(root)
+	if err != nil {
+		fail(fmt.Sprintf("stat: %v", err), http.StatusNotFound)
+		return
+	}
+	if !fi.IsDir() {
+		fail("not a directory", http.StatusBadRequest)
+		return
+	}
+
+	t, err := ts.register(id, "archive", root, 0, 0)
+	if err != nil {
+		fail(err.Error(), http.StatusConflict)
+		return
+	}
+	defer ts.finish(t)
+	// La fermeture de la requête interrompt l'archive comme un cancel.
+	stop := context.AfterFunc(r.Context(), t.cancel)
+	defer stop()
+
+	// Premier parcours, sur les seules métadonnées : la limite de taille est
+	// vérifiée avant l'envoi du premier octet.
+	var st opState
+	total, err := ts.archiveSize(t, root, filter, &st)
+	if err != nil {
+		ts.opFailed(t, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if total > maxSize {
+		fail(fmt.Sprintf("archive would exceed %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	t.size = total
+
+	name := path.Base(root)
+	if name == "/" || name == "." {
+		name = "root"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, strings.ReplaceAll(name, `"`, ""), format))
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+	}
+
+	st = opState{}
+	if format == "zip" {
+		err = ts.writeZip(w, t, root, name, filter, maxSize, &st)
+	} else {
+		err = ts.writeTarGz(w, t, root, name, filter, maxSize, &st)
+	}
+	ts.audit(audit.ActionSFTPArchive, map[string]interface{}{
+		"path": root, "format": format, "items": st.items, "size": st.bytes, "incomplete": err != nil,
+	})
+	if err != nil {
+		ts.opFailed(t, err)
+		log.Printf("sftp archive %s: %v", root, err)
+		// Couper la connexion : une archive tronquée mais bien terminée
+		// passerait pour complète.
+		panic(http.ErrAbortHandler)
+	}
+	ts.c.send(msgDone, map[string]any{"id": t.id, "op": "archive", "path": root, "items": st.items, "size": st.bytes})
+}
+
+// walkArchive appelle fn pour chaque entrée retenue par le filtre, avec son
+// chemin relatif au répertoire archivé.
+func (ts *transfers) walkArchive(t *transfer, root string, filter archiveFilter, fn func(p, rel string, fi os.FileInfo) error) error {
+	walker := ts.client.Walk(root)
+	for walker.Step() {
+		if err := t.ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if walker.Path() == root {
+			continue
+		}
+		rel := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(root, "/")+"/")
+		fi := walker.Stat()
+		if filter.excluded(rel) {
+			if fi.IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if fi.IsDir() {
+			if len(filter.include) > 0 {
+				continue
+			}
+		} else if !filter.included(rel) {
+			continue
+		}
+		if err := fn(walker.Path(), rel, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *transfers) archiveSize(t *transfer, root string, filter archiveFilter, st *opState) (int64, error) {
+	var total int64
+	err := ts.walkArchive(t, root, filter, func(p, _ string, fi os.FileInfo) error {
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		st.items++
+		ts.sendOpProgress(t, st, p)
+		return nil
+	})
+	return total, err
+}
+
+// copyEntryData écrit le contenu d'un fichier de l'archive, en s'assurant de
+// ne pas dépasser la limite si le fichier a grossi depuis le premier parcours.
+func (ts *transfers) copyEntryData(w io.Writer, t *transfer, p string, size, maxSize int64, st *opState) error {
+	if st.bytes+size > maxSize {
+		return fmt.Errorf("size limit exceeded")
+	}
+	f, err := ts.client.Open(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	defer f.Close()
+	pw := &progressWriter{w: w, onWrite: func(n int) {
+		st.bytes += int64(n)
+		ts.sendOpProgress(t, st, p)
+	}}
+	// Les lectures de la taille d'un morceau sont parallélisées par le client SFTP
+	buf := make([]byte, ts.opts.ChunkSize)
+	n, err := io.CopyBuffer(ctxWriter{t.ctx, pw}, io.LimitReader(f, size), buf)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	if n != size {
+		return fmt.Errorf("%s: file shrank while archiving", p)
+	}
+	return nil
+}
+
+func (ts *transfers) writeTarGz(w io.Writer, t *transfer, root, name string, filter archiveFilter, maxSize int64, st *opState) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := ts.walkArchive(t, root, filter, func(p, rel string, fi os.FileInfo) error {
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := ts.client.ReadLink(p)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			link = target
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil // fichiers spéciaux ignorés
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		hdr.Name = name + "/" + rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			if err := ts.copyEntryData(tw, t, p, fi.Size(), maxSize, st); err != nil {
+				return err
+			}
+		}
+		st.items++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (ts *transfers) writeZip(w io.Writer, t *transfer, root, name string, filter archiveFilter, maxSize int64, st *opState) error {
+	zw := zip.NewWriter(w)
+	err := ts.walkArchive(t, root, filter, func(p, rel string, fi os.FileInfo) error {
+		isLink := fi.Mode()&os.ModeSymlink != 0
+		if !isLink && !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		hdr.Name = name + "/" + rel
+		if fi.IsDir() {
+			hdr.Name += "/"
+		} else if fi.Mode().IsRegular() {
+			hdr.Method = zip.Deflate
+		}
+		entry, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		switch {
+		case isLink:
+			// Convention zip : le contenu d'un lien symbolique est sa cible.
+			target, err := ts.client.ReadLink(p)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			if _, err := io.WriteString(entry, target); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := ts.copyEntryData(entry, t, p, fi.Size(), maxSize, st); err != nil {
+				return err
+			}
+		}
+		st.items++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,37 @@
+package sftp
+
+import "testing"
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		rel      string
+		want     bool
+	}{
+		{[]string{"*.log"}, "app/logs/today.log", true},
+		{[]string{"*.log"}, "app/logs", false},
+		{[]string{"node_modules"}, "web/node_modules", true},
+		// Un motif avec "/" porte sur le chemin relatif entier
+		{[]string{"app/*.log"}, "app/today.log", true},
+		{[]string{"app/*.log"}, "other/app/today.log", false},
+		{[]string{"logs/*"}, "app/logs/today.log", false},
+		{[]string{"*.tmp", ".git"}, "src/.git", true},
+		{nil, "anything", false},
+		// Motif invalide : ignoré
+		{[]string{"[", "*.txt"}, "a.txt", true},
+		{[]string{"["}, "[", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.rel); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.patterns, tt.rel, got, tt.want)
+		}
+	}
+
+	f := archiveFilter{include: []string{"*.go"}, exclude: []string{"*_test.go"}}
+	if !f.included("pkg/main.go") || f.included("README.md") || !f.excluded("pkg/main_test.go") {
+		t.Fatal("include and exclude filters misapplied")
+	}
+	if !(archiveFilter{}).included("README.md") {
+		t.Fatal("empty include list must include everything")
+	}
+}
@@ -0,0 +1,133 @@
+package sftp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Vérification d'intégrité : SHA-256 d'un fichier distant, ou de ses length
+// premiers octets pour contrôler un fichier partiel avant une reprise.
+// sha256sum est exécuté sur l'hôte quand c'est possible, le fichier n'a alors
+// pas à traverser le réseau ; sinon (compte limité à SFTP, outil absent) le
+// fichier est relu par SFTP et haché au fil de l'eau.
+
+const (
+	checksumExec   = "exec"
+	checksumStream = "stream"
+)
+
+type checksumPayload struct {
+	ID     uint32 `json:"id"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"` // 0 ou absent : fichier entier
+}
+
+type checksumResult struct {
+	ID     uint32 `json:"id"`
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+	SHA256 string `json:"sha256"`
+	Method string `json:"method"`
+}
+
+// remoteSHA256 retourne l'empreinte des length premiers octets du fichier
+// (du fichier entier si length est négatif) et la méthode employée.
+func remoteSHA256(ctx context.Context, sshClient *ssh.Client, sftpClient *pkgsftp.Client, p string, length int64) (sum, method string, err error) {
+	if sum, err := execSHA256(ctx, sshClient, p, length); err == nil {
+		return sum, checksumExec, nil
+	}
+	if ctx.Err() != nil {
+		return "", "", ctx.Err()
+	}
+	sum, err = streamSHA256(ctx, sftpClient, p, length)
+	return sum, checksumStream, err
+}
+
+func execSHA256(ctx context.Context, client *ssh.Client, p string, length int64) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	cmd := "sha256sum -- " + shellQuote(p)
+	if length >= 0 {
+		// Le statut d'un pipe est celui de sha256sum : un fichier absent ou plus
+		// court que length donnerait l'empreinte d'un préfixe tronqué. Le fichier
+		// est donc vérifié et sa taille retournée avant l'empreinte.
+		cmd = fmt.Sprintf("test -f %[2]s && test -r %[2]s && wc -c < %[2]s && head -c %[1]d -- %[2]s | sha256sum", length, shellQuote(p))
+	}
+	out, err := session.Output(cmd)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(out))
+	if length >= 0 {
+		// Sortie : "<taille>\n<empreinte>  -"
+		size, rest, _ := strings.Cut(text, "\n")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("unexpected wc output")
+		}
+		if n < length {
+			return "", fmt.Errorf("file is %d bytes, shorter than %d", n, length)
+		}
+		text = rest
+	}
+	// Sortie : "<empreinte>  <fichier>"
+	sum, _, _ := strings.Cut(text, " ")
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*sha256.Size {
+		return "", fmt.Errorf("unexpected sha256sum output")
+	}
+	return strings.ToLower(sum), nil
+}
+
+func streamSHA256(ctx context.Context, client *pkgsftp.Client, p string, length int64) (string, error) {
+	f, err := client.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	var src io.Reader = f
+	if length >= 0 {
+		src = io.LimitReader(f, length)
+	}
+	n, err := io.Copy(ctxWriter{ctx, h}, src)
+	if err != nil {
+		return "", err
+	}
+	if length >= 0 && n < length {
+		return "", fmt.Errorf("file is %d bytes, shorter than %d", n, length)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ctxWriter interrompt une copie dès l'annulation du contexte.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w ctxWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// shellQuote protège un chemin pour le shell POSIX de l'hôte.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
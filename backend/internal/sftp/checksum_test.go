@@ -0,0 +1,17 @@
+package sftp
+
+import "testing"
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/srv/data":          `'/srv/data'`,
+		"it's":               `'it'\''s'`,
+		"$(rm -rf /); `x` *": `'$(rm -rf /); ` + "`x`" + ` *'`,
+		"":                   `''`,
+	}
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
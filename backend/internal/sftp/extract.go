@@ -0,0 +1,537 @@
+package sftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/audit"
+)
+
+// Upload et extraction d'une archive tar.gz ou zip sur l'hôte.
+//
+//	client → extract {id, dir, size, format, conflict}
+//	serveur → transfer {chunk_size, window}
+//	client → frames…   serveur → ack, progress, extract_entry…, done
+//
+// L'archive arrive par morceaux comme un put ; elle est décompressée au fil
+// de l'eau et chaque entrée est écrite sous dir par SFTP. Un zip se lit par
+// son répertoire central, en fin de fichier : il est d'abord stocké dans un
+// fichier temporaire du serveur.
+//
+// Chaque fichier ou lien produit un extract_entry (created, overwritten,
+// renamed, skipped, rejected ou failed). Les entrées qui sortiraient de dir
+// (chemin absolu, "..", lien symbolique dont la cible remonte ou traverse un
+// autre lien, chemin passant par un lien symbolique) sont rejetées. Un
+// fichier déjà présent est traité selon conflict : skip (défaut), overwrite
+// ou rename ("nom (1).ext"). Les permissions de l'archive sont conservées,
+// sans setuid ni setgid ; celles des répertoires déjà présents ne sont pas
+// modifiées. Une extraction annulée laisse en place les fichiers déjà écrits.
+
+type extractPayload struct {
+	ID        uint32 `json:"id"`
+	Dir       string `json:"dir"`
+	Size      int64  `json:"size"`
+	Format    string `json:"format"`   // "tar.gz" (défaut) ou "zip"
+	Conflict  string `json:"conflict"` // "skip" (défaut), "overwrite" ou "rename"
+	ChunkSize int    `json:"chunk_size"`
+}
+
+type extractEntry struct {
+	ID     uint32 `json:"id"`
+	Path   string `json:"path"`             // nom dans l'archive
+	Target string `json:"target,omitempty"` // chemin écrit sur l'hôte
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	extractCreated     = "created"
+	extractOverwritten = "overwritten"
+	extractRenamed     = "renamed"
+	extractSkipped     = "skipped"
+	extractRejected    = "rejected"
+	extractFailed      = "failed"
+
+	maxLinkTarget = 4096
+	maxRenames    = 1000
+)
+
+var errExtractSize = errors.New("extracted size limit exceeded")
+
+func (ts *transfers) startExtract(p extractPayload) {
+	if p.Format == "" {
+		p.Format = "tar.gz"
+	}
+	if p.Conflict == "" {
+		p.Conflict = "skip"
+	}
+	switch {
+	case p.Dir == "" || p.Size <= 0:
+		ts.c.sendTransferError(p.ID, "invalid extract payload")
+		return
+	case p.Format != "tar.gz" && p.Format != "zip":
+		ts.c.sendTransferError(p.ID, "format must be tar.gz or zip")
+		return
+	case p.Conflict != "skip" && p.Conflict != "overwrite" && p.Conflict != "rename":
+		ts.c.sendTransferError(p.ID, "conflict must be skip, overwrite or rename")
+		return
+	case p.Size > ts.opts.ArchiveMaxSize:
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("archive exceeds %d bytes", ts.opts.ArchiveMaxSize))
+		return
+	}
+	dir := path.Clean(p.Dir)
+	if err := ts.client.MkdirAll(dir); err != nil {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("mkdir: %v", err))
+		return
+	}
+	t, err := ts.register(p.ID, "extract", dir, p.Size, p.ChunkSize)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	ts.c.send(msgTransfer, transferPayload{
+		ID: t.id, Op: t.op, Path: t.path, Name: path.Base(t.path),
+		Size: t.size, ChunkSize: t.chunkSize, Window: ts.opts.Window,
+	})
+	go ts.runExtract(t, p.Format, p.Conflict)
+}
+
+func (ts *transfers) runExtract(t *transfer, format, conflict string) {
+	defer ts.finish(t)
+
+	pr, pw := io.Pipe()
+	received := make(chan error, 1)
+	go func() { received <- ts.receive(t, pw) }()
+
+	x := &extractor{
+		ts: ts, t: t, dir: t.path, conflict: conflict, maxSize: ts.opts.ArchiveMaxSize,
+		dirs: make(map[string]bool), created: make(map[string]bool), dirModes: make(map[string]os.FileMode), counts: make(map[string]int64),
+	}
+	var err error
+	if format == "zip" {
+		err = x.extractZip(pr)
+	} else {
+		err = x.extractTarGz(pr)
+	}
+	if err == nil {
+		// Bourrage après la fin de l'archive : le lire pour terminer l'upload
+		_, err = io.Copy(io.Discard, pr)
+	}
+	// Débloque la réception si l'extraction s'est arrêtée en route
+	pr.CloseWithError(errors.New("extraction stopped"))
+	if rerr := <-received; err == nil {
+		err = rerr
+	}
+	x.applyDirModes()
+
+	details := map[string]interface{}{"dir": t.path, "format": format, "size": t.size, "conflict": conflict}
+	for action, n := range x.counts {
+		details[action] = n
+	}
+	if err != nil {
+		details["incomplete"] = true
+	}
+	ts.audit(audit.ActionSFTPExtract, details)
+	if err != nil {
+		ts.opFailed(t, err)
+		return
+	}
+	done := map[string]any{"id": t.id, "op": "extract", "path": t.path, "size": x.written}
+	for action, n := range x.counts {
+		done[action] = n
+	}
+	ts.c.send(msgDone, done)
+}
+
+// receive recopie les morceaux de l'upload dans w. L'acquittement suit
+// l'écriture dans le pipe, donc la lecture de l'archive : l'extraction
+// impose son rythme au client.
+func (ts *transfers) receive(t *transfer, w *io.PipeWriter) error {
+	var received int64
+	var lastProgress time.Time
+	for received < t.size {
+		select {
+		case data := <-t.chunks:
+			if received+int64(len(data)) > t.size {
+				err := errors.New("more data than announced")
+				w.CloseWithError(err)
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			received += int64(len(data))
+			ts.c.send(msgAck, ackPayload{ID: t.id, Offset: received})
+			ts.sendProgress(t, received, &lastProgress)
+		case <-t.ctx.Done():
+			w.CloseWithError(t.ctx.Err())
+			return t.ctx.Err()
+		}
+	}
+	return w.Close()
+}
+
+// extractor écrit les entrées d'une archive sous dir.
+type extractor struct {
+	ts       *transfers
+	t        *transfer
+	dir      string
+	conflict string
+	maxSize  int64
+	written  int64 // octets extraits
+
+	dirs     map[string]bool        // répertoires vérifiés ou créés, relatifs à dir
+	created  map[string]bool        // répertoires créés par cette extraction
+	dirModes map[string]os.FileMode // appliqués en fin d'extraction
+	counts   map[string]int64       // entrées par action
+}
+
+func (x *extractor) extractTarGz(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("gzip: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if err := x.t.ctx.Err(); err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			x.dirEntry(hdr.Name, mode)
+		case tar.TypeReg:
+			err = x.fileEntry(hdr.Name, mode, hdr.ModTime, tr)
+		case tar.TypeSymlink:
+			x.linkEntry(hdr.Name, hdr.Linkname)
+		case tar.TypeXGlobalHeader:
+		default:
+			x.report(extractEntry{Path: hdr.Name, Action: extractRejected, Error: "unsupported entry type"})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Le reste du flux (bourrage tar, fin du gzip) est lu par l'appelant
+	return nil
+}
+
+func (x *extractor) extractZip(r io.Reader) error {
+	tmp, err := os.CreateTemp("", "sftp-extract-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, n)
+	if err != nil {
+		return fmt.Errorf("zip: %w", err)
+	}
+	for _, f := range zr.File {
+		if err := x.t.ctx.Err(); err != nil {
+			return err
+		}
+		// Certains outils Windows séparent les chemins par des "\"
+		name := strings.ReplaceAll(f.Name, `\`, "/")
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			x.dirEntry(name, mode)
+		case mode&os.ModeSymlink != 0:
+			// Convention zip : le contenu d'un lien symbolique est sa cible
+			target, err := readZipEntry(f, maxLinkTarget)
+			if err != nil {
+				x.report(extractEntry{Path: name, Action: extractFailed, Error: err.Error()})
+				continue
+			}
+			x.linkEntry(name, target)
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				x.report(extractEntry{Path: name, Action: extractFailed, Error: err.Error()})
+				continue
+			}
+			err = x.fileEntry(name, mode, f.Modified, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			x.report(extractEntry{Path: name, Action: extractRejected, Error: "unsupported entry type"})
+		}
+	}
+	return nil
+}
+
+func readZipEntry(f *zip.File, limit int64) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, limit))
+	return string(b), err
+}
+
+// cleanEntryName retourne le chemin de l'entrée relatif au répertoire cible,
+// ou false s'il en sort.
+func cleanEntryName(name string) (string, bool) {
+	if path.IsAbs(name) {
+		return "", false
+	}
+	rel := path.Clean(name)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+func (x *extractor) report(e extractEntry) {
+	e.ID = x.t.id
+	x.counts[e.Action]++
+	x.ts.c.send(msgExtractEntry, e)
+}
+
+// ensureDir crée les répertoires de rel sous dir. Un composant existant qui
+// est un lien symbolique est refusé : l'écriture le suivrait hors de dir.
+func (x *extractor) ensureDir(rel string) error {
+	if rel == "." {
+		return nil
+	}
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		if x.dirs[sub] {
+			continue
+		}
+		p := path.Join(x.dir, sub)
+		fi, err := x.ts.client.Lstat(p)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if err := x.ts.client.Mkdir(p); err != nil {
+				return fmt.Errorf("mkdir %s: %w", sub, err)
+			}
+			x.created[sub] = true
+		case err != nil:
+			return err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("%s is a symbolic link", sub)
+		case !fi.IsDir():
+			return fmt.Errorf("%s is not a directory", sub)
+		}
+		x.dirs[sub] = true
+	}
+	return nil
+}
+
+func (x *extractor) dirEntry(name string, mode os.FileMode) {
+	rel, ok := cleanEntryName(name)
+	if !ok {
+		if path.Clean(name) != "." {
+			x.report(extractEntry{Path: name, Action: extractRejected, Error: "path escapes target directory"})
+		}
+		return
+	}
+	if err := x.ensureDir(rel); err != nil {
+		x.report(extractEntry{Path: name, Action: extractRejected, Error: err.Error()})
+		return
+	}
+	// Les permissions d'un répertoire déjà présent sur l'hôte ne sont pas
+	// modifiées. Appliquées à la fin : un répertoire en lecture seule
+	// empêcherait d'y écrire ses fichiers.
+	if x.created[rel] {
+		x.dirModes[rel] = mode.Perm()
+	}
+}
+
+// target prépare l'écriture de l'entrée rel selon la politique de conflit.
+// action vaut extractSkipped si l'entrée ne doit pas être écrite.
+func (x *extractor) target(rel string) (p, action string, err error) {
+	if err := x.ensureDir(path.Dir(rel)); err != nil {
+		return "", extractRejected, err
+	}
+	p = path.Join(x.dir, rel)
+	fi, err := x.ts.client.Lstat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, extractCreated, nil
+	}
+	if err != nil {
+		return "", extractFailed, err
+	}
+	switch x.conflict {
+	case "overwrite":
+		if fi.IsDir() {
+			return "", extractFailed, errors.New("a directory exists with this name")
+		}
+		// Supprimer plutôt que tronquer : un lien symbolique serait suivi
+		if err := x.ts.client.Remove(p); err != nil {
+			return "", extractFailed, err
+		}
+		return p, extractOverwritten, nil
+	case "rename":
+		ext := path.Ext(p)
+		stem := strings.TrimSuffix(p, ext)
+		for i := 1; i <= maxRenames; i++ {
+			candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+			if _, err := x.ts.client.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+				return candidate, extractRenamed, nil
+			} else if err != nil {
+				return "", extractFailed, err
+			}
+		}
+		return "", extractFailed, errors.New("no free name")
+	}
+	return p, extractSkipped, nil
+}
+
+// fileEntry écrit un fichier. Une erreur retournée interrompt l'extraction
+// (annulation, limite de taille, flux ou connexion SFTP en échec) ; les refus
+// propres à l'entrée sont seulement signalés.
+func (x *extractor) fileEntry(name string, mode os.FileMode, modTime time.Time, r io.Reader) error {
+	rel, ok := cleanEntryName(name)
+	if !ok {
+		x.report(extractEntry{Path: name, Action: extractRejected, Error: "path escapes target directory"})
+		return nil
+	}
+	p, action, err := x.target(rel)
+	if err != nil {
+		x.report(extractEntry{Path: name, Action: action, Error: err.Error()})
+		return nil
+	}
+	if action == extractSkipped {
+		x.report(extractEntry{Path: name, Target: p, Action: action, Error: "already exists"})
+		return nil
+	}
+	// O_EXCL : ne jamais écrire à travers un lien apparu entre-temps
+	f, err := x.ts.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		x.report(extractEntry{Path: name, Target: p, Action: extractFailed, Error: err.Error()})
+		return nil
+	}
+	// Les écritures de la taille d'un morceau sont parallélisées par le
+	// client SFTP ; l'enveloppe masque ReadFrom, qui écrirait par paquets.
+	buf := make([]byte, x.ts.opts.ChunkSize)
+	n, err := io.CopyBuffer(struct{ io.Writer }{f}, &extractReader{x: x, r: r}, buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Pas de fichier partiel
+		x.ts.client.Remove(p)
+		return fmt.Errorf("%s: %w", rel, err)
+	}
+	if err := x.ts.client.Chmod(p, mode.Perm()); err != nil {
+		x.report(extractEntry{Path: name, Target: p, Size: n, Action: extractFailed, Error: err.Error()})
+		return nil
+	}
+	x.ts.client.Chtimes(p, modTime, modTime)
+	x.report(extractEntry{Path: name, Target: p, Size: n, Action: action})
+	return nil
+}
+
+// checkLinkTarget vérifie que la cible du lien rel reste sous dir. Une
+// comparaison des seuls chemins ne suffit pas : "x -> a/up/.." sort de dir si
+// a/up est lui-même un lien vers "..". La cible ne peut donc ni remonter
+// (aucun composant "..") ni traverser un lien symbolique existant ; les liens
+// créés ensuite par l'archive passent par la même vérification.
+func (x *extractor) checkLinkTarget(rel, link string) error {
+	if link == "" || path.IsAbs(link) {
+		return errors.New("link target escapes target directory")
+	}
+	for _, part := range strings.Split(link, "/") {
+		if part == ".." {
+			return errors.New("link target escapes target directory")
+		}
+	}
+	dest := path.Join(path.Dir(rel), link)
+	if dest == "." {
+		return nil
+	}
+	parts := strings.Split(dest, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		fi, err := x.ts.client.Lstat(path.Join(x.dir, sub))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("link target passes through symbolic link %s", sub)
+		}
+	}
+	return nil
+}
+
+// linkEntry recrée un lien symbolique dont la cible, relative, reste sous dir.
+func (x *extractor) linkEntry(name, link string) {
+	rel, ok := cleanEntryName(name)
+	if !ok {
+		x.report(extractEntry{Path: name, Action: extractRejected, Error: "path escapes target directory"})
+		return
+	}
+	if err := x.checkLinkTarget(rel, link); err != nil {
+		x.report(extractEntry{Path: name, Action: extractRejected, Error: err.Error()})
+		return
+	}
+	p, action, err := x.target(rel)
+	if err != nil {
+		x.report(extractEntry{Path: name, Action: action, Error: err.Error()})
+		return
+	}
+	if action == extractSkipped {
+		x.report(extractEntry{Path: name, Target: p, Action: action, Error: "already exists"})
+		return
+	}
+	if err := x.ts.client.Symlink(link, p); err != nil {
+		x.report(extractEntry{Path: name, Target: p, Action: extractFailed, Error: err.Error()})
+		return
+	}
+	x.report(extractEntry{Path: name, Target: p, Action: action})
+}
+
+func (x *extractor) applyDirModes() {
+	for rel, mode := range x.dirModes {
+		x.ts.client.Chmod(path.Join(x.dir, rel), mode)
+	}
+}
+
+// extractReader compte les octets extraits et s'arrête à l'annulation ou au
+// dépassement de la limite (archive très compressée).
+type extractReader struct {
+	x *extractor
+	r io.Reader
+}
+
+func (er *extractReader) Read(p []byte) (int, error) {
+	if err := er.x.t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := er.r.Read(p)
+	er.x.written += int64(n)
+	if er.x.written > er.x.maxSize {
+		return n, errExtractSize
+	}
+	return n, err
+}
@@ -0,0 +1,196 @@
+package sftp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCleanEntryName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"a/b.txt", "a/b.txt", true},
+		{"./a//b/", "a/b", true},
+		{"a/../b", "b", true},
+		{"a/b/../../c", "c", true},
+		{"..", "", false},
+		{"../evil", "", false},
+		{"a/../../evil", "", false},
+		{"/etc/passwd", "", false},
+		{".", "", false},
+		{"./", "", false},
+		{"..foo", "..foo", true},
+	}
+	for _, tt := range tests {
+		got, ok := cleanEntryName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanEntryName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// archiveEntry décrit une entrée d'archive de test : un répertoire (nom en
+// "/"), un fichier ou, avec link, un lien symbolique.
+type archiveEntry struct {
+	name, body, link string
+}
+
+// extractTestEntries couvre les entrées qui sortiraient du répertoire cible.
+// Le répertoire cible contient déjà "outside", un lien vers un autre
+// répertoire de l'hôte.
+var extractTestEntries = []struct {
+	archiveEntry
+	action string
+}{
+	{archiveEntry{name: "ok/"}, ""},
+	{archiveEntry{name: "ok/a.txt", body: "hello"}, extractCreated},
+	{archiveEntry{name: "../evil", body: "x"}, extractRejected},
+	{archiveEntry{name: "ok/../../evil", body: "x"}, extractRejected},
+	{archiveEntry{name: "/abs", body: "x"}, extractRejected},
+	{archiveEntry{name: "up", link: "../x"}, extractRejected},
+	{archiveEntry{name: "ok/up", link: "a/../../x"}, extractRejected},
+	{archiveEntry{name: "etc", link: "/etc"}, extractRejected},
+	{archiveEntry{name: "inner", link: "ok"}, extractCreated},
+	// Cible traversant un lien de l'archive ou de l'hôte
+	{archiveEntry{name: "through", link: "inner/a.txt"}, extractRejected},
+	{archiveEntry{name: "host", link: "outside/secret"}, extractRejected},
+	// Écriture à travers un lien
+	{archiveEntry{name: "inner/b.txt", body: "x"}, extractRejected},
+	{archiveEntry{name: "outside/x", body: "x"}, extractRejected},
+	{archiveEntry{name: "outside/", body: ""}, extractRejected},
+}
+
+func tarGzArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range extractTestEntries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Mode = tar.TypeSymlink, e.link, 0o777
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range extractTestEntries {
+		hdr := &zip.FileHeader{Name: e.name}
+		body := e.body
+		switch {
+		case e.link != "":
+			hdr.SetMode(os.ModeSymlink | 0o777)
+			body = e.link
+		case e.name[len(e.name)-1] == '/':
+			hdr.SetMode(os.ModeDir | 0o755)
+		default:
+			hdr.SetMode(0o644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	for _, format := range []string{"tar.gz", "zip"} {
+		t.Run(format, func(t *testing.T) {
+			e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize})
+			outside := t.TempDir()
+			writeFile(t, outside+"/secret", []byte("secret"))
+			os.MkdirAll(e.path("dest"), 0o755)
+			if err := os.Symlink(outside, e.path("dest/outside")); err != nil {
+				t.Fatal(err)
+			}
+			archive := tarGzArchive(t)
+			if format == "zip" {
+				archive = zipArchive(t)
+			}
+
+			e.ts.startExtract(extractPayload{ID: 5, Dir: e.path("dest"), Size: int64(len(archive)), Format: format})
+			var tp transferPayload
+			e.expect(msgTransfer, &tp)
+			go func() {
+				for sent := 0; sent < len(archive); sent += tp.ChunkSize {
+					e.ts.chunk(frame(5, archive[sent:min(sent+tp.ChunkSize, len(archive))]))
+				}
+			}()
+
+			actions := map[string]extractEntry{}
+			for {
+				m, ok := e.next(5 * time.Second)
+				if !ok {
+					t.Fatal("extraction did not finish")
+				}
+				if m.Type == msgDone {
+					break
+				}
+				if m.Type == msgError {
+					t.Fatalf("extraction failed: %s", m.Payload)
+				}
+				if m.Type == msgExtractEntry {
+					var entry extractEntry
+					json.Unmarshal(m.Payload, &entry)
+					actions[entry.Path] = entry
+				}
+			}
+			for _, want := range extractTestEntries {
+				got, reported := actions[want.name]
+				if want.action == "" {
+					continue
+				}
+				if !reported || got.Action != want.action {
+					t.Errorf("%s: %s (%s), want %s", want.name, got.Action, got.Error, want.action)
+				}
+			}
+
+			if got, _ := os.ReadFile(e.path("dest/ok/a.txt")); string(got) != "hello" {
+				t.Fatalf("ok/a.txt = %q", got)
+			}
+			if link, _ := os.Readlink(e.path("dest/inner")); link != "ok" {
+				t.Fatalf("inner -> %q", link)
+			}
+			for _, p := range []string{"evil", "dest/ok/up", "dest/up", "dest/etc", "dest/through", "dest/host", "dest/ok/b.txt"} {
+				if _, err := os.Lstat(e.path(p)); !os.IsNotExist(err) {
+					t.Errorf("%s written (%v)", p, err)
+				}
+			}
+			if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+				t.Fatalf("%d entries outside the target directory", len(entries))
+			}
+			if _, err := os.Lstat("/abs"); err == nil {
+				t.Fatal("/abs written")
+			}
+		})
+	}
+}
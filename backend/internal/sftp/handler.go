@@ -1,43 +1,63 @@
 package sftp
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
+	"path"
 	"strings"
 	"sync"
 	"time"
 
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/db"
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
 	pkgsftp "github.com/pkg/sftp"
-	gossh "golang.org/x/crypto/ssh"
 )
 
 // ── Types de messages ────────────────────────────────────────────────────────
 
 const (
 	// Client → Serveur
-	msgConnect = "connect"
-	msgLS      = "ls"
-	msgGet     = "get"
-	msgPut     = "put"
-	msgRM      = "rm"
-	msgMkdir   = "mkdir"
-	msgRename  = "rename"
+	msgConnect  = "connect"
+	msgLS       = "ls"
+	msgGet      = "get"
+	msgPut      = "put"
+	msgRM       = "rm"
+	msgMkdir    = "mkdir"
+	msgRename   = "rename"
+	msgCancel   = "cancel"
+	msgStat     = "stat"
+	msgChecksum = "checksum"
+	msgCopy     = "copy"
+	msgExtract  = "extract"
+
+	// Client ↔ Serveur : acquittement d'un transfert (octets reçus ou écrits)
+	msgAck = "ack"
 
 	// Serveur → Client
-	msgConnected = "connected"
-	msgLSResult  = "ls_result"
-	msgGetResult = "get_result"
-	msgDone      = "done"
-	msgError     = "error"
+	msgConnected      = "connected"
+	msgLSResult       = "ls_result"
+	msgTransfer       = "transfer"
+	msgProgress       = "progress"
+	msgTransferDone   = "transfer_done"
+	msgCancelled      = "transfer_cancelled"
+	msgStatResult     = "stat_result"
+	msgChecksumResult = "checksum_result"
+	msgRMPlan         = "rm_plan"
+	msgOpProgress     = "op_progress"
+	msgExtractEntry   = "extract_entry"
+	msgDone           = "done"
+	msgError          = "error"
+	msgClosed         = "closed"
+
+	msgHostKeyChanged = "host_key_changed"
 )
 
 type clientMsg struct {
@@ -46,8 +66,9 @@ type clientMsg struct {
 }
 
 type connectPayload struct {
-	HostID     string `json:"host_id"`
-	Credential string `json:"credential"`
+	HostID          string                   `json:"host_id"`
+	Credential      string                   `json:"credential"`
+	JumpCredentials []sshproxy.HopCredential `json:"jump_credentials"`
 }
 
 type lsPayload struct {
@@ -55,20 +76,33 @@ type lsPayload struct {
 }
 
 type getPayload struct {
-	Path string `json:"path"`
+	ID        uint32 `json:"id"`
+	Path      string `json:"path"`
+	ChunkSize int    `json:"chunk_size"` // facultatif, plafonné par la configuration
+	Offset    int64  `json:"offset"`     // reprise
+	Verify    bool   `json:"verify"`     // SHA-256 du fichier dans transfer_done
 }
 
 type putPayload struct {
-	Path string `json:"path"`
-	Data string `json:"data"` // base64
+	ID        uint32 `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunk_size"`
+	Offset    int64  `json:"offset"`
+	Verify    bool   `json:"verify"`
 }
 
 type rmPayload struct {
-	Path string `json:"path"`
+	ID        uint32 `json:"id"`
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive"`
+	DryRun    bool   `json:"dry_run"` // recursive : planifie sans supprimer
+	Token     string `json:"token"`   // recursive : jeton du rm_plan
 }
 
 type mkdirPayload struct {
-	Path string `json:"path"`
+	Path    string `json:"path"`
+	Parents bool   `json:"parents"` // crée les répertoires parents manquants (mkdir -p)
 }
 
 type renamePayload struct {
@@ -89,11 +123,16 @@ type FileEntry struct {
 
 type Handler struct {
 	pool     *pgxpool.Pool
+	sessions *sshproxy.Manager // registre des sessions actives (fermeture par un admin)
+	opts     TransferOptions
 	upgrader websocket.Upgrader
+
+	mu   sync.Mutex
+	live map[string]*liveSFTP // connexions ouvertes par session_id (archives)
 }
 
-func NewHandler(pool *pgxpool.Pool, allowedOrigins []string) *Handler {
-	h := &Handler{pool: pool}
+func NewHandler(pool *pgxpool.Pool, allowedOrigins []string, sessions *sshproxy.Manager, opts TransferOptions) *Handler {
+	h := &Handler{pool: pool, sessions: sessions, opts: opts.withDefaults(), live: make(map[string]*liveSFTP)}
 	h.upgrader = websocket.Upgrader{
 		ReadBufferSize:  32 * 1024,
 		WriteBufferSize: 32 * 1024,
@@ -113,27 +152,54 @@ func NewHandler(pool *pgxpool.Pool, allowedOrigins []string) *Handler {
 	return h
 }
 
+// writeWait borne chaque écriture sur le WebSocket : un client qui ne lit plus
+// ne doit pas bloquer indéfiniment les goroutines qui lui écrivent.
+const writeWait = 10 * time.Second
+
 // conn encapsule le WebSocket avec un mutex d'écriture.
 type conn struct {
 	ws      *websocket.Conn
 	writeMu sync.Mutex
 }
 
+// write envoie un message sous le mutex ; en cas d'échec (deadline dépassée
+// comprise) le WebSocket est fermé, ce qui termine la boucle de lecture et
+// annule les transferts de la connexion.
+func (c *conn) write(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		c.ws.Close()
+		return err
+	}
+	return nil
+}
+
 func (c *conn) send(msgType string, payload any) {
 	type outMsg struct {
 		Type    string `json:"type"`
 		Payload any    `json:"payload"`
 	}
 	data, _ := json.Marshal(outMsg{Type: msgType, Payload: payload})
-	c.writeMu.Lock()
-	defer c.writeMu.Unlock()
-	c.ws.WriteMessage(websocket.TextMessage, data)
+	c.write(websocket.TextMessage, data)
 }
 
 func (c *conn) sendError(msg string) {
 	c.send(msgError, map[string]string{"message": msg})
 }
 
+// sendTransferError signale l'échec d'un transfert ; id permet au client de
+// l'associer à sa demande.
+func (c *conn) sendTransferError(id uint32, msg string) {
+	c.send(msgError, map[string]any{"id": id, "message": msg})
+}
+
+// sendBinary envoie un morceau de fichier (en-tête de transfert inclus).
+func (c *conn) sendBinary(frame []byte) error {
+	return c.write(websocket.BinaryMessage, frame)
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	user := mw.GetUser(r)
 	if user == nil {
@@ -147,6 +213,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer wsConn.Close()
+	// Un message ne dépasse jamais un morceau de fichier et son en-tête
+	wsConn.SetReadLimit(int64(frameHeaderSize+h.opts.ChunkSize) + 64*1024)
 
 	c := &conn{ws: wsConn}
 
@@ -167,37 +235,32 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	host, err := db.GetHostByID(r.Context(), h.pool, cp.HostID, user.UserID)
+	hosts, err := db.GetHostChain(r.Context(), h.pool, cp.HostID, user.UserID)
 	if err != nil {
+		if errors.Is(err, db.ErrInvalidJumpChain) {
+			c.sendError("invalid jump host chain")
+			return
+		}
 		c.sendError("host not found")
 		return
 	}
+	host := hosts[len(hosts)-1]
 
-	sshCfg := &gossh.ClientConfig{
-		User:            host.Username,
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
-		Timeout:         15 * time.Second,
-	}
-
-	cred := cp.Credential
-	switch host.AuthType {
-	case "password":
-		sshCfg.Auth = []gossh.AuthMethod{gossh.Password(cred)}
-	case "key":
-		signer, err := gossh.ParsePrivateKey([]byte(cred))
-		if err != nil {
-			c.sendError("invalid private key")
+	chain, err := sshproxy.DialChain(r.Context(), h.pool, hosts, sshproxy.ChainCredentials(host.ID, cp.Credential, cp.JumpCredentials))
+	if err != nil {
+		if hkErr, ok := sshproxy.AsHostKeyChanged(err); ok {
+			c.send(msgHostKeyChanged, hkErr.Payload())
+			return
+		}
+		if errors.Is(err, sshproxy.ErrInvalidPrivateKey) || errors.Is(err, sshproxy.ErrMissingCredential) {
+			c.sendError(err.Error())
 			return
 		}
-		sshCfg.Auth = []gossh.AuthMethod{gossh.PublicKeys(signer)}
-	}
-
-	sshClient, err := gossh.Dial("tcp", fmt.Sprintf("%s:%d", host.Hostname, host.Port), sshCfg)
-	if err != nil {
 		c.sendError(fmt.Sprintf("connection failed: %v", err))
 		return
 	}
-	defer sshClient.Close()
+	defer chain.Close()
+	sshClient := chain.Target
 
 	sftpClient, err := pkgsftp.NewClient(sshClient)
 	if err != nil {
@@ -210,14 +273,54 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		home = "/"
 	}
-	c.send(msgConnected, map[string]string{"home": home, "host_name": host.Name})
+	// Utiliser X-Real-IP (positionné par nginx) plutôt que X-Forwarded-For (falsifiable)
+	clientIP := r.RemoteAddr
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		clientIP = realIP
+	}
+	sessionID, err := db.CreateSession(context.Background(), h.pool, user.UserID, host.ID, clientIP, "sftp")
+	if err != nil {
+		// Sans ligne de session, la connexion échapperait à la terminaison
+		// des sessions de l'utilisateur (révocation, désactivation).
+		log.Printf("sftp: failed to create session record: %v", err)
+		c.sendError("failed to create session")
+		return
+	}
+	defer db.CloseSession(context.Background(), h.pool, sessionID)
+	untrack := h.sessions.Track(sessionID, user.UserID, func(reason string) {
+		c.send(msgClosed, map[string]string{"reason": reason})
+		wsConn.Close()
+	})
+	defer untrack()
+	c.send(msgConnected, map[string]string{"session_id": sessionID, "home": home, "host_name": host.Name})
+
+	// Les opérations qui modifient l'hôte sont enregistrées dans le journal d'audit.
+	recordAudit := func(action string, details map[string]interface{}) {
+		details["host"] = host.Name
+		audit.Record(r.Context(), h.pool, audit.Event{
+			ActorID:    user.UserID,
+			ActorEmail: user.Email,
+			Action:     action,
+			Target:     host.ID,
+			IP:         clientIP,
+			Details:    details,
+		})
+	}
+
+	xfers := newTransfers(c, sshClient, sftpClient, h.opts, recordAudit)
+	defer xfers.closeAll()
+	defer h.register(sessionID, user.UserID, xfers)()
 
 	// Boucle principale des messages SFTP
 	for {
-		_, raw, err := wsConn.ReadMessage()
+		kind, raw, err := wsConn.ReadMessage()
 		if err != nil {
 			return
 		}
+		if kind == websocket.BinaryMessage {
+			xfers.chunk(raw)
+			continue
+		}
 
 		var msg clientMsg
 		if err := json.Unmarshal(raw, &msg); err != nil {
@@ -258,23 +361,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.sendError("invalid get payload")
 				continue
 			}
-			f, err := sftpClient.Open(p.Path)
-			if err != nil {
-				c.sendError(fmt.Sprintf("open: %v", err))
-				continue
-			}
-			data, err := io.ReadAll(f)
-			f.Close()
-			if err != nil {
-				c.sendError(fmt.Sprintf("read: %v", err))
-				continue
-			}
-			name := p.Path[strings.LastIndex(p.Path, "/")+1:]
-			c.send(msgGetResult, map[string]string{
-				"path": p.Path,
-				"name": name,
-				"data": base64.StdEncoding.EncodeToString(data),
-			})
+			xfers.startGet(p)
 
 		case msgPut:
 			var p putPayload
@@ -282,23 +369,37 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.sendError("invalid put payload")
 				continue
 			}
-			decoded, err := base64.StdEncoding.DecodeString(p.Data)
-			if err != nil {
-				c.sendError("invalid base64 data")
+			xfers.startPut(p)
+
+		case msgAck:
+			var p ackPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
 				continue
 			}
-			f, err := sftpClient.OpenFile(p.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
-			if err != nil {
-				c.sendError(fmt.Sprintf("create: %v", err))
+			xfers.ack(p)
+
+		case msgStat:
+			var p statPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil || p.Path == "" {
+				c.sendError("invalid stat payload")
 				continue
 			}
-			_, err = f.Write(decoded)
-			f.Close()
-			if err != nil {
-				c.sendError(fmt.Sprintf("write: %v", err))
+			xfers.stat(p)
+
+		case msgChecksum:
+			var p checksumPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid checksum payload")
 				continue
 			}
-			c.send(msgDone, map[string]string{"op": "put", "path": p.Path})
+			xfers.checksum(p)
+
+		case msgCancel:
+			var p cancelPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				continue
+			}
+			xfers.cancelTransfer(p.ID)
 
 		case msgRM:
 			var p rmPayload
@@ -306,12 +407,26 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.sendError("invalid rm payload")
 				continue
 			}
+			if p.Recursive {
+				switch {
+				case path.Clean(p.Path) == "/":
+					c.sendTransferError(p.ID, "refusing to remove /")
+				case p.DryRun:
+					xfers.rmPlan(p)
+				case p.Token != "":
+					xfers.rmConfirmed(p)
+				default:
+					c.sendTransferError(p.ID, "confirmation token required: run a dry run first")
+				}
+				continue
+			}
 			if err := sftpClient.RemoveDirectory(p.Path); err != nil {
 				if err := sftpClient.Remove(p.Path); err != nil {
 					c.sendError(fmt.Sprintf("remove: %v", err))
 					continue
 				}
 			}
+			recordAudit(audit.ActionSFTPRemove, map[string]interface{}{"path": p.Path})
 			c.send(msgDone, map[string]string{"op": "rm", "path": p.Path})
 
 		case msgMkdir:
@@ -320,12 +435,37 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.sendError("invalid mkdir payload")
 				continue
 			}
-			if err := sftpClient.Mkdir(p.Path); err != nil {
+			mkdir := sftpClient.Mkdir
+			if p.Parents {
+				mkdir = sftpClient.MkdirAll
+			}
+			if err := mkdir(p.Path); err != nil {
 				c.sendError(fmt.Sprintf("mkdir: %v", err))
 				continue
 			}
+			details := map[string]interface{}{"path": p.Path}
+			if p.Parents {
+				details["parents"] = true
+			}
+			recordAudit(audit.ActionSFTPMkdir, details)
 			c.send(msgDone, map[string]string{"op": "mkdir", "path": p.Path})
 
+		case msgCopy:
+			var p copyPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid copy payload")
+				continue
+			}
+			xfers.copyTree(p)
+
+		case msgExtract:
+			var p extractPayload
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				c.sendError("invalid extract payload")
+				continue
+			}
+			xfers.startExtract(p)
+
 		case msgRename:
 			var p renamePayload
 			if err := json.Unmarshal(msg.Payload, &p); err != nil {
@@ -336,6 +476,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				c.sendError(fmt.Sprintf("rename: %v", err))
 				continue
 			}
+			recordAudit(audit.ActionSFTPRename, map[string]interface{}{"from": p.From, "to": p.To})
 			c.send(msgDone, map[string]string{"op": "rename", "from": p.From, "to": p.To})
 		}
 	}
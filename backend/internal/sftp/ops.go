@@ -0,0 +1,346 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/audit"
+)
+
+// Opérations récursives : suppression d'une arborescence et copie sur l'hôte.
+//
+// Elles tournent en arrière-plan comme les transferts (même identifiant
+// choisi par le client, même limite par connexion, même cancel) et émettent
+// des événements op_progress. Une suppression récursive se fait en deux
+// temps : rm {dry_run} parcourt l'arborescence et renvoie un rm_plan portant
+// un jeton, puis rm {token} supprime. Le jeton est à usage unique et expire
+// après planTTL.
+
+type copyPayload struct {
+	ID   uint32 `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type rmPlan struct {
+	ID        uint32    `json:"id"`
+	Path      string    `json:"path"`
+	Files     int64     `json:"files"`
+	Dirs      int64     `json:"dirs"`
+	Bytes     int64     `json:"bytes"`
+	Entries   []string  `json:"entries"`
+	Truncated bool      `json:"truncated"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type opProgress struct {
+	ID    uint32 `json:"id"`
+	Op    string `json:"op"`
+	Items int64  `json:"items"`
+	Total int64  `json:"total,omitempty"`
+	Bytes int64  `json:"bytes"`
+	Path  string `json:"path"`
+}
+
+const (
+	planMaxEntries = 200
+	planTTL        = 5 * time.Minute
+)
+
+// rmToken confirme la suppression récursive de path, planifiée par un dry-run.
+type rmToken struct {
+	path    string
+	items   int64
+	expires time.Time
+}
+
+// opState suit l'avancement d'une opération pour les événements op_progress.
+type opState struct {
+	items, bytes int64
+	last         time.Time
+}
+
+func (ts *transfers) sendOpProgress(t *transfer, st *opState, current string) {
+	if time.Since(st.last) < progressInterval {
+		return
+	}
+	st.last = time.Now()
+	ts.c.send(msgOpProgress, opProgress{ID: t.id, Op: t.op, Items: st.items, Total: t.size, Bytes: st.bytes, Path: current})
+}
+
+// opFailed signale l'arrêt d'une opération : annulation ou erreur.
+func (ts *transfers) opFailed(t *transfer, err error) {
+	if t.ctx.Err() != nil {
+		ts.stopped(t)
+		return
+	}
+	ts.c.sendTransferError(t.id, fmt.Sprintf("%s: %v", t.op, err))
+}
+
+// ── Suppression récursive ────────────────────────────────────────────────────
+
+func (ts *transfers) rmPlan(p rmPayload) {
+	t, err := ts.register(p.ID, "rm", path.Clean(p.Path), 0, 0)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	go func() {
+		defer ts.finish(t)
+		plan := rmPlan{ID: t.id, Path: t.path, Entries: []string{}}
+		var st opState
+		walker := ts.client.Walk(t.path)
+		for walker.Step() {
+			if err := t.ctx.Err(); err != nil {
+				ts.opFailed(t, err)
+				return
+			}
+			if err := walker.Err(); err != nil {
+				ts.opFailed(t, err)
+				return
+			}
+			fi := walker.Stat()
+			if fi.IsDir() {
+				plan.Dirs++
+			} else {
+				plan.Files++
+				plan.Bytes += fi.Size()
+			}
+			if len(plan.Entries) < planMaxEntries {
+				plan.Entries = append(plan.Entries, walker.Path())
+			} else {
+				plan.Truncated = true
+			}
+			st.items, st.bytes = plan.Files+plan.Dirs, plan.Bytes
+			ts.sendOpProgress(t, &st, walker.Path())
+		}
+
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			ts.opFailed(t, err)
+			return
+		}
+		plan.Token = hex.EncodeToString(buf)
+		plan.ExpiresAt = time.Now().Add(planTTL)
+		ts.mu.Lock()
+		for token, tok := range ts.rmTokens {
+			if time.Now().After(tok.expires) {
+				delete(ts.rmTokens, token)
+			}
+		}
+		ts.rmTokens[plan.Token] = rmToken{path: t.path, items: plan.Files + plan.Dirs, expires: plan.ExpiresAt}
+		ts.mu.Unlock()
+		ts.c.send(msgRMPlan, plan)
+	}()
+}
+
+// rmConfirmed supprime l'arborescence planifiée par le dry-run du jeton.
+func (ts *transfers) rmConfirmed(p rmPayload) {
+	target := path.Clean(p.Path)
+	ts.mu.Lock()
+	tok, ok := ts.rmTokens[p.Token]
+	delete(ts.rmTokens, p.Token)
+	ts.mu.Unlock()
+	if !ok || tok.path != target || time.Now().After(tok.expires) {
+		ts.c.sendTransferError(p.ID, "invalid or expired confirmation token")
+		return
+	}
+	t, err := ts.register(p.ID, "rm", target, tok.items, 0)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	go func() {
+		defer ts.finish(t)
+		var st opState
+		err := ts.removeTree(t, &st)
+		if st.items > 0 {
+			details := map[string]interface{}{"path": t.path, "recursive": true, "items": st.items}
+			if err != nil {
+				details["incomplete"] = true
+			}
+			ts.audit(audit.ActionSFTPRemove, details)
+		}
+		if err != nil {
+			ts.opFailed(t, err)
+			return
+		}
+		ts.c.send(msgDone, map[string]any{"id": t.id, "op": "rm", "path": t.path, "items": st.items})
+	}()
+}
+
+func (ts *transfers) removeTree(t *transfer, st *opState) error {
+	fi, err := ts.client.Lstat(t.path)
+	if err != nil {
+		return err
+	}
+	return ts.removeEntry(t, t.path, fi, st)
+}
+
+// removeEntry supprime p en profondeur d'abord. Les liens symboliques sont
+// supprimés, jamais suivis.
+func (ts *transfers) removeEntry(t *transfer, p string, fi os.FileInfo, st *opState) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		children, err := ts.client.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := ts.removeEntry(t, path.Join(p, child.Name()), child, st); err != nil {
+				return err
+			}
+		}
+		if err := ts.client.RemoveDirectory(p); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	} else if err := ts.client.Remove(p); err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	st.items++
+	ts.sendOpProgress(t, st, p)
+	return nil
+}
+
+// ── Copie récursive ──────────────────────────────────────────────────────────
+
+// copyTree copie from vers to sur le même hôte ; les données transitent par
+// le serveur sans passer par le navigateur. La destination ne doit pas
+// exister. Une copie annulée laisse en place ce qui a déjà été copié.
+func (ts *transfers) copyTree(p copyPayload) {
+	if p.From == "" || p.To == "" {
+		ts.c.sendTransferError(p.ID, "invalid copy payload")
+		return
+	}
+	from, to := path.Clean(p.From), path.Clean(p.To)
+	if to == from || strings.HasPrefix(to, strings.TrimSuffix(from, "/")+"/") {
+		ts.c.sendTransferError(p.ID, "cannot copy a directory into itself")
+		return
+	}
+	fi, err := ts.client.Lstat(from)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("copy: %v", err))
+		return
+	}
+	if _, err := ts.client.Lstat(to); err == nil {
+		ts.c.sendTransferError(p.ID, "copy: destination already exists")
+		return
+	} else if !errors.Is(err, os.ErrNotExist) {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("copy: %v", err))
+		return
+	}
+	t, err := ts.register(p.ID, "copy", from, 0, 0)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	go func() {
+		defer ts.finish(t)
+		var st opState
+		err := ts.copyEntry(t, from, to, fi, &st)
+		if st.items > 0 {
+			details := map[string]interface{}{"from": from, "to": to, "items": st.items, "size": st.bytes}
+			if err != nil {
+				details["incomplete"] = true
+			}
+			ts.audit(audit.ActionSFTPCopy, details)
+		}
+		if err != nil {
+			ts.opFailed(t, err)
+			return
+		}
+		ts.c.send(msgDone, map[string]any{"id": t.id, "op": "copy", "from": from, "to": to, "items": st.items, "size": st.bytes})
+	}()
+}
+
+// copyEntry copie fichiers, répertoires et liens symboliques (recréés tels
+// quels) en conservant les permissions. Les fichiers spéciaux sont ignorés.
+func (ts *transfers) copyEntry(t *transfer, src, dst string, fi os.FileInfo, st *opState) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := ts.client.ReadLink(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		if err := ts.client.Symlink(target, dst); err != nil {
+			return fmt.Errorf("%s: %w", dst, err)
+		}
+	case fi.IsDir():
+		if err := ts.client.Mkdir(dst); err != nil {
+			return fmt.Errorf("%s: %w", dst, err)
+		}
+		children, err := ts.client.ReadDir(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		for _, child := range children {
+			if err := ts.copyEntry(t, path.Join(src, child.Name()), path.Join(dst, child.Name()), child, st); err != nil {
+				return err
+			}
+		}
+		if err := ts.client.Chmod(dst, fi.Mode().Perm()); err != nil {
+			return fmt.Errorf("%s: %w", dst, err)
+		}
+	case fi.Mode().IsRegular():
+		if err := ts.copyFile(t, src, dst, fi, st); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	st.items++
+	ts.sendOpProgress(t, st, dst)
+	return nil
+}
+
+func (ts *transfers) copyFile(t *transfer, src, dst string, fi os.FileInfo, st *opState) error {
+	in, err := ts.client.Open(src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := ts.client.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	w := &progressWriter{w: out, onWrite: func(n int) {
+		st.bytes += int64(n)
+		ts.sendOpProgress(t, st, dst)
+	}}
+	if _, err := io.Copy(ctxWriter{t.ctx, w}, in); err != nil {
+		out.Close()
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	if err := ts.client.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("%s: %w", dst, err)
+	}
+	return nil
+}
+
+// progressWriter compte les octets écrits.
+type progressWriter struct {
+	w       io.Writer
+	onWrite func(n int)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.onWrite(n)
+	return n, err
+}
@@ -0,0 +1,114 @@
+package sftp
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRMTokenSingleUse(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	os.MkdirAll(e.path("tree/sub"), 0o755)
+	writeFile(t, e.path("tree/sub/a"), []byte("a"))
+	writeFile(t, e.path("tree/b"), []byte("bb"))
+
+	e.ts.rmPlan(rmPayload{ID: 1, Path: e.path("tree/"), Recursive: true, DryRun: true})
+	var plan rmPlan
+	e.expect(msgRMPlan, &plan)
+	if plan.Files != 2 || plan.Dirs != 2 || plan.Bytes != 3 || plan.Token == "" {
+		t.Fatalf("plan %+v", plan)
+	}
+
+	// Jeton présenté pour un autre chemin : refusé et consommé
+	e.ts.rmConfirmed(rmPayload{ID: 2, Path: e.path("tree/sub"), Token: plan.Token})
+	e.expectError("invalid or expired confirmation token")
+	e.ts.rmConfirmed(rmPayload{ID: 2, Path: e.path("tree"), Token: plan.Token})
+	e.expectError("invalid or expired confirmation token")
+	if _, err := os.Stat(e.path("tree/sub/a")); err != nil {
+		t.Fatal("tree removed with a rejected token")
+	}
+
+	e.ts.rmPlan(rmPayload{ID: 1, Path: e.path("tree"), Recursive: true, DryRun: true})
+	e.expect(msgRMPlan, &plan)
+	e.ts.rmConfirmed(rmPayload{ID: 2, Path: e.path("tree"), Token: plan.Token})
+	var done struct {
+		Items int64 `json:"items"`
+	}
+	e.expect(msgDone, &done)
+	if done.Items != 4 {
+		t.Fatalf("%d items removed, want 4", done.Items)
+	}
+	if _, err := os.Stat(e.path("tree")); !os.IsNotExist(err) {
+		t.Fatalf("tree still present (%v)", err)
+	}
+	if e.auditCount() != 1 {
+		t.Fatalf("%d audit events, want 1", e.auditCount())
+	}
+
+	// Le jeton ne sert qu'une fois
+	os.MkdirAll(e.path("tree"), 0o755)
+	e.ts.rmConfirmed(rmPayload{ID: 3, Path: e.path("tree"), Token: plan.Token})
+	e.expectError("invalid or expired confirmation token")
+	if _, err := os.Stat(e.path("tree")); err != nil {
+		t.Fatal("tree removed with a reused token")
+	}
+}
+
+func TestRMTokenExpiry(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	os.MkdirAll(e.path("tree"), 0o755)
+
+	e.ts.rmPlan(rmPayload{ID: 1, Path: e.path("tree"), Recursive: true, DryRun: true})
+	var plan rmPlan
+	e.expect(msgRMPlan, &plan)
+	if d := time.Until(plan.ExpiresAt); d <= 0 || d > planTTL {
+		t.Fatalf("token expires in %v", d)
+	}
+	e.ts.mu.Lock()
+	tok := e.ts.rmTokens[plan.Token]
+	tok.expires = time.Now().Add(-time.Second)
+	e.ts.rmTokens[plan.Token] = tok
+	e.ts.mu.Unlock()
+
+	e.ts.rmConfirmed(rmPayload{ID: 2, Path: e.path("tree"), Token: plan.Token})
+	e.expectError("invalid or expired confirmation token")
+	if _, err := os.Stat(e.path("tree")); err != nil {
+		t.Fatal("tree removed with an expired token")
+	}
+
+	// Les jetons expirés sont purgés au plan suivant
+	e.ts.mu.Lock()
+	e.ts.rmTokens["stale"] = rmToken{path: e.path("tree"), expires: time.Now().Add(-time.Second)}
+	e.ts.mu.Unlock()
+	e.ts.rmPlan(rmPayload{ID: 1, Path: e.path("tree"), Recursive: true, DryRun: true})
+	e.expect(msgRMPlan, &plan)
+	e.ts.mu.Lock()
+	_, stale := e.ts.rmTokens["stale"]
+	e.ts.mu.Unlock()
+	if stale {
+		t.Fatal("expired token kept")
+	}
+}
+
+func TestCopyIntoItself(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	os.MkdirAll(e.path("src/sub"), 0o755)
+	writeFile(t, e.path("src/sub/a"), []byte("a"))
+	writeFile(t, e.path("other"), []byte("o"))
+
+	for _, to := range []string{"src", "src/", "src/sub/copy", "src/./copy"} {
+		e.ts.copyTree(copyPayload{ID: 1, From: e.path("src"), To: e.path(to)})
+		e.expectError("cannot copy a directory into itself")
+	}
+	e.ts.copyTree(copyPayload{ID: 1, From: "/", To: e.path("copy")})
+	e.expectError("cannot copy a directory into itself")
+	e.ts.copyTree(copyPayload{ID: 1, From: e.path("src"), To: e.path("other")})
+	e.expectError("destination already exists")
+
+	// Un préfixe commun n'est pas une inclusion
+	e.ts.copyTree(copyPayload{ID: 1, From: e.path("src"), To: e.path("src-copy")})
+	e.expect(msgDone, nil)
+	if got, err := os.ReadFile(e.path("src-copy/sub/a")); err != nil || string(got) != "a" {
+		t.Fatalf("copy: %q, %v", got, err)
+	}
+}
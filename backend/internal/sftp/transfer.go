@@ -0,0 +1,571 @@
+package sftp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/audit"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transferts de fichiers par morceaux.
+//
+// Le contenu circule dans des frames WebSocket binaires : 4 octets
+// d'identifiant de transfert (big-endian, choisi par le client) suivis des
+// données. Les commandes (get, put, ack, cancel) et les événements restent des
+// messages JSON. L'émetteur n'a jamais plus de Window morceaux non acquittés
+// en vol : la mémoire utilisée reste bornée quelle que soit la taille du
+// fichier.
+//
+//	get : client → get {id, path}        serveur → transfer, frames…, transfer_done
+//	      le client acquitte avec ack {id, offset} (octets reçus)
+//	put : client → put {id, path, size}  serveur → transfer {chunk_size, window}
+//	      client → frames…               serveur → ack {id, offset} (octets écrits)
+//	                                     serveur → transfer_done
+//
+// cancel {id} interrompt un transfert dans les deux sens ; un upload annulé
+// est supprimé de l'hôte, sauf s'il reprenait un fichier partiel.
+//
+// Reprise : get et put acceptent un offset. Le client interroge d'abord l'hôte
+// (stat, et checksum sur la longueur déjà transférée pour s'assurer que le
+// fichier partiel n'a pas changé), puis le transfert reprend à cet offset ;
+// offsets et acquittements sont toujours comptés depuis le début du fichier.
+// Avec verify, transfer_done porte le SHA-256 du fichier distant complet.
+
+// TransferOptions règle les transferts de fichiers.
+type TransferOptions struct {
+	ChunkSize      int   // taille maximale d'un morceau, en octets
+	Window         int   // morceaux en vol sans acquittement
+	ArchiveMaxSize int64 // taille maximale du contenu d'une archive téléchargée ou extraite
+}
+
+const (
+	minChunkSize     = 16 * 1024
+	maxChunkSize     = 4 * 1024 * 1024
+	maxTransfers     = 4 // transferts simultanés par connexion
+	frameHeaderSize  = 4
+	progressInterval = 500 * time.Millisecond
+)
+
+func (o TransferOptions) withDefaults() TransferOptions {
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = 256 * 1024
+	}
+	o.ChunkSize = min(max(o.ChunkSize, minChunkSize), maxChunkSize)
+	if o.Window <= 0 {
+		o.Window = 8
+	}
+	if o.ArchiveMaxSize <= 0 {
+		o.ArchiveMaxSize = 4 << 30
+	}
+	return o
+}
+
+type ackPayload struct {
+	ID     uint32 `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+type cancelPayload struct {
+	ID uint32 `json:"id"`
+}
+
+type progressPayload struct {
+	ID    uint32 `json:"id"`
+	Bytes int64  `json:"bytes"`
+	Size  int64  `json:"size"`
+}
+
+type transferPayload struct {
+	ID        uint32 `json:"id"`
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	ChunkSize int    `json:"chunk_size"`
+	Window    int    `json:"window"`
+}
+
+type transferDone struct {
+	ID     uint32 `json:"id"`
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Method string `json:"sha256_method,omitempty"`
+}
+
+type statPayload struct {
+	ID   uint32 `json:"id"`
+	Path string `json:"path"`
+}
+
+type statResult struct {
+	ID      uint32 `json:"id"`
+	Path    string `json:"path"`
+	Exists  bool   `json:"exists"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"is_dir"`
+	ModTime string `json:"mod_time,omitempty"`
+}
+
+type transfer struct {
+	id        uint32
+	op        string // "get", "put", "extract", "checksum"…
+	path      string
+	size      int64
+	offset    int64 // reprise : octets déjà transférés
+	verify    bool
+	chunkSize int
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled atomic.Bool // annulation demandée par le client
+
+	chunks chan []byte // put, extract : morceaux reçus en attente d'écriture
+
+	mu    sync.Mutex
+	acked int64         // get : octets acquittés par le client
+	wake  chan struct{} // get : signale un nouvel acquittement
+}
+
+func (t *transfer) ackedBytes() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.acked
+}
+
+// transfers gère les transferts en cours d'une connexion SFTP.
+type transfers struct {
+	c      *conn
+	ssh    *ssh.Client
+	client *pkgsftp.Client
+	opts   TransferOptions
+	audit  func(action string, details map[string]interface{})
+
+	mu       sync.Mutex
+	active   map[uint32]*transfer
+	rmTokens map[string]rmToken // jetons des suppressions récursives planifiées
+	wg       sync.WaitGroup
+}
+
+func newTransfers(c *conn, sshClient *ssh.Client, client *pkgsftp.Client, opts TransferOptions, record func(string, map[string]interface{})) *transfers {
+	return &transfers{c: c, ssh: sshClient, client: client, opts: opts, audit: record,
+		active: make(map[uint32]*transfer), rmTokens: make(map[string]rmToken)}
+}
+
+// register crée le transfert s'il reste de la place pour la connexion.
+func (ts *transfers) register(id uint32, op, p string, size int64, chunkSize int) (*transfer, error) {
+	if id == 0 {
+		return nil, errors.New("transfer id required")
+	}
+	if chunkSize <= 0 || chunkSize > ts.opts.ChunkSize {
+		chunkSize = ts.opts.ChunkSize
+	}
+	chunkSize = max(chunkSize, minChunkSize)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, exists := ts.active[id]; exists {
+		return nil, errors.New("transfer id already in use")
+	}
+	if len(ts.active) >= maxTransfers {
+		return nil, fmt.Errorf("too many concurrent transfers (max %d)", maxTransfers)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &transfer{
+		id:        id,
+		op:        op,
+		path:      p,
+		size:      size,
+		chunkSize: chunkSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		wake:      make(chan struct{}, 1),
+	}
+	if op == "put" || op == "extract" {
+		t.chunks = make(chan []byte, ts.opts.Window)
+	}
+	ts.active[id] = t
+	ts.wg.Add(1)
+	return t, nil
+}
+
+func (ts *transfers) get(id uint32) *transfer {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.active[id]
+}
+
+func (ts *transfers) finish(t *transfer) {
+	ts.mu.Lock()
+	delete(ts.active, t.id)
+	ts.mu.Unlock()
+	t.cancel()
+	ts.wg.Done()
+}
+
+// closeAll interrompt les transferts en cours à la fermeture de la connexion.
+func (ts *transfers) closeAll() {
+	ts.mu.Lock()
+	for _, t := range ts.active {
+		t.cancel()
+	}
+	ts.mu.Unlock()
+	ts.wg.Wait()
+}
+
+func (ts *transfers) sendProgress(t *transfer, bytes int64, last *time.Time) {
+	if time.Since(*last) < progressInterval {
+		return
+	}
+	*last = time.Now()
+	ts.c.send(msgProgress, progressPayload{ID: t.id, Bytes: bytes, Size: t.size})
+}
+
+// stopped signale au client l'arrêt d'un transfert qu'il a annulé.
+func (ts *transfers) stopped(t *transfer) {
+	if t.cancelled.Load() {
+		ts.c.send(msgCancelled, cancelPayload{ID: t.id})
+	}
+}
+
+// ── Téléchargement (hôte → navigateur) ───────────────────────────────────────
+
+func (ts *transfers) startGet(p getPayload) {
+	fi, err := ts.client.Stat(p.Path)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("stat: %v", err))
+		return
+	}
+	if fi.IsDir() {
+		ts.c.sendTransferError(p.ID, "get: is a directory")
+		return
+	}
+	if p.Offset < 0 || p.Offset > fi.Size() {
+		ts.c.sendTransferError(p.ID, "invalid offset")
+		return
+	}
+	f, err := ts.client.Open(p.Path)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("open: %v", err))
+		return
+	}
+	if _, err := f.Seek(p.Offset, io.SeekStart); err != nil {
+		f.Close()
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("seek: %v", err))
+		return
+	}
+	t, err := ts.register(p.ID, "get", p.Path, fi.Size(), p.ChunkSize)
+	if err != nil {
+		f.Close()
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	t.offset, t.acked, t.verify = p.Offset, p.Offset, p.Verify
+	ts.c.send(msgTransfer, transferPayload{
+		ID: t.id, Op: t.op, Path: t.path, Name: path.Base(t.path),
+		Size: t.size, Offset: t.offset, ChunkSize: t.chunkSize, Window: ts.opts.Window,
+	})
+	go ts.runGet(t, f)
+}
+
+func (ts *transfers) runGet(t *transfer, f *pkgsftp.File) {
+	defer ts.finish(t)
+	defer f.Close()
+
+	frame := make([]byte, frameHeaderSize+t.chunkSize)
+	binary.BigEndian.PutUint32(frame, t.id)
+	window := int64(ts.opts.Window) * int64(t.chunkSize)
+	sent := t.offset
+	var lastProgress time.Time
+	// Sans reprise, le fichier entier passe par ici : inutile de le relire
+	// pour la vérification.
+	var h hash.Hash
+	if t.verify && t.offset == 0 {
+		h = sha256.New()
+	}
+	for {
+		// Fenêtre pleine : attendre les acquittements du client
+		for sent-t.ackedBytes() >= window {
+			select {
+			case <-t.wake:
+			case <-t.ctx.Done():
+				ts.stopped(t)
+				return
+			}
+		}
+		if t.ctx.Err() != nil {
+			ts.stopped(t)
+			return
+		}
+		n, err := io.ReadFull(f, frame[frameHeaderSize:])
+		if n > 0 {
+			if h != nil {
+				h.Write(frame[frameHeaderSize : frameHeaderSize+n])
+			}
+			if err := ts.c.sendBinary(frame[:frameHeaderSize+n]); err != nil {
+				return
+			}
+			sent += int64(n)
+			ts.sendProgress(t, sent, &lastProgress)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			ts.c.sendTransferError(t.id, fmt.Sprintf("read: %v", err))
+			return
+		}
+	}
+	done := transferDone{ID: t.id, Op: t.op, Path: t.path, Size: sent}
+	if h != nil {
+		done.SHA256, done.Method = hex.EncodeToString(h.Sum(nil)), checksumStream
+	} else if t.verify && !ts.verify(t, &done) {
+		return
+	}
+	ts.c.send(msgTransferDone, done)
+}
+
+// verify complète done avec l'empreinte du fichier distant. Retourne false si
+// le transfert a été interrompu ou l'empreinte n'a pu être calculée.
+func (ts *transfers) verify(t *transfer, done *transferDone) bool {
+	sum, method, err := remoteSHA256(t.ctx, ts.ssh, ts.client, t.path, -1)
+	if err != nil {
+		if t.ctx.Err() != nil {
+			ts.stopped(t)
+		} else {
+			ts.c.sendTransferError(t.id, fmt.Sprintf("checksum: %v", err))
+		}
+		return false
+	}
+	done.SHA256, done.Method = sum, method
+	return true
+}
+
+// ack enregistre les octets reçus par le client et relance l'envoi.
+func (ts *transfers) ack(p ackPayload) {
+	t := ts.get(p.ID)
+	if t == nil || t.op != "get" {
+		return
+	}
+	t.mu.Lock()
+	if p.Offset > t.acked {
+		t.acked = p.Offset
+	}
+	t.mu.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ── Upload (navigateur → hôte) ───────────────────────────────────────────────
+
+func (ts *transfers) startPut(p putPayload) {
+	if p.Path == "" || p.Size < 0 || p.Offset < 0 || p.Offset > p.Size {
+		ts.c.sendTransferError(p.ID, "invalid put payload")
+		return
+	}
+	t, err := ts.register(p.ID, "put", p.Path, p.Size, p.ChunkSize)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	t.offset, t.verify = p.Offset, p.Verify
+	f, err := ts.openPut(p)
+	if err != nil {
+		ts.finish(t)
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	ts.c.send(msgTransfer, transferPayload{
+		ID: t.id, Op: t.op, Path: t.path, Name: path.Base(t.path),
+		Size: t.size, Offset: t.offset, ChunkSize: t.chunkSize, Window: ts.opts.Window,
+	})
+	go ts.runPut(t, f)
+}
+
+// openPut ouvre la destination d'un upload. Pour une reprise, le fichier
+// partiel doit contenir au moins Offset octets ; ce qui suit est tronqué.
+func (ts *transfers) openPut(p putPayload) (*pkgsftp.File, error) {
+	if p.Offset == 0 {
+		f, err := ts.client.OpenFile(p.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return nil, fmt.Errorf("create: %w", err)
+		}
+		return f, nil
+	}
+	fi, err := ts.client.Stat(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("resume: %w", err)
+	}
+	if fi.Size() < p.Offset {
+		return nil, fmt.Errorf("resume: remote file has only %d bytes", fi.Size())
+	}
+	f, err := ts.client.OpenFile(p.Path, os.O_WRONLY)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	if err := f.Truncate(p.Offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncate: %w", err)
+	}
+	if _, err := f.Seek(p.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	return f, nil
+}
+
+func (ts *transfers) runPut(t *transfer, f *pkgsftp.File) {
+	defer ts.finish(t)
+
+	written := t.offset
+	var lastProgress time.Time
+	for written < t.size {
+		select {
+		case data := <-t.chunks:
+			if written+int64(len(data)) > t.size {
+				f.Close()
+				ts.c.sendTransferError(t.id, "more data than announced")
+				return
+			}
+			if _, err := f.Write(data); err != nil {
+				f.Close()
+				ts.c.sendTransferError(t.id, fmt.Sprintf("write: %v", err))
+				return
+			}
+			written += int64(len(data))
+			ts.c.send(msgAck, ackPayload{ID: t.id, Offset: written})
+			ts.sendProgress(t, written, &lastProgress)
+		case <-t.ctx.Done():
+			f.Close()
+			if t.cancelled.Load() && t.offset == 0 {
+				ts.client.Remove(t.path)
+			}
+			ts.stopped(t)
+			return
+		}
+	}
+	if err := f.Close(); err != nil {
+		ts.c.sendTransferError(t.id, fmt.Sprintf("write: %v", err))
+		return
+	}
+	details := map[string]interface{}{"path": t.path, "size": written}
+	if t.offset > 0 {
+		details["resumed_at"] = t.offset
+	}
+	ts.audit(audit.ActionSFTPPut, details)
+
+	done := transferDone{ID: t.id, Op: t.op, Path: t.path, Size: written}
+	if t.verify && !ts.verify(t, &done) {
+		return
+	}
+	ts.c.send(msgTransferDone, done)
+}
+
+// ── Reprise et vérification ──────────────────────────────────────────────────
+
+// stat décrit le fichier distant ; un fichier absent n'est pas une erreur.
+func (ts *transfers) stat(p statPayload) {
+	fi, err := ts.client.Stat(p.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		ts.c.send(msgStatResult, statResult{ID: p.ID, Path: p.Path})
+		return
+	}
+	if err != nil {
+		ts.c.sendTransferError(p.ID, fmt.Sprintf("stat: %v", err))
+		return
+	}
+	ts.c.send(msgStatResult, statResult{
+		ID:      p.ID,
+		Path:    p.Path,
+		Exists:  true,
+		Size:    fi.Size(),
+		IsDir:   fi.IsDir(),
+		ModTime: fi.ModTime().Format(time.RFC3339),
+	})
+}
+
+// checksum calcule l'empreinte en arrière-plan ; comme un transfert, le
+// calcul compte dans la limite par connexion et s'annule avec cancel.
+func (ts *transfers) checksum(p checksumPayload) {
+	if p.Path == "" || p.Length < 0 {
+		ts.c.sendTransferError(p.ID, "invalid checksum payload")
+		return
+	}
+	t, err := ts.register(p.ID, "checksum", p.Path, p.Length, 0)
+	if err != nil {
+		ts.c.sendTransferError(p.ID, err.Error())
+		return
+	}
+	go func() {
+		defer ts.finish(t)
+		length := p.Length
+		if length == 0 {
+			length = -1
+		}
+		sum, method, err := remoteSHA256(t.ctx, ts.ssh, ts.client, t.path, length)
+		if err != nil {
+			if t.ctx.Err() != nil {
+				ts.stopped(t)
+			} else {
+				ts.c.sendTransferError(t.id, fmt.Sprintf("checksum: %v", err))
+			}
+			return
+		}
+		ts.c.send(msgChecksumResult, checksumResult{ID: t.id, Path: t.path, Length: p.Length, SHA256: sum, Method: method})
+	}()
+}
+
+// chunk achemine une frame binaire reçue vers l'upload concerné. Les frames
+// d'un transfert terminé ou annulé sont ignorées.
+func (ts *transfers) chunk(frame []byte) {
+	if len(frame) < frameHeaderSize {
+		return
+	}
+	t := ts.get(binary.BigEndian.Uint32(frame))
+	if t == nil || t.chunks == nil {
+		return
+	}
+	data := frame[frameHeaderSize:]
+	if len(data) > t.chunkSize {
+		ts.abort(t, "chunk larger than negotiated size")
+		return
+	}
+	select {
+	case t.chunks <- data:
+	default:
+		ts.abort(t, "flow control window exceeded")
+	}
+}
+
+// abort interrompt un transfert sur une erreur de protocole du client.
+func (ts *transfers) abort(t *transfer, msg string) {
+	ts.c.sendTransferError(t.id, msg)
+	t.cancel()
+}
+
+// cancelTransfer traite la demande d'annulation du client.
+func (ts *transfers) cancelTransfer(id uint32) {
+	t := ts.get(id)
+	if t == nil {
+		return
+	}
+	t.cancelled.Store(true)
+	t.cancel()
+}
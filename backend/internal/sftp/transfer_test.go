@@ -0,0 +1,491 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pkgsftp "github.com/pkg/sftp"
+)
+
+// testEnv relie un transfers à un serveur SFTP en mémoire, qui sert le système
+// de fichiers local, et à un WebSocket dont le test tient le côté navigateur.
+// Les commandes du client sont passées directement aux méthodes de transfers,
+// comme le fait la boucle de ServeHTTP.
+type testEnv struct {
+	t    *testing.T
+	dir  string // racine des fichiers du test
+	ts   *transfers
+	ws   *websocket.Conn
+	msgs chan testMsg
+
+	mu     sync.Mutex
+	audits []string
+}
+
+type testMsg struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	frame   []byte          // frame binaire
+}
+
+func newTestEnv(t *testing.T, opts TransferOptions) *testEnv {
+	t.Helper()
+	e := &testEnv{t: t, dir: t.TempDir(), msgs: make(chan testMsg, 1024)}
+
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	srv, err := pkgsftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverR, serverW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	client, err := pkgsftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Fermer le serveur d'abord : le client attend la fin de sa lecture.
+		srv.Close()
+		client.Close()
+	})
+
+	accepted := make(chan *websocket.Conn, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			accepted <- ws
+		}
+	}))
+	t.Cleanup(hs.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ws = ws
+	serverWS := <-accepted
+	t.Cleanup(func() {
+		ws.Close()
+		serverWS.Close()
+	})
+
+	e.ts = newTransfers(&conn{ws: serverWS}, nil, client, opts.withDefaults(), e.record)
+	t.Cleanup(e.ts.closeAll)
+	go e.read()
+	return e
+}
+
+func (e *testEnv) record(action string, details map[string]interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.audits = append(e.audits, action)
+}
+
+func (e *testEnv) auditCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.audits)
+}
+
+func (e *testEnv) read() {
+	defer close(e.msgs)
+	for {
+		kind, data, err := e.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m testMsg
+		if kind == websocket.BinaryMessage {
+			m.frame = data
+		} else if err := json.Unmarshal(data, &m); err != nil {
+			e.t.Errorf("malformed message %s", data)
+			return
+		}
+		e.msgs <- m
+	}
+}
+
+// path retourne le chemin absolu de rel sous la racine du test.
+func (e *testEnv) path(rel string) string {
+	return filepath.Join(e.dir, rel)
+}
+
+func (e *testEnv) next(timeout time.Duration) (testMsg, bool) {
+	select {
+	case m, ok := <-e.msgs:
+		return m, ok
+	case <-time.After(timeout):
+		return testMsg{}, false
+	}
+}
+
+// expect retourne le prochain message JSON de type typ, en ignorant les
+// événements d'avancement, et le décode dans v si non nil.
+func (e *testEnv) expect(typ string, v any) testMsg {
+	e.t.Helper()
+	for {
+		m, ok := e.next(5 * time.Second)
+		if !ok {
+			e.t.Fatalf("no %s message", typ)
+		}
+		if m.frame == nil && (m.Type == msgProgress || m.Type == msgOpProgress) {
+			continue
+		}
+		if m.frame != nil || m.Type != typ {
+			e.t.Fatalf("got %s %s (%d bytes binary), want %s", m.Type, m.Payload, len(m.frame), typ)
+		}
+		if v != nil {
+			if err := json.Unmarshal(m.Payload, v); err != nil {
+				e.t.Fatal(err)
+			}
+		}
+		return m
+	}
+}
+
+// expectError attend un message error contenant want.
+func (e *testEnv) expectError(want string) {
+	e.t.Helper()
+	var p struct {
+		Message string `json:"message"`
+	}
+	e.expect(msgError, &p)
+	if !strings.Contains(p.Message, want) {
+		e.t.Fatalf("error %q, want %q", p.Message, want)
+	}
+}
+
+// expectFrame attend une frame binaire du transfert id et retourne ses données.
+func (e *testEnv) expectFrame(id uint32) []byte {
+	e.t.Helper()
+	for {
+		m, ok := e.next(5 * time.Second)
+		if !ok {
+			e.t.Fatal("no binary frame")
+		}
+		if m.frame == nil && m.Type == msgProgress {
+			continue
+		}
+		if m.frame == nil {
+			e.t.Fatalf("got %s %s, want a binary frame", m.Type, m.Payload)
+		}
+		if got := binary.BigEndian.Uint32(m.frame); got != id {
+			e.t.Fatalf("frame for transfer %d, want %d", got, id)
+		}
+		return m.frame[frameHeaderSize:]
+	}
+}
+
+// quiet vérifie qu'aucune frame ni message autre qu'un avancement n'arrive.
+func (e *testEnv) quiet(d time.Duration) {
+	e.t.Helper()
+	deadline := time.After(d)
+	for {
+		select {
+		case m := <-e.msgs:
+			if m.frame == nil && m.Type == msgProgress {
+				continue
+			}
+			e.t.Fatalf("unexpected %s %s (%d bytes binary)", m.Type, m.Payload, len(m.frame))
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func frame(id uint32, data []byte) []byte {
+	f := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(f, id)
+	copy(f[frameHeaderSize:], data)
+	return f
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func writeFile(t *testing.T, p string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGetFlowControl(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize, Window: 2})
+	content := randomBytes(t, 5*minChunkSize+100)
+	writeFile(t, e.path("data.bin"), content)
+
+	e.ts.startGet(getPayload{ID: 7, Path: e.path("data.bin"), Verify: true})
+	var tp transferPayload
+	e.expect(msgTransfer, &tp)
+	if tp.Size != int64(len(content)) || tp.ChunkSize != minChunkSize || tp.Window != 2 {
+		t.Fatalf("transfer %+v", tp)
+	}
+
+	var got []byte
+	for len(got) < len(content) {
+		// Jamais plus de Window morceaux sans acquittement
+		for i := 0; i < 2 && len(got) < len(content); i++ {
+			data := e.expectFrame(7)
+			if len(data) > minChunkSize {
+				t.Fatalf("chunk of %d bytes", len(data))
+			}
+			got = append(got, data...)
+		}
+		if len(got) < len(content) {
+			e.quiet(50 * time.Millisecond)
+		}
+		e.ts.ack(ackPayload{ID: 7, Offset: int64(len(got))})
+	}
+	var done transferDone
+	e.expect(msgTransferDone, &done)
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded content differs")
+	}
+	if done.Size != int64(len(content)) || done.SHA256 != sha256Hex(content) || done.Method != checksumStream {
+		t.Fatalf("done %+v", done)
+	}
+}
+
+func TestGetResume(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize, Window: 4})
+	content := randomBytes(t, 3*minChunkSize)
+	writeFile(t, e.path("data.bin"), content)
+
+	offset := int64(minChunkSize + 10)
+	e.ts.startGet(getPayload{ID: 1, Path: e.path("data.bin"), Offset: offset})
+	var tp transferPayload
+	e.expect(msgTransfer, &tp)
+	if tp.Offset != offset {
+		t.Fatalf("offset %d, want %d", tp.Offset, offset)
+	}
+	var got []byte
+	for int64(len(got)) < int64(len(content))-offset {
+		got = append(got, e.expectFrame(1)...)
+	}
+	e.expect(msgTransferDone, nil)
+	if !bytes.Equal(got, content[offset:]) {
+		t.Fatal("resumed content differs")
+	}
+}
+
+func TestGetRejectsInvalidOffset(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	writeFile(t, e.path("data.bin"), []byte("0123456789"))
+
+	for _, offset := range []int64{-1, 11} {
+		e.ts.startGet(getPayload{ID: 1, Path: e.path("data.bin"), Offset: offset})
+		e.expectError("invalid offset")
+	}
+	e.ts.startGet(getPayload{ID: 1, Path: e.dir})
+	e.expectError("is a directory")
+}
+
+func TestPut(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize, Window: 2})
+	content := randomBytes(t, 3*minChunkSize+5)
+
+	e.ts.startPut(putPayload{ID: 3, Path: e.path("up.bin"), Size: int64(len(content))})
+	var tp transferPayload
+	e.expect(msgTransfer, &tp)
+	for sent := 0; sent < len(content); {
+		end := min(sent+tp.ChunkSize, len(content))
+		e.ts.chunk(frame(3, content[sent:end]))
+		sent = end
+		var ack ackPayload
+		e.expect(msgAck, &ack)
+		if ack.Offset != int64(sent) {
+			t.Fatalf("ack %d, want %d", ack.Offset, sent)
+		}
+	}
+	var done transferDone
+	e.expect(msgTransferDone, &done)
+	if got, _ := os.ReadFile(e.path("up.bin")); !bytes.Equal(got, content) {
+		t.Fatal("uploaded content differs")
+	}
+	if e.auditCount() != 1 {
+		t.Fatalf("%d audit events, want 1", e.auditCount())
+	}
+}
+
+func TestPutResume(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize})
+	content := randomBytes(t, 2*minChunkSize)
+	// Fichier partiel suivi d'octets invalides, tronqués à la reprise
+	partial := append(append([]byte{}, content[:1000]...), "garbage"...)
+	writeFile(t, e.path("up.bin"), partial)
+
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: int64(len(content)), Offset: 1000})
+	var tp transferPayload
+	e.expect(msgTransfer, &tp)
+	if tp.Offset != 1000 {
+		t.Fatalf("offset %d", tp.Offset)
+	}
+	e.ts.chunk(frame(1, content[1000:1000+minChunkSize]))
+	e.expect(msgAck, nil)
+	e.ts.chunk(frame(1, content[1000+minChunkSize:]))
+	e.expect(msgAck, nil)
+	e.expect(msgTransferDone, nil)
+	if got, _ := os.ReadFile(e.path("up.bin")); !bytes.Equal(got, content) {
+		t.Fatal("resumed upload differs")
+	}
+}
+
+func TestPutRejectsInvalidOffset(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	writeFile(t, e.path("up.bin"), []byte("0123"))
+
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: 10, Offset: 11})
+	e.expectError("invalid put payload")
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: 10, Offset: -1})
+	e.expectError("invalid put payload")
+	// Le fichier distant est plus court que l'offset annoncé
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: 10, Offset: 5})
+	e.expectError("remote file has only 4 bytes")
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("missing.bin"), Size: 10, Offset: 5})
+	e.expectError("resume:")
+	if got, _ := os.ReadFile(e.path("up.bin")); string(got) != "0123" {
+		t.Fatalf("rejected resume modified the file: %q", got)
+	}
+}
+
+func TestPutCancelRemovesPartialFile(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize})
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: 3 * minChunkSize})
+	e.expect(msgTransfer, nil)
+	e.ts.chunk(frame(1, randomBytes(t, minChunkSize)))
+	e.expect(msgAck, nil)
+	if _, err := os.Stat(e.path("up.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	e.ts.cancelTransfer(1)
+	var p cancelPayload
+	e.expect(msgCancelled, &p)
+	if p.ID != 1 {
+		t.Fatalf("cancelled %d", p.ID)
+	}
+	e.ts.wg.Wait()
+	if _, err := os.Stat(e.path("up.bin")); !os.IsNotExist(err) {
+		t.Fatalf("partial upload left on the host (%v)", err)
+	}
+}
+
+func TestPutCancelKeepsResumedFile(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize})
+	content := randomBytes(t, 3*minChunkSize)
+	writeFile(t, e.path("up.bin"), content[:1000])
+
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: int64(len(content)), Offset: 1000})
+	e.expect(msgTransfer, nil)
+	e.ts.chunk(frame(1, content[1000:1000+minChunkSize]))
+	e.expect(msgAck, nil)
+
+	e.ts.cancelTransfer(1)
+	e.expect(msgCancelled, nil)
+	e.ts.wg.Wait()
+	got, err := os.ReadFile(e.path("up.bin"))
+	if err != nil {
+		t.Fatalf("resumed upload removed on cancel (%v)", err)
+	}
+	if !bytes.Equal(got, content[:1000+minChunkSize]) {
+		t.Fatalf("partial file has %d bytes, want %d", len(got), 1000+minChunkSize)
+	}
+}
+
+func TestPutMoreDataThanAnnounced(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize})
+	e.ts.startPut(putPayload{ID: 1, Path: e.path("up.bin"), Size: 10})
+	e.expect(msgTransfer, nil)
+	e.ts.chunk(frame(1, make([]byte, 11)))
+	e.expectError("more data than announced")
+}
+
+func TestChunkFlowControlAbort(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{ChunkSize: minChunkSize, Window: 2})
+
+	// Transfert enregistré sans consommateur : la file de Window morceaux
+	// déborde au troisième.
+	tr, err := e.ts.register(1, "put", e.path("up.bin"), 10*minChunkSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ts.chunk(frame(1, make([]byte, 10)))
+	e.ts.chunk(frame(1, make([]byte, 10)))
+	if tr.ctx.Err() != nil {
+		t.Fatal("transfer aborted within the window")
+	}
+	e.ts.chunk(frame(1, make([]byte, 10)))
+	e.expectError("flow control window exceeded")
+	if tr.ctx.Err() == nil {
+		t.Fatal("transfer not aborted")
+	}
+	e.ts.finish(tr)
+
+	tr, err = e.ts.register(2, "put", e.path("up.bin"), 10*minChunkSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ts.chunk(frame(2, make([]byte, minChunkSize+1)))
+	e.expectError("chunk larger than negotiated size")
+	if tr.ctx.Err() == nil {
+		t.Fatal("oversized chunk accepted")
+	}
+	e.ts.finish(tr)
+
+	// Frames d'un transfert inconnu ou tronquées : ignorées
+	e.ts.chunk(frame(99, []byte("x")))
+	e.ts.chunk([]byte{0, 0})
+	e.quiet(50 * time.Millisecond)
+}
+
+func TestRegisterLimits(t *testing.T) {
+	e := newTestEnv(t, TransferOptions{})
+	if _, err := e.ts.register(0, "get", "/", 0, 0); err == nil {
+		t.Fatal("id 0 accepted")
+	}
+	var all []*transfer
+	for id := uint32(1); id <= maxTransfers; id++ {
+		tr, err := e.ts.register(id, "get", "/", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, tr)
+	}
+	if _, err := e.ts.register(1, "get", "/", 0, 0); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("duplicate id: %v", err)
+	}
+	if _, err := e.ts.register(maxTransfers+1, "get", "/", 0, 0); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Fatalf("over limit: %v", err)
+	}
+	for _, tr := range all {
+		e.ts.finish(tr)
+	}
+}
@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/jackc/pgx/v5/pgxpool"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const dialTimeout = 15 * time.Second
+
+var (
+	ErrInvalidPrivateKey = errors.New("invalid private key")
+	ErrMissingCredential = errors.New("missing credential")
+)
+
+// HopCredential est le credential déchiffré côté client pour un bastion de la chaîne.
+type HopCredential struct {
+	HostID     string `json:"host_id"`
+	Credential string `json:"credential"`
+}
+
+// ChainCredentials associe l'ID de chaque hôte de la chaîne à son credential en clair.
+func ChainCredentials(targetID, targetCredential string, jumps []HopCredential) map[string]string {
+	creds := make(map[string]string, len(jumps)+1)
+	for _, j := range jumps {
+		creds[j.HostID] = j.Credential
+	}
+	creds[targetID] = targetCredential
+	return creds
+}
+
+// Chain est une connexion SSH établie à travers zéro ou plusieurs bastions.
+// Target est le client connecté au dernier hôte de la chaîne.
+type Chain struct {
+	Target  *gossh.Client
+	clients []*gossh.Client
+}
+
+// Close ferme les connexions de la cible vers le premier bastion.
+func (c *Chain) Close() error {
+	var first error
+	for i := len(c.clients) - 1; i >= 0; i-- {
+		if err := c.clients[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// DialChain se connecte au dernier hôte de hosts en rebondissant par chacun des
+// hôtes précédents (client.Dial + NewClientConn). Chaque saut vérifie sa propre
+// clé d'hôte. Les credentials sont effacés une fois les connexions établies.
+func DialChain(ctx context.Context, pool *pgxpool.Pool, hosts []*models.Host, credentials map[string]string) (*Chain, error) {
+	defer func() {
+		for id, cred := range credentials {
+			zeroString(&cred)
+			credentials[id] = cred
+		}
+	}()
+
+	chain := &Chain{}
+	for i, host := range hosts {
+		client, err := dialHop(ctx, pool, chain, host, credentials[host.ID])
+		if err != nil {
+			chain.Close()
+			if i < len(hosts)-1 {
+				return nil, fmt.Errorf("jump host %s: %w", host.Name, err)
+			}
+			return nil, err
+		}
+		chain.clients = append(chain.clients, client)
+		chain.Target = client
+	}
+	return chain, nil
+}
+
+func dialHop(ctx context.Context, pool *pgxpool.Pool, chain *Chain, host *models.Host, credential string) (*gossh.Client, error) {
+	if credential == "" {
+		return nil, ErrMissingCredential
+	}
+
+	cfg := &gossh.ClientConfig{
+		User:    host.Username,
+		Timeout: dialTimeout,
+	}
+	if err := ApplyHostKeyPolicy(ctx, pool, host.ID, cfg); err != nil {
+		return nil, fmt.Errorf("host key verification unavailable: %w", err)
+	}
+	switch host.AuthType {
+	case "password":
+		cfg.Auth = []gossh.AuthMethod{gossh.Password(credential)}
+	case "key":
+		signer, err := gossh.ParsePrivateKey([]byte(credential))
+		if err != nil {
+			return nil, ErrInvalidPrivateKey
+		}
+		cfg.Auth = []gossh.AuthMethod{gossh.PublicKeys(signer)}
+	}
+
+	addr := net.JoinHostPort(host.Hostname, fmt.Sprint(host.Port))
+	if chain.Target == nil {
+		return gossh.Dial("tcp", addr, cfg)
+	}
+
+	conn, err := chain.Target.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Les canaux SSH ne supportent pas les deadlines : on coupe la connexion
+	// si le handshake dépasse le timeout.
+	timer := time.AfterFunc(dialTimeout, func() { conn.Close() })
+	c, chans, reqs, err := gossh.NewClientConn(conn, addr, cfg)
+	timer.Stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// HostKeyChangedError est retournée quand la clé présentée par le serveur ne
+// correspond pas à la clé épinglée. Elle traverse gossh.Dial (wrapping %w).
+type HostKeyChangedError struct {
+	HostID         string
+	KeyType        string
+	OldFingerprint string
+	NewFingerprint string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("host key changed for host %s: expected %s, got %s", e.HostID, e.OldFingerprint, e.NewFingerprint)
+}
+
+// AsHostKeyChanged extrait une HostKeyChangedError d'une erreur de connexion.
+func AsHostKeyChanged(err error) (*HostKeyChangedError, bool) {
+	var hkErr *HostKeyChangedError
+	if errors.As(err, &hkErr) {
+		return hkErr, true
+	}
+	return nil, false
+}
+
+// Payload retourne le payload du message WS "host_key_changed".
+func (e *HostKeyChangedError) Payload() map[string]string {
+	return map[string]string{
+		"host_id":         e.HostID,
+		"key_type":        e.KeyType,
+		"old_fingerprint": e.OldFingerprint,
+		"new_fingerprint": e.NewFingerprint,
+	}
+}
+
+// ApplyHostKeyPolicy configure cfg pour vérifier la clé d'hôte en trust-on-first-use :
+// la clé vue à la première connexion est épinglée, toute clé différente est refusée.
+func ApplyHostKeyPolicy(ctx context.Context, pool *pgxpool.Pool, hostID string, cfg *gossh.ClientConfig) error {
+	known, err := db.GetHostKey(ctx, pool, hostID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if err == nil {
+		// Négocier le même type de clé que celui épinglé, sinon un serveur
+		// proposant plusieurs clés pourrait en présenter une autre, légitime.
+		cfg.HostKeyAlgorithms = hostKeyAlgorithms(known.KeyType)
+	}
+
+	cfg.HostKeyCallback = func(_ string, _ net.Addr, key gossh.PublicKey) error {
+		return checkHostKey(ctx, pool, hostID, key)
+	}
+	return nil
+}
+
+func checkHostKey(ctx context.Context, pool *pgxpool.Pool, hostID string, key gossh.PublicKey) error {
+	fingerprint := gossh.FingerprintSHA256(key)
+	raw := key.Marshal()
+
+	known, err := db.GetHostKey(ctx, pool, hostID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		pinned, err := db.PinHostKey(ctx, pool, hostID, key.Type(), raw, fingerprint)
+		if err != nil {
+			return fmt.Errorf("pin host key: %w", err)
+		}
+		if pinned {
+			log.Printf("[host=%s] host key pinned on first use: %s %s", hostID, key.Type(), fingerprint)
+			return nil
+		}
+		// Une connexion concurrente a épinglé une clé entre-temps : on compare avec elle.
+		known, err = db.GetHostKey(ctx, pool, hostID)
+	}
+	if err != nil {
+		return fmt.Errorf("load host key: %w", err)
+	}
+
+	if bytes.Equal(known.PublicKey, raw) {
+		return nil
+	}
+
+	if err := db.SetPendingHostKey(ctx, pool, hostID, key.Type(), raw, fingerprint); err != nil {
+		log.Printf("[host=%s] failed to record pending host key: %v", hostID, err)
+	}
+	log.Printf("[host=%s] HOST KEY MISMATCH: pinned %s, got %s", hostID, known.Fingerprint, fingerprint)
+	return &HostKeyChangedError{
+		HostID:         hostID,
+		KeyType:        key.Type(),
+		OldFingerprint: known.Fingerprint,
+		NewFingerprint: fingerprint,
+	}
+}
+
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == gossh.KeyAlgoRSA {
+		return []string{gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
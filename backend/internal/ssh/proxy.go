@@ -3,17 +3,17 @@ package ssh
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"strings"
 	"sync"
 	"time"
 	"unsafe"
 
+	"github.com/gestion-ssh/backend/internal/audit"
 	"github.com/gestion-ssh/backend/internal/db"
 	"github.com/gorilla/websocket"
-	"github.com/jackc/pgx/v5/pgxpool"
 	gossh "golang.org/x/crypto/ssh"
 )
 
@@ -23,6 +23,8 @@ type ConnectPayload struct {
 	Credential string `json:"credential"`
 	Cols       uint16 `json:"cols"`
 	Rows       uint16 `json:"rows"`
+	// Credentials des bastions traversés pour joindre l'hôte (voir jump_host_id)
+	JumpCredentials []HopCredential `json:"jump_credentials"`
 }
 
 // Types WS internes prives, pas besoin d'importer le package ws.
@@ -36,59 +38,70 @@ type resizePayload struct {
 	Rows uint16 `json:"rows"`
 }
 
-// Proxy gere le cycle de vie d'une session SSH via WebSocket.
+// ReattachPayload permet de reprendre une session après une coupure du WebSocket.
+// Offset est le nombre d'octets de sortie déjà reçus (champ "offset" des messages output).
+type ReattachPayload struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+// Proxy relie un WebSocket à une Session SSH. La session elle-même est portée
+// par le Manager et peut survivre au Proxy (voir Session.detach).
 type Proxy struct {
-	pool      *pgxpool.Pool
-	wsConn    *websocket.Conn
-	writeMu   sync.Mutex
-	sessionID string
+	manager *Manager
+	wsConn  *websocket.Conn
+	writeMu sync.Mutex
+	userID  string
+	email   string
 }
 
-func NewProxy(pool *pgxpool.Pool, wsConn *websocket.Conn) *Proxy {
-	return &Proxy{pool: pool, wsConn: wsConn}
+func NewProxy(manager *Manager, wsConn *websocket.Conn, userID, email string) *Proxy {
+	return &Proxy{manager: manager, wsConn: wsConn, userID: userID, email: email}
 }
 
-func (p *Proxy) HandleConnection(ctx context.Context, payload ConnectPayload, userID, clientIP string) {
-	host, err := db.GetHostByID(ctx, p.pool, payload.HostID, userID)
+func (p *Proxy) HandleConnection(ctx context.Context, payload ConnectPayload, clientIP string) {
+	userID := p.userID
+	pool := p.manager.pool
+	hosts, err := db.GetHostChain(ctx, pool, payload.HostID, userID)
 	if err != nil {
+		if errors.Is(err, db.ErrInvalidJumpChain) {
+			p.sendError("invalid jump host chain")
+			return
+		}
 		p.sendError("host not found")
 		return
 	}
-
-	sshConfig := &gossh.ClientConfig{
-		User:            host.Username,
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
-		Timeout:         15 * time.Second,
-	}
+	host := hosts[len(hosts)-1]
 
 	credential := payload.Credential
-	switch host.AuthType {
-	case "password":
-		sshConfig.Auth = []gossh.AuthMethod{gossh.Password(credential)}
-	case "key":
-		signer, err := gossh.ParsePrivateKey([]byte(credential))
-		if err != nil {
-			p.sendError("invalid private key")
-			zeroString(&credential)
-			return
-		}
-		sshConfig.Auth = []gossh.AuthMethod{gossh.PublicKeys(signer)}
-	}
 	defer zeroString(&credential)
 
-	client, err := gossh.Dial("tcp", fmt.Sprintf("%s:%d", host.Hostname, host.Port), sshConfig)
+	chain, err := DialChain(ctx, pool, hosts, ChainCredentials(host.ID, credential, payload.JumpCredentials))
 	if err != nil {
+		if hkErr, ok := AsHostKeyChanged(err); ok {
+			p.send("host_key_changed", hkErr.Payload())
+			return
+		}
+		if errors.Is(err, ErrInvalidPrivateKey) || errors.Is(err, ErrMissingCredential) {
+			p.sendError(err.Error())
+			return
+		}
 		p.sendError(fmt.Sprintf("connection failed: %v", err))
 		return
 	}
-	defer client.Close()
+	// Jusqu'à la création de la Session, c'est à nous de fermer la connexion.
+	established := false
+	defer func() {
+		if !established {
+			chain.Close()
+		}
+	}()
 
-	session, err := client.NewSession()
+	session, err := chain.Target.NewSession()
 	if err != nil {
 		p.sendError("failed to create SSH session")
 		return
 	}
-	defer session.Close()
 
 	modes := gossh.TerminalModes{gossh.ECHO: 1, gossh.TTY_OP_ISPEED: 14400, gossh.TTY_OP_OSPEED: 14400}
 	cols, rows := int(payload.Cols), int(payload.Rows)
@@ -124,20 +137,98 @@ func (p *Proxy) HandleConnection(ctx context.Context, payload ConnectPayload, us
 		return
 	}
 
-	sessionID, err := db.CreateSession(ctx, p.pool, userID, host.ID, clientIP)
+	sessionID, err := db.CreateSession(ctx, pool, userID, host.ID, clientIP, "terminal")
 	if err != nil {
+		// Sans ligne de session, le terminal échapperait au Manager : ni
+		// fermeture par un administrateur, ni enregistrement, ni audit.
 		log.Printf("failed to create session record: %v", err)
+		p.sendError("failed to create session")
+		return
 	}
-	p.sessionID = sessionID
 	shortID := sessionID
 	if len(shortID) > 8 {
 		shortID = shortID[:8]
 	}
 	tag := fmt.Sprintf("[session=%s host=%s]", shortID, host.Name)
 	log.Printf("%s session started (user=%s ip=%s)", tag, userID, clientIP)
-	p.send("connected", map[string]string{"session_id": sessionID, "host_name": host.Name})
+	audit.Record(ctx, pool, audit.Event{
+		ActorID:    userID,
+		ActorEmail: p.email,
+		Action:     audit.ActionSSHSession,
+		Target:     host.ID,
+		IP:         clientIP,
+		Details:    map[string]interface{}{"session_id": sessionID, "host": host.Name, "hostname": host.Hostname},
+	})
 
-	ctx2, cancel := context.WithCancel(ctx)
+	sessCtx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ID:       sessionID,
+		UserID:   userID,
+		HostName: host.Name,
+		manager:  p.manager,
+		tag:      tag,
+		chain:    chain,
+		ssh:      session,
+		stdin:    stdin,
+		ctx:      sessCtx,
+		cancel:   cancel,
+	}
+	established = true
+
+	if err := p.manager.startRecording(ctx, s, host, cols, rows); err != nil {
+		log.Printf("%s recording: %v", tag, err)
+		p.sendError("session recording is required but unavailable")
+		s.Close("recording unavailable")
+		return
+	}
+	if s.rec != nil {
+		log.Printf("%s recording enabled", tag)
+	}
+
+	p.manager.add(s)
+	s.start(stdout, stderr)
+	if err := s.attach(p, "connected", 0); err != nil {
+		p.sendError(err.Error())
+		return
+	}
+	p.serve(s)
+}
+
+// HandleReattach rattache le WebSocket à une session encore vivante et rejoue
+// la sortie manquée depuis payload.Offset.
+func (p *Proxy) HandleReattach(payload ReattachPayload) {
+	s, err := p.manager.Get(payload.SessionID, p.userID)
+	if err != nil {
+		p.sendError(err.Error())
+		return
+	}
+	if err := s.attach(p, "reattached", payload.Offset); err != nil {
+		p.sendError(err.Error())
+		return
+	}
+	log.Printf("%s websocket reattached (offset=%d)", s.tag, payload.Offset)
+	p.serve(s)
+}
+
+// HandleJoin abonne le WebSocket à la session d'un autre utilisateur à l'aide
+// d'un jeton d'invitation.
+func (p *Proxy) HandleJoin(payload JoinPayload) {
+	s, canWrite, offset, err := p.manager.redeem(payload.Token, p.email)
+	if err != nil {
+		p.sendError(err.Error())
+		return
+	}
+	if err := s.join(p, canWrite, offset); err != nil {
+		p.sendError(err.Error())
+		return
+	}
+	log.Printf("%s viewer joined (user=%s write=%v)", s.tag, p.userID, canWrite)
+	p.serve(s)
+}
+
+// serve relaie les messages du WebSocket vers la session jusqu'à sa fermeture.
+func (p *Proxy) serve(s *Session) {
+	ctx, cancel := context.WithCancel(s.ctx)
 	defer cancel()
 
 	// WebSocket keepalive : envoie un ping toutes les 30s pour maintenir la connexion
@@ -147,85 +238,29 @@ func (p *Proxy) HandleConnection(ctx context.Context, payload ConnectPayload, us
 		defer ticker.Stop()
 		for {
 			select {
-			case <-ctx2.Done():
-				log.Printf("%s ws-keepalive goroutine: ctx done, exiting", tag)
+			case <-ctx.Done():
+				log.Printf("%s ws-keepalive goroutine: ctx done, exiting", s.tag)
 				return
 			case <-ticker.C:
 				p.writeMu.Lock()
 				err := p.wsConn.WriteMessage(websocket.PingMessage, nil)
 				p.writeMu.Unlock()
 				if err != nil {
-					log.Printf("%s ws-keepalive: ping failed: %v → cancelling", tag, err)
-					cancel()
+					log.Printf("%s ws-keepalive: ping failed: %v → closing ws", s.tag, err)
+					p.close()
 					return
 				}
-				log.Printf("%s ws-keepalive: ping OK", tag)
-			}
-		}
-	}()
-
-	// SSH keepalive : envoie un keepalive au serveur SSH toutes les 30s.
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx2.Done():
-				log.Printf("%s ssh-keepalive goroutine: ctx done, exiting", tag)
-				return
-			case <-ticker.C:
-				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
-				if err != nil {
-					log.Printf("%s ssh-keepalive: request failed: %v → cancelling", tag, err)
-					cancel()
-					return
-				}
-				log.Printf("%s ssh-keepalive: OK", tag)
-			}
-		}
-	}()
-
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := stdout.Read(buf)
-			if n > 0 {
-				p.send("output", map[string]string{"data": string(buf[:n])})
-			}
-			if err != nil {
-				log.Printf("%s stdout goroutine: read error: %v → closing ws", tag, err)
-				p.send("closed", map[string]string{"reason": "ssh closed"})
-				p.wsConn.Close()
-				cancel()
-				return
-			}
-		}
-	}()
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				p.send("output", map[string]string{"data": string(buf[:n])})
-			}
-			if err != nil {
-				log.Printf("%s stderr goroutine: read error: %v", tag, err)
-				return
+				log.Printf("%s ws-keepalive: ping OK", s.tag)
 			}
 		}
 	}()
 
+	readOnlyNotified := false
 	for {
-		select {
-		case <-ctx2.Done():
-			log.Printf("%s main loop: ctx done, exiting", tag)
-			return
-		default:
-		}
-
 		_, raw, err := p.wsConn.ReadMessage()
 		if err != nil {
-			log.Printf("%s main loop: ws ReadMessage error: %v", tag, err)
+			log.Printf("%s main loop: ws ReadMessage error: %v", s.tag, err)
+			s.detach(p)
 			return
 		}
 
@@ -240,15 +275,24 @@ func (p *Proxy) HandleConnection(ctx context.Context, payload ConnectPayload, us
 			if err := json.Unmarshal(msg.Payload, &in); err != nil {
 				continue
 			}
-			io.WriteString(stdin, in.Data)
+			if !s.input(p, in.Data) && !readOnlyNotified {
+				p.sendError("read-only access to this session")
+				readOnlyNotified = true
+			}
 		case "resize":
 			var r resizePayload
 			if err := json.Unmarshal(msg.Payload, &r); err != nil {
 				continue
 			}
-			session.WindowChange(int(r.Rows), int(r.Cols))
+			s.resize(p, int(r.Cols), int(r.Rows))
 		case "disconnect":
-			log.Printf("%s client sent disconnect", tag)
+			log.Printf("%s client sent disconnect (user=%s)", s.tag, p.userID)
+			// Un invité quitte seulement ; le propriétaire termine la session.
+			if s.isOwner(p) {
+				s.Close("client disconnected")
+			} else {
+				s.detach(p)
+			}
 			return
 		}
 	}
@@ -265,17 +309,19 @@ func (p *Proxy) send(msgType string, payload interface{}) {
 	}
 	p.writeMu.Lock()
 	defer p.writeMu.Unlock()
-	p.wsConn.WriteMessage(websocket.TextMessage, data)
+	// Deadline : un socket mort ne doit pas bloquer la session qui lui écrit.
+	p.wsConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := p.wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
+		p.wsConn.Close()
+	}
 }
 
 func (p *Proxy) sendError(message string) {
 	p.send("error", map[string]string{"message": message})
 }
 
-func (p *Proxy) CloseSession(ctx context.Context) {
-	if p.sessionID != "" {
-		db.CloseSession(ctx, p.pool, p.sessionID)
-	}
+func (p *Proxy) close() {
+	p.wsConn.Close()
 }
 
 func zeroString(s *string) {
@@ -0,0 +1,549 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gestion-ssh/backend/internal/db"
+	"github.com/gestion-ssh/backend/internal/models"
+	"github.com/gestion-ssh/backend/internal/recording"
+	"github.com/jackc/pgx/v5/pgxpool"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// scrollbackSize est la quantité de sortie conservée pour être rejouée lors d'un reattach.
+const scrollbackSize = 256 * 1024
+
+var ErrSessionNotFound = errors.New("session not found or expired")
+
+// Manager est le registre en mémoire des sessions terminal actives.
+// Une session survit à la coupure de son WebSocket pendant le délai de grâce,
+// le navigateur peut alors s'y rattacher avec un message "reattach".
+type Manager struct {
+	pool       *pgxpool.Pool
+	recordings recording.Storage
+	grace      time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	invites  map[string]*invite   // clé : SHA-256 du jeton d'invitation
+	conns    map[string]*liveConn // connexions SFTP et tunnels, par ID de session
+}
+
+// liveConn est une connexion SFTP ou un tunnel de redirection en cours. Les
+// sessions terminal, elles, sont suivies dans Manager.sessions.
+type liveConn struct {
+	userID    string
+	terminate func(reason string)
+}
+
+func NewManager(pool *pgxpool.Pool, recordings recording.Storage, grace time.Duration) *Manager {
+	return &Manager{
+		pool:       pool,
+		recordings: recordings,
+		grace:      grace,
+		sessions:   make(map[string]*Session),
+		invites:    make(map[string]*invite),
+		conns:      make(map[string]*liveConn),
+	}
+}
+
+// Track inscrit une connexion SFTP ou un tunnel en cours pour qu'un
+// administrateur puisse y mettre fin : terminate doit prévenir le client avec
+// la raison puis fermer la connexion. untrack est à appeler à la fermeture.
+func (m *Manager) Track(sessionID, userID string, terminate func(reason string)) (untrack func()) {
+	c := &liveConn{userID: userID, terminate: terminate}
+	m.mu.Lock()
+	m.conns[sessionID] = c
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.conns[sessionID] == c {
+			delete(m.conns, sessionID)
+		}
+	}
+}
+
+// Terminate ferme la session active sessionID, quel que soit son type
+// (terminal, SFTP ou tunnel). Retourne false si elle n'est pas active sur ce serveur.
+func (m *Manager) Terminate(sessionID, reason string) bool {
+	m.mu.Lock()
+	s := m.sessions[sessionID]
+	c := m.conns[sessionID]
+	m.mu.Unlock()
+	switch {
+	case s != nil:
+		s.Close(reason)
+	case c != nil:
+		c.terminate(reason)
+	default:
+		return false
+	}
+	return true
+}
+
+// Get retourne la session active sessionID si elle appartient à userID.
+func (m *Manager) Get(sessionID, userID string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[sessionID]
+	if !ok || s.UserID != userID {
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+func (m *Manager) add(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = s
+}
+
+func (m *Manager) remove(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[s.ID] == s {
+		delete(m.sessions, s.ID)
+	}
+	for key, inv := range m.invites {
+		if inv.session == s {
+			delete(m.invites, key)
+		}
+	}
+}
+
+// TerminateUser ferme toutes les sessions en cours de l'utilisateur : ses
+// sessions terminal, connexions SFTP et tunnels, et le détache des sessions
+// partagées qu'il suit en invité. Retourne le nombre de sessions fermées.
+func (m *Manager) TerminateUser(userID, reason string) int {
+	m.mu.Lock()
+	var owned, joined []*Session
+	for _, s := range m.sessions {
+		if s.UserID == userID {
+			owned = append(owned, s)
+		} else {
+			joined = append(joined, s)
+		}
+	}
+	var conns []*liveConn
+	for _, c := range m.conns {
+		if c.userID == userID {
+			conns = append(conns, c)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, s := range owned {
+		s.Close(reason)
+	}
+	for _, s := range joined {
+		s.dropUser(userID, reason)
+	}
+	for _, c := range conns {
+		c.terminate(reason)
+	}
+	return len(owned) + len(conns)
+}
+
+// startRecording démarre l'enregistrement asciicast de la session si la politique
+// de l'utilisateur l'impose pour cet hôte.
+func (m *Manager) startRecording(ctx context.Context, s *Session, host *models.Host, cols, rows int) error {
+	record, err := db.ShouldRecordSession(ctx, m.pool, s.UserID, host.ID)
+	if err != nil {
+		return err
+	}
+	if !record {
+		return nil
+	}
+	if m.recordings == nil {
+		return errors.New("no recording storage")
+	}
+	name := s.ID + ".cast"
+	rec, err := recording.Start(m.recordings, name, cols, rows, host.Name)
+	if err != nil {
+		return err
+	}
+	if err := db.SetSessionRecording(ctx, m.pool, s.ID, name); err != nil {
+		rec.Close()
+		return err
+	}
+	s.rec = rec
+	s.Recording = true
+	return nil
+}
+
+// Session est une session terminal SSH, indépendante des WebSockets qui l'affichent.
+// Elle diffuse sa sortie à son propriétaire et aux éventuels invités (voir share.go).
+type Session struct {
+	ID        string
+	UserID    string
+	HostName  string
+	Recording bool
+
+	manager *Manager
+	tag     string
+	chain   *Chain
+	ssh     *gossh.Session
+	stdin   io.WriteCloser
+	rec     *recording.Recorder
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// outMu ordonne la diffusion de la sortie, faite hors de mu : un abonné
+	// lent ne bloque ni la saisie ni les rattachements. viewersMu ordonne de
+	// même les annonces de la liste des participants.
+	outMu       sync.Mutex
+	viewersMu   sync.Mutex
+	mu          sync.Mutex
+	scrollback  ringBuffer
+	subscribers map[*Proxy]*subscriber
+	graceTimer  *time.Timer
+	closed      bool
+}
+
+// subscriber est un WebSocket abonné à la sortie de la session.
+// Le propriétaire est le seul à pouvoir redimensionner le terminal ; sa
+// déconnexion déclenche le délai de grâce.
+type subscriber struct {
+	owner    bool
+	canWrite bool
+}
+
+// Viewer décrit un participant dans le message "viewers".
+type Viewer struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Owner    bool   `json:"owner"`
+	CanWrite bool   `json:"can_write"`
+}
+
+// start lance les goroutines de lecture de la sortie SSH et du keepalive SSH.
+func (s *Session) start(stdout, stderr io.Reader) {
+	go func() {
+		s.pump(stdout, "stdout")
+		// Fin de stdout = fin du shell distant
+		s.Close("ssh closed")
+	}()
+	go s.pump(stderr, "stderr")
+
+	// SSH keepalive : envoie un keepalive au serveur SSH toutes les 30s.
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				log.Printf("%s ssh-keepalive goroutine: ctx done, exiting", s.tag)
+				return
+			case <-ticker.C:
+				_, _, err := s.chain.Target.SendRequest("keepalive@openssh.com", true, nil)
+				if err != nil {
+					log.Printf("%s ssh-keepalive: request failed: %v → closing", s.tag, err)
+					s.Close("ssh keepalive failed")
+					return
+				}
+				log.Printf("%s ssh-keepalive: OK", s.tag)
+			}
+		}
+	}()
+}
+
+func (s *Session) pump(r io.Reader, name string) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.output(buf[:n])
+		}
+		if err != nil {
+			log.Printf("%s %s goroutine: read error: %v", s.tag, name, err)
+			return
+		}
+	}
+}
+
+// output mémorise la sortie dans le scrollback puis la diffuse aux abonnés.
+// Les abonnés sont relevés sous le même verrou que l'écriture : un reattach
+// reçoit ces octets soit dans le scrollback rejoué, soit ici, jamais deux fois.
+func (s *Session) output(data []byte) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.mu.Lock()
+	s.scrollback.Write(data)
+	if s.rec != nil {
+		s.rec.Output(data)
+	}
+	offset := s.scrollback.total
+	subscribers := make([]*Proxy, 0, len(s.subscribers))
+	for p := range s.subscribers {
+		subscribers = append(subscribers, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range subscribers {
+		p.send("output", map[string]any{"data": string(data), "offset": offset})
+	}
+}
+
+// input écrit la saisie de p dans le shell s'il en a le droit.
+func (s *Session) input(p *Proxy, data string) bool {
+	s.mu.Lock()
+	sub := s.subscribers[p]
+	s.mu.Unlock()
+	if sub == nil || !sub.canWrite {
+		return false
+	}
+	io.WriteString(s.stdin, data)
+	return true
+}
+
+func (s *Session) isOwner(p *Proxy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub := s.subscribers[p]
+	return sub != nil && sub.owner
+}
+
+// resize redimensionne le PTY ; réservé au propriétaire de la session.
+func (s *Session) resize(p *Proxy, cols, rows int) {
+	s.mu.Lock()
+	sub := s.subscribers[p]
+	s.mu.Unlock()
+	if sub == nil || !sub.owner {
+		return
+	}
+	s.ssh.WindowChange(rows, cols)
+	if s.rec != nil {
+		s.rec.Resize(cols, rows)
+	}
+}
+
+// attach rattache le WebSocket du propriétaire à la session et lui rejoue la
+// sortie produite depuis offset (octets de sortie déjà reçus par le navigateur).
+func (s *Session) attach(p *Proxy, msgType string, offset int64) error {
+	return s.subscribe(p, &subscriber{owner: true, canWrite: true}, msgType, offset)
+}
+
+// join abonne un invité à la session ; il reçoit la sortie produite depuis
+// offset (création de son invitation) encore présente dans le scrollback.
+func (s *Session) join(p *Proxy, canWrite bool, offset int64) error {
+	return s.subscribe(p, &subscriber{canWrite: canWrite}, "joined", offset)
+}
+
+// outputOffset retourne le nombre d'octets de sortie produits jusqu'ici.
+func (s *Session) outputOffset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scrollback.total
+}
+
+// subscribe abonne p et lui rejoue la sortie produite depuis offset. outMu est
+// tenu de l'inscription jusqu'à la fin de la reprise : aucune sortie n'est
+// diffusée entre-temps, si bien que p reçoit chaque octet une fois, dans
+// l'ordre. Les envois sont faits hors de mu.
+func (s *Session) subscribe(p *Proxy, sub *subscriber, msgType string, offset int64) error {
+	s.outMu.Lock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.outMu.Unlock()
+		return ErrSessionNotFound
+	}
+	var replaced []*Proxy
+	if sub.owner {
+		if s.graceTimer != nil {
+			s.graceTimer.Stop()
+			s.graceTimer = nil
+		}
+		for old, oldSub := range s.subscribers {
+			if oldSub.owner && old != p {
+				delete(s.subscribers, old)
+				replaced = append(replaced, old)
+			}
+		}
+	}
+	missed, truncated := s.scrollback.Since(offset)
+	total := s.scrollback.total
+	if s.subscribers == nil {
+		s.subscribers = make(map[*Proxy]*subscriber)
+	}
+	s.subscribers[p] = sub
+	s.mu.Unlock()
+
+	p.send(msgType, map[string]any{
+		"session_id": s.ID,
+		"host_name":  s.HostName,
+		"recording":  s.Recording,
+		"offset":     total,
+		"truncated":  truncated,
+		"can_write":  sub.canWrite,
+	})
+	if len(missed) > 0 {
+		p.send("output", map[string]any{"data": string(missed), "offset": total})
+	}
+	s.outMu.Unlock()
+
+	for _, old := range replaced {
+		old.send("closed", map[string]string{"reason": "session attached elsewhere"})
+		old.close()
+	}
+	s.broadcastViewers()
+	return nil
+}
+
+// detach désabonne le WebSocket p. Si c'est le propriétaire (coupure réseau),
+// la session reste ouverte pendant le délai de grâce puis est fermée si
+// personne ne s'y rattache.
+func (s *Session) detach(p *Proxy) {
+	s.mu.Lock()
+	sub := s.subscribers[p]
+	if s.closed || sub == nil {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.subscribers, p)
+	if sub.owner {
+		if s.manager.grace <= 0 {
+			go s.Close("client disconnected")
+		} else {
+			log.Printf("%s websocket lost, keeping session for %s", s.tag, s.manager.grace)
+			s.graceTimer = time.AfterFunc(s.manager.grace, func() {
+				s.Close("reattach timeout")
+			})
+		}
+	}
+	s.mu.Unlock()
+	s.broadcastViewers()
+}
+
+// dropViewers déconnecte tous les invités ; le propriétaire reste attaché.
+func (s *Session) dropViewers(reason string) {
+	s.drop(reason, func(*Proxy) bool { return true })
+}
+
+// dropUser déconnecte les WebSockets invités de userID.
+func (s *Session) dropUser(userID, reason string) {
+	s.drop(reason, func(p *Proxy) bool { return p.userID == userID })
+}
+
+// drop désabonne les invités retenus par match puis, verrou relâché, les
+// déconnecte et annonce la nouvelle liste des participants.
+func (s *Session) drop(reason string, match func(*Proxy) bool) {
+	s.mu.Lock()
+	var dropped []*Proxy
+	for p, sub := range s.subscribers {
+		if !sub.owner && match(p) {
+			delete(s.subscribers, p)
+			dropped = append(dropped, p)
+		}
+	}
+	s.mu.Unlock()
+	if len(dropped) == 0 {
+		return
+	}
+
+	for _, p := range dropped {
+		p.send("closed", map[string]string{"reason": reason})
+		p.close()
+	}
+	s.broadcastViewers()
+}
+
+// broadcastViewers annonce la liste des participants à tous les abonnés,
+// verrou relâché. La liste est relevée sous viewersMu : la dernière annonce
+// reçue par un abonné est toujours la plus récente.
+func (s *Session) broadcastViewers() {
+	s.viewersMu.Lock()
+	defer s.viewersMu.Unlock()
+	s.mu.Lock()
+	viewers, subscribers := s.viewers()
+	s.mu.Unlock()
+	for _, p := range subscribers {
+		p.send("viewers", map[string]any{"viewers": viewers})
+	}
+}
+
+// viewers retourne la liste des participants et leurs WebSockets. Appelé verrou tenu.
+func (s *Session) viewers() ([]Viewer, []*Proxy) {
+	viewers := make([]Viewer, 0, len(s.subscribers))
+	subscribers := make([]*Proxy, 0, len(s.subscribers))
+	for p, sub := range s.subscribers {
+		viewers = append(viewers, Viewer{UserID: p.userID, Email: p.email, Owner: sub.owner, CanWrite: sub.canWrite})
+		subscribers = append(subscribers, p)
+	}
+	return viewers, subscribers
+}
+
+// Close termine la session SSH et notifie tous les abonnés.
+func (s *Session) Close(reason string) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+	}
+	subscribers := s.subscribers
+	s.subscribers = nil
+	s.mu.Unlock()
+
+	log.Printf("%s session closed: %s", s.tag, reason)
+	s.manager.remove(s)
+	s.cancel()
+	for p := range subscribers {
+		p.send("closed", map[string]string{"reason": reason})
+		p.close()
+	}
+	s.ssh.Close()
+	s.chain.Close()
+	if s.rec != nil {
+		s.rec.Close()
+	}
+	db.CloseSession(context.Background(), s.manager.pool, s.ID)
+}
+
+// ringBuffer conserve les derniers octets de sortie et le nombre total d'octets écrits.
+type ringBuffer struct {
+	buf   []byte
+	size  int
+	total int64
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	if r.buf == nil {
+		r.buf = make([]byte, scrollbackSize)
+	}
+	r.total += int64(len(p))
+	if len(p) > len(r.buf) {
+		p = p[len(p)-len(r.buf):]
+	}
+	pos := int((r.total - int64(len(p))) % int64(len(r.buf)))
+	n := copy(r.buf[pos:], p)
+	copy(r.buf, p[n:])
+	r.size = min(r.size+len(p), len(r.buf))
+}
+
+// Since retourne la sortie produite après offset. truncated indique qu'une
+// partie de cette sortie est déjà sortie du buffer.
+func (r *ringBuffer) Since(offset int64) (data []byte, truncated bool) {
+	start := r.total - int64(r.size)
+	if offset < start {
+		offset, truncated = start, true
+	}
+	if offset >= r.total {
+		return nil, truncated
+	}
+	data = make([]byte, r.total-offset)
+	pos := int(offset % int64(len(r.buf)))
+	n := copy(data, r.buf[pos:])
+	copy(data[n:], r.buf)
+	return data, truncated
+}
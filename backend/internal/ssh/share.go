@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Partage de session : le propriétaire génère un jeton d'invitation à durée
+// limitée ; un autre utilisateur authentifié l'échange via le message WS "join"
+// pour suivre la session en lecture seule ou avec droit de saisie. L'invité
+// ne voit que la sortie produite après la création de l'invitation : ce qui
+// précède (commandes, secrets affichés) n'est pas rejoué.
+
+const (
+	DefaultInviteTTL = 15 * time.Minute
+	MaxInviteTTL     = 24 * time.Hour
+)
+
+var ErrInvalidInvite = errors.New("invalid or expired invite")
+
+type invite struct {
+	session   *Session
+	canWrite  bool
+	email     string // si non vide, seul cet utilisateur peut rejoindre
+	offset    int64  // sortie de la session à la création de l'invitation
+	expiresAt time.Time
+}
+
+// JoinPayload est le payload du message WS "join".
+type JoinPayload struct {
+	Token string `json:"token"`
+}
+
+func inviteKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Invite crée un jeton d'invitation pour la session sessionID de ownerID.
+// Le jeton n'est conservé que sous forme hachée et disparaît avec la session.
+func (m *Manager) Invite(sessionID, ownerID string, canWrite bool, email string, ttl time.Duration) (string, time.Time, error) {
+	s, err := m.Get(sessionID, ownerID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expiresAt := time.Now().Add(ttl)
+	offset := s.outputOffset()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, inv := range m.invites {
+		if now.After(inv.expiresAt) {
+			delete(m.invites, key)
+		}
+	}
+	m.invites[inviteKey(token)] = &invite{
+		session:   s,
+		canWrite:  canWrite,
+		email:     strings.ToLower(email),
+		offset:    offset,
+		expiresAt: expiresAt,
+	}
+	return token, expiresAt, nil
+}
+
+// redeem valide un jeton d'invitation pour l'utilisateur email et retourne la
+// session, le droit de saisie et l'offset à partir duquel rejouer la sortie.
+// Le jeton reste utilisable jusqu'à expiration (pour rejoindre après une
+// coupure réseau).
+func (m *Manager) redeem(token, email string) (*Session, bool, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := inviteKey(token)
+	inv, ok := m.invites[key]
+	if !ok {
+		return nil, false, 0, ErrInvalidInvite
+	}
+	if time.Now().After(inv.expiresAt) {
+		delete(m.invites, key)
+		return nil, false, 0, ErrInvalidInvite
+	}
+	if inv.email != "" && inv.email != strings.ToLower(email) {
+		return nil, false, 0, ErrInvalidInvite
+	}
+	return inv.session, inv.canWrite, inv.offset, nil
+}
+
+// RevokeInvites invalide toutes les invitations d'une session et déconnecte
+// les invités déjà présents.
+func (m *Manager) RevokeInvites(sessionID, ownerID string) error {
+	s, err := m.Get(sessionID, ownerID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for key, inv := range m.invites {
+		if inv.session == s {
+			delete(m.invites, key)
+		}
+	}
+	m.mu.Unlock()
+	s.dropViewers("invitation revoked")
+	return nil
+}
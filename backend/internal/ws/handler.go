@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	mw "github.com/gestion-ssh/backend/internal/api/middleware"
+	"github.com/gestion-ssh/backend/internal/auth"
 	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -15,11 +16,12 @@ import (
 
 type Handler struct {
 	pool     *pgxpool.Pool
+	sessions *sshproxy.Manager
 	upgrader websocket.Upgrader
 }
 
-func NewHandler(pool *pgxpool.Pool, allowedOrigins []string) *Handler {
-	h := &Handler{pool: pool}
+func NewHandler(pool *pgxpool.Pool, allowedOrigins []string, sessions *sshproxy.Manager) *Handler {
+	h := &Handler{pool: pool, sessions: sessions}
 	h.upgrader = websocket.Upgrader{
 		ReadBufferSize:  4096,
 		WriteBufferSize: 4096,
@@ -54,7 +56,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	// Premier message attendu : "connect"
+	// Premier message attendu : "connect", "reattach" après une coupure,
+	// ou "join" pour suivre la session partagée d'un autre utilisateur
 	_, raw, err := conn.ReadMessage()
 	if err != nil {
 		return
@@ -66,33 +69,54 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if msg.Type != MsgConnect {
-		sendWSError(conn, "expected connect message")
-		return
-	}
+	proxy := sshproxy.NewProxy(h.sessions, conn, user.UserID, user.Email)
 
-	var payload sshproxy.ConnectPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sendWSError(conn, "invalid connect payload")
-		return
-	}
+	switch msg.Type {
+	case MsgConnect:
+		if !user.HasPermission(auth.PermHostsConnect) {
+			sendWSError(conn, "forbidden")
+			return
+		}
+		var payload sshproxy.ConnectPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			sendWSError(conn, "invalid connect payload")
+			return
+		}
 
-	if payload.HostID == "" || payload.Credential == "" {
-		sendWSError(conn, "host_id and credential are required")
-		return
-	}
+		if payload.HostID == "" || payload.Credential == "" {
+			sendWSError(conn, "host_id and credential are required")
+			return
+		}
 
-	// Utiliser X-Real-IP (positionné par nginx) plutôt que X-Forwarded-For (falsifiable)
-	clientIP := r.RemoteAddr
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		clientIP = realIP
-	}
+		// Utiliser X-Real-IP (positionné par nginx) plutôt que X-Forwarded-For (falsifiable)
+		clientIP := r.RemoteAddr
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			clientIP = realIP
+		}
+
+		// context.Background() : ne pas hériter de r.Context() qui a le middleware.Timeout(60s)
+		// de chi — ce timeout tuerait toutes les sessions SSH après 60 secondes.
+		proxy.HandleConnection(context.Background(), payload, clientIP)
+
+	case MsgReattach:
+		var payload sshproxy.ReattachPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.SessionID == "" {
+			sendWSError(conn, "session_id is required")
+			return
+		}
+		proxy.HandleReattach(payload)
 
-	proxy := sshproxy.NewProxy(h.pool, conn)
-	// context.Background() : ne pas hériter de r.Context() qui a le middleware.Timeout(60s)
-	// de chi — ce timeout tuerait toutes les sessions SSH après 60 secondes.
-	defer proxy.CloseSession(context.Background())
-	proxy.HandleConnection(context.Background(), payload, user.UserID, clientIP)
+	case MsgJoin:
+		var payload sshproxy.JoinPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Token == "" {
+			sendWSError(conn, "token is required")
+			return
+		}
+		proxy.HandleJoin(payload)
+
+	default:
+		sendWSError(conn, "expected connect, reattach or join message")
+	}
 }
 
 func sendWSError(conn *websocket.Conn, message string) {
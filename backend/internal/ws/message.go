@@ -1,12 +1,18 @@
 package ws
 
-import "encoding/json"
+import (
+	"encoding/json"
+
+	sshproxy "github.com/gestion-ssh/backend/internal/ssh"
+)
 
 type MessageType string
 
 const (
 	// Client -> Serveur
 	MsgConnect    MessageType = "connect"
+	MsgReattach   MessageType = "reattach"
+	MsgJoin       MessageType = "join"
 	MsgInput      MessageType = "input"
 	MsgResize     MessageType = "resize"
 	MsgDisconnect MessageType = "disconnect"
@@ -14,8 +20,16 @@ const (
 	// Serveur -> Client
 	MsgOutput    MessageType = "output"
 	MsgConnected MessageType = "connected"
-	MsgError     MessageType = "error"
-	MsgClosed    MessageType = "closed"
+	// Réponse à "reattach" : même payload que "connected", suivi de la sortie manquée
+	MsgReattached MessageType = "reattached"
+	// Réponse à "join" (invité) : même payload que "connected"
+	MsgJoined MessageType = "joined"
+	// Liste des participants, envoyée à chaque arrivée ou départ
+	MsgViewers MessageType = "viewers"
+	MsgError   MessageType = "error"
+	MsgClosed  MessageType = "closed"
+	// "host_key_changed" (clé d'hôte différente de la clé épinglée) est émis
+	// par le package ssh, payload : HostKeyChangedError.Payload.
 )
 
 type ClientMessage struct {
@@ -41,6 +55,8 @@ type ResizePayload struct {
 // Payloads serveur
 type OutputPayload struct {
 	Data string `json:"data"`
+	// Nombre total d'octets de sortie émis par la session, à renvoyer dans "reattach"
+	Offset int64 `json:"offset"`
 }
 
 type ErrorPayload struct {
@@ -50,4 +66,14 @@ type ErrorPayload struct {
 type ConnectedPayload struct {
 	SessionID string `json:"session_id"`
 	HostName  string `json:"host_name"`
+	Recording bool   `json:"recording"`
+	Offset    int64  `json:"offset"`
+	// Une partie de la sortie manquée n'est plus dans le scrollback (reattach)
+	Truncated bool `json:"truncated"`
+	// Faux pour un invité en lecture seule
+	CanWrite bool `json:"can_write"`
+}
+
+type ViewersPayload struct {
+	Viewers []sshproxy.Viewer `json:"viewers"`
 }
@@ -1,12 +1,14 @@
 import { useEffect, useRef, useState } from 'react'
 import {
   Loader2, AlertCircle, Folder, File, Download, Trash2,
-  FolderPlus, Upload, ChevronRight, Home, RefreshCw,
+  FolderPlus, Upload, ChevronRight, Home, RefreshCw, X, Copy, Archive, PackageOpen,
 } from 'lucide-react'
 import { hostsApi, Host } from '../../services/api'
 import { decryptCredential } from '../../crypto'
 import { useAuthStore } from '../../store/auth'
-import { SFTPService, FileEntry } from '../../services/sftp'
+import {
+  SFTPService, FileEntry, TransferProgress, RmPlan, ExtractConflict, ExtractEntry,
+} from '../../services/sftp'
 
 interface Props {
   hostId: string
@@ -21,6 +23,20 @@ function formatSize(bytes: number): string {
   return `${(bytes / 1024 / 1024 / 1024).toFixed(2)} GB`
 }
 
+// Répertoire d'extraction proposé : nom de l'archive sans son extension
+function archiveBaseName(name: string): string {
+  return name.replace(/\.(zip|tar\.gz|tgz)$/i, '') || name
+}
+
+const extractActionLabels: Record<string, string> = {
+  created: 'créés',
+  overwritten: 'remplacés',
+  renamed: 'renommés',
+  skipped: 'ignorés',
+  rejected: 'refusés',
+  failed: 'en échec',
+}
+
 function buildBreadcrumb(path: string): string[] {
   const parts = path.split('/').filter(Boolean)
   return ['/', ...parts.map((_, i) => '/' + parts.slice(0, i + 1).join('/'))]
@@ -37,11 +53,32 @@ export default function SFTPBrowser({ hostId }: Props) {
   const [entries, setEntries] = useState<FileEntry[]>([])
   const [pathLoading, setPathLoading] = useState(false)
   const [deleteConfirm, setDeleteConfirm] = useState<string | null>(null)
+  // Suppression d'un dossier : contenu listé par le dry-run, en attente de confirmation
+  const [rmPlan, setRmPlan] = useState<RmPlan | null>(null)
+  const [planning, setPlanning] = useState(false)
+  const [copySource, setCopySource] = useState<string | null>(null)
+  const [copyTo, setCopyTo] = useState('')
   const [mkdirName, setMkdirName] = useState('')
   const [showMkdir, setShowMkdir] = useState(false)
   const [renameTarget, setRenameTarget] = useState<string | null>(null)
   const [renameTo, setRenameTo] = useState('')
+  const [transfers, setTransfers] = useState<Record<number, TransferProgress>>({})
+  // Upload dont une version partielle existe déjà sur l'hôte
+  const [resumeCandidate, setResumeCandidate] = useState<{ file: File; path: string; offset: number } | null>(null)
+  // Téléchargement interrompu dont le début est conservé par le navigateur
+  const [downloadResume, setDownloadResume] = useState<{ name: string; path: string; offset: number; size: number } | null>(null)
   const uploadRef = useRef<HTMLInputElement>(null)
+  const extractRef = useRef<HTMLInputElement>(null)
+  // Archive à extraire sur l'hôte, puis compte rendu de l'extraction
+  const [extractFile, setExtractFile] = useState<File | null>(null)
+  const [extractDir, setExtractDir] = useState('')
+  const [extractConflict, setExtractConflict] = useState<ExtractConflict>('skip')
+  const [extractReport, setExtractReport] = useState<{
+    name: string
+    counts: Record<string, number>
+    issues: ExtractEntry[] // entrées non écrites ou renommées
+    done: boolean
+  } | null>(null)
 
   useEffect(() => {
     if (!masterKey) return
@@ -95,10 +132,8 @@ export default function SFTPBrowser({ hostId }: Props) {
           }))
           setPathLoading(false)
         },
-        onGetResult: (name, data) => {
+        onDownload: (name, blob) => {
           // Déclenche le téléchargement dans le navigateur
-          const bytes = Uint8Array.from(atob(data), (c) => c.charCodeAt(0))
-          const blob = new Blob([bytes])
           const url = URL.createObjectURL(blob)
           const a = document.createElement('a')
           a.href = url
@@ -106,10 +141,24 @@ export default function SFTPBrowser({ hostId }: Props) {
           a.click()
           URL.revokeObjectURL(url)
         },
+        onProgress: (t) => setTransfers((prev) => ({ ...prev, [t.id]: t })),
+        onExtractEntry: (entry) => setExtractReport((prev) => prev && {
+          ...prev,
+          counts: { ...prev.counts, [entry.action]: (prev.counts[entry.action] ?? 0) + 1 },
+          issues: entry.action === 'created' || entry.action === 'overwritten'
+            ? prev.issues
+            : [...prev.issues, entry],
+        }),
+        onTransferEnd: (id) => setTransfers((prev) => {
+          const next = { ...prev }
+          delete next[id]
+          return next
+        }),
         onDone: (op, detail) => {
-          if (op === 'rm' || op === 'put' || op === 'mkdir' || op === 'rename') {
+          if (op === 'rm' || op === 'put' || op === 'mkdir' || op === 'rename' || op === 'copy' || op === 'extract') {
             navigate(currentPath, svc)
           }
+          if (op === 'extract') setExtractReport((prev) => prev && { ...prev, done: true })
           if (op === 'rename') {
             setRenameTarget(null)
             setRenameTo('')
@@ -145,25 +194,86 @@ export default function SFTPBrowser({ hostId }: Props) {
     service.ls(path)
   }
 
-  function handleDownload(entry: FileEntry) {
+  async function handleDownload(entry: FileEntry) {
+    const svc = serviceRef.current
+    if (!svc) return
+    const path = currentPath.replace(/\/$/, '') + '/' + entry.name
+    const offset = await svc.partialDownload(path)
+    if (offset > 0 && offset < entry.size) {
+      setDownloadResume({ name: entry.name, path, offset, size: entry.size })
+      return
+    }
+    svc.get(path, { verify: true })
+  }
+
+  function handleDownloadResume(resume: boolean) {
+    if (!downloadResume || !serviceRef.current) return
+    const { path } = downloadResume
+    setDownloadResume(null)
+    if (!resume) {
+      serviceRef.current.get(path, { verify: true })
+      return
+    }
+    serviceRef.current.resumeGet(path).catch((err: Error) => setErrorMsg(err.message))
+  }
+
+  function handleArchive(entry: FileEntry, format: 'tar.gz' | 'zip') {
     const path = currentPath.replace(/\/$/, '') + '/' + entry.name
-    serviceRef.current?.get(path)
+    const url = serviceRef.current?.archiveUrl(path, { format })
+    if (!url) {
+      setErrorMsg('Archive indisponible pour cette session')
+      return
+    }
+    const a = document.createElement('a')
+    a.href = url
+    a.click()
   }
 
   function handleDelete(entry: FileEntry) {
     const path = currentPath.replace(/\/$/, '') + '/' + entry.name
     setDeleteConfirm(path)
+    setRmPlan(null)
+    if (entry.is_dir && serviceRef.current) {
+      setPlanning(true)
+      serviceRef.current.rmPlan(path)
+        .then(setRmPlan)
+        .catch((err: Error) => {
+          setDeleteConfirm(null)
+          setErrorMsg(err.message)
+        })
+        .finally(() => setPlanning(false))
+    }
+  }
+
+  function cancelDelete() {
+    setDeleteConfirm(null)
+    setRmPlan(null)
   }
 
   function confirmDelete() {
     if (!deleteConfirm) return
+    if (rmPlan) {
+      serviceRef.current?.rmRecursive(rmPlan.path, rmPlan.token)
+      cancelDelete()
+      return
+    }
     serviceRef.current?.rm(deleteConfirm)
   }
 
+  function handleCopy() {
+    if (!copySource || !copyTo.trim()) return
+    const dest = copyTo.trim().startsWith('/')
+      ? copyTo.trim()
+      : currentPath.replace(/\/$/, '') + '/' + copyTo.trim()
+    serviceRef.current?.copy(copySource, dest)
+    setCopySource(null)
+  }
+
   function handleMkdir() {
     if (!mkdirName.trim()) return
     const path = currentPath.replace(/\/$/, '') + '/' + mkdirName.trim()
-    serviceRef.current?.mkdir(path)
+    // "a/b/c" crée aussi les dossiers intermédiaires
+    serviceRef.current?.mkdir(path, mkdirName.includes('/'))
     setMkdirName('')
     setShowMkdir(false)
   }
@@ -177,14 +287,42 @@ export default function SFTPBrowser({ hostId }: Props) {
   function handleUpload(e: React.ChangeEvent<HTMLInputElement>) {
     const file = e.target.files?.[0]
     if (!file || !serviceRef.current) return
-    const reader = new FileReader()
-    reader.onload = () => {
-      const base64 = (reader.result as string).split(',')[1]
-      const path = currentPath.replace(/\/$/, '') + '/' + file.name
-      serviceRef.current!.put(path, base64)
+    const path = currentPath.replace(/\/$/, '') + '/' + file.name
+    e.target.value = ''
+    // Un fichier distant plus petit du même nom est probablement un envoi interrompu
+    const existing = entries.find((entry) => entry.name === file.name && !entry.is_dir)
+    if (existing && existing.size > 0 && existing.size < file.size) {
+      setResumeCandidate({ file, path, offset: existing.size })
+      return
+    }
+    serviceRef.current.put(path, file, { verify: true })
+  }
+
+  function handleResume(resume: boolean) {
+    if (!resumeCandidate || !serviceRef.current) return
+    const { file, path, offset } = resumeCandidate
+    setResumeCandidate(null)
+    if (!resume) {
+      serviceRef.current.put(path, file, { verify: true })
+      return
     }
-    reader.readAsDataURL(file)
+    serviceRef.current.resumePut(path, file, offset).catch((err: Error) => setErrorMsg(err.message))
+  }
+
+  function handleExtractFile(e: React.ChangeEvent<HTMLInputElement>) {
+    const file = e.target.files?.[0]
     e.target.value = ''
+    if (!file) return
+    setExtractFile(file)
+    setExtractDir(currentPath.replace(/\/$/, '') + '/' + archiveBaseName(file.name))
+    setExtractConflict('skip')
+  }
+
+  function handleExtract() {
+    if (!extractFile || !extractDir.trim() || !serviceRef.current) return
+    setExtractReport({ name: extractFile.name, counts: {}, issues: [], done: false })
+    serviceRef.current.extract(extractDir.trim(), extractFile, extractConflict)
+    setExtractFile(null)
   }
 
   // ── États non connectés ───────────────────────────────────────────────────
@@ -261,6 +399,20 @@ export default function SFTPBrowser({ hostId }: Props) {
             <Upload className="w-3.5 h-3.5" />
           </button>
           <input ref={uploadRef} type="file" className="hidden" onChange={handleUpload} />
+          <button
+            onClick={() => extractRef.current?.click()}
+            className="btn-ghost p-1.5"
+            title="Envoyer et extraire une archive (zip, tar.gz)"
+          >
+            <PackageOpen className="w-3.5 h-3.5" />
+          </button>
+          <input
+            ref={extractRef}
+            type="file"
+            accept=".zip,.tar.gz,.tgz"
+            className="hidden"
+            onChange={handleExtractFile}
+          />
         </div>
 
         {host && (
@@ -278,6 +430,69 @@ export default function SFTPBrowser({ hostId }: Props) {
         </div>
       )}
 
+      {/* Transferts en cours */}
+      {Object.values(transfers).length > 0 && (
+        <div className="px-4 py-2 border-b border-surface-700 space-y-1.5">
+          {Object.values(transfers).map((t) => (
+            <div key={t.id} className="flex items-center gap-3 text-xs text-gray-400">
+              {t.op === 'get' && <Download className="w-3.5 h-3.5 shrink-0" />}
+              {t.op === 'put' && <Upload className="w-3.5 h-3.5 shrink-0" />}
+              {t.op === 'rm' && <Trash2 className="w-3.5 h-3.5 shrink-0" />}
+              {t.op === 'copy' && <Copy className="w-3.5 h-3.5 shrink-0" />}
+              {t.op === 'archive' && <Archive className="w-3.5 h-3.5 shrink-0" />}
+              {t.op === 'extract' && <PackageOpen className="w-3.5 h-3.5 shrink-0" />}
+              <span className="truncate w-48">{t.name}</span>
+              <div className="flex-1 h-1.5 bg-surface-700 rounded">
+                <div
+                  className="h-full bg-accent-500 rounded"
+                  style={{ width: `${t.size ? Math.min(100, (t.bytes / t.size) * 100) : 0}%` }}
+                />
+              </div>
+              <span className="tabular-nums shrink-0">
+                {t.op === 'rm'
+                  ? `${t.bytes} / ${t.size} éléments`
+                  : t.size ? `${formatSize(t.bytes)} / ${formatSize(t.size)}` : formatSize(t.bytes)}
+              </span>
+              <button
+                onClick={() => serviceRef.current?.cancel(t.id)}
+                className="btn-ghost p-0.5 hover:text-danger"
+                title="Annuler"
+              >
+                <X className="w-3.5 h-3.5" />
+              </button>
+            </div>
+          ))}
+        </div>
+      )}
+
+      {/* Compte rendu d'extraction */}
+      {extractReport && (
+        <div className="px-4 py-2 border-b border-surface-700 text-xs text-gray-400">
+          <div className="flex items-center gap-2">
+            <PackageOpen className="w-3.5 h-3.5 shrink-0" />
+            <span className="truncate">{extractReport.name}</span>
+            <span className="flex-1 truncate">
+              {Object.entries(extractReport.counts)
+                .map(([action, n]) => `${n} ${extractActionLabels[action] ?? action}`)
+                .join(', ') || 'Extraction…'}
+              {extractReport.done && ' — terminé'}
+            </span>
+            <button onClick={() => setExtractReport(null)} className="hover:text-gray-200">×</button>
+          </div>
+          {extractReport.issues.length > 0 && (
+            <ul className="mt-1.5 max-h-32 overflow-y-auto space-y-0.5 font-mono">
+              {extractReport.issues.map((entry, i) => (
+                <li key={i} className={entry.action === 'rejected' || entry.action === 'failed' ? 'text-danger' : ''}>
+                  {entry.path} : {extractActionLabels[entry.action] ?? entry.action}
+                  {entry.action === 'renamed' && entry.target && ` → ${entry.target.split('/').pop()}`}
+                  {entry.error && ` (${entry.error})`}
+                </li>
+              ))}
+            </ul>
+          )}
+        </div>
+      )}
+
       {/* Liste des fichiers */}
       <div className="flex-1 overflow-y-auto">
         {pathLoading ? (
@@ -377,6 +592,35 @@ export default function SFTPBrowser({ hostId }: Props) {
                             <Download className="w-3.5 h-3.5" />
                           </button>
                         )}
+                        {entry.is_dir && (
+                          <>
+                            <button
+                              onClick={(e) => { e.stopPropagation(); handleArchive(entry, 'tar.gz') }}
+                              className="btn-ghost p-1"
+                              title="Télécharger en .tar.gz"
+                            >
+                              <Archive className="w-3.5 h-3.5" />
+                            </button>
+                            <button
+                              onClick={(e) => { e.stopPropagation(); handleArchive(entry, 'zip') }}
+                              className="btn-ghost p-1 text-xs px-1.5"
+                              title="Télécharger en .zip"
+                            >
+                              zip
+                            </button>
+                          </>
+                        )}
+                        <button
+                          onClick={(e) => {
+                            e.stopPropagation()
+                            setCopySource(fullPath)
+                            setCopyTo(entry.name + '.copie')
+                          }}
+                          className="btn-ghost p-1"
+                          title="Copier"
+                        >
+                          <Copy className="w-3.5 h-3.5" />
+                        </button>
                         <button
                           onClick={(e) => {
                             e.stopPropagation()
@@ -426,6 +670,94 @@ export default function SFTPBrowser({ hostId }: Props) {
         </div>
       )}
 
+      {/* Modal copie */}
+      {copySource && (
+        <div className="fixed inset-0 bg-black/60 flex items-center justify-center z-50">
+          <div className="card p-5 w-80">
+            <h3 className="font-medium text-gray-100 mb-3">Copier {copySource.split('/').pop()}</h3>
+            <input
+              autoFocus
+              className="input w-full mb-4"
+              placeholder="Destination"
+              value={copyTo}
+              onChange={(e) => setCopyTo(e.target.value)}
+              onKeyDown={(e) => { if (e.key === 'Enter') handleCopy(); if (e.key === 'Escape') setCopySource(null) }}
+            />
+            <div className="flex gap-2">
+              <button onClick={() => setCopySource(null)} className="btn-ghost flex-1 justify-center">Annuler</button>
+              <button onClick={handleCopy} className="btn-primary flex-1 justify-center">Copier</button>
+            </div>
+          </div>
+        </div>
+      )}
+
+      {/* Modal extraction d'archive */}
+      {extractFile && (
+        <div className="fixed inset-0 bg-black/60 flex items-center justify-center z-50">
+          <div className="card p-5 w-96">
+            <h3 className="font-medium text-gray-100 mb-3 break-all">Extraire {extractFile.name}</h3>
+            <label className="block text-xs text-gray-400 mb-1">Répertoire de destination</label>
+            <input
+              autoFocus
+              className="input w-full mb-3"
+              value={extractDir}
+              onChange={(e) => setExtractDir(e.target.value)}
+              onKeyDown={(e) => { if (e.key === 'Enter') handleExtract(); if (e.key === 'Escape') setExtractFile(null) }}
+            />
+            <label className="block text-xs text-gray-400 mb-1">Fichiers déjà présents</label>
+            <select
+              className="input w-full mb-4"
+              value={extractConflict}
+              onChange={(e) => setExtractConflict(e.target.value as ExtractConflict)}
+            >
+              <option value="skip">Conserver (ignorer l'entrée de l'archive)</option>
+              <option value="overwrite">Remplacer</option>
+              <option value="rename">Renommer (nom (1).ext)</option>
+            </select>
+            <div className="flex gap-2">
+              <button onClick={() => setExtractFile(null)} className="btn-ghost flex-1 justify-center">Annuler</button>
+              <button onClick={handleExtract} className="btn-primary flex-1 justify-center">Extraire</button>
+            </div>
+          </div>
+        </div>
+      )}
+
+      {/* Modal reprise d'upload */}
+      {resumeCandidate && (
+        <div className="fixed inset-0 bg-black/60 flex items-center justify-center z-50">
+          <div className="card p-5 w-96">
+            <h3 className="font-medium text-gray-100 mb-2">Reprendre l'envoi ?</h3>
+            <p className="text-sm text-gray-400 mb-4 break-all">
+              <strong className="text-gray-300">{resumeCandidate.file.name}</strong> existe déjà sur l'hôte
+              ({formatSize(resumeCandidate.offset)} sur {formatSize(resumeCandidate.file.size)}).
+            </p>
+            <div className="flex gap-2">
+              <button onClick={() => setResumeCandidate(null)} className="btn-ghost flex-1 justify-center">Annuler</button>
+              <button onClick={() => handleResume(false)} className="btn-ghost flex-1 justify-center">Remplacer</button>
+              <button onClick={() => handleResume(true)} className="btn-primary flex-1 justify-center">Reprendre</button>
+            </div>
+          </div>
+        </div>
+      )}
+
+      {/* Modal reprise de téléchargement */}
+      {downloadResume && (
+        <div className="fixed inset-0 bg-black/60 flex items-center justify-center z-50">
+          <div className="card p-5 w-96">
+            <h3 className="font-medium text-gray-100 mb-2">Reprendre le téléchargement ?</h3>
+            <p className="text-sm text-gray-400 mb-4 break-all">
+              <strong className="text-gray-300">{downloadResume.name}</strong> a été interrompu
+              ({formatSize(downloadResume.offset)} sur {formatSize(downloadResume.size)}).
+            </p>
+            <div className="flex gap-2">
+              <button onClick={() => setDownloadResume(null)} className="btn-ghost flex-1 justify-center">Annuler</button>
+              <button onClick={() => handleDownloadResume(false)} className="btn-ghost flex-1 justify-center">Recommencer</button>
+              <button onClick={() => handleDownloadResume(true)} className="btn-primary flex-1 justify-center">Reprendre</button>
+            </div>
+          </div>
+        </div>
+      )}
+
       {/* Modal confirmation suppression */}
       {deleteConfirm && (
         <div className="fixed inset-0 bg-black/60 flex items-center justify-center z-50">
@@ -434,9 +766,27 @@ export default function SFTPBrowser({ hostId }: Props) {
             <p className="text-sm text-gray-400 mb-4 break-all">
               <strong className="text-gray-300">{deleteConfirm.split('/').pop()}</strong> sera supprimé définitivement.
             </p>
+            {planning && (
+              <div className="flex items-center gap-2 mb-4 text-xs text-gray-500">
+                <Loader2 className="w-3.5 h-3.5 animate-spin" /> Analyse du contenu…
+              </div>
+            )}
+            {rmPlan && (
+              <div className="mb-4 text-xs text-gray-400">
+                <p className="mb-2">
+                  {rmPlan.files} fichier(s), {rmPlan.dirs} dossier(s), {formatSize(rmPlan.bytes)}
+                </p>
+                <ul className="max-h-32 overflow-y-auto font-mono text-gray-500 break-all">
+                  {rmPlan.entries.map((e) => <li key={e}>{e}</li>)}
+                  {rmPlan.truncated && <li>…</li>}
+                </ul>
+              </div>
+            )}
             <div className="flex gap-2">
-              <button onClick={() => setDeleteConfirm(null)} className="btn-ghost flex-1 justify-center">Annuler</button>
-              <button onClick={confirmDelete} className="btn-danger flex-1 justify-center">Supprimer</button>
+              <button onClick={cancelDelete} className="btn-ghost flex-1 justify-center">Annuler</button>
+              <button onClick={confirmDelete} className="btn-danger flex-1 justify-center" disabled={planning}>
+                Supprimer
+              </button>
             </div>
           </div>
         </div>
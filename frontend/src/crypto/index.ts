@@ -1,3 +1,4 @@
 export { deriveMasterKey, base64ToUint8Array, uint8ArrayToBase64 } from './keys'
 export { encryptCredential, decryptCredential } from './aes'
 export type { EncryptedBlob } from './aes'
+export { SHA256 } from './sha256'
@@ -27,6 +27,7 @@ export default function DashboardPage() {
   const [showForm, setShowForm] = useState(false)
   const [editHost, setEditHost] = useState<Host | undefined>()
   const [deleteConfirm, setDeleteConfirm] = useState<Host | undefined>()
+  const [deleteError, setDeleteError] = useState('')
 
   useEffect(() => {
     hostsApi.list()
@@ -59,11 +60,23 @@ export default function DashboardPage() {
   }
 
   async function handleDelete(host: Host) {
-    await hostsApi.delete(host.id)
+    try {
+      await hostsApi.delete(host.id)
+    } catch (err: unknown) {
+      const msg = (err as { response?: { data?: { error?: string } } })
+        ?.response?.data?.error
+      setDeleteError(msg ?? 'Erreur lors de la suppression')
+      return
+    }
     setHosts((prev) => prev.filter((h) => h.id !== host.id))
     setDeleteConfirm(undefined)
   }
 
+  function closeDeleteConfirm() {
+    setDeleteConfirm(undefined)
+    setDeleteError('')
+  }
+
   function toggleTag(tag: string) {
     setActiveTags((prev) =>
       prev.includes(tag) ? prev.filter((t) => t !== tag) : [...prev, tag]
@@ -253,8 +266,13 @@ export default function DashboardPage() {
               Supprimer <strong className="text-gray-300">{deleteConfirm.name}</strong> ?
               Cette action est irréversible.
             </p>
+            {deleteError && (
+              <div className="mb-4 px-3 py-2 bg-danger/10 border border-danger/30 rounded-md text-sm text-danger">
+                {deleteError}
+              </div>
+            )}
             <div className="flex gap-3">
-              <button onClick={() => setDeleteConfirm(undefined)} className="btn-ghost flex-1 justify-center">
+              <button onClick={closeDeleteConfirm} className="btn-ghost flex-1 justify-center">
                 Annuler
               </button>
               <button onClick={() => handleDelete(deleteConfirm)} className="btn-danger flex-1 justify-center">
@@ -378,8 +378,8 @@ export default function ProfilePage() {
                       <div className="flex items-start gap-2 p-2 bg-warning/10 border border-warning/20 rounded-md">
                         <AlertTriangle className="w-3.5 h-3.5 text-warning mt-0.5 shrink-0" />
                         <p className="text-xs text-gray-400">
-                          Changer le mot de passe <strong className="text-gray-300">supprimera tous vos hôtes et credentials</strong> enregistrés
-                          et vous déconnectera. Les données chiffrées ne peuvent pas être re-chiffrées.
+                          Changer le mot de passe <strong className="text-gray-300">supprimera tous vos hôtes et credentials</strong> enregistrés,
+                          révoquera vos jetons d'API et vous déconnectera. Les données chiffrées ne peuvent pas être re-chiffrées.
                         </p>
                       </div>
 
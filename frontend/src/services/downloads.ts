@@ -0,0 +1,138 @@
+// Stockage des téléchargements SFTP. Les octets reçus sont écrits au fil de
+// l'eau dans l'origin private file system (OPFS) au lieu de s'accumuler en
+// mémoire ; le fichier terminé est remis au navigateur sous forme de File
+// adossé au disque. Sans OPFS (navigateur ancien, navigation privée), le
+// fichier est assemblé en mémoire et sa taille est limitée par celle-ci.
+//
+// Un téléchargement interrompu laisse son préfixe sur disque : il peut être
+// repris à partir de sa taille. Les fichiers OPFS sont indexés dans
+// localStorage (le parcours d'un dossier OPFS n'est pas disponible partout) ;
+// à l'ouverture du stockage, les fichiers déjà remis au navigateur et les
+// préfixes abandonnés depuis PARTIAL_TTL sont supprimés.
+
+const DIR_NAME = 'sftp-downloads'
+const INDEX_KEY = 'sftp-downloads'
+const PARTIAL_TTL = 7 * 24 * 3600 * 1000
+
+interface IndexEntry {
+  complete: boolean
+  updated: number
+}
+
+type Index = Record<string, IndexEntry>
+
+export interface DownloadSink {
+  write(data: Uint8Array): Promise<void>
+  // finish ferme le fichier et le retourne
+  finish(): Promise<Blob>
+  // abort abandonne le téléchargement ; avec keep, les octets reçus sont
+  // conservés pour une reprise, sinon l'espace occupé est libéré.
+  abort(keep: boolean): Promise<void>
+}
+
+function readIndex(): Index {
+  try {
+    return JSON.parse(localStorage.getItem(INDEX_KEY) ?? '{}') as Index
+  } catch {
+    return {}
+  }
+}
+
+function updateIndex(fn: (index: Index) => void): void {
+  const index = readIndex()
+  fn(index)
+  localStorage.setItem(INDEX_KEY, JSON.stringify(index))
+}
+
+export class DownloadStore {
+  private dir: Promise<FileSystemDirectoryHandle | null>
+
+  constructor() {
+    this.dir = this.open()
+  }
+
+  private async open(): Promise<FileSystemDirectoryHandle | null> {
+    try {
+      const root = await navigator.storage.getDirectory()
+      const dir = await root.getDirectoryHandle(DIR_NAME, { create: true })
+      for (const [name, entry] of Object.entries(readIndex())) {
+        if (entry.complete || Date.now() - entry.updated > PARTIAL_TTL) await this.remove(dir, name)
+      }
+      return dir
+    } catch {
+      return null
+    }
+  }
+
+  private async remove(dir: FileSystemDirectoryHandle, name: string): Promise<void> {
+    await dir.removeEntry(name).catch(() => undefined)
+    updateIndex((index) => { delete index[name] })
+  }
+
+  // partial retourne le préfixe conservé d'un téléchargement interrompu.
+  async partial(name: string): Promise<File | null> {
+    const dir = await this.dir
+    const entry = readIndex()[name]
+    if (!dir || !entry || entry.complete) return null
+    try {
+      const file = await (await dir.getFileHandle(name)).getFile()
+      return file.size > 0 ? file : null
+    } catch {
+      return null
+    }
+  }
+
+  // create ouvre le fichier qui recevra un téléchargement ; name doit être
+  // unique parmi les téléchargements en cours. Avec offset, les offset
+  // premiers octets d'un préfixe conservé sont gardés et l'écriture reprend à
+  // leur suite ; sinon le fichier est vidé.
+  async create(name: string, offset = 0): Promise<DownloadSink> {
+    const dir = await this.dir
+    if (!dir) {
+      if (offset > 0) throw new Error('Reprise impossible : stockage local indisponible')
+      return memorySink()
+    }
+    let writable: FileSystemWritableFileStream
+    let handle: FileSystemFileHandle
+    try {
+      handle = await dir.getFileHandle(name, { create: true })
+      writable = await handle.createWritable({ keepExistingData: offset > 0 })
+      if (offset > 0) {
+        if ((await handle.getFile()).size < offset) throw new Error('préfixe local incomplet')
+        await writable.truncate(offset)
+        await writable.seek(offset)
+      }
+    } catch (err) {
+      if (offset > 0) throw new Error(`Reprise impossible : ${(err as Error).message}`)
+      return memorySink()
+    }
+    updateIndex((index) => { index[name] = { complete: false, updated: Date.now() } })
+    return {
+      write: (data) => writable.write(data),
+      finish: async () => {
+        await writable.close()
+        updateIndex((index) => { index[name] = { complete: true, updated: Date.now() } })
+        return handle.getFile()
+      },
+      abort: async (keep) => {
+        if (keep) {
+          // close enregistre les octets écrits depuis createWritable
+          await writable.close().catch(() => undefined)
+          updateIndex((index) => { index[name] = { complete: false, updated: Date.now() } })
+          return
+        }
+        await writable.abort().catch(() => undefined)
+        await this.remove(dir, name)
+      },
+    }
+  }
+}
+
+function memorySink(): DownloadSink {
+  let parts: Uint8Array[] = []
+  return {
+    write: async (data) => { parts.push(data) },
+    finish: async () => new Blob(parts),
+    abort: async () => { parts = [] },
+  }
+}
@@ -1,3 +1,6 @@
+import { SHA256 } from '../crypto'
+import { DownloadStore, type DownloadSink } from './downloads'
+
 export interface FileEntry {
   name: string
   size: number
@@ -6,18 +9,116 @@ export interface FileEntry {
   mod_time: string
 }
 
+export type TransferOp = 'get' | 'put' | 'rm' | 'copy' | 'archive' | 'extract'
+
+// Pour rm, bytes et size comptent les éléments supprimés et à supprimer ;
+// pour copy, size est inconnue (0).
+
+export type ArchiveFormat = 'tar.gz' | 'zip'
+
+export interface ArchiveOptions {
+  format?: ArchiveFormat
+  include?: string[] // motifs (ex. *.conf) ; sans "/", appliqués au nom
+  exclude?: string[]
+  maxSize?: number   // octets, plafonnée par le serveur
+}
+
+// Politique d'extraction pour un fichier déjà présent
+export type ExtractConflict = 'skip' | 'overwrite' | 'rename'
+
+export type ExtractAction = 'created' | 'overwritten' | 'renamed' | 'skipped' | 'rejected' | 'failed'
+
+export interface ExtractEntry {
+  id: number
+  path: string    // nom dans l'archive
+  target?: string // chemin écrit sur l'hôte
+  size: number
+  action: ExtractAction
+  error?: string
+}
+export interface TransferProgress {
+  id: number
+  op: TransferOp
+  name: string
+  bytes: number
+  size: number
+}
+
+export interface RmPlan {
+  path: string
+  files: number
+  dirs: number
+  bytes: number
+  entries: string[]
+  truncated: boolean
+  token: string
+}
+
+export interface StatResult {
+  path: string
+  exists: boolean
+  size: number
+  is_dir: boolean
+  mod_time?: string
+}
+
+export interface TransferOptions {
+  offset?: number  // reprise : octets déjà présents
+  verify?: boolean // compare le SHA-256 distant à celui des octets transférés
+}
+
 export interface SFTPCallbacks {
   onConnected: (home: string, hostName: string) => void
   onLSResult: (path: string, entries: FileEntry[]) => void
-  onGetResult: (name: string, data: string) => void
+  onDownload: (name: string, data: Blob) => void
+  onProgress: (transfer: TransferProgress) => void
+  onTransferEnd: (id: number) => void
+  onExtractEntry?: (entry: ExtractEntry) => void
   onDone: (op: string, detail: Record<string, string>) => void
   onError: (message: string) => void
   onClose: () => void
 }
 
+// Un transfert circule en frames binaires : 4 octets d'identifiant
+// (big-endian) suivis des données. L'émetteur attend un "ack" dès que
+// `window` morceaux sont en vol.
+const HEADER_SIZE = 4
+
+// Lecture du fichier local pour le hachage d'un préfixe avant reprise
+const HASH_READ_SIZE = 4 * 1024 * 1024
+
+interface Transfer {
+  id: number
+  op: TransferOp
+  path: string
+  name: string
+  size: number
+  bytes: number // reçus (get) ou acquittés (put), depuis le début du fichier
+  // Empreinte des octets transférés (préfixe inclus en cas de reprise)
+  hash?: SHA256
+  // get : fichier de destination et écritures en cours, chaînées dans
+  // l'ordre de réception ; l'ack suit l'écriture sur disque.
+  key?: string
+  sink?: Promise<DownloadSink>
+  writes: Promise<void>
+  // put : fichier source et état de l'envoi
+  file?: File
+  sent: number
+  chunkSize: number
+  window: number
+  pumping: boolean
+}
+
 export class SFTPService {
   private ws: WebSocket | null = null
   private callbacks: SFTPCallbacks
+  private transfers = new Map<number, Transfer>()
+  private nextId = 1
+  private sessionId = ''
+  private hostId = ''
+  private downloads = new DownloadStore()
+  // Requêtes stat / checksum en attente de réponse
+  private pending = new Map<number, { resolve: (v: never) => void; reject: (e: Error) => void }>()
 
   constructor(callbacks: SFTPCallbacks) {
     this.callbacks = callbacks
@@ -26,12 +127,18 @@ export class SFTPService {
   connect(hostId: string, credential: string): void {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
     this.ws = new WebSocket(`${protocol}//${window.location.host}/ws/sftp`)
+    this.ws.binaryType = 'arraybuffer'
+    this.hostId = hostId
 
     this.ws.onopen = () => {
       this.send('connect', { host_id: hostId, credential })
     }
 
     this.ws.onmessage = (event) => {
+      if (event.data instanceof ArrayBuffer) {
+        this.handleChunk(event.data)
+        return
+      }
       try {
         const msg = JSON.parse(event.data) as { type: string; payload: unknown }
         this.handleMessage(msg)
@@ -40,7 +147,14 @@ export class SFTPService {
       }
     }
 
-    this.ws.onclose = () => this.callbacks.onClose()
+    this.ws.onclose = () => {
+      // Les téléchargements interrompus gardent leur préfixe pour une reprise
+      this.transfers.forEach((t) => this.abortDownload(t, true))
+      this.transfers.clear()
+      this.pending.forEach((p) => p.reject(new Error('Connexion SFTP fermée')))
+      this.pending.clear()
+      this.callbacks.onClose()
+    }
     this.ws.onerror = () => this.callbacks.onError('Erreur WebSocket SFTP')
   }
 
@@ -48,6 +162,7 @@ export class SFTPService {
     const p = msg.payload as Record<string, string>
     switch (msg.type) {
       case 'connected':
+        this.sessionId = p.session_id ?? ''
         this.callbacks.onConnected(p.home, p.host_name)
         break
       case 'ls_result': {
@@ -55,25 +170,366 @@ export class SFTPService {
         this.callbacks.onLSResult(r.path, r.entries ?? [])
         break
       }
-      case 'get_result':
-        this.callbacks.onGetResult(p.name, p.data)
+      case 'transfer': {
+        const r = msg.payload as { id: number; size: number; chunk_size: number; window: number }
+        const t = this.transfers.get(r.id)
+        if (!t) break
+        t.size = r.size
+        t.sent = t.bytes = (r as { offset?: number }).offset ?? 0
+        t.chunkSize = r.chunk_size
+        t.window = r.window
+        this.report(t)
+        if (t.op === 'put' || t.op === 'extract') this.pump(t)
+        break
+      }
+      case 'ack': {
+        const r = msg.payload as { id: number; offset: number }
+        const t = this.transfers.get(r.id)
+        if (!t) break
+        t.bytes = r.offset
+        this.pump(t)
+        break
+      }
+      case 'progress': {
+        const r = msg.payload as { id: number; bytes: number }
+        const t = this.transfers.get(r.id)
+        if (t && (t.op === 'put' || t.op === 'extract')) this.report(t)
+        break
+      }
+      case 'transfer_done': {
+        const r = msg.payload as { id: number; op: string; path: string; sha256?: string }
+        const t = this.transfers.get(r.id)
+        if (!t) break
+        if (t.op === 'get') {
+          this.finishDownload(t, r.sha256)
+          break
+        }
+        this.endTransfer(t.id)
+        if (t.hash && r.sha256 && t.hash.digestHex() !== r.sha256) {
+          this.callbacks.onError(`${t.name} : empreinte SHA-256 différente de celle de l'hôte`)
+          break
+        }
+        this.callbacks.onDone('put', { path: r.path })
+        break
+      }
+      case 'stat_result':
+      case 'checksum_result':
+      case 'rm_plan': {
+        const r = msg.payload as { id: number }
+        this.pending.get(r.id)?.resolve(msg.payload as never)
+        this.pending.delete(r.id)
+        break
+      }
+      case 'op_progress': {
+        const r = msg.payload as { id: number; items: number; total?: number; bytes: number }
+        const t = this.transfers.get(r.id)
+        if (!t) break
+        if (t.op === 'rm') {
+          t.bytes = r.items
+          t.size = r.total ?? 0
+        } else {
+          t.bytes = r.bytes
+          if (t.op === 'archive') t.size = r.total ?? 0
+        }
+        this.report(t)
+        break
+      }
+      case 'extract_entry':
+        this.callbacks.onExtractEntry?.(msg.payload as ExtractEntry)
+        break
+      case 'transfer_cancelled': {
+        const r = msg.payload as { id: number }
+        this.pending.get(r.id)?.reject(new Error('Opération annulée'))
+        this.pending.delete(r.id)
+        this.endTransfer(r.id)
         break
-      case 'done':
+      }
+      case 'done': {
+        const r = msg.payload as { id?: number }
+        if (r.id) this.endTransfer(r.id)
         this.callbacks.onDone(p.op, p)
         break
-      case 'error':
-        this.callbacks.onError(p.message)
+      }
+      case 'error': {
+        const r = msg.payload as { id?: number; message: string }
+        const req = r.id ? this.pending.get(r.id) : undefined
+        if (req && r.id) {
+          this.pending.delete(r.id)
+          req.reject(new Error(r.message))
+          break
+        }
+        if (r.id) this.endTransfer(r.id, true)
+        this.callbacks.onError(r.message)
         break
+      }
+    }
+  }
+
+  private handleChunk(frame: ArrayBuffer): void {
+    if (frame.byteLength < HEADER_SIZE) return
+    const id = new DataView(frame).getUint32(0)
+    const t = this.transfers.get(id)
+    if (!t || t.op !== 'get') return
+    const data = new Uint8Array(frame, HEADER_SIZE)
+    t.hash?.update(data)
+    t.bytes += data.byteLength
+    const offset = t.bytes
+    const sink = t.sink
+    if (!sink) return
+    t.writes = t.writes
+      .then(async () => {
+        await (await sink).write(data)
+        if (this.transfers.has(id)) this.send('ack', { id, offset })
+      })
+      .catch((err: Error) => {
+        if (!this.transfers.has(id)) return
+        this.cancel(id)
+        this.endTransfer(id)
+        this.callbacks.onError(`${t.name} : écriture impossible (${err.message})`)
+      })
+    this.report(t)
+  }
+
+  // finishDownload attend la fin des écritures puis remet le fichier au
+  // navigateur, après comparaison de l'empreinte avec celle de l'hôte.
+  private async finishDownload(t: Transfer, sha256?: string): Promise<void> {
+    await t.writes
+    const pending = t.sink
+    if (!this.transfers.has(t.id) || !pending) return
+    t.sink = undefined
+    this.endTransfer(t.id)
+    const sink = await pending
+    if (t.hash && sha256 && t.hash.digestHex() !== sha256) {
+      await sink.abort(false)
+      this.callbacks.onError(`${t.name} : empreinte SHA-256 différente de celle de l'hôte`)
+      return
     }
+    try {
+      this.callbacks.onDownload(t.name, await sink.finish())
+    } catch (err) {
+      await sink.abort(false)
+      this.callbacks.onError(`${t.name} : écriture impossible (${(err as Error).message})`)
+    }
+  }
+
+  // abortDownload abandonne le fichier de destination une fois les écritures
+  // en cours terminées ; keep conserve les octets reçus pour une reprise.
+  private abortDownload(t: Transfer, keep: boolean): void {
+    const sink = t.sink
+    if (!sink) return
+    t.sink = undefined
+    t.writes.then(() => sink).then((s) => s.abort(keep)).catch(() => undefined)
+  }
+
+  // pump envoie les morceaux de l'upload tant que la fenêtre le permet.
+  private async pump(t: Transfer): Promise<void> {
+    if (t.pumping || !t.file) return
+    t.pumping = true
+    try {
+      while (
+        this.transfers.has(t.id) &&
+        t.sent < t.size &&
+        t.sent - t.bytes < t.window * t.chunkSize
+      ) {
+        const end = Math.min(t.sent + t.chunkSize, t.size)
+        const data = await t.file.slice(t.sent, end).arrayBuffer()
+        const ws = this.ws
+        if (!this.transfers.has(t.id) || !ws || ws.readyState !== WebSocket.OPEN) return
+        const frame = new Uint8Array(HEADER_SIZE + data.byteLength)
+        new DataView(frame.buffer).setUint32(0, t.id)
+        frame.set(new Uint8Array(data), HEADER_SIZE)
+        t.hash?.update(frame.subarray(HEADER_SIZE))
+        ws.send(frame)
+        t.sent = end
+      }
+    } finally {
+      t.pumping = false
+    }
+  }
+
+  private report(t: Transfer): void {
+    this.callbacks.onProgress({ id: t.id, op: t.op, name: t.name, bytes: t.bytes, size: t.size })
+  }
+
+  // endTransfer retire le transfert ; un téléchargement non remis au
+  // navigateur est abandonné, son préfixe conservé si keep.
+  private endTransfer(id: number, keep = false): void {
+    const t = this.transfers.get(id)
+    if (!t) return
+    this.transfers.delete(id)
+    this.abortDownload(t, keep)
+    this.callbacks.onTransferEnd(id)
+  }
+
+  private newTransfer(op: TransferOp, path: string, file?: File): Transfer {
+    const t: Transfer = {
+      id: this.nextId++,
+      op,
+      path,
+      name: path.split('/').pop() ?? path,
+      size: file?.size ?? 0,
+      bytes: 0,
+      writes: Promise.resolve(),
+      file,
+      sent: 0,
+      chunkSize: 0,
+      window: 0,
+      pumping: false,
+    }
+    this.transfers.set(t.id, t)
+    return t
   }
 
   ls(path: string): void        { this.send('ls',     { path }) }
-  get(path: string): void       { this.send('get',    { path }) }
-  put(path: string, data: string): void { this.send('put', { path, data }) }
   rm(path: string): void        { this.send('rm',     { path }) }
-  mkdir(path: string): void     { this.send('mkdir',  { path }) }
+  mkdir(path: string, parents = false): void { this.send('mkdir', { path, parents }) }
+
+  // rmPlan liste ce que supprimerait rmRecursive et fournit le jeton de
+  // confirmation.
+  rmPlan(path: string): Promise<RmPlan> {
+    return this.request('rm', { path, recursive: true, dry_run: true })
+  }
+
+  rmRecursive(path: string, token: string): number {
+    const t = this.newTransfer('rm', path)
+    this.send('rm', { id: t.id, path, recursive: true, token })
+    this.report(t)
+    return t.id
+  }
+
+  // archiveUrl prépare le téléchargement de path en archive : le navigateur
+  // suit l'URL retournée, l'avancement arrive par le WebSocket.
+  archiveUrl(path: string, opts: ArchiveOptions = {}): string | null {
+    if (!this.sessionId) return null
+    const t = this.newTransfer('archive', path)
+    t.name = `${t.name}.${opts.format ?? 'tar.gz'}`
+    const params = new URLSearchParams({
+      session: this.sessionId,
+      id: String(t.id),
+      path,
+      format: opts.format ?? 'tar.gz',
+    })
+    opts.include?.forEach((p) => params.append('include', p))
+    opts.exclude?.forEach((p) => params.append('exclude', p))
+    if (opts.maxSize) params.set('max_size', String(opts.maxSize))
+    this.report(t)
+    return `/api/sftp/archive?${params}`
+  }
+
+  copy(from: string, to: string): number {
+    const t = this.newTransfer('copy', from)
+    this.send('copy', { id: t.id, from, to })
+    this.report(t)
+    return t.id
+  }
   rename(from: string, to: string): void { this.send('rename', { from, to }) }
 
+  get(path: string, opts: { verify?: boolean } = {}): number {
+    const t = this.newTransfer('get', path)
+    if (opts.verify) t.hash = new SHA256()
+    // Un second téléchargement simultané du même fichier n'est pas reprenable
+    const key = this.downloadKey(path)
+    const busy = [...this.transfers.values()].some((o) => o.key === key)
+    t.key = busy ? `${key}-${t.id}` : key
+    t.sink = this.downloads.create(t.key)
+    this.send('get', { id: t.id, path, offset: 0, verify: opts.verify ?? false })
+    return t.id
+  }
+
+  // partialDownload retourne la taille du préfixe conservé d'un
+  // téléchargement interrompu de path (0 s'il n'y en a pas).
+  async partialDownload(path: string): Promise<number> {
+    const key = this.downloadKey(path)
+    if ([...this.transfers.values()].some((t) => t.key === key)) return 0
+    return (await this.downloads.partial(key))?.size ?? 0
+  }
+
+  // resumeGet reprend le téléchargement de path à la suite du préfixe
+  // conservé ; l'empreinte comparée à celle de l'hôte couvre le fichier entier.
+  async resumeGet(path: string): Promise<number> {
+    const key = this.downloadKey(path)
+    const partial = await this.downloads.partial(key)
+    if (!partial) throw new Error('Aucun téléchargement interrompu à reprendre')
+    const prefix = new SHA256()
+    for (let pos = 0; pos < partial.size; pos += HASH_READ_SIZE) {
+      const end = Math.min(pos + HASH_READ_SIZE, partial.size)
+      prefix.update(new Uint8Array(await partial.slice(pos, end).arrayBuffer()))
+    }
+    const sink = await this.downloads.create(key, partial.size)
+    const t = this.newTransfer('get', path)
+    t.hash = prefix
+    t.key = key
+    t.sink = Promise.resolve(sink)
+    this.send('get', { id: t.id, path, offset: partial.size, verify: true })
+    return t.id
+  }
+
+  // downloadKey nomme le fichier local d'un téléchargement : le même chemin du
+  // même hôte retrouve son préfixe après une interruption.
+  private downloadKey(path: string): string {
+    return new SHA256().update(new TextEncoder().encode(`${this.hostId}\n${path}`)).digestHex()
+  }
+
+  put(path: string, file: File, opts: TransferOptions = {}, prefixHash?: SHA256): number {
+    const t = this.newTransfer('put', path, file)
+    if (opts.verify) t.hash = prefixHash ?? new SHA256()
+    this.send('put', { id: t.id, path, size: file.size, offset: opts.offset ?? 0, verify: opts.verify ?? false })
+    return t.id
+  }
+
+  // extract envoie l'archive file (zip ou tar.gz), extraite par le serveur
+  // dans dir ; chaque entrée est signalée par onExtractEntry.
+  extract(dir: string, file: File, conflict: ExtractConflict = 'skip'): number {
+    const t = this.newTransfer('extract', dir, file)
+    t.name = file.name
+    const format = /\.zip$/i.test(file.name) ? 'zip' : 'tar.gz'
+    this.send('extract', { id: t.id, dir, size: file.size, format, conflict })
+    return t.id
+  }
+
+  // resumePut reprend l'upload de file à partir de offset, après avoir
+  // vérifié que le fichier partiel distant correspond au début du fichier local.
+  async resumePut(path: string, file: File, offset: number): Promise<number> {
+    const prefix = new SHA256()
+    const [remote] = await Promise.all([
+      this.checksum(path, offset),
+      (async () => {
+        for (let pos = 0; pos < offset; pos += HASH_READ_SIZE) {
+          const end = Math.min(pos + HASH_READ_SIZE, offset)
+          prefix.update(new Uint8Array(await file.slice(pos, end).arrayBuffer()))
+        }
+      })(),
+    ])
+    if (prefix.clone().digestHex() !== remote.sha256) {
+      throw new Error('Le fichier distant ne correspond pas au début du fichier local')
+    }
+    return this.put(path, file, { offset, verify: true }, prefix)
+  }
+
+  stat(path: string): Promise<StatResult> {
+    return this.request('stat', { path })
+  }
+
+  checksum(path: string, length = 0): Promise<{ sha256: string; method: string }> {
+    return this.request('checksum', { path, length })
+  }
+
+  private request<T>(type: string, payload: Record<string, unknown>): Promise<T> {
+    const id = this.nextId++
+    return new Promise<T>((resolve, reject) => {
+      if (this.ws?.readyState !== WebSocket.OPEN) {
+        reject(new Error('Connexion SFTP fermée'))
+        return
+      }
+      this.pending.set(id, { resolve: resolve as (v: never) => void, reject })
+      this.send(type, { id, ...payload })
+    })
+  }
+
+  cancel(id: number): void {
+    if (this.transfers.has(id) || this.pending.has(id)) this.send('cancel', { id })
+  }
+
   disconnect(): void {
     this.ws?.close()
     this.ws = null